@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// agentMain implements the "agent" subcommand, for running through a
+// guest agent's exec call, such as qemu-ga's guest-exec:
+//
+//	embiggen-disk agent plan|resize|status <mount-point>
+//
+// It writes exactly one JSON object to stdout, the same as the
+// corresponding HTTP API endpoint returns, and exits non-zero if the
+// operation failed. All other output goes to stderr.
+func agentMain(args []string) {
+	if len(args) != 2 {
+		fatalf("usage: embiggen-disk agent plan|resize|status <mount-point>")
+	}
+	out := json.NewEncoder(os.Stdout)
+	// Keep anything else from mixing into the JSON.
+	os.Stdout = os.Stderr
+
+	op, mnt := args[0], args[1]
+	var v interface{}
+	var err error
+	switch op {
+	case "plan":
+		v, err = apiRun(mnt, true)
+	case "resize":
+		v, err = apiRun(mnt, false)
+	case "status":
+		v, err = apiStatus(mnt)
+	default:
+		fatalf("unknown agent operation %q; want plan, resize, or status", op)
+	}
+	if werr := out.Encode(v); werr != nil {
+		fatalf("%v", werr)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// allocateMain implements the "allocate" subcommand, an interactive
+// wizard for hosts with several LVs: it shows how much space each
+// volume group has, or will have once its PVs grow, asks how much of
+// it each LV should get, and after confirmation, grows them all in one
+// run, as would otherwise take several lvextend commands by hand.
+func allocateMain(args []string) {
+	fs := flag.NewFlagSet("allocate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk allocate:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] allocate [<vg>...]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	ctx, cancel := runContext()
+	sts, err := resize.VGStatuses(ctx, fs.Args()...)
+	cancel()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	in := bufio.NewReader(os.Stdin)
+	var (
+		targets []string
+		shares  []resize.Share
+		plan    []string // each allocation, described
+	)
+	for _, vg := range sts {
+		free := vg.FreeBytesAfterGrowth()
+		var lvs []resize.LVStatus
+		for _, lv := range vg.LVs {
+			if lv.Candidate {
+				lvs = append(lvs, lv)
+			}
+		}
+		if free < vg.ExtentBytes || len(lvs) == 0 {
+			continue
+		}
+		printVGStatus(vg)
+		fmt.Printf("\nAssign its %s free to its LVs: a size like 10G, a percentage of it like 25%%, \"rest\" for what's left, or nothing to skip.\n", resize.HumanBytes(free))
+		left := free
+		for _, lv := range lvs {
+			if left < vg.ExtentBytes {
+				break
+			}
+			for {
+				fmt.Printf("  %s [%s left]: ", lvLabel(lv), resize.HumanBytes(left))
+				answer, err := in.ReadString('\n')
+				if err != nil && (err != io.EOF || answer == "") {
+					fmt.Println()
+					fatalf("no answer read; allocate is interactive, so use --distribute in scripts")
+				}
+				s, n, err := parseAllocation(answer, free, left)
+				if err != nil {
+					fmt.Printf("  %s\n", colorize(os.Stdout, colorRed, err.Error()))
+					continue
+				}
+				if n == 0 {
+					break
+				}
+				left -= n
+				target := lv.Mountpoint
+				if target == "" {
+					target = lv.Path
+				}
+				targets = append(targets, target)
+				shares = append(shares, s)
+				plan = append(plan, fmt.Sprintf("%s: %s", lvLabel(lv), resize.HumanDelta(n)))
+				break
+			}
+		}
+		fmt.Println()
+	}
+	if len(shares) == 0 {
+		fmt.Printf("Nothing to allocate.\n")
+		return
+	}
+	fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Plan:"))
+	for _, p := range plan {
+		fmt.Printf("  * %s\n", p)
+	}
+	if !*dry {
+		fmt.Printf("Apply? [y/N]: ")
+		answer, _ := in.ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Printf("No changes made.\n")
+			return
+		}
+	}
+	if err := growDistributed("allocate", targets, shares); err != nil {
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, err.Error()))
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// lvLabel describes lv for the allocate prompts.
+func lvLabel(lv resize.LVStatus) string {
+	if lv.Mountpoint == "" {
+		return fmt.Sprintf("%s (%s)", lv.Path, resize.HumanBytes(lv.Bytes))
+	}
+	return fmt.Sprintf("%s (%s, %s)", lv.Path, lv.Mountpoint, resize.HumanBytes(lv.Bytes))
+}
+
+// parseAllocation parses an answer to an allocate prompt, given the
+// volume group's free bytes and how many are still unassigned, into
+// the LV's share and the bytes it comes to, which are 0 if the answer
+// is empty.
+func parseAllocation(answer string, free, left int64) (s resize.Share, n int64, err error) {
+	answer = strings.TrimSpace(answer)
+	switch {
+	case answer == "" || answer == "0":
+		return s, 0, nil
+	case answer == "rest":
+		// A weighted share gets what the fixed ones leave.
+		return resize.Share{Weight: 1}, left, nil
+	default:
+		if n, err = resize.ParseSizeOf(answer, free); err != nil {
+			return s, 0, err
+		}
+	}
+	if n > left {
+		return s, 0, fmt.Errorf("%s is more than the %s left", resize.HumanBytes(n), resize.HumanBytes(left))
+	}
+	return resize.Share{Bytes: n}, n, nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// ansibleArgs are the module arguments Ansible passes in its args
+// file. Keys starting with "_ansible_" other than check mode are
+// ignored.
+type ansibleArgs struct {
+	Mountpoint string `json:"mountpoint"`
+	CheckMode  bool   `json:"_ansible_check_mode"`
+}
+
+// ansibleResult is the JSON object an Ansible module prints.
+type ansibleResult struct {
+	Changed    bool           `json:"changed"`
+	Failed     bool           `json:"failed,omitempty"`
+	Msg        string         `json:"msg"`
+	Mountpoint string         `json:"mountpoint,omitempty"`
+	Layers     []ansibleLayer `json:"layers"`
+}
+
+// ansibleLayer is one resized (or, in check mode, planned) layer.
+type ansibleLayer struct {
+	Stage       string `json:"stage"`
+	Device      string `json:"device"`
+	BeforeBytes int64  `json:"before_bytes"`
+	AfterBytes  int64  `json:"after_bytes"`
+	Changed     bool   `json:"changed"`
+}
+
+// ansibleMain implements the "ansible" subcommand, following the
+// conventions of Ansible's non-Python (WANT_JSON) modules:
+//
+//	embiggen-disk ansible <args-file>
+//
+// It reads the module arguments as JSON from the file, runs as with
+// --dry-run in check mode, and prints a single JSON object with
+// "changed", "msg", and the per-layer sizes. All other output goes to
+// stderr. See ansible/embiggen_disk for a module wrapping it.
+func ansibleMain(args []string) {
+	out := json.NewEncoder(os.Stdout)
+	// Keep anything else from mixing into the JSON.
+	os.Stdout = os.Stderr
+
+	res := ansibleRun(args)
+	if res.Layers == nil {
+		res.Layers = []ansibleLayer{}
+	}
+	if err := out.Encode(res); err != nil {
+		fatalf("%v", err)
+	}
+	if res.Failed {
+		os.Exit(1)
+	}
+}
+
+// ansibleRun runs the module as described by the args file named in
+// args, describing any failure in the result.
+func ansibleRun(args []string) ansibleResult {
+	if len(args) != 1 {
+		return ansibleResult{Failed: true, Msg: "usage: embiggen-disk ansible <args-file>"}
+	}
+	a, err := readAnsibleArgs(args[0])
+	if err != nil {
+		return ansibleResult{Failed: true, Msg: err.Error()}
+	}
+	*dry = *dry || a.CheckMode
+	res := ansibleResult{Mountpoint: a.Mountpoint}
+	_, err = grow(a.Mountpoint)
+	if *dry {
+		for _, st := range lastRun.plan.Stages {
+			res.Layers = append(res.Layers, ansibleLayer{
+				Stage:       st.Stage,
+				Device:      st.Device,
+				BeforeBytes: st.CurrentBytes,
+				AfterBytes:  st.ProposedBytes,
+				Changed:     st.ProposedBytes != st.CurrentBytes,
+			})
+		}
+	} else {
+		for _, st := range lastRun.steps {
+			after := st.after
+			if after == 0 {
+				after = st.before // failed
+			}
+			res.Layers = append(res.Layers, ansibleLayer{
+				Stage:       st.stage,
+				Device:      resize.Device(st.r),
+				BeforeBytes: st.before,
+				AfterBytes:  after,
+				Changed:     after != st.before,
+			})
+		}
+	}
+	var changed []string
+	for _, l := range res.Layers {
+		if l.Changed {
+			res.Changed = true
+			changed = append(changed, fmt.Sprintf("%s: %s → %s", l.Stage, resize.HumanBytes(l.BeforeBytes), resize.HumanBytes(l.AfterBytes)))
+		}
+	}
+	switch {
+	case err != nil:
+		res.Failed = true
+		res.Msg = err.Error()
+		if errors.Is(err, errReported) && lastRun.plan.Error != "" {
+			res.Msg = lastRun.plan.Error
+		}
+	case !res.Changed:
+		res.Msg = fmt.Sprintf("%s is already as large as it can be", a.Mountpoint)
+	case *dry:
+		res.Msg = "would enlarge " + strings.Join(changed, "; ")
+	default:
+		res.Msg = "enlarged " + strings.Join(changed, "; ")
+	}
+	return res
+}
+
+// readAnsibleArgs reads the module arguments from the args file at
+// path, rejecting unknown ones as Ansible's own modules do.
+func readAnsibleArgs(path string) (ansibleArgs, error) {
+	a := ansibleArgs{Mountpoint: "/"}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return a, fmt.Errorf("reading module arguments: %v", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return a, fmt.Errorf("parsing module arguments: %v", err)
+	}
+	var unknown []string
+	for k := range raw {
+		if k != "mountpoint" && !strings.HasPrefix(k, "_ansible_") {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return a, fmt.Errorf("Unsupported parameters for (embiggen_disk) module: %s. Supported parameters include: mountpoint.", strings.Join(unknown, ", "))
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return a, fmt.Errorf("parsing module arguments: %v", err)
+	}
+	if a.Mountpoint == "" {
+		a.Mountpoint = "/"
+	}
+	return a, nil
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+)
+
+var awsRescan = flag.Duration("aws-rescan", 0, "in daemon mode on EC2, if non-zero, rescan the EBS NVMe controllers this often, resizing when a volume grew; for kernels that miss the capacity change after ModifyVolume")
+
+// ebsModel is the NVMe model string of EBS volumes on Nitro instances.
+// (Instance store volumes are "Amazon EC2 NVMe Instance Storage".)
+const ebsModel = "Amazon Elastic Block Store"
+
+// onEC2 reports whether we're running on an EC2 instance.
+func onEC2() bool {
+	if dmiField("sys_vendor") == "Amazon EC2" {
+		return true // Nitro
+	}
+	// Older Xen instances.
+	uuid, _ := ioutil.ReadFile("/sys/hypervisor/uuid")
+	return strings.HasPrefix(string(uuid), "ec2")
+}
+
+// rescanEBS rescans the EBS volumes' NVMe controllers.
+//
+// The instance metadata service doesn't report volume sizes, and
+// asking the EC2 API would need credentials, so instead we ask the
+// controllers themselves: once a ModifyVolume has reached the guest,
+// a rescan shows the namespace's new size.
+func rescanEBS() {
+	rescanNVMe(func(model string) bool { return model == ebsModel })
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// azureMain implements the "azure-extension" subcommand, the entry
+// point for running as an Azure VM extension. The waagent runs it from
+// the extension's directory with one of the operations named in
+// azure/HandlerManifest.json.
+//
+// On "enable", it rescans the SCSI bus (Azure doesn't tell the guest
+// when a disk is resized) and enlarges the OS disk's root filesystem
+// and every filesystem on a data disk, or the mount points listed in
+// the "mountpoints" public setting.
+func azureMain(args []string) {
+	if len(args) != 1 {
+		fatalf("usage: embiggen-disk azure-extension install|enable|disable|uninstall|update")
+	}
+	switch op := args[0]; op {
+	case "install", "disable", "uninstall", "update":
+		// Nothing to set up or tear down.
+	case "enable":
+		he, err := readAzureHandlerEnv()
+		if err != nil {
+			fatalf("%v", err)
+		}
+		seq, settings, err := readAzureSettings(he.ConfigFolder)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		writeAzureStatus(he.StatusFolder, seq, "transitioning", "Resizing")
+		msg, err := azureEnable(settings)
+		if err != nil {
+			writeAzureStatus(he.StatusFolder, seq, "error", err.Error())
+			fatalf("%v", err)
+		}
+		writeAzureStatus(he.StatusFolder, seq, "success", msg)
+	default:
+		fatalf("unknown Azure extension operation %q", op)
+	}
+}
+
+// azureSettings are the extension's public settings.
+type azureSettings struct {
+	Mountpoints []string `json:"mountpoints"`
+}
+
+func azureEnable(settings azureSettings) (msg string, err error) {
+	rescanSCSI()
+	// The rescan's capacity changes reach the partitions asynchronously.
+	time.Sleep(2 * time.Second)
+	mnts := settings.Mountpoints
+	if len(mnts) == 0 {
+		mnts = rootAndMountsOnDisks(azureDataDisks())
+	}
+	var results, failed []string
+	for _, mnt := range mnts {
+		res, err := grow(mnt)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", mnt, err))
+			continue
+		}
+		results = append(results, fmt.Sprintf("%s: %d changes, %s gained", mnt, len(res.Changes), resize.HumanBytes(res.BytesGained)))
+	}
+	if len(failed) > 0 {
+		return "", fmt.Errorf("resizing failed: %s", strings.Join(failed, "; "))
+	}
+	return strings.Join(results, "; "), nil
+}
+
+// azureDataDisks returns the data disks, which the waagent's udev
+// rules link under /dev/disk/azure/scsi1.
+func azureDataDisks() map[string]bool {
+	links, _ := filepath.Glob("/dev/disk/azure/scsi1/lun*")
+	disks := map[string]bool{}
+	for _, l := range links {
+		if strings.Contains(filepath.Base(l), "-part") {
+			continue
+		}
+		for _, d := range backingDisks(l) {
+			disks[d] = true
+		}
+	}
+	return disks
+}
+
+// azureHandlerEnv is the handlerEnvironment in HandlerEnvironment.json.
+type azureHandlerEnv struct {
+	LogFolder    string `json:"logFolder"`
+	ConfigFolder string `json:"configFolder"`
+	StatusFolder string `json:"statusFolder"`
+}
+
+func readAzureHandlerEnv() (azureHandlerEnv, error) {
+	b, err := ioutil.ReadFile("HandlerEnvironment.json")
+	if err != nil {
+		return azureHandlerEnv{}, fmt.Errorf("not run by the Azure agent? %v", err)
+	}
+	var envs []struct {
+		HandlerEnvironment azureHandlerEnv `json:"handlerEnvironment"`
+	}
+	if err := json.Unmarshal(b, &envs); err != nil || len(envs) == 0 {
+		return azureHandlerEnv{}, fmt.Errorf("bad HandlerEnvironment.json: %v", err)
+	}
+	return envs[0].HandlerEnvironment, nil
+}
+
+// readAzureSettings reads the newest <seq>.settings file in dir.
+func readAzureSettings(dir string) (seq int, s azureSettings, err error) {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.settings"))
+	seq = -1
+	for _, f := range files {
+		if n, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(f), ".settings")); err == nil && n > seq {
+			seq = n
+		}
+	}
+	if seq < 0 {
+		return 0, s, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.settings", seq)))
+	if err != nil {
+		return seq, s, err
+	}
+	var doc struct {
+		RuntimeSettings []struct {
+			HandlerSettings struct {
+				PublicSettings azureSettings `json:"publicSettings"`
+			} `json:"handlerSettings"`
+		} `json:"runtimeSettings"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return seq, s, fmt.Errorf("bad %d.settings: %v", seq, err)
+	}
+	if len(doc.RuntimeSettings) > 0 {
+		s = doc.RuntimeSettings[0].HandlerSettings.PublicSettings
+	}
+	return seq, s, nil
+}
+
+// writeAzureStatus reports the extension's status, status being one
+// of "transitioning", "error", or "success", to the waagent.
+func writeAzureStatus(dir string, seq int, status, msg string) {
+	type formatted struct {
+		Lang    string `json:"lang"`
+		Message string `json:"message"`
+	}
+	code := 0
+	if status == "error" {
+		code = 1
+	}
+	st := []interface{}{map[string]interface{}{
+		"version":      1.0,
+		"timestampUTC": time.Now().UTC().Format(time.RFC3339),
+		"status": map[string]interface{}{
+			"name":             "embiggen-disk",
+			"operation":        "Enable",
+			"status":           status,
+			"code":             code,
+			"formattedMessage": formatted{"en-US", msg},
+		},
+	}}
+	b, _ := json.Marshal(st)
+	path := filepath.Join(dir, fmt.Sprintf("%d.status", seq))
+	err := ioutil.WriteFile(path+".tmp", b, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logger.Error("writing Azure extension status failed", "err", err)
+	}
+}
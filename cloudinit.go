@@ -0,0 +1,243 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"gopkg.in/yaml.v3"
+)
+
+// growrootDisabledFile disables growpart, as with cloud-init, unless
+// the config sets ignore_growroot_disabled.
+const growrootDisabledFile = "/etc/growroot-disabled"
+
+// growpartConfig is the "growpart" key of cloud-init's cloud.cfg, as
+// used by its cc_growpart module.
+type growpartConfig struct {
+	Mode                   interface{} `yaml:"mode"` // "auto", "growpart", "off", or false
+	Devices                []string    `yaml:"devices"`
+	IgnoreGrowrootDisabled bool        `yaml:"ignore_growroot_disabled"`
+}
+
+// Results of growing one growpart device, as cloud-init names them.
+const (
+	growpartSkipped  = "SKIPPED"
+	growpartChanged  = "CHANGED"
+	growpartNoChange = "NOCHANGE"
+	growpartFailed   = "FAILED"
+)
+
+// growpartMain implements the "growpart" subcommand, a stand-in for
+// cloud-init's growpart and resizefs modules using the same config.
+func growpartMain(args []string) {
+	fs := flag.NewFlagSet("growpart", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/cloud/cloud.cfg", "cloud-init config to read the growpart key from; files in its .d directory are read after it and take precedence")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk growpart:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] growpart [--config=/etc/cloud/cloud.cfg] [<mount-point-or-device>...]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	cfg, err := readGrowpartConfig(*cfgPath)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if fs.NArg() > 0 {
+		cfg.Devices = fs.Args()
+	}
+	mode := fmt.Sprint(cfg.Mode)
+	switch mode {
+	case "auto", "growpart":
+	case "off", "false":
+		cloudLogf("DEBUG", "growpart disabled: mode=%s", mode)
+		return
+	default:
+		fatalf("unknown growpart mode %q; want auto, growpart, or off", mode)
+	}
+	if _, err := os.Stat(growrootDisabledFile); err == nil && !cfg.IgnoreGrowrootDisabled {
+		cloudLogf("INFO", "growpart disabled: %s exists", growrootDisabledFile)
+		return
+	}
+
+	failed := false
+	for _, dev := range cfg.Devices {
+		action, msg := growpartDevice(dev)
+		switch action {
+		case growpartChanged:
+			cloudLogf("INFO", "'%s' resized: %s", dev, msg)
+		case growpartFailed:
+			failed = true
+			cloudLogf("WARNING", "'%s' %s: %s", dev, action, msg)
+		default:
+			cloudLogf("DEBUG", "'%s' %s: %s", dev, action, msg)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// readGrowpartConfig reads the growpart key from the cloud-init config
+// at path and then from path + ".d/*.cfg", later files overriding
+// earlier ones. Missing files aren't an error.
+func readGrowpartConfig(path string) (growpartConfig, error) {
+	cfg := growpartConfig{Mode: "auto", Devices: []string{"/"}}
+	for _, f := range cloudConfigFiles(path) {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cfg, err
+		}
+		var doc struct {
+			Growpart *growpartConfig `yaml:"growpart"`
+		}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %v", f, err)
+		}
+		if g := doc.Growpart; g != nil {
+			if g.Mode != nil {
+				cfg.Mode = g.Mode
+			}
+			if g.Devices != nil {
+				cfg.Devices = g.Devices
+			}
+			cfg.IgnoreGrowrootDisabled = g.IgnoreGrowrootDisabled
+		}
+	}
+	return cfg, nil
+}
+
+// cloudConfigFiles returns the cloud-init config at path and the files
+// in its .d directory, in the order cloud-init reads them.
+func cloudConfigFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".d/*.cfg") // sorted
+	return append([]string{path}, matches...)
+}
+
+// growpartListed reports whether the cloud-init config at path, like
+// readGrowpartConfig reads it, lists cc_growpart among the modules
+// some stage runs. Without it, cloud-init never reads the growpart key.
+func growpartListed(path string) (bool, error) {
+	stages := map[string][]interface{}{} // by key, e.g. "cloud_init_modules"
+	for _, f := range cloudConfigFiles(path) {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(b, &doc); err != nil {
+			return false, fmt.Errorf("parsing %s: %v", f, err)
+		}
+		for k, v := range doc {
+			if mods, ok := v.([]interface{}); ok && strings.HasSuffix(k, "_modules") {
+				stages[k] = mods
+			}
+		}
+	}
+	for _, mods := range stages {
+		for _, m := range mods {
+			// An entry is a module name or a list of its name
+			// and frequency, as in [growpart, always].
+			if l, ok := m.([]interface{}); ok && len(l) > 0 {
+				m = l[0]
+			}
+			if name, _ := m.(string); strings.TrimPrefix(name, "cc_") == "growpart" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// growpartDevice enlarges dev, a mount point or the device mounted
+// somewhere, and describes the outcome as cloud-init would.
+func growpartDevice(dev string) (action, msg string) {
+	mnt := dev
+	if strings.HasPrefix(dev, "/dev/") {
+		var ok bool
+		if mnt, ok = devMountPoint(dev); !ok {
+			return growpartSkipped, "unable to find mount point for " + dev
+		}
+	}
+	if _, err := resize.Stat(mnt); err != nil {
+		return growpartSkipped, fmt.Sprintf("unable to find mount point for %s: %v", dev, err)
+	}
+	// Under cloud-init, its unit running is us.
+	if _, err := growIn(&run{asGrowpart: true}, mnt); err != nil {
+		return growpartFailed, err.Error()
+	}
+	var parts, other []string
+	for _, st := range lastRun.steps {
+		if st.after == st.before {
+			continue
+		}
+		if resize.KindOf(st.r) == resize.KindPartition {
+			dev := resize.Device(st.r)
+			disk, err := resize.DiskOf(context.Background(), dev)
+			if err != nil {
+				other = append(other, fmt.Sprintf("%s from %d to %d", st.stage, st.before, st.after))
+				continue
+			}
+			num := strings.TrimLeft(strings.TrimPrefix(dev, disk), "p")
+			parts = append(parts, fmt.Sprintf("changed (%s, %s) from %d to %d", disk, num, st.before, st.after))
+		} else {
+			other = append(other, fmt.Sprintf("%s from %d to %d", st.stage, st.before, st.after))
+		}
+	}
+	if len(parts) == 0 && len(other) == 0 {
+		return growpartNoChange, "no change necessary"
+	}
+	return growpartChanged, strings.Join(append(parts, other...), "; ")
+}
+
+// devMountPoint returns where the block device dev is mounted.
+func devMountPoint(dev string) (mnt string, ok bool) {
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = real
+	}
+	m, ok, err := resize.DeviceMount(dev)
+	if err != nil || !ok {
+		return "", false
+	}
+	return m.Mountpoint, true
+}
+
+// cloudLogf writes a log line to stderr in the format cloud-init's
+// modules use, so it reads the same in cloud-init-output.log.
+func cloudLogf(level, format string, args ...interface{}) {
+	if level == "DEBUG" && !*verbose {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s - cc_growpart.py[%s]: %s\n",
+		time.Now().Format("2006-01-02 15:04:05,000"), level, fmt.Sprintf(format, args...))
+}
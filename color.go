@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var colorFlag = flag.String("color", "auto", "colorize output: never, auto (if a terminal), or always")
+
+// ANSI SGR codes.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+	colorBold   = "1"
+)
+
+// useColor reports whether output written to f should be colorized.
+func useColor(f *os.File) bool {
+	switch *colorFlag {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	return err == nil
+}
+
+// colorize returns s wrapped in the ANSI color code if output to f
+// should be colorized, else s unchanged.
+func colorize(f *os.File, code, s string) string {
+	if !useColor(f) {
+		return s
+	}
+	return fmt.Sprintf("\x1b[%sm%s\x1b[0m", code, s)
+}
+
+// dryRunf prints a description of something --dry-run skipped.
+// It's also recorded in the plan; see planCommand.
+func dryRunf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	planCommand(strings.TrimPrefix(msg, "would've run: "))
+	if machineOutput() {
+		return
+	}
+	fmt.Printf("%s %s\n", colorize(os.Stdout, colorYellow, "[dry-run]"), msg)
+}
+
+// colorLevel is a slog ReplaceAttr function coloring the level of
+// warnings and errors.
+func colorLevel(groups []string, a slog.Attr) slog.Attr {
+	l, ok := a.Value.Any().(slog.Level)
+	if a.Key != slog.LevelKey || len(groups) > 0 || !ok {
+		return a
+	}
+	switch {
+	case l >= slog.LevelError:
+		a.Value = slog.StringValue(colorize(os.Stderr, colorRed, l.String()))
+	case l >= slog.LevelWarn:
+		a.Value = slog.StringValue(colorize(os.Stderr, colorYellow, l.String()))
+	}
+	return a
+}
+
+func checkColorFlag() error {
+	switch *colorFlag {
+	case "never", "auto", "always":
+		return nil
+	}
+	return fmt.Errorf("unknown --color %q; want never, auto, or always", *colorFlag)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+var containerFlag = flag.String("container", "auto", `whether to resize the host's filesystems from inside a container: "auto" (when a container with the host's PID namespace is detected), "on", or "off"`)
+
+// inContainer reports whether we seem to be running in a container.
+func inContainer() bool {
+	if os.Getenv("container") != "" { // systemd-nspawn, podman, LXC
+		return true
+	}
+	for _, f := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	cg, _ := ioutil.ReadFile("/proc/1/cgroup")
+	for _, s := range []string{"docker", "kubepods", "containerd", "libpod", "lxc"} {
+		if bytes.Contains(cg, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharesHostPIDNamespace reports whether PID 1 is outside our mount
+// namespace, as it is in a container started with the host's PID
+// namespace (Docker's --pid=host, Kubernetes' hostPID).
+func sharesHostPIDNamespace() bool {
+	ours, err1 := os.Readlink("/proc/self/ns/mnt")
+	host, err2 := os.Readlink("/proc/1/ns/mnt")
+	return err1 == nil && err2 == nil && ours != host
+}
+
+// namespaceMismatch returns why the mount table and device numbers we
+// see might not match our /dev and root directory, as in a chroot, or
+// in a mount namespace other than PID 1's when not resizing a
+// container's host. It returns the empty string if they should match.
+func namespaceMismatch() string {
+	if resize.HostRoot != "" {
+		return ""
+	}
+	var root, initRoot unix.Stat_t
+	if unix.Stat("/", &root) == nil && unix.Stat("/proc/1/root", &initRoot) == nil &&
+		(root.Dev != initRoot.Dev || root.Ino != initRoot.Ino) {
+		return "running in a chroot: / isn't PID 1's root directory"
+	}
+	if sharesHostPIDNamespace() {
+		return "running in a mount namespace other than PID 1's"
+	}
+	return ""
+}
+
+// namespaceAdvice is how to run embiggen-disk when namespaceMismatch
+// finds a problem.
+const namespaceAdvice = "mount points and devices may not be found; run it in PID 1's namespaces (nsenter --target 1 --mount --pid), or bind mount the host's /dev, /proc, and /sys into the chroot"
+
+// checkContainer decides according to --container whether to resize
+// the host's filesystems, checking that the container has what that
+// needs. If so, the resize package is set up to use the host's mount
+// table, found in /proc/1/mounts, and reach its mount points through
+// /proc/1/root.
+func checkContainer() error {
+	switch *containerFlag {
+	case "off":
+		return nil
+	case "on":
+		if !sharesHostPIDNamespace() {
+			return fmt.Errorf("--container=on needs the host's PID namespace (docker run --pid=host, or hostPID in Kubernetes)")
+		}
+	case "auto":
+		if !inContainer() {
+			return nil
+		}
+		if !sharesHostPIDNamespace() {
+			logger.Info("running in a container without the host's PID namespace; only the container's own mounts are visible")
+			return nil
+		}
+	default:
+		return fmt.Errorf(`unknown --container %q; want "auto", "on", or "off"`, *containerFlag)
+	}
+	if _, err := os.Stat("/proc/1/root/"); err != nil {
+		return fmt.Errorf("can't reach the host's filesystems through /proc/1/root (is the container privileged?): %v", err)
+	}
+	if _, err := os.Stat("/sys/block"); err != nil {
+		return fmt.Errorf("no /sys/block in the container; mount the host's /sys: %v", err)
+	}
+	resize.MountinfoFile = "/proc/1/mountinfo"
+	resize.MountsFile = "/proc/1/mounts"
+	resize.HostRoot = "/proc/1/root"
+	resize.FstabPath = resize.HostPath(resize.FstabPath)
+	logger.Info("running in a container; resizing the host's filesystems")
+	return nil
+}
@@ -0,0 +1,313 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// engineSockets are where containerStorageMain looks for the Docker
+// or Podman API socket, in order, unless $DOCKER_HOST names one.
+var engineSockets = []string{
+	"/var/run/docker.sock",
+	"/run/podman/podman.sock",
+}
+
+// containerStorageMain implements the "container-storage" subcommand,
+// which grows the storage behind a Docker or Podman container or named
+// volume, as the container engine's API reports it: the filesystem
+// holding an overlay container's layers and those of its volumes and
+// bind mounts, a devicemapper thin pool's LV, or a volume's
+// filesystem.
+func containerStorageMain(args []string) {
+	fs := flag.NewFlagSet("container-storage", flag.ExitOnError)
+	socket := fs.String("socket", "", "the Docker or Podman API's unix socket; default is $DOCKER_HOST or the first of "+strings.Join(engineSockets, ", ")+" that exists")
+	volumes := fs.Bool("volumes", true, "for a container, also grow the filesystems of its volumes and bind mounts")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk container-storage:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] container-storage [--socket=<path>] [--volumes=false] <container-or-volume>\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	if *socket == "" {
+		*socket = findEngineSocket()
+	}
+	if *socket == "" {
+		fatalf("no Docker or Podman API socket found; give its path with --socket")
+	}
+	ec := newEngineClient(*socket)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	st, err := ec.storage(ctx, fs.Arg(0), *volumes)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if st.lv != "" {
+		vlogf("%s is on the devicemapper thin pool %s", fs.Arg(0), st.lv)
+		if err := growLV(st.lv); err != nil {
+			if !errors.Is(err, errReported) {
+				fatalf("%v", err)
+			}
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+	vlogf("%s is stored on %s", fs.Arg(0), strings.Join(st.mounts, ", "))
+	growMainAll(st.mounts)
+}
+
+// findEngineSocket returns the path of the container engine's API
+// socket, or "" if none is found.
+func findEngineSocket() string {
+	if h := os.Getenv("DOCKER_HOST"); h != "" {
+		if p, ok := strings.CutPrefix(h, "unix://"); ok {
+			return p
+		}
+	}
+	socks := engineSockets
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		socks = append(socks, filepath.Join(d, "podman", "podman.sock"))
+	}
+	for _, s := range socks {
+		if fi, err := os.Stat(s); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return s
+		}
+	}
+	return ""
+}
+
+// An engineClient talks to the Docker Engine API, or Podman's
+// Docker-compatible one, over a unix socket.
+type engineClient struct {
+	c *http.Client
+}
+
+func newEngineClient(socket string) *engineClient {
+	return &engineClient{c: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}}
+}
+
+// errEngineNotFound is returned by engineClient.get for a 404.
+var errEngineNotFound = errors.New("not found")
+
+// get decodes the JSON the API returns for path into v.
+func (ec *engineClient) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://engine"+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := ec.c.Do(req)
+	if err != nil {
+		return fmt.Errorf("container engine API: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errEngineNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("container engine API: GET %s: %v", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// engineContainer is the part of a container's inspection we use.
+type engineContainer struct {
+	Name        string
+	GraphDriver struct {
+		Name string            // "overlay2", "overlay", "devicemapper", "btrfs", ...
+		Data map[string]string // "UpperDir", "MergedDir", "DeviceName", ...
+	}
+	Mounts []struct {
+		Type   string // "volume", "bind", or "tmpfs"
+		Name   string // for volumes
+		Source string // the path on the host
+	}
+}
+
+// engineVolume is the part of a volume's inspection we use.
+type engineVolume struct {
+	Name       string
+	Driver     string
+	Mountpoint string
+}
+
+// engineInfo is the part of the engine's system info we use.
+type engineInfo struct {
+	Driver        string
+	DriverStatus  [][2]string // like {"Pool Name", "docker-thinpool"}
+	DockerRootDir string
+}
+
+func (info engineInfo) driverStatus(key string) string {
+	for _, kv := range info.DriverStatus {
+		if kv[0] == key {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// engineStorage is what stores a container or volume: the LV of a
+// devicemapper thin pool, or else the mount points of the filesystems
+// holding its data.
+type engineStorage struct {
+	lv     string
+	mounts []string
+}
+
+// storage returns what stores the container or volume name, with a
+// container's volumes and bind mounts if withVolumes.
+func (ec *engineClient) storage(ctx context.Context, name string, withVolumes bool) (st engineStorage, err error) {
+	var paths []string
+	var c engineContainer
+	err = ec.get(ctx, "/containers/"+url.PathEscape(name)+"/json", &c)
+	switch {
+	case err == errEngineNotFound:
+		var v engineVolume
+		if err := ec.get(ctx, "/volumes/"+url.PathEscape(name), &v); err != nil {
+			if err == errEngineNotFound {
+				return st, fmt.Errorf("no container or volume named %q: %w", name, resize.ErrDeviceNotFound)
+			}
+			return st, err
+		}
+		if v.Driver != "local" || v.Mountpoint == "" {
+			return st, fmt.Errorf("volume %s uses the %s driver; only local volumes can be grown: %w", name, v.Driver, resize.ErrNotLocalBlockFilesystem)
+		}
+		paths = append(paths, v.Mountpoint)
+	case err != nil:
+		return st, err
+	default:
+		if c.GraphDriver.Name == "devicemapper" {
+			var info engineInfo
+			if err := ec.get(ctx, "/info", &info); err != nil {
+				return st, err
+			}
+			if st.lv, err = thinPoolLV(info); err != nil {
+				return st, err
+			}
+		} else {
+			p, err := ec.layerDir(ctx, c)
+			if err != nil {
+				return st, err
+			}
+			paths = append(paths, p)
+		}
+		if withVolumes {
+			for _, m := range c.Mounts {
+				if m.Type == "volume" || m.Type == "bind" {
+					paths = append(paths, m.Source)
+				}
+			}
+		}
+		if st.lv != "" && len(paths) > 0 {
+			logger.Warn("growing only the devicemapper thin pool, not the filesystems of the container's volumes and bind mounts", "container", name)
+		}
+	}
+	if st.lv != "" {
+		return st, nil
+	}
+	seen := map[string]bool{}
+	for _, p := range paths {
+		mnt, err := mountContaining(p)
+		if err != nil {
+			return st, err
+		}
+		if !seen[mnt] {
+			seen[mnt] = true
+			st.mounts = append(st.mounts, mnt)
+		}
+	}
+	return st, nil
+}
+
+// layerDir returns a directory holding the container c's writable
+// layer: its overlay upper directory, or else the engine's root
+// directory, where drivers like btrfs and vfs keep layers.
+func (ec *engineClient) layerDir(ctx context.Context, c engineContainer) (string, error) {
+	if d := c.GraphDriver.Data["UpperDir"]; d != "" {
+		return d, nil
+	}
+	var info engineInfo
+	if err := ec.get(ctx, "/info", &info); err != nil {
+		return "", err
+	}
+	if info.DockerRootDir == "" {
+		return "", fmt.Errorf("the container engine doesn't say where the %s storage driver keeps container %s's layers", c.GraphDriver.Name, c.Name)
+	}
+	return info.DockerRootDir, nil
+}
+
+// thinPoolLV returns the LV of the devicemapper storage driver's thin
+// pool, per the engine's info.
+func thinPoolLV(info engineInfo) (string, error) {
+	if f := info.driverStatus("Data loop file"); f != "" {
+		return "", fmt.Errorf("the devicemapper thin pool is on the loop file %s, not an LV; only direct-lvm pools can be grown", f)
+	}
+	pool := info.driverStatus("Pool Name")
+	if pool == "" {
+		return "", errors.New("the container engine doesn't name its devicemapper thin pool")
+	}
+	return "/dev/mapper/" + pool, nil
+}
+
+// mountContaining returns the mount point of the filesystem holding
+// path: the innermost mount point above it.
+func mountContaining(path string) (string, error) {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		path = p
+	}
+	mounts, err := resize.Mounts()
+	if err != nil {
+		return "", err
+	}
+	best := ""
+	for _, m := range mounts {
+		mp := m.Mountpoint
+		if path == mp || mp == "/" || strings.HasPrefix(path, mp+"/") {
+			if len(mp) >= len(best) {
+				best = mp
+			}
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no mount holds %s", path)
+	}
+	return best, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var csiEndpoint = flag.String("csi-endpoint", "", `if non-empty, serve the CSI Node and Identity gRPC services on this Unix socket ("unix:///path/to/csi.sock"), implementing NodeExpandVolume so CSI node plugins can delegate expansion to us`)
+
+// csiPluginName is our name in GetPluginInfo.
+const csiPluginName = "embiggen-disk.bradfitz.github.com"
+
+// csiMain implements --csi-endpoint.
+func csiMain() {
+	// The CSI services are unauthenticated, so only serve them on a
+	// Unix socket, which the file's permissions protect, as kubelet
+	// and CSI sidecars expect anyway.
+	addr, ok := strings.CutPrefix(*csiEndpoint, "unix://")
+	if !ok || addr == "" {
+		fatalf(`bad --csi-endpoint %q; want "unix:///path/to/csi.sock"`, *csiEndpoint)
+	}
+	// A socket left behind by a previous run would fail the Listen,
+	// but don't remove anything else.
+	if fi, err := os.Lstat(addr); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			fatalf("--csi-endpoint %s exists and isn't a socket", addr)
+		}
+		if err := os.Remove(addr); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	srv := grpc.NewServer()
+	csi.RegisterIdentityServer(srv, &csiIdentity{})
+	csi.RegisterNodeServer(srv, &csiNode{})
+	go func() {
+		<-stopRequested
+		srv.GracefulStop()
+	}()
+	logger.Info("serving CSI", "endpoint", *csiEndpoint)
+	if err := srv.Serve(ln); err != nil {
+		fatalf("%v", err)
+	}
+	logger.Info("CSI server stopped")
+}
+
+type csiIdentity struct {
+	csi.UnimplementedIdentityServer
+}
+
+func (*csiIdentity) GetPluginInfo(context.Context, *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{Name: csiPluginName, VendorVersion: version}, nil
+}
+
+func (*csiIdentity) GetPluginCapabilities(context.Context, *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE},
+			},
+		}},
+	}, nil
+}
+
+func (*csiIdentity) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+type csiNode struct {
+	csi.UnimplementedNodeServer
+}
+
+func (*csiNode) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME},
+			},
+		}},
+	}, nil
+}
+
+func (*csiNode) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeGetInfoResponse{NodeId: host}, nil
+}
+
+// NodeExpandVolume grows the filesystem mounted at the request's
+// volume path, and everything below it, to fill its disk. It fails if
+// the block device holding the filesystem is then still smaller than
+// the required bytes.
+func (*csiNode) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	mnt := req.GetVolumePath()
+	if mnt == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume_path is required")
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// Raw block volumes have no filesystem or layers of ours
+		// above the disk; the disk itself has already grown.
+		return &csi.NodeExpandVolumeResponse{}, nil
+	}
+	if _, err := resize.Stat(mnt); err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume path %s: %v", mnt, err)
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	logger.Info("CSI NodeExpandVolume", "volume", req.GetVolumeId(), "path", mnt, "requiredBytes", req.GetCapacityRange().GetRequiredBytes())
+	if _, err := grow(mnt); err != nil {
+		return nil, status.Errorf(codes.Internal, "expanding %s: %v", mnt, err)
+	}
+	st, err := resize.Stat(mnt)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// Report the size of the device rather than the filesystem, which
+	// is smaller by its metadata; that's what CSI callers compare
+	// against the size they asked for.
+	n, err := blockDevSize(st.Device)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if need := req.GetCapacityRange().GetRequiredBytes(); n < need {
+		return nil, status.Errorf(codes.OutOfRange, "%s only grew to %d bytes; %d required", mnt, n, need)
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: n}, nil
+}
+
+// blockDevSize returns the size in bytes of the block device dev.
+func blockDevSize(dev string) (int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
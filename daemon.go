@@ -0,0 +1,233 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var (
+	daemonSettle = flag.Duration("daemon-settle", 2*time.Second, "in daemon mode, how long to wait after a block device uevent for more to arrive before resizing")
+	watch        = flag.Duration("watch", 0, "if non-zero, run as a daemon that checks this often whether any disk in /sys/block grew, for when uevents aren't delivered")
+)
+
+// daemonMain implements the "daemon" subcommand: it enlarges the given
+// mount points (default /) once at startup and then again whenever the
+// kernel reports that a block device changed size or appeared, or,
+// with --watch, when polling finds a disk grew.
+func daemonMain(args []string) {
+	mnts := args
+	if len(mnts) == 0 {
+		mnts = []string{"/"}
+	}
+	runDaemon(func() []string { return mnts })
+}
+
+// runDaemon implements daemon mode, enlarging the mount points
+// returned by mnts, which is called before each run.
+func runDaemon(mnts func() []string) {
+	triggers := make(chan string, 16)
+	uevents, err := listenUevents()
+	if err != nil {
+		if *watch == 0 {
+			fatalf("listening for uevents: %v", err)
+		}
+		logger.Warn("can't listen for uevents; relying on --watch polling", "err", err)
+	} else {
+		go func() {
+			for ev := range uevents {
+				triggers <- fmt.Sprintf("%s of %s", ev.action, ev.env["DEVNAME"])
+			}
+			if *watch == 0 {
+				fatalf("uevent socket closed")
+			}
+			logger.Warn("uevent socket closed; relying on --watch polling")
+		}()
+	}
+	logger.Info("daemon started", "mountpoints", mnts(), "watch", *watch)
+	growAll(mnts())
+	if *watch > 0 {
+		go pollBlockSizes(*watch, triggers)
+	}
+	if *awsRescan > 0 {
+		if onEC2() {
+			go rescanLoop(*awsRescan, "EBS", rescanEBS, triggers)
+		} else {
+			logger.Warn("not on EC2; ignoring --aws-rescan")
+		}
+	}
+	if *openstackRescan > 0 {
+		if onOpenStack() {
+			go rescanLoop(*openstackRescan, "SCSI", rescanSCSI, triggers)
+		} else {
+			logger.Warn("not on OpenStack; ignoring --openstack-rescan")
+		}
+	}
+	if *vmwareRescan > 0 {
+		if onVMware() {
+			go rescanLoop(*vmwareRescan, "SCSI", rescanSCSI, triggers)
+		} else {
+			logger.Warn("not on VMware; ignoring --vmware-rescan")
+		}
+	}
+	for {
+		select {
+		case <-stopRequested:
+			logger.Info("daemon stopping")
+			return
+		case why := <-triggers:
+			logger.Info("block device event", "event", why)
+		}
+		// Disk resizes tend to come as a burst of events (the disk,
+		// then each partition); wait for them to stop.
+		settle := time.NewTimer(*daemonSettle)
+	drain:
+		for {
+			select {
+			case <-triggers:
+				settle.Reset(*daemonSettle)
+			case <-settle.C:
+				break drain
+			case <-stopRequested:
+				logger.Info("daemon stopping")
+				return
+			}
+		}
+		growAll(mnts())
+	}
+}
+
+// growAll enlarges each of mnts, logging rather than exiting on failure.
+// It reports whether all succeeded.
+func growAll(mnts []string) (ok bool) {
+	var mu sync.Mutex
+	ok = true
+	growEach(mnts, func(mnt string, res runResult, err error) {
+		recordResult(mnt, res, err)
+		if err != nil {
+			mu.Lock()
+			ok = false
+			mu.Unlock()
+			if !errors.Is(err, errReported) {
+				logger.Error("resize failed", "mountpoint", mnt, "err", err)
+			}
+		}
+	})
+	return ok && checkInterrupted() == nil
+}
+
+// uevent is a kernel object event, as sent over NETLINK_KOBJECT_UEVENT.
+type uevent struct {
+	action string            // "add", "change", ...
+	env    map[string]string // "SUBSYSTEM", "DEVNAME", "DEVTYPE", "RESIZE", ...
+}
+
+// parseUevent parses a kernel uevent message: an "action@devpath"
+// header followed by NUL-separated KEY=value pairs.
+func parseUevent(msg []byte) (uevent, bool) {
+	parts := bytes.Split(msg, []byte{0})
+	action, _, ok := bytes.Cut(parts[0], []byte("@"))
+	if !ok {
+		// Probably a libudev message, which we don't subscribe to.
+		return uevent{}, false
+	}
+	ev := uevent{action: string(action), env: map[string]string{}}
+	for _, p := range parts[1:] {
+		if k, v, ok := bytes.Cut(p, []byte("=")); ok {
+			ev.env[string(k)] = string(v)
+		}
+	}
+	return ev, true
+}
+
+// wantsResize reports whether ev might mean there's new space to use:
+// a block device's capacity changed, or a new disk appeared.
+func (ev uevent) wantsResize() bool {
+	if ev.env["SUBSYSTEM"] != "block" {
+		return false
+	}
+	switch ev.action {
+	case "change":
+		return ev.env["RESIZE"] == "1"
+	case "add":
+		return ev.env["DEVTYPE"] == "disk"
+	}
+	return false
+}
+
+// pollBlockSizes checks the size of every disk in /sys/block each
+// interval and sends to c when one grew or a new one appeared.
+func pollBlockSizes(interval time.Duration, c chan<- string) {
+	last := blockSizes()
+	for range time.Tick(interval) {
+		cur := blockSizes()
+		for _, why := range diskGrowth(last, cur) {
+			c <- why
+		}
+		last = cur
+	}
+}
+
+// diskGrowth describes each disk in cur that's new or bigger than it
+// was in last, both from blockSizes.
+func diskGrowth(last, cur map[string]int64) (changes []string) {
+	for disk, n := range cur {
+		if old, ok := last[disk]; !ok {
+			changes = append(changes, fmt.Sprintf("new disk %s", disk))
+		} else if n > old {
+			changes = append(changes, fmt.Sprintf("%s grew from %s to %s", disk, resize.HumanBytes(old), resize.HumanBytes(n)))
+		}
+	}
+	return changes
+}
+
+// blockSizes returns the size in bytes of each disk in /sys/block,
+// keyed by name ("sda").
+func blockSizes() map[string]int64 {
+	m := map[string]int64{}
+	files, _ := filepath.Glob("/sys/block/*/size")
+	for _, f := range files {
+		disk := filepath.Base(filepath.Dir(f))
+		if resize.IsMMCHardwarePartition(disk) {
+			// Fixed in size, and never what we grow.
+			continue
+		}
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		// Always in 512 byte sectors, regardless of the device's
+		// logical block size.
+		n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			continue
+		}
+		m[disk] = n * 512
+	}
+	return m
+}
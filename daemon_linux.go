@@ -0,0 +1,58 @@
+//go:build linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// listenUevents subscribes to the kernel's uevents and returns a
+// channel of those that might call for a resize.
+func listenUevents() (<-chan uevent, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// Group 1 is the kernel's own broadcast, which arrives whether
+	// or not udev is running.
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	c := make(chan uevent, 16)
+	go func() {
+		defer close(c)
+		defer unix.Close(fd)
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				// ENOBUFS means we missed some; the next
+				// resize catches up regardless.
+				continue
+			}
+			if err != nil {
+				logger.Error("reading uevents failed", "err", err)
+				return
+			}
+			if ev, ok := parseUevent(buf[:n]); ok && ev.wantsResize() {
+				c <- ev
+			}
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// kernelUevent returns a kernel uevent message for action on devpath,
+// with env's KEY=value pairs.
+func kernelUevent(action, devpath string, env ...string) []byte {
+	return []byte(action + "@" + devpath + "\x00" + strings.Join(env, "\x00") + "\x00")
+}
+
+// libudevUevent returns a message as udevd rebroadcasts one, after a
+// binary header, with properties only.
+func libudevUevent(env ...string) []byte {
+	props := []byte(strings.Join(env, "\x00") + "\x00")
+	hdr := make([]byte, 40)
+	copy(hdr, "libudev\x00")
+	binary.BigEndian.PutUint32(hdr[8:], 0xfeedcafe)
+	binary.LittleEndian.PutUint32(hdr[12:], 40)
+	binary.LittleEndian.PutUint32(hdr[16:], 40)
+	binary.LittleEndian.PutUint32(hdr[20:], uint32(len(props)))
+	binary.LittleEndian.PutUint32(hdr[24:], 0x40404040) // subsystem hash; '@'s
+	return append(hdr, props...)
+}
+
+func TestParseUevent(t *testing.T) {
+	const vda = "/devices/pci0000:00/0000:00:04.0/virtio1/block/vda"
+	tests := []struct {
+		name    string
+		msg     []byte
+		ok      bool
+		action  string
+		devname string
+		resize  bool
+	}{
+		{
+			name:    "resize",
+			msg:     kernelUevent("change", vda, "ACTION=change", "DEVPATH="+vda, "SUBSYSTEM=block", "RESIZE=1", "DEVNAME=vda", "DEVTYPE=disk", "SEQNUM=1874"),
+			ok:      true,
+			action:  "change",
+			devname: "vda",
+			resize:  true,
+		},
+		{
+			name:    "change_without_resize",
+			msg:     kernelUevent("change", vda, "ACTION=change", "SUBSYSTEM=block", "DISK_MEDIA_CHANGE=1", "DEVNAME=vda", "DEVTYPE=disk"),
+			ok:      true,
+			action:  "change",
+			devname: "vda",
+		},
+		{
+			name:    "new_disk",
+			msg:     kernelUevent("add", "/devices/virtual/block/vdb", "ACTION=add", "SUBSYSTEM=block", "DEVNAME=vdb", "DEVTYPE=disk"),
+			ok:      true,
+			action:  "add",
+			devname: "vdb",
+			resize:  true,
+		},
+		{
+			name:    "new_partition",
+			msg:     kernelUevent("add", vda+"/vda1", "ACTION=add", "SUBSYSTEM=block", "DEVNAME=vda1", "DEVTYPE=partition", "PARTN=1"),
+			ok:      true,
+			action:  "add",
+			devname: "vda1",
+		},
+		{
+			name:    "removed_disk",
+			msg:     kernelUevent("remove", vda, "ACTION=remove", "SUBSYSTEM=block", "DEVNAME=vda", "DEVTYPE=disk"),
+			ok:      true,
+			action:  "remove",
+			devname: "vda",
+		},
+		{
+			name:   "other_subsystem",
+			msg:    kernelUevent("change", "/devices/system/memory/memory32", "ACTION=change", "SUBSYSTEM=memory", "RESIZE=1"),
+			ok:     true,
+			action: "change",
+		},
+		{
+			// The header names the action; ACTION and DEVNAME
+			// are only extra.
+			name:   "missing_action_and_devname",
+			msg:    kernelUevent("change", vda, "SUBSYSTEM=block", "RESIZE=1"),
+			ok:     true,
+			action: "change",
+			resize: true,
+		},
+		{
+			name: "libudev",
+			msg:  libudevUevent("ACTION=change", "DEVPATH="+vda, "SUBSYSTEM=block", "RESIZE=1", "DEVNAME=/dev/vda", "DEVTYPE=disk"),
+		},
+		{
+			name: "no_header",
+			msg:  []byte("ACTION=change\x00SUBSYSTEM=block\x00RESIZE=1\x00"),
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		ev, ok := parseUevent(tt.msg)
+		if ok != tt.ok {
+			t.Errorf("%s: parseUevent ok = %v; want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if ev.action != tt.action || ev.env["DEVNAME"] != tt.devname {
+			t.Errorf("%s: action %q, DEVNAME %q; want %q, %q", tt.name, ev.action, ev.env["DEVNAME"], tt.action, tt.devname)
+		}
+		if got := ev.wantsResize(); got != tt.resize {
+			t.Errorf("%s: wantsResize = %v; want %v", tt.name, got, tt.resize)
+		}
+	}
+}
+
+func TestDiskGrowth(t *testing.T) {
+	const gib = 1 << 30
+	tests := []struct {
+		name      string
+		last, cur map[string]int64
+		want      []string
+	}{
+		{
+			name: "unchanged",
+			last: map[string]int64{"vda": 10 * gib, "vdb": 20 * gib},
+			cur:  map[string]int64{"vda": 10 * gib, "vdb": 20 * gib},
+		},
+		{
+			name: "grew",
+			last: map[string]int64{"vda": 10 * gib, "vdb": 20 * gib},
+			cur:  map[string]int64{"vda": 10 * gib, "vdb": 30 * gib},
+			want: []string{"vdb grew from 20.0 GiB to 30.0 GiB"},
+		},
+		{
+			name: "new_disk",
+			last: map[string]int64{"vda": 10 * gib},
+			cur:  map[string]int64{"vda": 10 * gib, "sda": gib},
+			want: []string{"new disk sda"},
+		},
+		{
+			name: "shrank",
+			last: map[string]int64{"vda": 10 * gib},
+			cur:  map[string]int64{"vda": 5 * gib},
+		},
+		{
+			name: "disappeared",
+			last: map[string]int64{"vda": 10 * gib, "vdb": 20 * gib},
+			cur:  map[string]int64{"vda": 10 * gib},
+		},
+		{
+			name: "several",
+			last: map[string]int64{"vda": 10 * gib, "vdb": 20 * gib, "vdc": gib},
+			cur:  map[string]int64{"vda": 15 * gib, "vdb": 10 * gib, "vdd": gib},
+			want: []string{"new disk vdd", "vda grew from 10.0 GiB to 15.0 GiB"},
+		},
+	}
+	for _, tt := range tests {
+		got := diskGrowth(tt.last, tt.cur)
+		sort.Strings(got)
+		sort.Strings(tt.want)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: diskGrowth = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
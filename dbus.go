@@ -0,0 +1,150 @@
+//go:build linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+var dbusFlag = flag.Bool("dbus", false, "serve the "+dbusName+" interface on the system D-Bus, authorizing callers with PolicyKit; see the dbus directory for the bus and PolicyKit policy files to install")
+
+const (
+	dbusName  = "org.embiggen.Disk1"
+	dbusPath  = "/org/embiggen/Disk1"
+	dbusIface = dbusName
+
+	// PolicyKit actions, as declared in dbus/org.embiggen.disk1.policy.
+	polkitActionResize = "org.embiggen.disk1.resize"
+	polkitActionPlan   = "org.embiggen.disk1.plan"
+)
+
+const dbusIntrospect = `
+<node>
+	<interface name="` + dbusIface + `">
+		<method name="Resize">
+			<arg name="mountpoint" direction="in" type="s"/>
+			<arg name="result" direction="out" type="s"/>
+		</method>
+		<method name="Plan">
+			<arg name="mountpoint" direction="in" type="s"/>
+			<arg name="plan" direction="out" type="s"/>
+		</method>
+		<method name="Status">
+			<arg name="mountpoint" direction="in" type="s"/>
+			<arg name="status" direction="out" type="s"/>
+		</method>
+	</interface>` + introspect.IntrospectDataString + `</node>`
+
+// dbusMain implements --dbus.
+func dbusMain() {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		fatalf("connecting to the system bus: %v", err)
+	}
+	defer conn.Close()
+	svc := &dbusService{conn: conn}
+	if err := conn.Export(svc, dbusPath, dbusIface); err != nil {
+		fatalf("%v", err)
+	}
+	if err := conn.Export(introspect.Introspectable(dbusIntrospect), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		fatalf("%v", err)
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		fatalf("requesting D-Bus name %s: %v", dbusName, err)
+	}
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		fatalf("D-Bus name %s is already taken", dbusName)
+	}
+	logger.Info("serving D-Bus", "name", dbusName)
+	<-stopRequested
+	// Let any run in progress finish first.
+	serveMu.Lock()
+	logger.Info("D-Bus service stopped")
+}
+
+// dbusService implements the D-Bus methods. Each returns its result
+// as the same JSON as the corresponding HTTP API endpoint.
+type dbusService struct {
+	conn *dbus.Conn
+}
+
+func (s *dbusService) Resize(sender dbus.Sender, mnt string) (string, *dbus.Error) {
+	if err := s.authorize(sender, polkitActionResize); err != nil {
+		return "", err
+	}
+	logger.Info("D-Bus request", "method", "Resize", "mountpoint", mnt, "sender", string(sender))
+	return dbusReply(apiRun(mnt, false))
+}
+
+func (s *dbusService) Plan(sender dbus.Sender, mnt string) (string, *dbus.Error) {
+	if err := s.authorize(sender, polkitActionPlan); err != nil {
+		return "", err
+	}
+	logger.Info("D-Bus request", "method", "Plan", "mountpoint", mnt, "sender", string(sender))
+	return dbusReply(apiRun(mnt, true))
+}
+
+func (s *dbusService) Status(sender dbus.Sender, mnt string) (string, *dbus.Error) {
+	if err := s.authorize(sender, polkitActionPlan); err != nil {
+		return "", err
+	}
+	return dbusReply(apiStatus(mnt))
+}
+
+// dbusReply encodes v as a method's JSON result. Failed runs still
+// return their result, whose "error" field says what went wrong,
+// rather than a D-Bus error, so callers see how far it got.
+func dbusReply(v interface{}, _ error) (string, *dbus.Error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+	return string(b), nil
+}
+
+// authorize asks PolicyKit whether sender may perform action, allowing
+// it to prompt the user to authenticate.
+func (s *dbusService) authorize(sender dbus.Sender, action string) *dbus.Error {
+	subject := struct {
+		Kind    string
+		Details map[string]dbus.Variant
+	}{"system-bus-name", map[string]dbus.Variant{"name": dbus.MakeVariant(string(sender))}}
+	const allowUserInteraction = 1
+	var res struct {
+		IsAuthorized bool
+		IsChallenge  bool
+		Details      map[string]string
+	}
+	call := s.conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority").Call(
+		"org.freedesktop.PolicyKit1.Authority.CheckAuthorization", 0,
+		subject, action, map[string]string{}, uint32(allowUserInteraction), "")
+	if err := call.Store(&res); err != nil {
+		return dbus.MakeFailedError(fmt.Errorf("checking authorization with PolicyKit: %v", err))
+	}
+	if !res.IsAuthorized {
+		return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []interface{}{fmt.Sprintf("not authorized for %s", action)})
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "flag"
+
+var dbusFlag = flag.Bool("dbus", false, "serve the org.embiggen.Disk1 interface on the system D-Bus (Linux only)")
+
+// dbusMain fails: the D-Bus service and PolicyKit are only supported
+// on Linux.
+func dbusMain() {
+	fatalf("--dbus is only supported on Linux")
+}
@@ -0,0 +1,517 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+// diagFiles are the files collect-diagnostics copies as they are.
+var diagFiles = []string{
+	"/proc/partitions",
+	"/proc/devices",
+	"/proc/mdstat",
+	"/proc/cmdline",
+	"/proc/version",
+	"/etc/fstab",
+}
+
+// diagSysfsAttrs are the files collect-diagnostics copies from each
+// block device's /sys/class/block directory.
+var diagSysfsAttrs = []string{
+	"dev", "size", "ro", "removable", "partition", "start",
+	"alignment_offset", "ext_range", "capability",
+	"queue/logical_block_size", "queue/physical_block_size", "queue/rotational",
+	"dm/name", "dm/uuid", "dm/suspended",
+	"md/level", "md/array_state",
+	"device/model", "device/vendor", "device/type", "device/state",
+}
+
+// diagEntry is one file of a diagnostics bundle.
+type diagEntry struct {
+	name string // relative to the bundle's top directory
+	data []byte
+	link string // if non-empty, it's a symlink to link
+}
+
+// diagBundle is a diagnostics bundle being collected.
+type diagBundle struct {
+	entries []diagEntry
+	errors  map[string]string // what couldn't be collected, and why
+	rec     *resize.RecordRunner
+	text    bytes.Buffer             // commands.txt
+	statfs  map[string]unix.Statfs_t // statfs.json
+
+	// secrets are strings to sanitize, and the placeholders to
+	// replace them with.
+	secrets map[string]string
+}
+
+// diagManifest is manifest.json in a diagnostics bundle.
+type diagManifest struct {
+	Version     string            `json:"version"`
+	Time        time.Time         `json:"time"`
+	OS          string            `json:"os"`
+	Kernel      string            `json:"kernel"`
+	Machine     string            `json:"machine"`
+	Mountpoints []string          `json:"mountpoints"`
+	Sanitized   bool              `json:"sanitized"`
+	Errors      map[string]string `json:"errors,omitempty"`
+}
+
+// collectDiagnosticsMain implements the "collect-diagnostics"
+// subcommand. It gathers what's needed to understand, and reproduce,
+// how embiggen-disk sees a machine's disks into a tarball to attach to
+// bug reports: the partition tables, lsblk, LVM, and device mapper
+// reports, the mount tables, the relevant sysfs entries, and a
+// recording of every command a --dry-run of each mount point runs.
+// Nothing is changed.
+//
+// Unless --sanitize=false, the hostname, disk serial numbers and WWNs,
+// and the servers of network filesystems are replaced by placeholders.
+// Filesystem and partition UUIDs and labels are kept, since fstab
+// entries are matched by them.
+func collectDiagnosticsMain(args []string) {
+	fs := flag.NewFlagSet("collect-diagnostics", flag.ExitOnError)
+	out := fs.String("out", "", `file to write the .tar.gz to, or "-" for stdout; default embiggen-disk-diagnostics-<time>.tar.gz`)
+	sanitize := fs.Bool("sanitize", true, "replace the hostname, disk serial numbers, and network filesystem servers with placeholders")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk collect-diagnostics:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] collect-diagnostics [--out=<file.tar.gz>] [--sanitize=false] [<mount-point>...]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	mnts := fs.Args()
+	if len(mnts) == 0 {
+		mnts = []string{"/"}
+	}
+	now := time.Now()
+	if *out == "" {
+		*out = "embiggen-disk-diagnostics-" + now.Format("20060102-150405") + ".tar.gz"
+	}
+
+	b := &diagBundle{
+		errors:  map[string]string{},
+		rec:     &resize.RecordRunner{Runner: resize.CommandRunner},
+		secrets: map[string]string{},
+		statfs:  map[string]unix.Statfs_t{},
+	}
+	resize.CommandRunner = b.rec
+
+	for _, f := range diagFiles {
+		b.addFile(f)
+	}
+	for _, dir := range resize.RepartDirs {
+		confs, _ := filepath.Glob(filepath.Join(dir, "*.conf"))
+		for _, f := range confs {
+			b.addFile(f)
+		}
+	}
+	// The mount table resized can be another's, as in a container.
+	b.addFileAs(resize.MountinfoFile, "proc/self/mountinfo")
+	b.addFileAs(resize.MountsFile, "proc/mounts")
+	b.addSysfs()
+	b.addDevLinks()
+	b.addTools()
+	for _, args := range diagCommands() {
+		b.runCommand(args...)
+	}
+	b.recordStatfs()
+	b.dryRuns(mnts)
+	sj, _ := json.MarshalIndent(b.statfs, "", "  ")
+	b.add("statfs.json", append(sj, '\n'))
+
+	m := diagManifest{
+		Version:     versionString(),
+		Time:        now.UTC(),
+		OS:          runtime.GOOS,
+		Mountpoints: mnts,
+		Sanitized:   *sanitize,
+		Errors:      b.errors,
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		m.Kernel = unix.ByteSliceToString(uts.Release[:]) + " " + unix.ByteSliceToString(uts.Version[:])
+		m.Machine = unix.ByteSliceToString(uts.Machine[:])
+	}
+	mj, _ := json.MarshalIndent(m, "", "  ")
+	b.add("manifest.json", append(mj, '\n'))
+	var recs bytes.Buffer
+	for _, rec := range b.rec.Recordings() {
+		line, _ := json.Marshal(rec)
+		recs.Write(append(line, '\n'))
+	}
+	b.add("commands.jsonl", recs.Bytes())
+	b.add("commands.txt", b.text.Bytes())
+
+	if *sanitize {
+		b.findSecrets()
+		b.sanitize()
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := b.writeTarball(w, now); err != nil {
+		fatalf("writing %s: %v", *out, err)
+	}
+	if *out != "-" {
+		fmt.Fprintf(os.Stderr, "Wrote %s; attach it to your bug report.\n", *out)
+	}
+}
+
+// diagCommands returns the read-only commands collect-diagnostics
+// runs, along with one sfdisk --dump per disk.
+func diagCommands() [][]string {
+	if runtime.GOOS == "freebsd" {
+		return [][]string{
+			{"gpart", "show", "-p"},
+			{"gpart", "list"},
+			{"sysctl", "-n", "kern.geom.conftxt"},
+			{"zpool", "list", "-vHP"},
+			{"zpool", "status"},
+		}
+	}
+	cmds := [][]string{
+		{"lsblk", "-J", "-b", "-O"},
+		{"blkid"},
+		{"pvdisplay", "-c"},
+		{"lvdisplay", "-c"},
+		{"pvs", "--reportformat", "json", "--units", "b", "-o", "pv_all"},
+		{"vgs", "--reportformat", "json", "--units", "b", "-o", "vg_all"},
+		{"lvs", "--reportformat", "json", "--units", "b", "-a", "-o", "lv_all"},
+		{"dmsetup", "table"},
+	}
+	des, _ := os.ReadDir("/sys/block")
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "dm-") {
+			continue
+		}
+		if b, err := os.ReadFile("/sys/block/" + name + "/size"); err == nil && strings.TrimSpace(string(b)) == "0" {
+			continue
+		}
+		cmds = append(cmds, []string{"sfdisk", "--dump", "/dev/" + name})
+	}
+	return cmds
+}
+
+func (b *diagBundle) add(name string, data []byte) {
+	b.entries = append(b.entries, diagEntry{name: name, data: data})
+}
+
+// addFile adds the file at path, under its path in the bundle.
+func (b *diagBundle) addFile(path string) {
+	b.addFileAs(path, strings.TrimPrefix(path, "/"))
+}
+
+// addFileAs adds the file at path as name.
+func (b *diagBundle) addFileAs(path, name string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			b.errors[path] = err.Error()
+		}
+		return
+	}
+	b.add(name, data)
+}
+
+// addSysfs adds diagSysfsAttrs of each block device but empty ones,
+// like unused loop devices, laid out as in sysfs: in its directory
+// under /sys/devices, linked to from /sys/class/block, /sys/block, and
+// /sys/dev/block, with its slaves and holders as links too. An empty
+// file stands in for its device node in /dev.
+func (b *diagBundle) addSysfs() {
+	des, err := os.ReadDir("/sys/class/block")
+	if err != nil {
+		b.errors["/sys/class/block"] = err.Error()
+		return
+	}
+	for _, de := range des {
+		name := de.Name()
+		dir, err := filepath.EvalSymlinks("/sys/class/block/" + name)
+		if err != nil {
+			continue
+		}
+		if b, err := os.ReadFile(dir + "/size"); err == nil && strings.TrimSpace(string(b)) == "0" {
+			continue
+		}
+		b.addLink("/sys/class/block/" + name)
+		b.addLink("/sys/block/" + name)
+		if devno, err := os.ReadFile(dir + "/dev"); err == nil {
+			b.addLink("/sys/dev/block/" + strings.TrimSpace(string(devno)))
+		}
+		for _, attr := range diagSysfsAttrs {
+			b.addFile(dir + "/" + attr)
+		}
+		for _, sub := range []string{"slaves", "holders"} {
+			ents, _ := os.ReadDir(dir + "/" + sub)
+			for _, e := range ents {
+				b.addLink(dir + "/" + sub + "/" + e.Name())
+			}
+		}
+		b.add("dev/"+name, nil)
+	}
+}
+
+// addDevLinks adds the udev symlinks in /dev/disk and /dev/mapper, and
+// those LVM makes in a directory per volume group.
+func (b *diagBundle) addDevLinks() {
+	links, _ := filepath.Glob("/dev/disk/by-*/*")
+	mapper, _ := filepath.Glob("/dev/mapper/*")
+	links = append(links, mapper...)
+	all, _ := filepath.Glob("/dev/*/*")
+	for _, p := range all {
+		if l, err := os.Readlink(p); err == nil && strings.HasPrefix(filepath.Base(l), "dm-") && !strings.HasPrefix(p, "/dev/disk/") && !strings.HasPrefix(p, "/dev/mapper/") {
+			links = append(links, p)
+		}
+	}
+	for _, p := range links {
+		b.addLink(p)
+	}
+}
+
+// addLink adds the symlink at path, if it is one.
+func (b *diagBundle) addLink(path string) {
+	if link, err := os.Readlink(path); err == nil {
+		b.entries = append(b.entries, diagEntry{name: strings.TrimPrefix(path, "/"), link: link})
+	}
+}
+
+// recordStatfs makes resize.Statfs record what it returns in
+// statfs.json, keyed by the mount point, for replaying.
+func (b *diagBundle) recordStatfs() {
+	statfs := resize.Statfs
+	resize.Statfs = func(path string, st *unix.Statfs_t) error {
+		err := statfs(path, st)
+		if err == nil {
+			b.statfs[strings.TrimPrefix(path, resize.HostRoot)] = *st
+		}
+		return err
+	}
+}
+
+// addTools adds tools.json, where the tools embiggen-disk may run were
+// found, for replaying.
+func (b *diagBundle) addTools() {
+	tools := map[string]string{}
+	names := []string{"lsblk", "udevadm", "mount", "findmnt", "dmsetup", "pvs", "vgs", "lvs", "vgchange",
+		"gpart", "growfs", "zpool", "sysctl"}
+	for _, t := range doctorTools {
+		names = append(names, t.name)
+	}
+	for _, name := range names {
+		if p, err := resize.ToolPath(name); err == nil {
+			tools[name] = p
+		}
+	}
+	j, _ := json.MarshalIndent(tools, "", "  ")
+	b.add("tools.json", append(j, '\n'))
+}
+
+// runCommand runs the read-only command args, which is recorded by
+// b.rec, and adds its output to commands.txt.
+func (b *diagBundle) runCommand(args ...string) {
+	ctx, cancel := runContext()
+	defer cancel()
+	cmd := resize.Command(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := resize.CommandRunner.Run(cmd)
+	fmt.Fprintf(&b.text, "$ %s\n%s%s", strings.Join(args, " "), stdout.Bytes(), stderr.Bytes())
+	if err != nil {
+		fmt.Fprintf(&b.text, "[error: %v]\n", err)
+	}
+	b.text.WriteString("\n")
+}
+
+// dryRuns does a --dry-run of each of mnts, so the commands it runs
+// are recorded, and adds what it would've done to dry-run.txt.
+func (b *diagBundle) dryRuns(mnts []string) {
+	var buf bytes.Buffer
+	resize.DryRun = true
+	resize.DryRunf = func(format string, args ...interface{}) {
+		fmt.Fprintf(&buf, "  [dry-run] "+format+"\n", args...)
+	}
+	for _, mnt := range mnts {
+		fmt.Fprintf(&buf, "%s:\n", mnt)
+		ctx, cancel := runContext()
+		e, err := resize.FileSystem(ctx, mnt)
+		if err == nil {
+			var changes []resize.Change
+			changes, err = resize.Resize(ctx, e, nil)
+			for _, c := range changes {
+				fmt.Fprintf(&buf, "  * %s\n", c)
+			}
+		}
+		cancel()
+		if err != nil {
+			fmt.Fprintf(&buf, "  error: %v\n", err)
+		}
+		buf.WriteString("\n")
+	}
+	b.add("dry-run.txt", buf.Bytes())
+}
+
+// findSecrets fills in b.secrets from what's been collected.
+func (b *diagBundle) findSecrets() {
+	if host, err := os.Hostname(); err == nil {
+		b.secret(host, "HOSTNAME")
+		if short, _, ok := strings.Cut(host, "."); ok {
+			b.secret(short, "HOSTNAME")
+		}
+	}
+	for _, rec := range b.rec.Recordings() {
+		if len(rec.Args) > 0 && rec.Args[0] == "lsblk" {
+			var v any
+			if json.Unmarshal([]byte(rec.Stdout), &v) == nil {
+				b.lsblkSecrets(v)
+			}
+		}
+	}
+	for _, e := range b.entries {
+		if e.name != "proc/mounts" {
+			continue
+		}
+		for _, line := range strings.Split(string(e.data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 3 {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(f[2], "nfs"), f[2] == "cifs", f[2] == "smb3", f[2] == "9p" && strings.Contains(f[0], ":"):
+				if server, _, ok := strings.Cut(f[0], ":"); ok {
+					b.secret(server, "SERVER")
+				} else {
+					b.secret(f[0], "SERVER")
+				}
+			}
+		}
+	}
+}
+
+// lsblkSecrets adds the serial numbers and WWNs in v, lsblk's JSON
+// output, to b.secrets.
+func (b *diagBundle) lsblkSecrets(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, x := range v {
+			switch k {
+			case "serial":
+				if s, ok := x.(string); ok {
+					b.secret(s, "SERIAL")
+				}
+			case "wwn":
+				if s, ok := x.(string); ok {
+					b.secret(s, "WWN")
+				}
+			default:
+				b.lsblkSecrets(x)
+			}
+		}
+	case []any:
+		for _, x := range v {
+			b.lsblkSecrets(x)
+		}
+	}
+}
+
+// secret notes that s is to be replaced by kind and a number. Strings
+// too short to be identifying, which would otherwise mangle
+// everything, are ignored.
+func (b *diagBundle) secret(s, kind string) {
+	s = strings.TrimSpace(s)
+	if len(s) < 4 || b.secrets[s] != "" {
+		return
+	}
+	n := 1
+	for _, v := range b.secrets {
+		if strings.HasPrefix(v, kind) {
+			n++
+		}
+	}
+	b.secrets[s] = fmt.Sprintf("%s%d", kind, n)
+}
+
+// sanitize replaces b.secrets in the bundle's names and contents.
+func (b *diagBundle) sanitize() {
+	var ss []string
+	for s := range b.secrets {
+		ss = append(ss, s)
+	}
+	// Longest first, so one secret containing another is replaced
+	// whole.
+	sort.Slice(ss, func(i, j int) bool { return len(ss[i]) > len(ss[j]) })
+	var oldnew []string
+	for _, s := range ss {
+		oldnew = append(oldnew, s, b.secrets[s])
+	}
+	r := strings.NewReplacer(oldnew...)
+	for i := range b.entries {
+		e := &b.entries[i]
+		e.name = r.Replace(e.name)
+		e.link = r.Replace(e.link)
+		if e.data != nil {
+			e.data = []byte(r.Replace(string(e.data)))
+		}
+	}
+}
+
+// writeTarball writes the bundle to w as a gzipped tarball, with its
+// files in an embiggen-disk-diagnostics directory.
+func (b *diagBundle) writeTarball(w io.Writer, mtime time.Time) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, e := range b.entries {
+		hdr := &tar.Header{Name: "embiggen-disk-diagnostics/" + e.name, Mode: 0644, ModTime: mtime, Size: int64(len(e.data)), Typeflag: tar.TypeReg}
+		if e.link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Mode, hdr.Size = tar.TypeSymlink, e.link, 0777, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var diskFlag = flag.String("disk", "", "comma-separated disks whose free space to use when several could grow, as when a volume group's PVs are on several disks: each a path like /dev/disk/by-id/..., or a disk's WWN or serial number; only the PVs on them are grown and the LV given their space")
+
+// setDisks resolves --disk into resize.Disks.
+func setDisks() error {
+	if *diskFlag == "" {
+		return nil
+	}
+	for _, spec := range strings.Split(*diskFlag, ",") {
+		disk, err := resize.ResolveDisk(context.Background(), strings.TrimSpace(spec))
+		if err != nil {
+			return fmt.Errorf("--disk: %w", err)
+		}
+		vlogf("--disk %s is %s", spec, disk)
+		resize.Disks = append(resize.Disks, disk)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var distribute = flag.String("distribute", "", "comma-separated mountpoint=share list, like /var=50%,/home=50% or /var=2,/home=1, of filesystems on LVs in the same volume group to split its new space among, by percentage or by weight, instead of giving it all to one")
+
+// distributeMain implements --distribute: it grows the volume groups
+// of the named filesystems' LVs and splits their new space among them
+// by the spec's shares.
+func distributeMain(spec string) {
+	mnts, shares, err := resize.ParseShares(spec)
+	if err != nil {
+		fatalf("--distribute: %v", err)
+	}
+	if err := growDistributed(spec, mnts, shares); err != nil {
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, err.Error()))
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// growDistributed grows the filesystems at mnts, or the LVs named by
+// those that are /dev paths, by shares, reporting what it did on
+// stdout like grow. The history log records the run as label.
+func growDistributed(label string, mnts []string, shares []resize.Share) error {
+	ctx, end, err := beginRun()
+	if err != nil {
+		return err
+	}
+	defer end()
+	r := &run{ctx: ctx, start: time.Now()}
+	lastRun = r
+	for i, mnt := range mnts {
+		if strings.HasPrefix(mnt, "/dev/") {
+			shares[i].Resizer = resize.NewLVResizer(mnt)
+			continue
+		}
+		e, err := resize.FileSystem(ctx, mnt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", mnt, err)
+		}
+		shares[i].Resizer = e
+	}
+	changes, err := resize.Distribute(ctx, shares, r.hooks())
+	r.record(label, resize.ActionGrow, err)
+	if len(changes) > 0 {
+		fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Changes made:"))
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", colorize(os.Stdout, colorGreen, c.String()))
+		}
+	} else if err == nil {
+		fmt.Printf("No changes made.\n")
+	}
+	if err != nil {
+		return fmt.Errorf("error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+// doctorTool describes an external program embiggen-disk may run.
+type doctorTool struct {
+	name     string   // as looked up in $PATH, or absolute
+	args     []string // arguments printing its version
+	pkg      string   // package that usually provides it
+	required bool     // needed for every run, vs only some stacks
+	usedFor  string
+}
+
+var doctorTools = []doctorTool{
+	{"sfdisk", []string{"--version"}, "util-linux", true, "reading and writing partition tables"},
+	{"sgdisk", []string{"--version"}, "gdisk", false, "writing GPT partition tables without sfdisk"},
+	{"parted", []string{"--version"}, "parted", false, "writing partition tables without sfdisk or sgdisk"},
+	{"blkid", []string{"-V"}, "util-linux", false, "reading partition tables for sgdisk and parted"},
+	{"resize2fs", nil, "e2fsprogs", false, "growing ext2/ext3/ext4 filesystems"},
+	{"e2fsck", []string{"-V"}, "e2fsprogs", false, "checking ext2/ext3/ext4 filesystems before offline resizes"},
+	{"dumpe2fs", []string{"-V"}, "e2fsprogs", false, "reading the size of unmounted ext2/ext3/ext4 filesystems"},
+	{"xfs_growfs", []string{"-V"}, "xfsprogs", false, "growing XFS filesystems"},
+	{"btrfs", []string{"--version"}, "btrfs-progs", false, "growing btrfs filesystems"},
+	{"lvdisplay", []string{"--version"}, "lvm2", false, "inspecting LVM logical volumes"},
+	{"pvdisplay", []string{"--version"}, "lvm2", false, "inspecting LVM physical volumes"},
+	{"lvextend", []string{"--version"}, "lvm2", false, "growing LVM logical volumes"},
+	{"pvresize", []string{"--version"}, "lvm2", false, "growing LVM physical volumes"},
+	{"dmsetup", []string{"--version"}, "dmsetup", false, "growing plain dm-linear devices"},
+	{"cryptsetup", []string{"--version"}, "cryptsetup", false, "growing LUKS/dm-crypt devices"},
+	{"wipefs", []string{"--version"}, "util-linux", false, "checking that disks to provision are blank"},
+	{"mkfs.ext4", []string{"-V"}, "e2fsprogs", false, "making ext4 filesystems on provisioned disks"},
+	{"mkfs.xfs", []string{"-V"}, "xfsprogs", false, "making XFS filesystems on provisioned disks"},
+	{"mkfs.btrfs", []string{"--version"}, "btrfs-progs", false, "making btrfs filesystems on provisioned disks"},
+	{"ubirsvol", []string{"--version"}, "mtd-utils", false, "growing UBI volumes"},
+	{"lvm", []string{"version"}, "lvm2", false, "running LVM commands when their individual symlinks are missing"},
+}
+
+// runDoctor checks for the tools, kernel features, and privileges
+// embiggen-disk needs, writing a report to w. It returns whether
+// everything required was found.
+func runDoctor(w io.Writer) bool {
+	setToolPaths()
+	ok := true
+	fmt.Fprintf(w, "%s\n\n", versionString())
+
+	fmt.Fprintf(w, "Tools:\n")
+	for _, t := range doctorTools {
+		path, err := resize.ToolPath(t.name)
+		if err != nil {
+			status := "missing (optional)"
+			if t.required {
+				status = "MISSING"
+				ok = false
+			}
+			fmt.Fprintf(w, "  %-12s %s; needed for %s. Install the %s package.\n", t.name, status, t.usedFor, t.pkg)
+			continue
+		}
+		fmt.Fprintf(w, "  %-12s ok: %s", t.name, path)
+		if v := toolVersion(path, t.args); v != "" {
+			fmt.Fprintf(w, " (%s)", v)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "\nKernel:\n")
+	if rel, err := kernelRelease(); err != nil {
+		fmt.Fprintf(w, "  uname: %v\n", err)
+		ok = false
+	} else if !kernelAtLeast(rel, 3, 6) {
+		fmt.Fprintf(w, "  %s: TOO OLD; BLKPG_RESIZE_PARTITION needs Linux 3.6+. Upgrade the kernel.\n", rel)
+		ok = false
+	} else {
+		fmt.Fprintf(w, "  %s: ok, supports BLKPG_RESIZE_PARTITION\n", rel)
+	}
+	for _, p := range []string{"/proc/self/mountinfo", "/sys/block"} {
+		if _, err := os.Stat(p); err != nil {
+			fmt.Fprintf(w, "  %s: MISSING (%v); mount proc and sysfs.\n", p, err)
+			ok = false
+		}
+	}
+
+	fmt.Fprintf(w, "\nNamespaces:\n")
+	if why := namespaceMismatch(); why != "" {
+		fmt.Fprintf(w, "  %s; %s.\n", why, namespaceAdvice)
+	} else {
+		fmt.Fprintf(w, "  same root and mount namespace as PID 1: ok\n")
+	}
+
+	fmt.Fprintf(w, "\nPrivileges:\n")
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(w, "  not running as root; resizing requires root. Re-run with sudo.\n")
+		ok = false
+	} else {
+		fmt.Fprintf(w, "  running as root: ok\n")
+	}
+
+	if ok {
+		fmt.Fprintf(w, "\nEverything required was found.\n")
+	} else {
+		fmt.Fprintf(w, "\nProblems were found; see above.\n")
+	}
+	return ok
+}
+
+// toolVersion returns the first line of output from running path with
+// args, or the empty string if that fails or args is nil.
+func toolVersion(path string, args []string) string {
+	if args == nil {
+		return ""
+	}
+	out, _ := resize.Command(context.Background(), path, args...).CombinedOutput()
+	line, _, _ := strings.Cut(string(bytes.TrimSpace(out)), "\n")
+	return strings.TrimSpace(line)
+}
+
+func kernelRelease() (string, error) {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(u.Release[:], "\x00")), nil
+}
+
+// kernelAtLeast reports whether the kernel release string rel
+// (e.g. "4.19.0-6-amd64") is at least version major.minor.
+func kernelAtLeast(rel string, major, minor int) bool {
+	f := strings.FieldsFunc(rel, func(r rune) bool { return r == '.' || r == '-' })
+	if len(f) < 2 {
+		return false
+	}
+	vmaj, err1 := strconv.Atoi(f[0])
+	vmin, err2 := strconv.Atoi(f[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return vmaj > major || (vmaj == major && vmin >= minor)
+}
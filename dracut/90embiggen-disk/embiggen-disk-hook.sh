@@ -0,0 +1,10 @@
+#!/bin/sh
+# Grows the root device before it's mounted. Disable with rd.embiggen=0
+# on the kernel command line.
+
+type getargbool >/dev/null 2>&1 || . /lib/dracut-lib.sh
+
+getargbool 1 rd.embiggen || return 0
+
+embiggen-disk --lock-file= initramfs --root="${root#block:}" ||
+	warn "embiggen-disk: failed to grow the root device"
@@ -0,0 +1,21 @@
+#!/bin/bash
+# dracut module running "embiggen-disk initramfs" before the root is
+# mounted. Install this directory in /usr/lib/dracut/modules.d and
+# rebuild the initramfs with "dracut -f --add embiggen-disk".
+
+check() {
+	require_binaries embiggen-disk blkid lsblk sfdisk || return 1
+	return 255
+}
+
+depends() {
+	echo udev-rules
+	return 0
+}
+
+install() {
+	inst_multiple embiggen-disk blkid lsblk sfdisk udevadm
+	inst_multiple -o resize2fs e2fsck dumpe2fs \
+		lvm lvdisplay lvextend pvdisplay pvresize pvs
+	inst_hook pre-mount 90 "$moddir/embiggen-disk-hook.sh"
+}
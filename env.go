@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix starts the names of the environment variables that set
+// flags.
+const envPrefix = "EMBIGGEN_"
+
+// flagEnvName returns the environment variable setting the flag named
+// name of the subcommand sub, or of the global flags if sub is empty:
+// EMBIGGEN_LOCK_FILE for --lock-file, and EMBIGGEN_FIRSTBOOT_MARKER for
+// firstboot's --marker.
+func flagEnvName(sub, name string) string {
+	if sub != "" {
+		name = sub + "_" + name
+	}
+	return envPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// setFlagsFromEnv sets each flag in fs, those of the subcommand sub or
+// the global ones if sub is empty, whose environment variable is set,
+// even to the empty string. It's called before parsing the command
+// line, so flags given there take precedence. Flags set this way count
+// as set, so they're passed on, like those on the command line, to
+// the units install-systemd writes and to --remote hosts.
+func setFlagsFromEnv(fs *flag.FlagSet, sub string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		env := flagEnvName(sub, f.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok || err != nil {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for $%s: %v", v, env, serr)
+			return
+		}
+		// Let a flag given several times know the command line
+		// replaces, rather than adds to, what its variable set.
+		if ev, ok := f.Value.(interface{ setFromEnv() }); ok {
+			ev.setFromEnv()
+		}
+	})
+	return err
+}
+
+// parseFlags parses the flags of the subcommand whose flag set is fs
+// from its environment variables and then from args.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if err := setFlagsFromEnv(fs, fs.Name()); err != nil {
+		fatalf("%v", err)
+	}
+	fs.Parse(args)
+}
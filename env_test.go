@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagEnvName(t *testing.T) {
+	tests := []struct {
+		sub, name string
+		want      string
+	}{
+		{"", "lock-file", "EMBIGGEN_LOCK_FILE"},
+		{"", "dry-run", "EMBIGGEN_DRY_RUN"},
+		{"", "timeout", "EMBIGGEN_TIMEOUT"},
+		{"", "vmware-rescan", "EMBIGGEN_VMWARE_RESCAN"},
+		{"", "log.format", "EMBIGGEN_LOG_FORMAT"},
+		{"", "ipv6", "EMBIGGEN_IPV6"},
+		{"firstboot", "marker", "EMBIGGEN_FIRSTBOOT_MARKER"},
+		{"container-storage", "socket", "EMBIGGEN_CONTAINER_STORAGE_SOCKET"},
+		{"image grow", "size", "EMBIGGEN_IMAGE_GROW_SIZE"},
+	}
+	for _, tt := range tests {
+		if got := flagEnvName(tt.sub, tt.name); got != tt.want {
+			t.Errorf("flagEnvName(%q, %q) = %q; want %q", tt.sub, tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestFlagSet returns a flag set named sub with a flag of each kind.
+func newTestFlagSet(sub string) (fs *flag.FlagSet, lockFile *string, dry *bool, timeout *time.Duration) {
+	fs = flag.NewFlagSet(sub, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	lockFile = fs.String("lock-file", "/run/embiggen-disk.lock", "")
+	dry = fs.Bool("dry-run", false, "")
+	timeout = fs.Duration("timeout", 0, "")
+	return
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	t.Setenv("EMBIGGEN_LOCK_FILE", "")
+	t.Setenv("EMBIGGEN_DRY_RUN", "true")
+	t.Setenv("EMBIGGEN_TIMEOUT", "5m")
+	fs, lockFile, dry, timeout := newTestFlagSet("")
+	if err := setFlagsFromEnv(fs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if *lockFile != "" || !*dry || *timeout != 5*time.Minute {
+		t.Errorf("from the environment: lock-file %q, dry-run %v, timeout %v; want \"\", true, 5m", *lockFile, *dry, *timeout)
+	}
+	// Set to the empty string counts as set.
+	var set []string
+	fs.Visit(func(f *flag.Flag) { set = append(set, f.Name) })
+	if got := strings.Join(set, ","); got != "dry-run,lock-file,timeout" {
+		t.Errorf("flags set = %s; want dry-run,lock-file,timeout", got)
+	}
+
+	// The command line overrides the environment.
+	if err := fs.Parse([]string{"--dry-run=false", "--timeout=30s", "/data"}); err != nil {
+		t.Fatal(err)
+	}
+	if *dry || *timeout != 30*time.Second || fs.Arg(0) != "/data" {
+		t.Errorf("after the command line: dry-run %v, timeout %v, args %q; want false, 30s, [/data]", *dry, *timeout, fs.Args())
+	}
+}
+
+func TestSetFlagsFromEnvSubcommand(t *testing.T) {
+	// Global variables don't set a subcommand's flags, nor its variables
+	// the global ones.
+	t.Setenv("EMBIGGEN_DRY_RUN", "true")
+	t.Setenv("EMBIGGEN_CONTAINER_STORAGE_TIMEOUT", "1h")
+	fs, _, dry, timeout := newTestFlagSet("container-storage")
+	if err := setFlagsFromEnv(fs, fs.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if *dry || *timeout != time.Hour {
+		t.Errorf("container-storage: dry-run %v, timeout %v; want false, 1h", *dry, *timeout)
+	}
+	gfs, _, gdry, gtimeout := newTestFlagSet("")
+	if err := setFlagsFromEnv(gfs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !*gdry || *gtimeout != 0 {
+		t.Errorf("global: dry-run %v, timeout %v; want true, 0", *gdry, *gtimeout)
+	}
+}
+
+func TestSetFlagsFromEnvBadValue(t *testing.T) {
+	for env, val := range map[string]string{
+		"EMBIGGEN_DRY_RUN": "maybe",
+		"EMBIGGEN_TIMEOUT": "5 minutes",
+	} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, val)
+			fs, _, _, _ := newTestFlagSet("")
+			err := setFlagsFromEnv(fs, "")
+			if err == nil || !strings.Contains(err.Error(), "$"+env) {
+				t.Errorf("setFlagsFromEnv with %s=%q: %v; want error naming $%s", env, val, err, env)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var eventsFlag = flag.String("events", "", `if "ndjson", print one JSON object per lifecycle event to stdout instead of human-readable output`)
+
+// Event types.
+const (
+	eventRunStart      = "run-start"
+	eventStageStart    = "stage-start"
+	eventStageProgress = "stage-progress"
+	eventStageDone     = "stage-done"
+	eventError         = "error"
+	eventRunDone       = "run-done"
+)
+
+// event is one line of --events=ndjson output.
+type event struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Mountpoint  string    `json:"mountpoint,omitempty"`
+	Stage       string    `json:"stage,omitempty"`
+	Device      string    `json:"device,omitempty"`
+	BeforeBytes int64     `json:"beforeBytes,omitempty"`
+	AfterBytes  int64     `json:"afterBytes,omitempty"`
+	Pass        int       `json:"pass,omitempty"`
+	Percent     float64   `json:"percent,omitempty"`
+	DurationMs  int64     `json:"durationMs,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var eventMu sync.Mutex
+
+func eventsEnabled() bool { return *eventsFlag == "ndjson" }
+
+func checkEventsFlag() error {
+	switch *eventsFlag {
+	case "", "ndjson":
+		return nil
+	}
+	return fmt.Errorf(`unknown --events %q; want "ndjson"`, *eventsFlag)
+}
+
+// emitEvent writes ev to stdout if --events=ndjson.
+func emitEvent(ev event) {
+	if !eventsEnabled() {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// machineOutput reports whether stdout is reserved for machine-readable
+// output, so human-readable text must not be written there.
+func machineOutput() bool { return *jsonOut || eventsEnabled() }
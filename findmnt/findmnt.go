@@ -0,0 +1,169 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package findmnt runs util-linux's findmnt and parses its JSON
+// output into a tree of mounted filesystems.
+package findmnt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Columns are the findmnt output columns a Filesystem holds, as given
+// to its --output flag.
+const Columns = "TARGET,SOURCE,FSTYPE,OPTIONS,MAJ:MIN,UUID,LABEL"
+
+// ErrNotFound is returned by Target and Source when findmnt finds
+// nothing.
+var ErrNotFound = errors.New("findmnt: no matching filesystem")
+
+// Output is the output of findmnt --json.
+type Output struct {
+	Filesystems []*Filesystem `json:"filesystems"`
+}
+
+// A Filesystem is one mounted filesystem in Output.
+type Filesystem struct {
+	Target   string        `json:"target"`  // mount point, e.g. "/"
+	Source   string        `json:"source"`  // e.g. "/dev/sda1" or "/dev/sda1[/subdir]" for a bind mount
+	FSType   string        `json:"fstype"`  // e.g. "ext4"
+	Options  string        `json:"options"` // comma-separated, e.g. "rw,relatime"
+	MajMin   string        `json:"maj:min"` // device number, e.g. "8:1"
+	UUID     string        `json:"uuid"`    // filesystem UUID, if any
+	Label    string        `json:"label"`   // filesystem label, if any
+	Children []*Filesystem `json:"children"`
+}
+
+// HasOption reports whether fs is mounted with the option opt, such as
+// "ro".
+func (fs *Filesystem) HasOption(opt string) bool {
+	for _, o := range strings.Split(fs.Options, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns fs's device number.
+func (fs *Filesystem) Device() (major, minor uint32, err error) {
+	maj, min, ok := strings.Cut(fs.MajMin, ":")
+	if ok {
+		var ma, mi uint64
+		if ma, err = strconv.ParseUint(maj, 10, 32); err == nil {
+			if mi, err = strconv.ParseUint(min, 10, 32); err == nil {
+				return uint32(ma), uint32(mi), nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("findmnt: bad MAJ:MIN %q for %s", fs.MajMin, fs.Target)
+}
+
+// Parse parses the output of findmnt --json.
+func Parse(data []byte) (*Output, error) {
+	o := new(Output)
+	if err := json.Unmarshal(data, o); err != nil {
+		return nil, fmt.Errorf("findmnt: parsing output: %v", err)
+	}
+	return o, nil
+}
+
+// All returns every filesystem in o, parents before their children.
+func (o *Output) All() []*Filesystem {
+	var all []*Filesystem
+	var add func([]*Filesystem)
+	add = func(fss []*Filesystem) {
+		for _, fs := range fss {
+			all = append(all, fs)
+			add(fs.Children)
+		}
+	}
+	add(o.Filesystems)
+	return all
+}
+
+// ByTarget returns the filesystem mounted at target, or nil if there's
+// none. If several are, it returns the last mounted, which hides the
+// others.
+func (o *Output) ByTarget(target string) *Filesystem {
+	var found *Filesystem
+	for _, fs := range o.All() {
+		if fs.Target == target {
+			found = fs
+		}
+	}
+	return found
+}
+
+// BySource returns the filesystems mounted from the device source,
+// including bind mounts of parts of it.
+func (o *Output) BySource(source string) []*Filesystem {
+	var found []*Filesystem
+	for _, fs := range o.All() {
+		if src, _, _ := strings.Cut(fs.Source, "["); src == source {
+			found = append(found, fs)
+		}
+	}
+	return found
+}
+
+// Args returns the arguments to run findmnt with to get Output,
+// followed by extra.
+func Args(extra ...string) []string {
+	return append([]string{"--json", "--output", Columns}, extra...)
+}
+
+// Run runs findmnt with Args(extra...) and parses its output. If
+// findmnt finds nothing, the error is ErrNotFound.
+func Run(ctx context.Context, extra ...string) (*Output, error) {
+	cmd := exec.CommandContext(ctx, "findmnt", Args(extra...)...)
+	cmd.Env = append(cmd.Environ(), "LC_ALL=C")
+	out, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 1 && len(out) == 0 {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("findmnt: %v", err)
+	}
+	return Parse(out)
+}
+
+// Target returns the filesystem mounted at the mount point target.
+func Target(ctx context.Context, target string) (*Filesystem, error) {
+	o, err := Run(ctx, "--mountpoint", target)
+	if err != nil {
+		return nil, err
+	}
+	if fs := o.ByTarget(target); fs != nil {
+		return fs, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Source returns the filesystems mounted from the device source.
+func Source(ctx context.Context, source string) ([]*Filesystem, error) {
+	o, err := Run(ctx, "--source", source)
+	if err != nil {
+		return nil, err
+	}
+	return o.All(), nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// firstbootMarker is where the firstboot subcommand records that it
+// ran, by default.
+const firstbootMarker = "/var/lib/embiggen-disk/firstboot-done"
+
+// firstbootMain implements the "firstboot" subcommand, for embedded
+// images flashed onto a larger SD card or eMMC than they were built
+// for. Like raspi-config's expand-rootfs, it enlarges the root
+// partition and filesystem to fill the card, but only once: after a
+// successful run it writes a marker file, and from then on does
+// nothing. The unit from "install-systemd --mode=firstboot" also
+// checks for the marker, so it drops out of the boot sequence.
+func firstbootMain(args []string) {
+	fs := flag.NewFlagSet("firstboot", flag.ExitOnError)
+	marker := fs.String("marker", firstbootMarker, "file to write once the filesystem was enlarged; if it exists, do nothing")
+	disk := fs.String("disk", "/dev/mmcblk0", "the card the filesystem must be on; if it's elsewhere, fail rather than resize some other disk")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk firstboot:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] firstboot [--marker=%s] [--disk=/dev/mmcblk0] [<mount-point>]\n\n", firstbootMarker)
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+	}
+	if resize.IsMMCHardwarePartition(*disk) {
+		fatalf("--disk=%s is an eMMC boot or RPMB area, not the card's main storage", *disk)
+	}
+	mnt := "/"
+	if fs.NArg() == 1 {
+		mnt = fs.Arg(0)
+	}
+
+	if _, err := os.Stat(*marker); err == nil {
+		logger.Info("already expanded on first boot; nothing to do", "marker", *marker)
+		return
+	}
+	st, err := resize.Stat(mnt)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	want := filepath.Base(*disk)
+	if disks := backingDisks(st.Device); !slices.Contains(disks, want) {
+		fatalf("%s is on %s, not %s; not expanding it", mnt, strings.Join(disks, ", "), *disk)
+	}
+	// Leave the marker unwritten on failure so the next boot retries.
+	growMain(mnt)
+	if *dry {
+		dryRunf("would've written %s", *marker)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(*marker), 0755); err != nil {
+		fatalf("%v", err)
+	}
+	msg := fmt.Sprintf("%s expanded on %s by %s\n", mnt, time.Now().Format(time.RFC3339), versionString())
+	if err := ioutil.WriteFile(*marker, []byte(msg), 0644); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func firstbootUnit(mnts []string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Expand the root filesystem to fill the SD card on first boot
+After=local-fs.target
+Wants=local-fs.target
+ConditionPathExists=!%s
+
+[Service]
+Type=oneshot
+ExecStart=%s
+
+[Install]
+WantedBy=multi-user.target
+`, firstbootMarker, unitCommand(append([]string{"firstboot"}, mnts...)))
+}
@@ -1,8 +1,20 @@
 module github.com/bradfitz/embiggen-disk
 
-go 1.15
+go 1.21
 
 require (
+	github.com/container-storage-interface/spec v1.9.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/u-root/u-root v0.0.0-20180806213625-12f9029297cf
-	golang.org/x/sys v0.0.0-20201112073958-5cba982894dd
+	golang.org/x/sys v0.8.0
+	google.golang.org/grpc v1.57.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230803162519-f966b187b2e5 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
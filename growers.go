@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var otherGrowers = flag.String("other-growers", "wait", "what to do about systemd-growfs or cloud-init's growpart set up to grow the same mount point, as on first boot: wait, for one that's running to finish first; defer, leaving the mount point to it; or ignore")
+
+// A grower is another program set up to grow a mount point, run by
+// one of its systemd units.
+type grower struct {
+	name  string
+	units []string
+}
+
+// unitPathEscape escapes the path p for a systemd unit name, as
+// systemd-escape --path does.
+func unitPathEscape(p string) string {
+	p = strings.Trim(filepath.Clean(p), "/")
+	if p == "" {
+		return "-"
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == ':', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String()
+}
+
+// generatorDirs are where systemd's generators write units, and the
+// .wants directories hooking them up, at boot.
+var generatorDirs = []string{"/run/systemd/generator.early", "/run/systemd/generator", "/run/systemd/generator.late"}
+
+// wanted reports whether the unit u is written or pulled in by some
+// .wants directory in any of dirs.
+func wanted(u string, dirs ...string) bool {
+	for _, d := range dirs {
+		if _, err := os.Stat(filepath.Join(d, u)); err == nil {
+			return true
+		}
+		if m, _ := filepath.Glob(filepath.Join(d, "*.wants", u)); len(m) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// growersOf returns the growers other than embiggen-disk set up to
+// grow the filesystem at mnt: systemd-growfs, which systemd's fstab
+// generator hooks up for x-systemd.growfs mounts, and cloud-init's
+// growpart, if cloud-init is enabled and its config runs cc_growpart
+// on mnt.
+func growersOf(mnt string) []grower {
+	var gs []grower
+	growfs := []string{"systemd-growfs@" + unitPathEscape(mnt) + ".service"}
+	if mnt == "/" {
+		// systemd 253 and later name the root's unit specially.
+		growfs = append(growfs, "systemd-growfs-root.service")
+	}
+	if slices.ContainsFunc(growfs, func(u string) bool { return wanted(u, generatorDirs...) }) {
+		gs = append(gs, grower{"systemd-growfs", growfs})
+	}
+	if _, err := os.Stat("/etc/cloud/cloud-init.disabled"); err == nil {
+		return gs
+	}
+	if !wanted("cloud-init.target", append(generatorDirs, "/etc/systemd/system")...) {
+		return gs
+	}
+	if listed, err := growpartListed("/etc/cloud/cloud.cfg"); err != nil || !listed {
+		return gs
+	}
+	cfg, err := readGrowpartConfig("/etc/cloud/cloud.cfg")
+	mode := fmt.Sprint(cfg.Mode)
+	_, disabled := os.Stat(growrootDisabledFile)
+	if err == nil && mode != "off" && mode != "false" && (disabled != nil || cfg.IgnoreGrowrootDisabled) && slices.Contains(cfg.Devices, mnt) {
+		// cc_growpart runs in the network stage, whose unit
+		// cloud-init 24.3 renamed.
+		gs = append(gs, grower{"cloud-init growpart", []string{"cloud-init-network.service", "cloud-init.service"}})
+	}
+	return gs
+}
+
+// unitStates returns the ActiveState of each of units.
+func unitStates(ctx context.Context, units []string) (active map[string]string, err error) {
+	args := []string{"show", "--property=Id,ActiveState"}
+	out, err := resize.Command(ctx, "systemctl", append(args, units...)...).Output()
+	if err != nil {
+		return nil, err
+	}
+	active = map[string]string{}
+	// Each unit's properties are a block, in no particular order,
+	// ended by a blank line.
+	block := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(append(out, '\n')))
+	for s.Scan() {
+		if s.Text() != "" {
+			k, v, _ := strings.Cut(s.Text(), "=")
+			block[k] = v
+			continue
+		}
+		if id := block["Id"]; id != "" {
+			active[id] = block["ActiveState"]
+		}
+		block = map[string]string{}
+	}
+	return active, nil
+}
+
+// coordinateGrowers applies --other-growers for the mount point mnt.
+// It returns the name of the grower to leave mnt to, under defer, or
+// after waiting, under wait, for any running one to finish, "".
+func coordinateGrowers(ctx context.Context, mnt string) (deferTo string, err error) {
+	if *otherGrowers == "ignore" || resize.Sysroot != "" {
+		return "", nil
+	}
+	gs := growersOf(mnt)
+	if len(gs) == 0 {
+		return "", nil
+	}
+	if *otherGrowers == "defer" {
+		return gs[0].name, nil
+	}
+	var units []string
+	for _, g := range gs {
+		units = append(units, g.units...)
+	}
+	for {
+		active, err := unitStates(ctx, units)
+		if err != nil {
+			vlogf("checking for other growers of %s: %v", mnt, err)
+			return "", nil
+		}
+		var running string
+		for _, g := range gs {
+			for _, u := range g.units {
+				if active[u] == "activating" {
+					running = g.name + " (" + u + ")"
+				}
+			}
+		}
+		if running == "" {
+			return "", nil
+		}
+		logger.Info("waiting for another grower to finish", "mountpoint", mnt, "grower", running)
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for %s to finish growing %s: %w", running, mnt, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// checkOtherGrowersFlag validates --other-growers.
+func checkOtherGrowersFlag() error {
+	switch *otherGrowers {
+	case "wait", "defer", "ignore":
+		return nil
+	}
+	return fmt.Errorf("unknown --other-growers value %q; want wait, defer, or ignore", *otherGrowers)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var historyFile = flag.String("history", "/var/lib/embiggen-disk/history.jsonl", "file to append a JSON record of each run to, for the history subcommand; empty to disable")
+
+// historyEntry is one line of the --history log: what one run on one
+// mount point did, and who ran it.
+type historyEntry struct {
+	Time       time.Time      `json:"time"`
+	DurationMs int64          `json:"durationMs"`
+	Action     string         `json:"action"` // resize.ActionGrow or resize.ActionShrink
+	Mountpoint string         `json:"mountpoint"`
+	User       string         `json:"user,omitempty"`
+	Command    []string       `json:"command"` // os.Args
+	Version    string         `json:"version"`
+	DryRun     bool           `json:"dryRun,omitempty"`
+	Plan       []*planStep    `json:"plan,omitempty"`   // in --dry-run mode
+	Stages     []historyStage `json:"stages,omitempty"` // otherwise, each stage resized
+	ExitStatus int            `json:"exitStatus"`       // per exitCode
+	Error      string         `json:"error,omitempty"`
+}
+
+// historyStage is one stage resized in a historyEntry's run.
+type historyStage struct {
+	Stage       string `json:"stage"`
+	Device      string `json:"device,omitempty"`
+	BeforeBytes int64  `json:"beforeBytes"`
+	AfterBytes  int64  `json:"afterBytes,omitempty"` // unset if it failed
+	DurationMs  int64  `json:"durationMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+// historyMu keeps the entries of runs going at once from interleaving.
+var historyMu sync.Mutex
+
+// record appends r's run on mnt, which ended with err, to the
+// --history log. Failing to write it is logged, not fatal: the resize
+// itself already happened.
+func (r *run) record(mnt, action string, err error) {
+	if *historyFile == "" {
+		return
+	}
+	h := historyEntry{
+		Time:       r.start,
+		DurationMs: time.Since(r.start).Milliseconds(),
+		Action:     action,
+		Mountpoint: mnt,
+		User:       invokingUser(),
+		Command:    os.Args,
+		Version:    versionString(),
+		DryRun:     *dry,
+		Plan:       r.plan.Stages,
+	}
+	for _, st := range r.steps {
+		hs := historyStage{
+			Stage:       st.stage,
+			Device:      resize.Device(st.r),
+			BeforeBytes: st.before,
+			AfterBytes:  st.after,
+			DurationMs:  st.d.Milliseconds(),
+		}
+		if st.err != nil {
+			hs.Error = st.err.Error()
+		}
+		h.Stages = append(h.Stages, hs)
+	}
+	if err != nil {
+		h.ExitStatus = exitCode(err)
+		h.Error = err.Error()
+	}
+	if werr := appendHistory(*historyFile, h); werr != nil {
+		// Unprivileged dry runs can't be expected to write it.
+		if *dry {
+			logger.Debug("not recording history", "err", werr)
+		} else {
+			logger.Warn("recording history failed", "err", werr)
+		}
+	}
+}
+
+// appendHistory appends h to the history log at path as one line of
+// JSON, creating it and its directory if needed.
+func appendHistory(path string, h historyEntry) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := resize.Privileges.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := resize.Privileges.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// invokingUser returns the name of the user who ran embiggen-disk,
+// looking through sudo.
+func invokingUser() string {
+	if u := os.Getenv("SUDO_USER"); u != "" {
+		return u
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprint(os.Getuid())
+}
+
+// readHistory returns the entries of the history log at path, oldest
+// first. Lines it can't parse, like one cut short by a crash, are
+// skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var hs []historyEntry
+	bs := bufio.NewScanner(f)
+	bs.Buffer(nil, 1<<20)
+	for bs.Scan() {
+		var h historyEntry
+		if err := json.Unmarshal(bs.Bytes(), &h); err != nil {
+			continue
+		}
+		hs = append(hs, h)
+	}
+	return hs, bs.Err()
+}
+
+// historyMain implements the "history" subcommand, showing the runs
+// recorded in the --history log.
+func historyMain(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := fs.Int("n", 0, "show only the last n runs; zero shows them all")
+	jsonFlag := fs.Bool("json", false, "print the entries as JSON lines, as they're stored")
+	all := fs.Bool("all", false, "include --dry-run runs and runs that changed nothing")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk history:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [--history=<file>] history [-n=<count>] [--json] [--all] [<mount-point>]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() > 1 || *historyFile == "" {
+		fs.Usage()
+	}
+	hs, err := readHistory(*historyFile)
+	if os.IsNotExist(err) {
+		fmt.Printf("No runs recorded in %s.\n", *historyFile)
+		return
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var shown []historyEntry
+	for _, h := range hs {
+		if fs.NArg() == 1 && h.Mountpoint != fs.Arg(0) {
+			continue
+		}
+		if !*all && (h.DryRun || len(h.Stages) == 0 && h.Error == "") {
+			continue
+		}
+		shown = append(shown, h)
+	}
+	if *limit > 0 && len(shown) > *limit {
+		shown = shown[len(shown)-*limit:]
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		for _, h := range shown {
+			enc.Encode(h)
+		}
+		return
+	}
+	for i, h := range shown {
+		if i > 0 {
+			fmt.Println()
+		}
+		printHistoryEntry(h)
+	}
+}
+
+// printHistoryEntry writes h to stdout for the history subcommand.
+func printHistoryEntry(h historyEntry) {
+	status := colorize(os.Stdout, colorGreen, "ok")
+	if h.Error != "" {
+		status = colorize(os.Stdout, colorRed, fmt.Sprintf("failed (exit %d)", h.ExitStatus))
+	}
+	what := h.Action
+	if h.DryRun {
+		what += " (dry run)"
+	}
+	fmt.Printf("%s  %s %s by %s: %s\n", colorize(os.Stdout, colorBold, h.Time.Local().Format("2006-01-02 15:04:05")),
+		what, h.Mountpoint, h.User, status)
+	fmt.Printf("  $ %s\n", strings.Join(h.Command, " "))
+	for _, st := range h.Plan {
+		fmt.Printf("  * would resize %s: %s → %s\n", st.Stage, resize.HumanBytes(st.CurrentBytes), resize.HumanBytes(st.ProposedBytes))
+	}
+	for _, st := range h.Stages {
+		if st.Error != "" {
+			fmt.Printf("  * %s: %s\n", st.Stage, colorize(os.Stdout, colorRed, st.Error))
+			continue
+		}
+		fmt.Printf("  * %s: %s → %s (+%s)\n", st.Stage, resize.HumanBytes(st.BeforeBytes), resize.HumanBytes(st.AfterBytes),
+			resize.HumanBytes(st.AfterBytes-st.BeforeBytes))
+	}
+	if h.Error != "" {
+		fmt.Printf("  %s\n", colorize(os.Stdout, colorRed, h.Error))
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var (
+	preHook  = flag.String("pre-hook", "", "shell command to run before resizing anything; a failure aborts the run")
+	postHook = flag.String("post-hook", "", "shell command to run after resizing finishes, successfully or not")
+
+	stageHooks stageHookFlag
+)
+
+func init() {
+	flag.Var(&stageHooks, "stage-hook", "shell command to run before and after each stage (partition, PV, LV, filesystem), or with a kind: prefix, like partition:cmd, only those of that kind ("+strings.Join(stageKinds(), ", ")+"); may be given more than once; a failure aborts the run")
+}
+
+// A stageHook is a --stage-hook: a shell command to run for each stage
+// of kind, or for every stage if kind is empty.
+type stageHook struct {
+	kind resize.Kind
+	cmd  string
+}
+
+// stageHookFlag is the --stage-hook flag, which accumulates a hook each
+// time it's given. Those on the command line replace the one set by
+// $EMBIGGEN_STAGE_HOOK.
+type stageHookFlag struct {
+	hooks   []stageHook
+	fromEnv bool
+}
+
+// hookKindRx matches what could be meant as a kind: prefix, rather
+// than as the start of a command, which has a space or slash first.
+var hookKindRx = regexp.MustCompile(`^[a-z][a-z-]*$`)
+
+// stageKinds returns the kinds of stage a --stage-hook can be for.
+func stageKinds() []string {
+	var kinds []string
+	for _, k := range []resize.Kind{resize.KindPartition, resize.KindPV, resize.KindLV, resize.KindFilesystem, resize.KindDMLinear, resize.KindDisk, resize.KindUBI} {
+		kinds = append(kinds, string(k))
+	}
+	return kinds
+}
+
+func (f *stageHookFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.values(), "\n")
+}
+
+// values returns each hook as it's given on the command line.
+func (f *stageHookFlag) values() []string {
+	var vs []string
+	for _, h := range f.hooks {
+		if h.kind == "" {
+			vs = append(vs, h.cmd)
+		} else {
+			vs = append(vs, string(h.kind)+":"+h.cmd)
+		}
+	}
+	return vs
+}
+
+func (f *stageHookFlag) Set(v string) error {
+	if f.fromEnv {
+		f.hooks, f.fromEnv = nil, false
+	}
+	h := stageHook{cmd: v}
+	if k, cmd, ok := strings.Cut(v, ":"); ok && hookKindRx.MatchString(k) {
+		if !contains(stageKinds(), k) {
+			return fmt.Errorf("unknown stage kind %q; want one of %s", k, strings.Join(stageKinds(), ", "))
+		}
+		h = stageHook{kind: resize.Kind(k), cmd: cmd}
+	}
+	if h.cmd == "" {
+		return nil
+	}
+	f.hooks = append(f.hooks, h)
+	return nil
+}
+
+func (f *stageHookFlag) setFromEnv() { f.fromEnv = true }
+
+// commands returns the shell commands of f's hooks.
+func (f *stageHookFlag) commands() []string {
+	var cmds []string
+	for _, h := range f.hooks {
+		cmds = append(cmds, h.cmd)
+	}
+	return cmds
+}
+
+// hookEnv is the environment passed to hook commands, in addition to
+// the process's own environment.
+type hookEnv map[string]string
+
+// runHook runs the shell command cmdline, if non-empty, with env added
+// to the environment. Its output goes to our stdout and stderr.
+func runHook(ctx context.Context, name, cmdline string, env hookEnv) error {
+	if cmdline == "" {
+		return nil
+	}
+	cmd := resize.Command(ctx, "/bin/sh", "-c", cmdline)
+	cmd.Env = os.Environ()
+	var envArgs []string
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, "EMBIGGEN_"+k+"="+v)
+		envArgs = append(envArgs, "EMBIGGEN_"+k+"="+v)
+	}
+	if *dry {
+		sort.Strings(envArgs)
+		dryRunf("would've run %s: env %s /bin/sh -c %s", name, shellQuote(envArgs), shellQuote([]string{cmdline}))
+		return nil
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	vlogf("running %s %q", name, cmdline)
+	if err := runConfigured(cmd); err != nil {
+		return fmt.Errorf("%s %q: %v", name, cmdline, err)
+	}
+	return nil
+}
+
+// runStageHook runs each --stage-hook for e's kind, in order, for phase
+// ("pre" or "post") of resizing e. after is only meaningful for the
+// post phase.
+func runStageHook(ctx context.Context, phase string, e resize.Resizer, before, after int64) error {
+	env := hookEnv{
+		"PHASE":        phase,
+		"STAGE":        e.String(),
+		"DEVICE":       resize.Device(e),
+		"BEFORE_BYTES": fmt.Sprint(before),
+	}
+	if phase == "post" {
+		env["AFTER_BYTES"] = fmt.Sprint(after)
+	}
+	kind := resize.KindOf(e)
+	for _, h := range stageHooks.hooks {
+		if h.kind != "" && h.kind != kind {
+			continue
+		}
+		if err := runHook(ctx, "stage-hook", h.cmd, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
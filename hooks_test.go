@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+func TestStageHookFlag(t *testing.T) {
+	var f stageHookFlag
+	for _, v := range []string{"echo all", "partition:partprobe $EMBIGGEN_DEVICE", "dm-linear:true", "echo a:b", "/usr/bin/x:y", "lv:"} {
+		if err := f.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	want := []stageHook{
+		{"", "echo all"},
+		{resize.KindPartition, "partprobe $EMBIGGEN_DEVICE"},
+		{resize.KindDMLinear, "true"},
+		{"", "echo a:b"},
+		{"", "/usr/bin/x:y"},
+	}
+	if !reflect.DeepEqual(f.hooks, want) {
+		t.Errorf("hooks = %q; want %q", f.hooks, want)
+	}
+	if got, want := f.values(), []string{"echo all", "partition:partprobe $EMBIGGEN_DEVICE", "dm-linear:true", "echo a:b", "/usr/bin/x:y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("values = %q; want %q", got, want)
+	}
+	for _, v := range []string{"partiton:true", "fs:true"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("Set(%q) succeeded; want unknown kind error", v)
+		}
+	}
+}
+
+func TestStageHookFlagEnv(t *testing.T) {
+	t.Setenv("EMBIGGEN_STAGE_HOOK", "pv:echo env")
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var f stageHookFlag
+	fs.Var(&f, "stage-hook", "")
+	if err := setFlagsFromEnv(fs, ""); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pv:echo env"}; !reflect.DeepEqual(f.values(), want) {
+		t.Errorf("from the environment: %q; want %q", f.values(), want)
+	}
+	// The command line replaces the variable's hook, and adds to its
+	// own.
+	if err := fs.Parse([]string{"--stage-hook=echo one", "--stage-hook=filesystem:echo two"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"echo one", "filesystem:echo two"}; !reflect.DeepEqual(f.values(), want) {
+		t.Errorf("after the command line: %q; want %q", f.values(), want)
+	}
+}
+
+// otherResizer is a Resizer of no kind the resize package knows.
+type otherResizer struct{ resize.Resizer }
+
+func (otherResizer) String() string { return "other layer" }
+
+func TestRunStageHookKinds(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	defer func(old stageHookFlag) { stageHooks = old }(stageHooks)
+	stageHooks = stageHookFlag{}
+	for _, v := range []string{
+		"echo all $EMBIGGEN_PHASE $EMBIGGEN_STAGE >>" + out,
+		"pv:echo pv $EMBIGGEN_DEVICE >>" + out,
+		"partition:echo partition >>" + out,
+	} {
+		if err := stageHooks.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	for _, e := range []resize.Resizer{resize.NewPVResizer("/dev/vdb"), otherResizer{}} {
+		if err := runStageHook(ctx, "pre", e, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "all pre LVM PV /dev/vdb\npv /dev/vdb\nall pre other layer\n"
+	if string(got) != want {
+		t.Errorf("hooks ran:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := stageHooks.Set("lv:exit 3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStageHook(ctx, "pre", resize.NewLVResizer("/dev/vg/lv"), 1, 0); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("failing lv hook: %v; want exit status 3", err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// imageMain implements the "image" subcommand, which grows disk image
+// files without booting them: "image grow" enlarges the image, attaches
+// it, and enlarges the filesystem the image's fstab has at the given
+// mount point, and the partition and LVM layers below it, to fill it.
+func imageMain(args []string) {
+	fs := flag.NewFlagSet("image grow", flag.ExitOnError)
+	sizeFlag := fs.String("size", "", "new size of the image's disk, e.g. 50G, or with a leading +, how much to add to it, e.g. +10G or +20% (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk image:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] image grow <file.img|file.qcow2> --size=<size> <mount-point-in-image>\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	if len(args) == 0 || args[0] != "grow" {
+		fs.Usage()
+	}
+	if err := setFlagsFromEnv(fs, fs.Name()); err != nil {
+		fatalf("%v", err)
+	}
+	// Flags may come between the arguments, as in the usage.
+	var pos []string
+	for args = args[1:]; ; args = fs.Args()[1:] {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		pos = append(pos, fs.Arg(0))
+	}
+	if len(pos) != 2 || *sizeFlag == "" {
+		fs.Usage()
+	}
+	if resize.Sysroot != "" {
+		fatalf("image grow finds the mount point in the image itself; it can't be combined with --sysroot")
+	}
+	path, mnt := pos[0], pos[1]
+	_, cur, err := resize.ImageSize(path)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var size int64
+	if add, ok := strings.CutPrefix(*sizeFlag, "+"); ok {
+		size, err = resize.ParseSizeOf(add, cur)
+		size += cur
+	} else {
+		size, err = resize.ParseSize(*sizeFlag)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *dry {
+		dryRunf("would've grown image %s from %s to %s, attached it, and enlarged %s in it", path, resize.HumanBytes(cur), resize.HumanBytes(size), mnt)
+		return
+	}
+	if err := growImage(path, size, mnt); err != nil {
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, err.Error()))
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// growImage grows the image at path to size bytes and then the
+// filesystem at mnt in it, with the layers below it.
+func growImage(path string, size int64, mnt string) (err error) {
+	ctx := context.Background()
+	grew, err := resize.GrowImage(ctx, path, size)
+	if err != nil {
+		return err
+	}
+	if grew {
+		logger.Info("grew image", "path", path, "size", size)
+	}
+	im, err := resize.AttachImage(ctx, path)
+	if err != nil {
+		return err
+	}
+	vlogf("attached %s to %s", path, im.Device)
+	defer func() {
+		if derr := im.Detach(ctx); derr != nil && err == nil {
+			err = fmt.Errorf("detaching %s from %s: %w", path, im.Device, derr)
+		}
+	}()
+	dev, fstype, err := im.Filesystem(ctx, mnt)
+	if err != nil {
+		return err
+	}
+	vlogf("%s in %s is the %s filesystem on %s", mnt, path, fstype, dev)
+	dir, unmount, err := im.Mount(ctx, dev, "rw")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unmount(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	_, err = grow(dir)
+	return err
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// initramfsMain implements the "initramfs" subcommand, run by the
+// dracut module in the dracut directory from the initramfs, after the
+// root device appears but before it's mounted. There, an ext2/3/4 root
+// filesystem grows offline, which is safer and, on old kernels, the
+// only way, and for other types, the partition and LVM layers below it
+// grow, leaving the filesystem to grow once mounted. Nothing running
+// from the root can race with it.
+func initramfsMain(args []string) {
+	fs := flag.NewFlagSet("initramfs", flag.ExitOnError)
+	root := fs.String("root", "", "the root device, or an fstab-style spec like UUID=...; default is root= on the kernel command line")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk initramfs:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] initramfs [--root=<device>]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+	}
+	ctx, end, err := beginRun()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer end()
+	dev, err := resize.RootDevice(ctx, *root)
+	if err != nil {
+		fatalf("finding the root device: %v", err)
+	}
+	if m, ok, err := resize.DeviceMount(dev); err == nil && ok {
+		fatalf("root device %s is already mounted at %s; the initramfs subcommand runs before it's mounted", dev, m.Mountpoint)
+	}
+	e, err := resize.NewUnmountedResizer(ctx, dev)
+	if err != nil {
+		fatalf("error preparing to enlarge %s: %v", dev, err)
+	}
+	if !*dry && !resize.MayGrow(ctx, e) {
+		logger.Debug("nothing can grow", "device", dev)
+		return
+	}
+	changes, err := resize.Resize(ctx, e, nil)
+	if len(changes) > 0 {
+		fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Changes made:"))
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", colorize(os.Stdout, colorGreen, c.String()))
+		}
+	} else if err == nil {
+		fmt.Printf("No changes made.\n")
+	}
+	if err != nil {
+		fatalf("error: %v", err)
+	}
+}
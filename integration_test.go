@@ -21,6 +21,8 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"debug/elf"
 	"flag"
 	"fmt"
 	"io"
@@ -31,13 +33,16 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/bradfitz/embiggen-disk/resize"
 	"github.com/u-root/u-root/pkg/cpio"
 )
 
@@ -54,8 +59,35 @@ const (
 	kernelObj = "07f3c3a7d08340bdc292cf483cad9ff6cd0938d7"
 )
 
+// A qemuArch is how to boot the qemu guest for one GOARCH. The guest
+// runs the test binary itself as init, so it's the same architecture.
+type qemuArch struct {
+	qemu      string   // qemu binary
+	args      []string // machine-specific qemu args
+	cmdline   string   // machine-specific kernel args, including the console
+	kernelRef string   // as kernelRef, or empty if no kernel is published
+	kernelObj string   // as kernelObj
+}
+
+var qemuArches = map[string]qemuArch{
+	"amd64": {
+		qemu:      "qemu-system-x86_64",
+		args:      []string{"-vga", "none"},
+		cmdline:   "console=ttyS0,115200 acpi=off",
+		kernelRef: kernelRef,
+		kernelObj: kernelObj,
+	},
+	"arm64": {
+		qemu:    "qemu-system-aarch64",
+		args:    []string{"-machine", "virt", "-cpu", "max"},
+		cmdline: "console=ttyAMA0",
+	},
+}
+
 var inQemu bool
 
+var qemuBench = flag.Bool("qemubench", false, "in TestInQemu, also time growing each filesystem type, with and without LVM; see QemuTest.BenchGrow")
+
 func init() {
 	if os.Getpid() != 1 {
 		// Not in qemu.
@@ -78,6 +110,10 @@ func init() {
 		}
 	}
 
+	// There's no udev, so have LVM create its device nodes itself.
+	os.Setenv("DM_DISABLE_UDEV", "1")
+	os.MkdirAll("/run/lock/lvm", 0755)
+
 	// Now that /proc is mounted, get our arguments we passed to the kernel.
 	if all, err := ioutil.ReadFile("/proc/cmdline"); err != nil {
 		log.Fatal(err)
@@ -122,8 +158,16 @@ func TestInQemu(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping in short mode")
 	}
-	if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
-		t.Skipf("skipping test due to qemu-system-x86_64 not found: %v", err)
+	arch, ok := qemuArches[runtime.GOARCH]
+	if !ok {
+		t.Skipf("skipping test on unsupported GOARCH %s", runtime.GOARCH)
+	}
+	if _, err := exec.LookPath(arch.qemu); err != nil {
+		t.Skipf("skipping test due to %s not found: %v", arch.qemu, err)
+	}
+	kernelPath := os.Getenv("EMBIGGEN_TEST_KERNEL")
+	if kernelPath == "" && arch.kernelRef == "" {
+		t.Skipf("skipping test due to no published %s test kernel; set EMBIGGEN_TEST_KERNEL", runtime.GOARCH)
 	}
 	td, err := ioutil.TempDir("", "embiggen-disk-test")
 	if err != nil {
@@ -131,20 +175,28 @@ func TestInQemu(t *testing.T) {
 	}
 	defer os.RemoveAll(td)
 
-	kernelPath := filepath.Join(td, "bzImage")
-	if err := downloadKernel(kernelPath); err != nil {
-		t.Fatalf("failed to download linux kernel: %v", err)
+	if kernelPath == "" {
+		kernelPath = filepath.Join(td, "bzImage")
+		if err := downloadKernel(kernelPath, arch); err != nil {
+			t.Fatalf("failed to download linux kernel: %v", err)
+		}
 	}
 
 	initrdPath := filepath.Join(td, "initrd")
-	if err := genRootFS(initrdPath); err != nil {
+	if err := genRootFS(initrdPath, os.Getenv("EMBIGGEN_TEST_INITRD"), os.Getenv("EMBIGGEN_TEST_STATIC_TOOLS")); err != nil {
 		t.Fatalf("failed to generate/write initrd: %v", err)
 	}
 
 	monSockPath := filepath.Join(td, "monsock")
 
 	// Create some disks to work with.
-	for _, name := range []string{"foo"} {
+	disks := []string{"foo", "grow", "busy", "lvm", "xfs", "btrfs", "gpt", "gptroot", "gptother", "sector4k"}
+	if *qemuBench {
+		for _, c := range benchStacks {
+			disks = append(disks, c.disk())
+		}
+	}
+	for _, name := range disks {
 		err := exec.Command("qemu-img", "create", "-f", "qcow2", filepath.Join(td, name+".qcow2"), "10G").Run()
 		if err != nil {
 			t.Fatalf("creating %s qcow2: %v", name, err)
@@ -184,8 +236,7 @@ func TestInQemu(t *testing.T) {
 			}()
 		}
 	}()
-	cmd := exec.Command("qemu-system-x86_64",
-		"-vga", "none",
+	args := append(arch.args,
 		"-nographic",
 		"-m", "256",
 		"-display", "none",
@@ -198,8 +249,10 @@ func TestInQemu(t *testing.T) {
 		"-kernel", kernelPath,
 		"-initrd", initrdPath,
 		"-no-reboot",
-		"-append", "console=ttyS0,115200 panic=-1 acpi=off nosmp ip=dhcp "+
-			"parentTempDir="+td+" goTestRun="+flag.Lookup("test.run").Value.String())
+		"-append", arch.cmdline+" panic=-1 nosmp ip=dhcp "+
+			"parentTempDir="+td+" goTestRun="+flag.Lookup("test.run").Value.String()+
+			" qemuBench="+fmt.Sprint(*qemuBench))
+	cmd := exec.Command(arch.qemu, args...)
 	var out bytes.Buffer
 	var std io.Writer = &out
 	const verbose = true
@@ -271,7 +324,7 @@ func (mc *monClient) run(cmd string) (out string, err error) {
 	return mc.readToPrompt()
 }
 
-func (mc *monClient) addDisk(t *testing.T, diskBase string) {
+func (mc *monClient) addDisk(t *testing.T, diskBase string, devOpts ...string) {
 	tempDir := kernelParam("parentTempDir")
 	if tempDir == "" {
 		t.Fatal("missing kernel parameter parentTempDir")
@@ -284,7 +337,11 @@ func (mc *monClient) addDisk(t *testing.T, diskBase string) {
 		t.Fatalf("drive_add %q: %s", diskBase, out)
 	}
 
-	out, err = monc.run("device_add scsi-hd,drive=" + diskBase + ",id=" + diskBase)
+	dev := "scsi-hd,drive=" + diskBase + ",id=" + diskBase
+	for _, o := range devOpts {
+		dev += "," + o
+	}
+	out, err = monc.run("device_add " + dev)
 	if err != nil {
 		t.Fatalf("device_add %q: %v", diskBase, err)
 	}
@@ -365,6 +422,484 @@ func (QemuTest) Mke2fs(t *testing.T) {
 	}
 }
 
+// GrowChain grows a 1 GiB partition with ext4 on it after the disk
+// grows from 10 GiB to 20 GiB, as embiggen-disk / would on a VM.
+func (QemuTest) GrowChain(t *testing.T) {
+	testGrowPartition(t, "grow", mbrTable, "ext4", "mke2fs", "-q", "-t", "ext4")
+}
+
+// GrowBusy is GrowChain with the filesystem busy with writes
+// throughout, as a production one would be, so the partition must be
+// resized in the kernel with BLKPG while in use.
+func (QemuTest) GrowBusy(t *testing.T) {
+	part := monc.addPartitionedDisk(t, "busy", mbrTable)
+	defer monc.removeDisk(t, "busy")
+	runTool(t, "mke2fs", "-q", "-t", "ext4", "/dev/"+part)
+	if err := unix.Mount("/dev/"+part, "/mnt/b", "ext4", 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/b", 0)
+
+	// Keep rewriting a 64 MiB file, syncing each MiB, until told to
+	// stop.
+	stop := make(chan bool)
+	werrc := make(chan error, 1)
+	var written int64
+	go func() {
+		werrc <- func() error {
+			f, err := os.Create("/mnt/b/busy")
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			buf := bytes.Repeat([]byte("embiggen"), 128<<10/8)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return nil
+				default:
+				}
+				if _, err := f.WriteAt(buf, int64(i%512)*int64(len(buf))); err != nil {
+					return err
+				}
+				if i%8 == 7 {
+					if err := f.Sync(); err != nil {
+						return err
+					}
+				}
+				written += int64(len(buf))
+			}
+		}()
+	}()
+
+	monc.resizeDisk(t, "busy", "20G")
+	res, err := grow("/mnt/b")
+	close(stop)
+	if werr := <-werrc; werr != nil {
+		t.Errorf("writing during grow: %v", werr)
+	}
+	if err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	t.Logf("changes: %q; wrote %d MiB meanwhile", res.Changes, written>>20)
+
+	const gib = 1 << 30
+	for _, it := range lsblk(t) {
+		if it.Name == part && it.Size < 19*gib {
+			t.Errorf("partition %s is %d bytes after growing; want about 20 GiB", part, it.Size)
+		}
+	}
+	fs, err := resize.Stat("/mnt/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.SizeBytes(); n < 18*gib {
+		t.Errorf("filesystem is %d bytes after growing; want about 20 GiB", n)
+	}
+}
+
+// XFSChain is GrowChain with XFS, grown by xfs_growfs.
+func (QemuTest) XFSChain(t *testing.T) {
+	needTools(t, "mkfs.xfs", "xfs_growfs")
+	testGrowPartition(t, "xfs", mbrTable, "xfs", "mkfs.xfs", "-q", "-f")
+}
+
+// BtrfsChain is GrowChain with btrfs, grown by btrfs filesystem
+// resize.
+func (QemuTest) BtrfsChain(t *testing.T) {
+	needTools(t, "mkfs.btrfs", "btrfs")
+	testGrowPartition(t, "btrfs", mbrTable, "btrfs", "mkfs.btrfs", "-q", "-f")
+}
+
+// GPTChain is GrowChain with a GPT partition table, whose backup
+// header is left behind at the old end of the disk when it grows.
+func (QemuTest) GPTChain(t *testing.T) {
+	testGrowPartition(t, "gpt", gptTable(linuxGPTType), "ext4", "mke2fs", "-q", "-t", "ext4")
+}
+
+// GPTRootType is GPTChain with the partition type that
+// systemd-gpt-auto-generator mounts as / on this architecture.
+func (QemuTest) GPTRootType(t *testing.T) {
+	typ, ok := map[string]string{
+		"amd64": "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+		"arm64": "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+	}[runtime.GOARCH]
+	if !ok {
+		t.Skipf("no GPT root partition type known for %s", runtime.GOARCH)
+	}
+	testGrowPartition(t, "gptroot", gptTable(typ), "ext4", "mke2fs", "-q", "-t", "ext4")
+}
+
+// GPTUnknownType checks that a GPT partition of a type embiggen-disk
+// doesn't know holds a Linux filesystem isn't grown.
+func (QemuTest) GPTUnknownType(t *testing.T) {
+	const msBasicDataType = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	part := monc.addPartitionedDisk(t, "gptother", gptTable(msBasicDataType))
+	defer monc.removeDisk(t, "gptother")
+	runTool(t, "mke2fs", "-q", "-t", "ext4", "/dev/"+part)
+	if err := unix.Mount("/dev/"+part, "/mnt/b", "ext4", 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/b", 0)
+
+	monc.resizeDisk(t, "gptother", "20G")
+	_, err := grow("/mnt/b")
+	if err == nil || !strings.Contains(err.Error(), "unknown GPT partition type") {
+		t.Errorf("grow error = %v; want unknown GPT partition type", err)
+	}
+	for _, it := range lsblk(t) {
+		if it.Name == part && it.Size != 1<<30 {
+			t.Errorf("partition %s is %d bytes; want it left at 1 GiB", part, it.Size)
+		}
+	}
+}
+
+// Sector4K checks that a disk with 4096 byte logical sectors is either
+// grown correctly or, as long as only 512 byte sectors are supported,
+// left alone. Taking its sector numbers as 512 byte ones would
+// truncate the partition.
+func (QemuTest) Sector4K(t *testing.T) {
+	const gib = 1 << 30
+	// 1 GiB in 4096 byte sectors, starting at 1 MiB.
+	part := monc.addPartitionedDisk(t, "sector4k", "start=256, size=262144, type=83",
+		"logical_block_size=4096", "physical_block_size=4096")
+	defer monc.removeDisk(t, "sector4k")
+	disk := strings.TrimRight(part, "0123456789")
+	runTool(t, "mke2fs", "-q", "-t", "ext4", "/dev/"+part)
+	if err := unix.Mount("/dev/"+part, "/mnt/b", "ext4", 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/b", 0)
+
+	monc.resizeDisk(t, "sector4k", "20G")
+	table := runTool(t, "sfdisk", "-d", "/dev/"+disk)
+	res, err := grow("/mnt/b")
+	fs, serr := resize.Stat("/mnt/b")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	var partSize int64
+	for _, it := range lsblk(t) {
+		if it.Name == part {
+			partSize = it.Size
+		}
+	}
+	if err != nil {
+		t.Logf("grow refused: %v", err)
+		if got := runTool(t, "sfdisk", "-d", "/dev/"+disk); got != table {
+			t.Errorf("partition table changed by failed grow; was:\n%s\nnow:\n%s", table, got)
+		}
+		if partSize != gib {
+			t.Errorf("partition %s is %d bytes after failed grow; want 1 GiB", part, partSize)
+		}
+		return
+	}
+	t.Logf("changes: %q", res.Changes)
+	if partSize < 19*gib {
+		t.Errorf("partition %s is %d bytes after growing; want about 20 GiB", part, partSize)
+	}
+	if n := fs.SizeBytes(); n < 18*gib {
+		t.Errorf("filesystem is %d bytes after growing; want about 20 GiB", n)
+	}
+}
+
+// testGrowPartition makes a filesystem of type fstype with the command
+// mkfs on the 1 GiB partition of the disk diskBase that the sfdisk
+// script table makes, grows the disk to 20 GiB, and checks that
+// embiggen-disk grows the partition and the filesystem to fill it, and
+// that doing it again does nothing.
+func testGrowPartition(t *testing.T, diskBase, table, fstype string, mkfs ...string) {
+	part := monc.addPartitionedDisk(t, diskBase, table)
+	defer monc.removeDisk(t, diskBase)
+	runTool(t, mkfs[0], append(mkfs[1:], "/dev/"+part)...)
+	if err := unix.Mount("/dev/"+part, "/mnt/b", fstype, 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/b", 0)
+
+	monc.resizeDisk(t, diskBase, "20G")
+	res, err := grow("/mnt/b")
+	if err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	t.Logf("changes: %q", res.Changes)
+	if len(res.Changes) != 2 {
+		t.Errorf("got %d changes; want the partition's and the filesystem's", len(res.Changes))
+	}
+
+	const gib = 1 << 30
+	st := lsblk(t)
+	for _, it := range st {
+		if it.Name == part && it.Size < 19*gib {
+			t.Errorf("partition %s is %d bytes after growing; want about 20 GiB", part, it.Size)
+		}
+	}
+	fs, err := resize.Stat("/mnt/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.SizeBytes(); n < 18*gib {
+		t.Errorf("filesystem is %d bytes after growing; want about 20 GiB", n)
+	}
+
+	if strings.Contains(table, "label: gpt") {
+		checkGPTEnd(t, strings.TrimRight(part, "0123456789"))
+	}
+
+	// Growing again does nothing.
+	res, err = grow("/mnt/b")
+	if err != nil {
+		t.Fatalf("second grow: %v", err)
+	}
+	if len(res.Changes) != 0 {
+		t.Errorf("second grow made changes: %q", res.Changes)
+	}
+}
+
+// LVMChain grows an LVM PV, its volume group's one LV, and ext4 on
+// it after the disk the PV's partition is on grows from 10 GiB to 20
+// GiB.
+func (QemuTest) LVMChain(t *testing.T) {
+	needTools(t, "lvm")
+	part := monc.addPartitionedDisk(t, "lvm", mbrTable)
+	defer monc.removeDisk(t, "lvm")
+	pv := "/dev/" + part
+	runTool(t, "pvcreate", "-q", pv)
+	runTool(t, "vgcreate", "-q", "testvg", pv)
+	runTool(t, "lvcreate", "-q", "-l", "100%FREE", "-n", "lv", "testvg")
+	defer runTool(t, "vgchange", "-q", "-an", "testvg")
+	lv := "/dev/mapper/testvg-lv"
+	runTool(t, "mke2fs", "-q", "-t", "ext4", lv)
+	if err := unix.Mount(lv, "/mnt/c", "ext4", 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/c", 0)
+
+	monc.resizeDisk(t, "lvm", "20G")
+	res, err := grow("/mnt/c")
+	if err != nil {
+		t.Fatalf("grow: %v", err)
+	}
+	t.Logf("changes: %q", res.Changes)
+	if len(res.Changes) != 4 {
+		t.Errorf("got %d changes; want the partition's, PV's, LV's, and filesystem's", len(res.Changes))
+	}
+
+	const gib = 1 << 30
+	lvmSize := func(tool, field, obj string) int64 {
+		t.Helper()
+		out := runTool(t, tool, "--noheadings", "--nosuffix", "--units", "b", "-o", field, obj)
+		n, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			t.Fatalf("%s -o %s %s: %q", tool, field, obj, out)
+		}
+		return n
+	}
+	if n := lvmSize("pvs", "pv_size", pv); n < 19*gib {
+		t.Errorf("PV is %d bytes after growing; want about 20 GiB", n)
+	}
+	if n := lvmSize("vgs", "vg_size", "testvg"); n < 19*gib {
+		t.Errorf("VG is %d bytes after growing; want about 20 GiB", n)
+	}
+	if n := lvmSize("vgs", "vg_free", "testvg"); n != 0 {
+		t.Errorf("VG has %d bytes free after growing; want none", n)
+	}
+	if n := lvmSize("lvs", "lv_size", lv); n < 19*gib {
+		t.Errorf("LV is %d bytes after growing; want about 20 GiB", n)
+	}
+	fs, err := resize.Stat("/mnt/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.SizeBytes(); n < 18*gib {
+		t.Errorf("filesystem is %d bytes after growing; want about 20 GiB", n)
+	}
+}
+
+// Partition tables for addPartitionedDisk, with one 1 GiB partition.
+const (
+	mbrTable     = "start=2048, size=2097152, type=83"
+	linuxGPTType = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+func gptTable(typ string) string {
+	return "label: gpt\nstart=2048, size=2097152, type=" + typ + "\n"
+}
+
+// checkGPTEnd checks that the GPT on disk, like "sdb", has been moved
+// to the end of the disk: that its last usable sector is right before
+// the backup partition entries there, and its one partition ends in
+// the last 1 MiB before that.
+func checkGPTEnd(t *testing.T, disk string) {
+	t.Helper()
+	b, err := ioutil.ReadFile("/sys/block/" + disk + "/size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sectors, _ := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	dump := runTool(t, "sfdisk", "-d", "/dev/"+disk)
+	var lastLBA, end int64
+	for _, line := range strings.Split(dump, "\n") {
+		if v, ok := strings.CutPrefix(line, "last-lba: "); ok {
+			lastLBA, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if strings.HasPrefix(line, "/dev/") {
+			var start, size int64
+			for _, f := range strings.Split(line[strings.Index(line, ":")+1:], ",") {
+				k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+				n, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+				switch k {
+				case "start":
+					start = n
+				case "size":
+					size = n
+				}
+			}
+			end = start + size - 1
+		}
+	}
+	// The backup header and 128 partition entries take the last 33
+	// sectors.
+	if want := sectors - 34; lastLBA != want {
+		t.Errorf("last-lba = %d; want %d on a %d sector disk:\n%s", lastLBA, want, sectors, dump)
+	}
+	if end > lastLBA || lastLBA-end > 2048 {
+		t.Errorf("partition ends at sector %d; want it in the 1 MiB before last-lba %d:\n%s", end, lastLBA, dump)
+	}
+}
+
+// addPartitionedDisk adds the disk diskBase, as addDisk does, has
+// sfdisk write the partition table script table to it, and returns the
+// first partition's name, like "sdb1".
+func (mc *monClient) addPartitionedDisk(t *testing.T, diskBase, table string, devOpts ...string) string {
+	t.Helper()
+	before := lsblk(t)
+	mc.addDisk(t, diskBase, devOpts...)
+	var disk string
+	for _, it := range lsblk(t) {
+		if it.Type == "disk" && !before.contains(it.Name) {
+			disk = it.Name
+		}
+	}
+	if disk == "" {
+		t.Fatalf("disk %s not in lsblk: %s", diskBase, lsblk(t))
+	}
+	cmd := exec.Command("/sbin/sfdisk", "-f", "/dev/"+disk)
+	cmd.Stdin = strings.NewReader(table)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sfdisk: %v, %s", err, out)
+	}
+	return disk + "1"
+}
+
+// needTools skips t unless each of tools is installed.
+func needTools(t *testing.T, tools ...string) {
+	t.Helper()
+	for _, tool := range tools {
+		if _, err := resize.ToolPath(tool); err != nil {
+			t.Skip(err)
+		}
+	}
+}
+
+// runTool runs the tool name, found as the resize package finds it,
+// with args, and returns its output, failing t if it fails.
+func runTool(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	out, err := resize.Command(context.Background(), name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %q: %v, %s", name, args, err, out)
+	}
+	return string(out)
+}
+
+// A benchStack is a filesystem type, on LVM or not, to time growing.
+type benchStack struct {
+	fstype string
+	lvm    bool
+}
+
+var benchStacks = []benchStack{
+	{"ext4", false},
+	{"ext4", true},
+	{"xfs", false},
+	{"xfs", true},
+	{"btrfs", false},
+	{"btrfs", true},
+}
+
+func (c benchStack) String() string {
+	if c.lvm {
+		return c.fstype + "-lvm"
+	}
+	return c.fstype
+}
+
+// disk returns the name of the qcow2 disk c is set up on.
+func (c benchStack) disk() string { return "bench-" + c.String() }
+
+// BenchGrow times growing each of benchStacks with the resize package,
+// layer by layer, from a 1 GiB partition on a 10 GiB disk. It's only
+// run with go test -qemubench, and logs its timings rather than
+// checking them; compare them between runs to find regressions.
+func (QemuTest) BenchGrow(t *testing.T) {
+	if kernelParam("qemuBench") != "true" {
+		t.Skip("not run without -qemubench")
+	}
+	for _, c := range benchStacks {
+		t.Run(c.String(), func(t *testing.T) { benchGrow(t, c) })
+	}
+}
+
+func benchGrow(t *testing.T, c benchStack) {
+	mkfs := map[string][]string{
+		"ext4":  {"mke2fs", "-q", "-t", "ext4"},
+		"xfs":   {"mkfs.xfs", "-q"},
+		"btrfs": {"mkfs.btrfs", "-q"},
+	}[c.fstype]
+	needTools(t, mkfs[0])
+	if c.lvm {
+		needTools(t, "lvm")
+	}
+	dev := "/dev/" + monc.addPartitionedDisk(t, c.disk(), mbrTable)
+	defer monc.removeDisk(t, c.disk())
+	if c.lvm {
+		runTool(t, "pvcreate", "-q", dev)
+		runTool(t, "vgcreate", "-q", "benchvg", dev)
+		runTool(t, "lvcreate", "-q", "-l", "100%FREE", "-n", "lv", "benchvg")
+		defer runTool(t, "vgchange", "-q", "-an", "benchvg")
+		dev = "/dev/mapper/benchvg-lv"
+	}
+	runTool(t, mkfs[0], append(mkfs[1:], dev)...)
+	if err := unix.Mount(dev, "/mnt/a", c.fstype, 0, ""); err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	defer unix.Unmount("/mnt/a", 0)
+
+	ctx := context.Background()
+	t0 := time.Now()
+	e, err := resize.FileSystem(ctx, "/mnt/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("bench %v: finding layers: %v", c, time.Since(t0))
+	h := &resize.Hooks{
+		After: func(r resize.Resizer, before, after int64, d time.Duration, err error) error {
+			t.Logf("bench %v: %v: %v (%d → %d bytes)", c, r, d, before, after)
+			return nil
+		},
+	}
+	t1 := time.Now()
+	changes, err := resize.Resize(ctx, e, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("bench %v: total: %v, %d changes", c, time.Since(t1), len(changes))
+	t2 := time.Now()
+	grow := resize.MayGrow(ctx, e)
+	t.Logf("bench %v: no-op check: %v (MayGrow = %v)", c, time.Since(t2), grow)
+}
+
 type lsblkItem struct {
 	Name  string
 	Size  int64
@@ -376,15 +911,21 @@ type lsblkState []lsblkItem
 
 func lsblk(t *testing.T) lsblkState {
 	t.Helper()
-	out, err := exec.Command("/bin/lsblk", "-b", "-l").CombinedOutput()
+	out, err := resize.Command(context.Background(), "lsblk", "-b", "-l").CombinedOutput()
 	if err != nil {
 		t.Fatalf("lsblk error: %v, %s", err, out)
 	}
+	st, err := parseLsblk(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// parseLsblk parses the output of lsblk -b -l.
+func parseLsblk(out []byte) (lsblkState, error) {
 	lines := strings.Split(string(out), "\n")
 	var st lsblkState
-	if len(lines) == 0 {
-		return nil
-	}
 	/* Parse:
 	NAME         MAJ:MIN RM         SIZE RO TYPE  MOUNTPOINT
 	sda            8:0    0 107374182400  0 disk
@@ -403,10 +944,31 @@ func lsblk(t *testing.T) lsblkState {
 		if len(f) == 7 {
 			it.Mount = f[6]
 		}
-		it.Size, _ = strconv.ParseInt(f[3], 10, 64)
+		var err error
+		it.Size, err = strconv.ParseInt(f[3], 10, 64)
+		if err != nil || it.Size < 0 {
+			return nil, fmt.Errorf("bad size in lsblk line %q", line)
+		}
 		st = append(st, it)
 	}
-	return st
+	return st, nil
+}
+
+func FuzzParseLsblk(f *testing.F) {
+	f.Add([]byte("NAME MAJ:MIN RM SIZE RO TYPE MOUNTPOINT\n" +
+		"sda    8:0    0 107374182400  0 disk\n" +
+		"sda1   8:1    0    254803968  0 part  /boot\n"))
+	f.Fuzz(func(t *testing.T, out []byte) {
+		st, err := parseLsblk(out)
+		if err != nil {
+			return
+		}
+		for _, it := range st {
+			if it.Size < 0 || it.Name == "" {
+				t.Errorf("parseLsblk(%q) has %+v", out, it)
+			}
+		}
+	})
 }
 
 func (s lsblkState) contains(dev string) bool {
@@ -431,7 +993,7 @@ func (s lsblkState) String() string {
 }
 
 func (QemuTest) Lsblk(t *testing.T) {
-	out, err := exec.Command("/bin/lsblk").CombinedOutput()
+	out, err := resize.Command(context.Background(), "lsblk").CombinedOutput()
 	if err != nil {
 		t.Fatalf("lsblk error: %v, %s", err, out)
 	}
@@ -440,12 +1002,12 @@ func (QemuTest) Lsblk(t *testing.T) {
 	}
 }
 
-func downloadKernel(dst string) error {
-	out, err := exec.Command("git", "fetch", "https://github.com/google/embiggen-disk.git", kernelRef).Output()
+func downloadKernel(dst string, arch qemuArch) error {
+	out, err := exec.Command("git", "fetch", "https://github.com/google/embiggen-disk.git", arch.kernelRef).Output()
 	if err != nil {
 		return fmt.Errorf("git fetch: %v, %s", err, out)
 	}
-	out, err = exec.Command("git", "cat-file", "-p", kernelObj).CombinedOutput()
+	out, err = exec.Command("git", "cat-file", "-p", arch.kernelObj).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("git cat-file: %v, %s", err, out)
 	}
@@ -455,17 +1017,55 @@ func downloadKernel(dst string) error {
 	return nil
 }
 
-func genRootFS(dst string) error {
+// genRootFS writes to dst the initrd for the qemu guest, with this
+// test binary as its init. If base is non-empty, it names an initrd
+// providing the tools the tests run, which dst starts with instead of
+// the host's copies of them. If staticDir is non-empty, it's a
+// directory of statically linked tools, like busybox, sfdisk, and
+// mke2fs, which go in /sbin instead of the host's; they make the guest
+// the same whatever the host's library layout.
+func genRootFS(dst, base, staticDir string) error {
 	initProg, err := os.Executable()
 	if err != nil {
 		return err
 	}
-	files := rootFSFiles(initProg)
+	files := rootFSFiles(initProg, base == "" && staticDir == "")
+	var staticTools []string
+	if staticDir != "" {
+		ents, err := os.ReadDir(staticDir)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			path := filepath.Join(staticDir, ent.Name())
+			if err := checkStatic(path); err != nil {
+				return err
+			}
+			staticTools = append(staticTools, path)
+		}
+	}
 
 	f, err := os.Create(dst)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if base != "" {
+		// The kernel unpacks each archive of a concatenation in
+		// turn, so ours adds init to base's.
+		bf, err := os.Open(base)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, bf)
+		bf.Close()
+		if err != nil {
+			return err
+		}
+		// Archives must start 4 byte aligned.
+		if _, err := f.Write(make([]byte, (4-n%4)%4)); err != nil {
+			return err
+		}
+	}
 	bw := bufio.NewWriter(f)
 	recw := cpio.Newc.Writer(bw)
 
@@ -485,6 +1085,22 @@ func genRootFS(dst string) error {
 		}
 	}
 
+	if len(staticTools) > 0 {
+		if err := recw.WriteRecord(cpio.Directory("sbin", 0755)); err != nil {
+			return err
+		}
+	}
+	for _, file := range staticTools {
+		rec, err := cpio.GetRecord(file)
+		if err != nil {
+			return err
+		}
+		rec.Info.Name = "sbin/" + filepath.Base(file)
+		if err := recw.WriteRecord(rec); err != nil {
+			return err
+		}
+	}
+
 	extraRec := []cpio.Record{
 		cpio.Directory("proc", 0755),
 		cpio.Directory("sys", 0755),
@@ -506,7 +1122,26 @@ func genRootFS(dst string) error {
 	return f.Close()
 }
 
-func rootFSFiles(initProg string) []string {
+// checkStatic returns an error unless the file at path is a
+// statically linked ELF executable, needing no dynamic loader.
+func checkStatic(path string) error {
+	ef, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("static tool %s: %v", path, err)
+	}
+	defer ef.Close()
+	for _, p := range ef.Progs {
+		if p.Type == elf.PT_INTERP {
+			return fmt.Errorf("static tool %s is dynamically linked", path)
+		}
+	}
+	return nil
+}
+
+// rootFSFiles returns the files for genRootFS's archive: initProg and
+// what it needs to run, and if withTools is set, the tools the tests
+// run.
+func rootFSFiles(initProg string, withTools bool) []string {
 	set := map[string]bool{}
 
 	var add func(string)
@@ -559,17 +1194,35 @@ func rootFSFiles(initProg string) []string {
 		add(path)
 		return nil
 	})
+	if !withTools {
+		return sortedKeys(set)
+	}
 
 	add("/sbin/sfdisk")    // util-linux
 	add("/bin/lsblk")      // util-linux
 	add("/sbin/mke2fs")    // e2fsprogs
 	add("/sbin/resize2fs") // e2fsprogs
-	var files []string
-	for f := range set {
-		files = append(files, f)
+	add("/sbin/dumpe2fs")  // e2fsprogs
+	add("/sbin/blkid")     // util-linux
+
+	// For the LVM, XFS, and btrfs tests, if they're installed:
+	for _, dir := range []string{"/sbin", "/usr/sbin", "/bin", "/usr/bin"} {
+		for _, f := range []string{"mkfs.xfs", "xfs_growfs", "mkfs.btrfs", "btrfs",
+			"lvm", "pvcreate", "vgcreate", "lvcreate", "vgchange",
+			"lvdisplay", "pvdisplay", "lvextend", "pvresize", "pvs", "lvs", "vgs"} {
+			add(filepath.Join(dir, f))
+		}
 	}
-	sort.Strings(files)
-	return files
+	return sortedKeys(set)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 var kernelCmdLineFields []string
@@ -584,3 +1237,53 @@ func kernelParam(k string) string {
 	}
 	return ""
 }
+
+// benchLVMReply replies to the LVM commands for an LV on one 10 GiB PV,
+// a whole disk, as lvm would.
+func benchLVMReply(args []string, stdin []byte) ([]byte, error) {
+	name := filepath.Base(args[0])
+	if name == "lvm" {
+		name = args[1]
+	}
+	switch name {
+	case "lvdisplay":
+		return []byte("  /dev/benchvg/lv:benchvg:3:1:-1:1:20963328:2559:-1:0:-1:254:0\n"), nil
+	case "pvdisplay":
+		return []byte("  /dev/vdb:benchvg:20963328:-1:8:8:-1:4096:2559:0:2559:bench-uuid\n"), nil
+	case "pvs":
+		return []byte("  1048576 4194304\n"), nil
+	}
+	return nil, nil
+}
+
+// benchLVM runs fn b.N times with the resize package's commands
+// answered by benchLVMReply, reporting how many commands each run
+// needs, since running them dominates the real cost.
+func benchLVM(b *testing.B, fn func(ctx context.Context, r resize.Resizer) error) {
+	rr := &resize.RecordingRunner{Reply: benchLVMReply}
+	defer func(old resize.Runner) { resize.CommandRunner = old }(resize.CommandRunner)
+	resize.CommandRunner = rr
+	ctx := context.Background()
+	r := resize.NewLVResizer("/dev/mapper/benchvg-lv")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := fn(ctx, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(rr.Commands()))/float64(b.N), "cmds/op")
+}
+
+func BenchmarkPlanLVM(b *testing.B) {
+	benchLVM(b, func(ctx context.Context, r resize.Resizer) error {
+		_, err := resize.Plan(ctx, r)
+		return err
+	})
+}
+
+func BenchmarkResizeLVM(b *testing.B) {
+	benchLVM(b, func(ctx context.Context, r resize.Resizer) error {
+		_, err := resize.Resize(ctx, r, nil)
+		return err
+	})
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	lockFile = flag.String("lock-file", "/run/embiggen-disk.lock", "lock file preventing concurrent runs from interleaving partition table writes; empty to disable")
+	lockWait = flag.Duration("lock-wait", 0, "how long to wait for another run holding --lock-file to finish; zero means fail immediately")
+)
+
+// acquireLock takes an exclusive flock on path, waiting up to wait
+// for any other holder to release it. The returned file holds the lock
+// until closed or the process exits.
+func acquireLock(path string, wait time.Duration) (*os.File, error) {
+	f, err := resize.Privileges.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %v", path, err)
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			holder := "another process"
+			if pid, _ := ioutil.ReadFile(path); len(bytes.TrimSpace(pid)) > 0 {
+				holder = "pid " + string(bytes.TrimSpace(pid))
+			}
+			return nil, fmt.Errorf("another embiggen-disk (%s) is already running; lock %s is held (use --lock-wait to wait for it)", holder, path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return f, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	logFormat = flag.String("log-format", "text", "log output format: text or json")
+	logTarget = flag.String("log-target", "stderr", "where to send logs: stderr, journal, or syslog")
+)
+
+// logger is where all diagnostic logging goes. It's replaced by
+// initLogging once flags are parsed.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+// initLogging configures logger from the --log-format, --log-target
+// and --verbose flags.
+//
+// Verbose runs log at debug level. JSON runs, and runs logging to the
+// journal or syslog, log each step at info level even without
+// --verbose, as they're meant for log pipelines. Otherwise only
+// warnings and errors are logged.
+func initLogging(w io.Writer) error {
+	level := slog.LevelWarn
+	if *logFormat == "json" || *logTarget != "stderr" {
+		level = slog.LevelInfo
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	switch *logTarget {
+	case "stderr":
+	case "journal":
+		h, err := newJournalHandler(level)
+		if err != nil {
+			return err
+		}
+		logger = slog.New(h)
+		return nil
+	case "syslog":
+		h, err := newSyslogHandler(level)
+		if err != nil {
+			return err
+		}
+		logger = slog.New(h)
+		return nil
+	default:
+		return fmt.Errorf("unknown --log-target %q; want stderr, journal, or syslog", *logTarget)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		if w == os.Stderr && useColor(os.Stderr) {
+			opts.ReplaceAttr = colorLevel
+		}
+		logger = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return fmt.Errorf("unknown --log-format %q; want text or json", *logFormat)
+	}
+	return nil
+}
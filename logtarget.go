@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// sinkHandler is a slog.Handler that hands each record, flattened to a
+// message and a list of key/value attributes, to emit. It's used for the
+// syslog and journal log targets, which have their own notion of
+// priority and structure.
+type sinkHandler struct {
+	level slog.Leveler
+	attrs []slog.Attr
+	group string // dotted prefix for attribute keys, or empty
+	emit  func(level slog.Level, msg string, attrs []slog.Attr) error
+}
+
+func (h *sinkHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, h.qualify(a))
+		return true
+	})
+	return h.emit(r.Level, r.Message, attrs)
+}
+
+func (h *sinkHandler) WithAttrs(as []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range as {
+		h2.attrs = append(h2.attrs, h.qualify(a))
+	}
+	return &h2
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func (h *sinkHandler) qualify(a slog.Attr) slog.Attr {
+	a.Key = h.group + a.Key
+	return a
+}
+
+// formatAttrs returns attrs formatted as space-separated key=value pairs.
+func formatAttrs(attrs []slog.Attr) string {
+	var buf strings.Builder
+	for i, a := range attrs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&buf, "%s=%s", a.Key, v)
+	}
+	return buf.String()
+}
+
+// newSyslogHandler returns a slog.Handler logging to the local syslog
+// daemon, mapping slog levels to syslog priorities.
+func newSyslogHandler(level slog.Leveler) (slog.Handler, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "embiggen-disk")
+	if err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %v", err)
+	}
+	return &sinkHandler{
+		level: level,
+		emit: func(l slog.Level, msg string, attrs []slog.Attr) error {
+			if len(attrs) > 0 {
+				msg += " " + formatAttrs(attrs)
+			}
+			switch {
+			case l >= slog.LevelError:
+				return w.Err(msg)
+			case l >= slog.LevelWarn:
+				return w.Warning(msg)
+			case l >= slog.LevelInfo:
+				return w.Info(msg)
+			default:
+				return w.Debug(msg)
+			}
+		},
+	}, nil
+}
+
+// newJournalHandler returns a slog.Handler logging to the systemd journal
+// using its native protocol, so attributes become journal fields
+// (e.g. "stage" becomes STAGE=).
+func newJournalHandler(level slog.Leveler) (slog.Handler, error) {
+	c, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journal: %v", err)
+	}
+	return &sinkHandler{
+		level: level,
+		emit: func(l slog.Level, msg string, attrs []slog.Attr) error {
+			var buf bytes.Buffer
+			writeJournalField(&buf, "PRIORITY", fmt.Sprint(journalPriority(l)))
+			writeJournalField(&buf, "SYSLOG_IDENTIFIER", "embiggen-disk")
+			writeJournalField(&buf, "MESSAGE", msg)
+			for _, a := range attrs {
+				writeJournalField(&buf, journalFieldName(a.Key), a.Value.String())
+			}
+			_, err := c.Write(buf.Bytes())
+			return err
+		},
+	}, nil
+}
+
+// journalPriority maps a slog level to a syslog(3) priority number.
+func journalPriority(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+// journalFieldName maps a slog key to a valid journal field name: at
+// most 64 ASCII uppercase letters, digits and underscores, not
+// starting with an underscore or digit.
+func journalFieldName(k string) string {
+	var buf strings.Builder
+	for _, r := range k {
+		switch {
+		case r >= 'a' && r <= 'z':
+			buf.WriteRune(r - 'a' + 'A')
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			buf.WriteRune(r)
+		default:
+			buf.WriteByte('_')
+		}
+	}
+	s := strings.TrimLeft(buf.String(), "_0123456789")
+	if s == "" {
+		return "FIELD"
+	}
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	return s
+}
+
+// writeJournalField writes k=v in the journal native protocol, using the
+// binary length-prefixed form if v contains a newline.
+func writeJournalField(buf *bytes.Buffer, k, v string) {
+	if !strings.Contains(v, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", k, v)
+		return
+	}
+	buf.WriteString(k)
+	buf.WriteByte('\n')
+	n := uint64(len(v))
+	for i := 0; i < 8; i++ {
+		buf.WriteByte(byte(n >> (8 * i)))
+	}
+	buf.WriteString(v)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"device", "DEVICE"},
+		{"DEVICE", "DEVICE"},
+		{"beforeBytes", "BEFOREBYTES"},
+		{"http.status", "HTTP_STATUS"},
+		{"run-id", "RUN_ID"},
+		{"stage.device-path", "STAGE_DEVICE_PATH"},
+		{"_hidden", "HIDDEN"},
+		{"__SYSTEMD_UNIT", "SYSTEMD_UNIT"},
+		{"2fa", "FA"},
+		{"9_lives", "LIVES"},
+		{"ipv6", "IPV6"},
+		{"größe", "GR__E"},
+		{"x٣", "X_"}, // an Arabic-Indic digit isn't one the journal allows
+		{"", "FIELD"},
+		{"123", "FIELD"},
+		{"-.", "FIELD"},
+		{strings.Repeat("a", 70), strings.Repeat("A", 64)},
+	}
+	for _, tt := range tests {
+		got := journalFieldName(tt.key)
+		if got != tt.want {
+			t.Errorf("journalFieldName(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+		for i, r := range got {
+			if !(r >= 'A' && r <= 'Z' || r == '_' && i > 0 || r >= '0' && r <= '9' && i > 0) {
+				t.Errorf("journalFieldName(%q) = %q, invalid at byte %d", tt.key, got, i)
+				break
+			}
+		}
+	}
+}
+
+func TestJournalPriority(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  int
+	}{
+		{slog.LevelError + 4, 3},
+		{slog.LevelError, 3},
+		{slog.LevelWarn + 1, 4},
+		{slog.LevelWarn, 4},
+		{slog.LevelInfo + 1, 6},
+		{slog.LevelInfo, 6},
+		{slog.LevelInfo - 1, 7},
+		{slog.LevelDebug, 7},
+		{slog.LevelDebug - 4, 7},
+	}
+	for _, tt := range tests {
+		if got := journalPriority(tt.level); got != tt.want {
+			t.Errorf("journalPriority(%v) = %d; want %d", tt.level, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// lvMain implements the "lv" subcommand, which grows an LVM logical
+// volume by name, and the PVs and partitions below it, without a
+// filesystem on top: for LVs used raw, like VM disks, iSCSI exports,
+// or database devices, which have no mount point to name.
+func lvMain(args []string) {
+	fs := flag.NewFlagSet("lv", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk lv:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] lv <vg>/<lv>\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+	}
+	vg, lv, ok := strings.Cut(strings.TrimPrefix(fs.Arg(0), "/dev/"), "/")
+	if !ok || vg == "" || lv == "" || strings.Contains(lv, "/") {
+		fatalf("%q isn't a logical volume name like vg/lv", fs.Arg(0))
+	}
+	dev := "/dev/" + vg + "/" + lv
+	// The kernel's mount table names it by its device mapper name,
+	// with the VG and LV's own dashes doubled.
+	mapper := "/dev/mapper/" + strings.ReplaceAll(vg, "-", "--") + "-" + strings.ReplaceAll(lv, "-", "--")
+	for _, d := range []string{dev, mapper} {
+		if m, ok, err := resize.DeviceMount(d); err == nil && ok {
+			fatalf("%s has a filesystem mounted at %s; enlarge that mount point instead, so the filesystem grows too", fs.Arg(0), m.Mountpoint)
+		}
+	}
+	if err := growLV(dev); err != nil {
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, err.Error()))
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// growLV grows the logical volume dev and everything below it,
+// reporting what it did on stdout like grow.
+func growLV(dev string) error {
+	ctx, end, err := beginRun()
+	if err != nil {
+		return err
+	}
+	defer end()
+	r := &run{ctx: ctx, start: time.Now()}
+	lastRun = r
+	e := resize.NewLVResizer(dev)
+	emitEvent(event{Type: eventRunStart, Device: dev})
+	var changes []resize.Change
+	if *dry || resize.MayGrow(ctx, e) {
+		changes, err = resize.Resize(ctx, e, r.hooks())
+	} else {
+		logger.Debug("nothing can grow", "device", dev)
+	}
+	r.record(dev, resize.ActionGrow, err)
+	if eventsEnabled() {
+		ev := event{Type: eventRunDone, Device: dev}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		emitEvent(ev)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errReported, err)
+		}
+		return nil
+	}
+	if *jsonOut {
+		r.plan.Mountpoint = dev
+		if err != nil {
+			r.plan.Error = err.Error()
+		}
+		if werr := r.writePlanJSON(os.Stdout); werr != nil {
+			return fmt.Errorf("writing plan: %v", werr)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errReported, err)
+		}
+		return nil
+	}
+	if len(changes) > 0 {
+		fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Changes made:"))
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", colorize(os.Stdout, colorGreen, c.String()))
+		}
+	} else if err == nil {
+		fmt.Printf("No changes made.\n")
+	}
+	if err != nil {
+		return fmt.Errorf("error: %w", err)
+	}
+	if *verifyFlag && !*dry {
+		if err := verifySteps(ctx, r.steps); err != nil {
+			return fmt.Errorf("verification failed: %v", err)
+		}
+		fmt.Printf("Verified: each layer grew to fill the one below it.\n")
+	}
+	return nil
+}
@@ -23,105 +23,737 @@ package main
 // TODO: test/fix on disks with non-512 byte sectors ( /sys/block/sda/queue/hw_sector_size)
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
 )
 
 var (
-	dry     = flag.Bool("dry-run", false, "don't make changes")
-	verbose = flag.Bool("verbose", false, "verbose output")
+	dry     = &resize.DryRun
+	verbose = &resize.Verbose
+	timeout = flag.Duration("timeout", 0, "if non-zero, give up after this long, killing any running command")
+	largest = flag.Bool("largest", false, "with no mount point argument, enlarge the largest local filesystem instead of /")
+	all     = flag.Bool("all", false, "with no mount point argument, enlarge every mounted filesystem on a local block device, silently skipping network, FUSE, and in-memory ones like NFS, CIFS, and tmpfs")
+
+	recordCommands = flag.String("record-commands", "", "if non-empty, append each external command run and its output to this file, as JSON lines for resize.ReadRecordings, to replay in tests")
 )
 
 func init() {
+	flag.BoolVar(dry, "dry-run", false, "don't make changes")
+	flag.BoolVar(verbose, "verbose", false, "verbose output, including the progress of ext2/3/4 resizes; resize2fs reports progress only when resizing offline, so growing a mounted filesystem reports none")
+	flag.StringVar(&resize.Repart, "repart", "honor", "how to grow GPT partitions systemd-repart manages (matched by a repart.d definition, or with the GrowFileSystem attribute): honor, to stay within their definition's SizeMaxBytes and Weight share; skip, to leave them to repart; or ignore")
+	flag.StringVar(&resize.BtrfsPolicy, "btrfs-policy", "grow", "how to grow a btrfs filesystem on a partition: grow, to grow its partition; or add-device, to create a new partition in the disk's free space after its last partition and add it with btrfs device add, leaving existing partition entries untouched")
+	flag.StringVar(&resize.Sysroot, "sysroot", "", "alternate root, such as a mounted image tree, whose mount points to enlarge: each is looked for under it, and if not mounted there, in its etc/fstab, on the disk it's mounted from")
+	flag.BoolVar(&resize.Offline, "offline", false, "if the target isn't mounted but is in /etc/fstab, also resize its (ext2/3/4) filesystem offline, rather than only the layers below it")
+	flag.BoolVar(&resize.RegeneratePartUUIDs, "regenerate-partuuids", false, "give a grown GPT partition a new random PARTUUID, rather than keeping it exactly; anything naming the partition by its old PARTUUID, like fstab or the boot loader, must be updated")
+	flag.BoolVar(&resize.Force, "force", false, "grow the filesystem even if its superblock records errors, which normally it must be checked with e2fsck first, and grow partitions whose GPT entries mark them read-only (attribute bit 60)")
+	flag.BoolVar(&resize.UDisks, "udisks", false, "grow partitions and filesystems through the udisks2 daemon, which authorizes the caller with PolicyKit, so it needn't run as root; LVM isn't supported")
+	flag.BoolVar(&resize.MoveSwap, "move-swap", false, "if the partition to grow is followed, last on its disk, by encrypted swap that /etc/crypttab sets up with a random key, turn the swap off, move its partition to the end of the disk, and set it up again, so the partition can grow")
+	flag.StringVar(&resize.LUKSHeaderBackupDir, "luks-header-backup", "", "if non-empty, a directory in which to save the header of any LUKS container on a partition being grown, with cryptsetup luksHeaderBackup, before changing the partition")
+	flag.BoolVar(&resize.RemountRW, "remount-rw", false, "if the target is mounted read-only, remount it read-write to resize it, then restore its mount options; without this, read-only targets are refused")
 	flag.Usage = usage
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of embiggen-disk:\n\n")
-	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] <mount-point-to-enlarge>\n\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] [<mount-point-to-enlarge>...]  (default /, or see --largest and --all; several at once with --parallel)\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] --distribute=<mount-point>=<share>[,...]  (split a volume group's new space among its LVs)\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] lv <vg>/<lv>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] container-storage [--socket=<path>] <container-or-volume>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] vg-status [--json] [<vg>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] allocate [<vg>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] shrink --target-size=<size> [--yes] <mount-point>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] daemon [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] node-agent [--config=<file>] [--status-listen=<addr>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] agent plan|resize|status <mount-point>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] ansible <args-file>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] azure-extension install|enable|disable|uninstall|update\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] openstack [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] vmware [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] proxmox [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] growpart [--config=/etc/cloud/cloud.cfg] [<mount-point-or-device>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] firstboot [--marker=<file>] [--disk=/dev/mmcblk0] [<mount-point>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] install-systemd [--mode=boot|daemon|path|firstboot|all] [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] initramfs [--root=<device>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] history [-n=<count>] [--json] [--all] [<mount-point>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] collect-diagnostics [--out=<file.tar.gz>] [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] replay <diagnostics.tar.gz|dir> [<mount-point>...]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] repart-config [--dir=/etc/repart.d] [<mount-point>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] provision [--fs=ext4] [--label=<label>] [--options=defaults] <disk> <mount-point>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] image grow <file.img|file.qcow2> --size=<size> <mount-point-in-image>\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] --remote=[user@]host[,...] [<mount-point-to-enlarge>]\n")
+	fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] doctor\n\n")
+	fmt.Fprintf(os.Stderr, "Each flag can also be set by an environment variable, which the command line overrides:\n")
+	fmt.Fprintf(os.Stderr, "--lock-file by EMBIGGEN_LOCK_FILE, and a subcommand's, like firstboot --marker, by EMBIGGEN_FIRSTBOOT_MARKER.\n\n")
 	flag.PrintDefaults()
 	os.Exit(1)
 }
 
 func fatalf(format string, args ...interface{}) {
 	log.SetFlags(0)
-	log.Fatalf(format, args...)
+	log.Fatal(colorize(os.Stderr, colorRed, fmt.Sprintf(format, args...)))
 }
 
 func vlogf(format string, args ...interface{}) {
 	if *verbose {
-		log.Printf(format, args...)
+		logger.Debug(fmt.Sprintf(format, args...))
 	}
 }
 
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == privsepHelperArg {
+		privsepHelperMain()
+		return
+	}
+	if err := setFlagsFromEnv(flag.CommandLine, ""); err != nil {
+		fatalf("%v", err)
+	}
 	flag.Parse()
-	if flag.NArg() != 1 {
-		usage()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if flag.NArg() == 1 && flag.Arg(0) == "doctor" {
+		checkGrowOnly("doctor")
+		if !runDoctor(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *remoteHosts != "" {
+		checkGrowOnly("--remote")
+		// The hosts do the work; this end needn't be Linux or root.
+		if err := initLogging(os.Stderr); err != nil {
+			fatalf("%v", err)
+		}
+		remoteMain(flag.Args())
+		return
+	}
+	setup()
+	if sub, ok := subcommands[flag.Arg(0)]; ok {
+		checkGrowOnly("subcommand " + flag.Arg(0))
+		sub(flag.Args()[1:])
+		return
+	}
+	switch {
+	case *csiEndpoint != "":
+		if *dbusFlag || *listen != "" || *watch > 0 || flag.NArg() > 0 {
+			fatalf("--csi-endpoint takes no mount points and can't be combined with --dbus, --listen, or --watch")
+		}
+		checkGrowOnly("--csi-endpoint")
+		csiMain()
+		return
+	case *dbusFlag:
+		if *listen != "" || *watch > 0 || flag.NArg() > 0 {
+			fatalf("--dbus takes no mount points and can't be combined with --csi-endpoint, --listen, or --watch")
+		}
+		checkGrowOnly("--dbus")
+		dbusMain()
+		return
+	case *listen != "":
+		if *watch > 0 || flag.NArg() > 0 {
+			fatalf("--listen takes no mount points and can't be combined with --watch")
+		}
+		checkGrowOnly("--listen")
+		serveMain()
+		return
+	case *watch > 0:
+		checkGrowOnly("--watch")
+		daemonMain(flag.Args())
+		return
+	case *distribute != "":
+		if flag.NArg() > 0 {
+			fatalf("--distribute names its mount points itself; it takes no arguments")
+		}
+		checkGrowOnly("--distribute")
+		distributeMain(*distribute)
+		return
+	}
+	mnts := flag.Args()
+	switch {
+	case *all:
+		if len(mnts) > 0 {
+			fatalf("--all takes no mount point arguments")
+		}
+		if *largest {
+			fatalf("--all and --largest are mutually exclusive")
+		}
+		var err error
+		if mnts, err = allLocalMounts(); err != nil {
+			fatalf("finding mounted filesystems: %v", err)
+		}
+	case len(mnts) == 0:
+		mnt := "/"
+		if *largest {
+			var err error
+			if mnt, err = largestLocalFS(); err != nil {
+				fatalf("finding largest local filesystem: %v", err)
+			}
+			vlogf("largest local filesystem is %s", mnt)
+		}
+		mnts = []string{mnt}
+	}
+	// The helper is set up for these mount points alone.
+	startPrivsep(mnts)
+	startSandbox()
+	if len(mnts) == 1 && !*all {
+		growMain(mnts[0])
+	} else {
+		growMainAll(mnts)
 	}
-	if runtime.GOOS != "linux" {
-		fatalf("embiggen-disk only runs on Linux.")
+}
+
+// subcommands are the subcommands, by name, which main runs with the
+// arguments after the name.
+var subcommands = map[string]func(args []string){
+	"shrink":              shrinkMain,
+	"daemon":              daemonMain,
+	"node-agent":          nodeAgentMain,
+	"azure-extension":     azureMain,
+	"openstack":           openstackMain,
+	"agent":               agentMain,
+	"ansible":             ansibleMain,
+	"vmware":              vmwareMain,
+	"proxmox":             proxmoxMain,
+	"growpart":            growpartMain,
+	"firstboot":           firstbootMain,
+	"install-systemd":     installSystemdMain,
+	"image":               imageMain,
+	"provision":           provisionMain,
+	"repart-config":       repartConfigMain,
+	"initramfs":           initramfsMain,
+	"history":             historyMain,
+	"collect-diagnostics": collectDiagnosticsMain,
+	"replay":              replayMain,
+	"container-storage":   containerStorageMain,
+	"lv":                  lvMain,
+	"vg-status":           vgStatusMain,
+	"allocate":            allocateMain,
+}
+
+// checkGrowOnly exits if --privsep or --sandbox is given for what,
+// as they're only set up for enlarging the mount points given.
+func checkGrowOnly(what string) {
+	if *privsep || *sandbox {
+		fatalf("--privsep and --sandbox only apply to enlarging mount points, not to %s", what)
 	}
+}
 
-	mnt := flag.Arg(0)
-	e, err := getFileSystemResizer(mnt)
-	vlogf("getFileSystemResizer(%q) = %#v, %v", mnt, e, err)
+// allLocalMounts returns the mount points --all enlarges: one for each
+// filesystem mounted from a local block device.
+func allLocalMounts() ([]string, error) {
+	mounts, err := resize.Mounts()
 	if err != nil {
-		fatalf("error preparing to enlarge %s: %v", mnt, err)
+		return nil, err
 	}
-	changes, err := Resize(e)
-	if len(changes) > 0 {
-		fmt.Printf("Changes made:\n")
-		for _, c := range changes {
-			fmt.Printf("  * %s\n", c)
+	var mnts []string
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		if !resize.LocalBlockFilesystem(m.Type, m.Source) {
+			vlogf("--all: skipping %s filesystem %s at %s", m.Type, m.Source, m.Mountpoint)
+			continue
 		}
-	} else if err == nil {
-		fmt.Printf("No changes made.\n")
+		if seen[m.Source] {
+			continue // a bind mount, or a btrfs subvolume
+		}
+		seen[m.Source] = true
+		mnts = append(mnts, m.Mountpoint)
 	}
+	return mnts, nil
+}
+
+// largestLocalFS returns the mount point of the largest mounted
+// filesystem backed by a local block device.
+func largestLocalFS() (string, error) {
+	mounts, err := resize.Mounts()
 	if err != nil {
-		fatalf("error: %v", err)
+		return "", err
+	}
+	var best string
+	var bestSize int64
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Source, "/dev/") {
+			continue
+		}
+		mnt := m.Mountpoint
+		st, err := resize.Stat(mnt)
+		if err != nil {
+			continue
+		}
+		if n := st.SizeBytes(); n > bestSize {
+			best, bestSize = mnt, n
+		}
+	}
+	if best == "" {
+		return "", errors.New("no filesystems on local block devices are mounted")
+	}
+	return best, nil
+}
+
+// setup validates the global flags and initializes logging and signal
+// handling, as needed before changing anything.
+func setup() {
+	if err := checkColorFlag(); err != nil {
+		fatalf("%v", err)
+	}
+	if *jsonOut && !*dry {
+		fatalf("--json requires --dry-run")
+	}
+	if err := checkEventsFlag(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkOtherGrowersFlag(); err != nil {
+		fatalf("%v", err)
+	}
+	if err := initLogging(os.Stderr); err != nil {
+		fatalf("%v", err)
+	}
+	if err := checkContainer(); err != nil {
+		fatalf("%v", err)
+	}
+	if why := namespaceMismatch(); why != "" {
+		logger.Warn(why + "; " + namespaceAdvice)
+	}
+	setToolPaths()
+	if *recordCommands != "" {
+		f, err := os.OpenFile(*recordCommands, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		resize.CommandRunner = &resize.RecordRunner{Runner: resize.CommandRunner, Out: f}
 	}
+	resize.Logger = logger
+	resize.DryRunf = dryRunf
+	resize.ProposeSize = planProposedSize
+	if *verbose || *logFormat == "json" || eventsEnabled() {
+		resize.Progress = reportProgress
+	}
+	logger.Info("starting", "version", version, "commit", commit, "buildDate", buildDate)
+	vlogf("%s", versionString())
+	if runtime.GOOS != "linux" && runtime.GOOS != "freebsd" {
+		fatalf("embiggen-disk only runs on Linux and FreeBSD.")
+	}
+	if err := setDisks(); err != nil {
+		fatalf("%v", err)
+	}
+	handleSignals()
 }
 
-// An Resizer is anything that can enlarge something and describe its state.
-// An Resizer can depend on another Resizer to run first.
-type Resizer interface {
-	String() string                       // "ext4 filesystem at /", "LVM PV foo"
-	State() (string, error)               // "534 blocks"
-	Resize() error                        // both may be non-zero
-	DepResizer() (dep Resizer, err error) // can return (nil, nil) for none
+// beginRun prepares for one grow or shrink run: it takes the
+// --lock-file lock and starts the --timeout clock for the returned
+// context. The returned func releases the lock and the context.
+func beginRun() (ctx context.Context, end func(), err error) {
+	unlock, err := lockRun()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := runContext()
+	return ctx, func() {
+		cancel()
+		unlock()
+	}, nil
 }
 
-// Resize resizes e's dependencies and then resizes e.
-func Resize(e Resizer) (changes []string, err error) {
-	s0, err := e.State()
+// lockRun takes the --lock-file lock, if any, and returns the func
+// releasing it.
+func lockRun() (unlock func(), err error) {
+	if *lockFile == "" || *dry {
+		return func() {}, nil
+	}
+	lf, err := acquireLock(*lockFile, *lockWait)
 	if err != nil {
-		return
+		return nil, err
+	}
+	return func() { lf.Close() }, nil
+}
+
+// runContext returns the context bounding a run's resizers and hooks,
+// per --timeout.
+func runContext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
 	}
-	dep, err := e.DepResizer()
+	return context.WithCancel(context.Background())
+}
+
+// errReported is wrapped by the errors grow returns when it has
+// already reported the failure in its output and the caller only needs
+// to exit non-zero.
+var errReported = errors.New("error already reported")
+
+// growMain enlarges the filesystem mounted at mnt and everything below
+// it, exiting on failure with the status from exitCode.
+func growMain(mnt string) {
+	res, err := grow(mnt)
+	writeResultFile([]runResult{resultOf(mnt, res, err)}, err)
 	if err != nil {
-		return
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, err.Error()))
+		}
+		os.Exit(exitCode(err))
 	}
-	if dep != nil {
-		changes, err = Resize(dep)
-		if err != nil {
+}
+
+// growMainAll enlarges each of mnts, several at once with --parallel,
+// exiting with the status from exitCode for the first failure, if
+// any.
+func growMainAll(mnts []string) {
+	var mu sync.Mutex
+	var firstErr error
+	var results []runResult // in the order they finish
+	growEach(mnts, func(mnt string, res runResult, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if *all && errors.Is(err, resize.ErrNotLocalBlockFilesystem) {
+			return
+		}
+		if *all && errors.Is(err, resize.ErrImmutable) {
+			// Like a snap's squashfs image: there's nothing to grow.
+			logger.Info("skipping immutable filesystem", "mountpoint", mnt, "err", err)
 			return
 		}
+		results = append(results, resultOf(mnt, res, err))
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, errReported) {
+			log.SetFlags(0)
+			log.Print(colorize(os.Stderr, colorRed, mnt+": "+err.Error()))
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	})
+	if firstErr == nil {
+		firstErr = checkInterrupted()
+	}
+	writeResultFile(results, firstErr)
+	if firstErr != nil {
+		os.Exit(exitCode(firstErr))
 	}
-	err = e.Resize()
+}
+
+// exitCode returns the process exit status for a failed run, so
+// scripts can tell common causes apart.
+func exitCode(err error) int {
+	var te *resize.ToolError
+	switch {
+	case errors.Is(err, resize.ErrUnsupportedFilesystem):
+		return 3
+	case errors.Is(err, resize.ErrNoFreeSpace):
+		return 4
+	case errors.Is(err, resize.ErrDeviceNotFound):
+		return 5
+	case errors.Is(err, resize.ErrToolMissing):
+		return 6
+	case errors.Is(err, resize.ErrPartitionNotLast):
+		return 7
+	case errors.As(err, &te):
+		return 8
+	case errors.Is(err, resize.ErrReadOnly):
+		return 9
+	case errors.Is(err, resize.ErrFilesystemErrors):
+		return 10
+	case errors.Is(err, resize.ErrWouldShrink):
+		return 11
+	case errors.Is(err, resize.ErrImmutable):
+		return 12
+	case errors.Is(err, resize.ErrNotLocalBlockFilesystem):
+		return 13
+	}
+	return 1
+}
+
+// grow enlarges the filesystem mounted at mnt and everything below it,
+// reporting what it did on stdout. The returned result is only filled
+// in if the resize was attempted. The run's details are left in
+// lastRun.
+func grow(mnt string) (res runResult, err error) {
+	return growIn(new(run), mnt)
+}
+
+// growIn is grow, in the run r, whose ctx it sets.
+func growIn(r *run, mnt string) (res runResult, err error) {
+	ctx, end, err := beginRun()
 	if err != nil {
-		return
+		return res, err
+	}
+	defer end()
+	r.ctx = ctx
+	lastRun = r
+	return r.grow(mnt)
+}
+
+// A run is the state of one grow run.
+type run struct {
+	ctx      context.Context // bounds its resizers and hooks, per --timeout
+	start    time.Time       // when it began, for the --history log
+	steps    []*stepRecord   // each step, in the order they ran
+	curStage string          // the String of the Resizer being worked on, for error messages
+
+	// asGrowpart is whether it's cloud-init's growpart, by way of
+	// the growpart subcommand, so isn't to wait for or defer to it.
+	asGrowpart bool
+
+	// plan is its plan, in --dry-run mode.
+	plan    runPlan
+	planCur *planStep // stage currently being planned, or nil
+
+	// planBelow holds, for each stage entered but not yet finished,
+	// innermost last, the finished stages directly below it.
+	planBelow [][]*planStep
+}
+
+// lastRun is the run most recently started by grow. The --dry-run
+// callbacks the resize package calls record into its plan.
+var lastRun = new(run)
+
+// reportMu keeps the reports of runs going at once from interleaving
+// on stdout.
+var reportMu sync.Mutex
+
+// grow is grow, within the run r.
+func (r *run) grow(mnt string) (res runResult, err error) {
+	if !r.asGrowpart {
+		deferTo, err := coordinateGrowers(r.ctx, mnt)
+		if err != nil {
+			return res, err
+		}
+		if deferTo != "" {
+			logger.Info("leaving mount point to another grower", "mountpoint", mnt, "grower", deferTo)
+			if !*jsonOut && !eventsEnabled() {
+				fmt.Printf("Leaving %s to %s.\n", mnt, deferTo)
+			}
+			return res, nil
+		}
 	}
-	s1, err := e.State()
+	r.start = time.Now()
+	e, err := resize.FileSystem(r.ctx, mnt)
+	vlogf("resize.FileSystem(%q) = %#v, %v", mnt, e, err)
 	if err != nil {
-		err = fmt.Errorf("error after successful resize of %v: %v", e, err)
-		return
+		return res, fmt.Errorf("error preparing to enlarge %s: %w", mnt, err)
+	}
+	before, _ := resize.Stat(resize.SysrootPath(mnt))
+	henv := hookEnv{
+		"MOUNTPOINT":   mnt,
+		"DEVICE":       before.Device,
+		"FSTYPE":       before.Type,
+		"BEFORE_BYTES": fmt.Sprint(before.SizeBytes()),
+	}
+	if err := runHook(r.ctx, "pre-hook", *preHook, henv); err != nil {
+		return res, err
+	}
+	emitEvent(event{Type: eventRunStart, Mountpoint: mnt, Device: before.Device, BeforeBytes: before.SizeBytes()})
+	var resumed *resumeInfo
+	prev, failed := lastFailedRun(mnt)
+	if failed && !*dry {
+		resumed = newResumeInfo(prev)
+		logger.Info("resuming after a failed run", "mountpoint", mnt, "failedRun", prev.Time, "stage", resumed.FailedStage, "err", prev.Error)
+	}
+	// Most runs, like those at every boot, have nothing to do, and
+	// finding that out cheaply keeps them from running any tools.
+	var changes []resize.Change
+	if *dry || resize.MayGrow(r.ctx, e) {
+		changes, err = resize.Resize(r.ctx, e, r.hooks())
+	} else {
+		logger.Debug("nothing can grow", "mountpoint", mnt)
+	}
+	henv["CHANGES"] = fmt.Sprint(len(changes))
+	henv["STATUS"] = "ok"
+	if err != nil {
+		henv["STATUS"] = "error"
+		henv["ERROR"] = err.Error()
+	}
+	res = runResult{
+		Mountpoint: mnt,
+		Version:    versionString(),
+	}
+	for _, c := range changes {
+		res.Changes = append(res.Changes, c.String())
+	}
+	res.ChangeDetails = changes
+	if resumed != nil {
+		resumed.finish(prev, r.steps)
+		res.Resumed = resumed
+	}
+	for _, st := range r.steps {
+		l := layerResult{
+			Stage:       st.stage,
+			Device:      resize.Device(st.r),
+			BeforeBytes: st.before,
+			AfterBytes:  st.after,
+			DurationMs:  st.d.Milliseconds(),
+		}
+		if st.err != nil {
+			l.Error = st.err.Error()
+		}
+		res.Layers = append(res.Layers, l)
+	}
+	if after, serr := resize.Stat(resize.SysrootPath(mnt)); serr == nil {
+		henv["AFTER_BYTES"] = fmt.Sprint(after.SizeBytes())
+		res.BytesGained = after.SizeBytes() - before.SizeBytes()
 	}
-	if s0 != s1 {
-		changes = append(changes, fmt.Sprintf("%v: before: %v, after: %v", e, s0, s1))
+	if herr := runHook(r.ctx, "post-hook", *postHook, henv); herr != nil && err == nil {
+		err = herr
 	}
-	return
+	res.Success = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.record(mnt, resize.ActionGrow, err)
+	if nerr := notify(res); nerr != nil {
+		logger.Error("notification failed", "err", nerr)
+	}
+	if eventsEnabled() {
+		ev := event{Type: eventRunDone, Mountpoint: mnt, Error: res.Error}
+		if after, serr := resize.Stat(resize.SysrootPath(mnt)); serr == nil {
+			ev.AfterBytes = after.SizeBytes()
+		}
+		emitEvent(ev)
+		if err != nil {
+			return res, fmt.Errorf("%w: %w", errReported, err)
+		}
+		return res, nil
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	if *jsonOut {
+		r.plan.Mountpoint = mnt
+		if err != nil {
+			r.plan.Error = err.Error()
+		}
+		if werr := r.writePlanJSON(os.Stdout); werr != nil {
+			return res, fmt.Errorf("writing plan: %v", werr)
+		}
+		if err != nil {
+			return res, fmt.Errorf("%w: %w", errReported, err)
+		}
+		return res, nil
+	}
+	if resumed != nil {
+		printResumed(resumed)
+	}
+	if len(changes) > 0 {
+		fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Changes made:"))
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", colorize(os.Stdout, colorGreen, c.String()))
+		}
+	} else if err == nil {
+		fmt.Printf("No changes made.\n")
+	}
+	if *verbose && len(r.steps) > 0 {
+		fmt.Printf("Step timings:\n")
+		for _, st := range r.steps {
+			fmt.Printf("  * %s: %v\n", st.stage, st.d.Round(time.Millisecond))
+		}
+	}
+	if r.ctx.Err() == context.DeadlineExceeded {
+		return res, fmt.Errorf("timed out after %v during stage %q: %w", *timeout, r.curStage, err)
+	}
+	if err != nil {
+		return res, fmt.Errorf("error: %w", err)
+	}
+	if *verifyFlag && !*dry {
+		if err := verifySteps(r.ctx, r.steps); err != nil {
+			return res, fmt.Errorf("verification failed: %v", err)
+		}
+		fmt.Printf("Verified: each layer grew to fill the one below it.\n")
+	}
+	if len(changes) > 0 && !*dry {
+		if after, err := resize.Stat(resize.SysrootPath(mnt)); err == nil {
+			fmt.Println()
+			printDFSummary(os.Stdout, before, after)
+		}
+	}
+	return res, nil
+}
+
+// printDFSummary writes a df-style table of the filesystem's size,
+// used, and available space before and after resizing.
+func printDFSummary(w io.Writer, before, after resize.FSStat) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tSize\tUsed\tAvail\t\n", after.Mountpoint)
+	for _, row := range []struct {
+		name string
+		fs   resize.FSStat
+	}{
+		{"before", before},
+		{"after", after},
+	} {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", row.name,
+			resize.HumanBytes(row.fs.SizeBytes()),
+			resize.HumanBytes(row.fs.UsedBytes()),
+			resize.HumanBytes(row.fs.AvailBytes()))
+	}
+	tw.Flush()
+}
+
+// stepRecord records one Resizer's Resize step.
+type stepRecord struct {
+	r             resize.Resizer
+	stage         string // r's String
+	d             time.Duration
+	before, after int64 // sizes in bytes; after is only set on success
+	err           error
+}
+
+// hooks returns the hooks for r's resize, which stop it when
+// interrupted, run the --stage-hook commands, and log, emit events
+// for, and record each step, and in --dry-run mode, its plan.
+func (r *run) hooks() *resize.Hooks {
+	return &resize.Hooks{
+		Enter: func(e resize.Resizer) {
+			r.curStage = e.String()
+			if *dry {
+				r.enterPlanStep()
+			}
+		},
+		Before: func(e resize.Resizer, n0 int64) error {
+			r.curStage = e.String()
+			if err := checkInterrupted(); err != nil {
+				return err
+			}
+			if err := runStageHook(r.ctx, "pre", e, n0, 0); err != nil {
+				return err
+			}
+			if *dry {
+				r.beginPlanStep(e, n0)
+			}
+			emitEvent(event{Type: eventStageStart, Stage: e.String(), Device: resize.Device(e), BeforeBytes: n0})
+			return nil
+		},
+		After: func(e resize.Resizer, n0, n1 int64, d time.Duration, err error) error {
+			if *dry {
+				r.endPlanStep()
+			}
+			r.steps = append(r.steps, &stepRecord{r: e, stage: e.String(), d: d, before: n0, after: n1, err: err})
+			if err != nil {
+				logger.Error("resize failed", "stage", e.String(), "device", resize.Device(e), "before", n0, "duration", d, "err", err)
+				emitEvent(event{Type: eventError, Stage: e.String(), Device: resize.Device(e), BeforeBytes: n0, DurationMs: d.Milliseconds(), Error: err.Error()})
+				return err
+			}
+			logger.Info("resized", "stage", e.String(), "device", resize.Device(e), "before", n0, "after", n1, "gained", n1-n0, "duration", d)
+			emitEvent(event{Type: eventStageDone, Stage: e.String(), Device: resize.Device(e), BeforeBytes: n0, AfterBytes: n1, DurationMs: d.Milliseconds()})
+			return runStageHook(r.ctx, "post", e, n0, n1)
+		},
+	}
+}
+
+// reportProgress logs and emits an event for progress resizing r.
+func reportProgress(r resize.Resizer, pass int, percent float64, eta time.Duration) {
+	logger.Info("progress", "stage", r.String(), "device", resize.Device(r),
+		"pass", pass, "percent", int(percent), "eta", eta)
+	emitEvent(event{Type: eventStageProgress, Stage: r.String(), Device: resize.Device(r), Pass: pass, Percent: percent})
 }
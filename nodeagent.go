@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"gopkg.in/yaml.v3"
+)
+
+// nodeAgentMain implements the "node-agent" subcommand, daemon mode
+// for running in a Kubernetes DaemonSet (see k8s/daemonset.yaml). It
+// enlarges the mount points listed in a config file, typically from a
+// ConfigMap and re-read before each run, and serves their status and
+// Prometheus metrics over HTTP.
+func nodeAgentMain(args []string) {
+	fs := flag.NewFlagSet("node-agent", flag.ExitOnError)
+	cfgPath := fs.String("config", "/etc/embiggen-disk/node-agent.yaml", `YAML file with a "mountpoints" list of the hostPath or local PV mount points to enlarge`)
+	statusAddr := fs.String("status-listen", ":9847", "address to serve /healthz, /status, and /metrics on; empty to disable")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk node-agent:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] node-agent [--config=<file>] [--status-listen=<addr>]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+	}
+	if _, err := readNodeAgentConfig(*cfgPath); err != nil {
+		fatalf("%v", err)
+	}
+	if *statusAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+		mux.HandleFunc("/status", serveResults)
+		mux.HandleFunc("/metrics", serveMetrics)
+		go func() {
+			fatalf("status server: %v", http.ListenAndServe(*statusAddr, mux))
+		}()
+	}
+	runDaemon(func() []string {
+		mnts, err := readNodeAgentConfig(*cfgPath)
+		if err != nil {
+			// Keep going with what worked before.
+			logger.Error("reading node agent config failed", "err", err)
+		}
+		return mnts
+	})
+}
+
+var (
+	agentCfgMu   sync.Mutex
+	agentCfgLast []string // last good mount point list
+)
+
+// readNodeAgentConfig returns the mount points listed in the config at
+// path. On error, it returns the last list it read successfully.
+func readNodeAgentConfig(path string) ([]string, error) {
+	agentCfgMu.Lock()
+	defer agentCfgMu.Unlock()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return agentCfgLast, err
+	}
+	var cfg struct {
+		Mountpoints []string `yaml:"mountpoints"`
+	}
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return agentCfgLast, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(cfg.Mountpoints) == 0 {
+		return agentCfgLast, fmt.Errorf("%s lists no mountpoints", path)
+	}
+	agentCfgLast = cfg.Mountpoints
+	return cfg.Mountpoints, nil
+}
+
+// mountResult is the outcome of the daemon's runs for one mount point.
+type mountResult struct {
+	Last        runResult `json:"last"`
+	LastRun     time.Time `json:"lastRun"`
+	SizeBytes   int64     `json:"sizeBytes"`
+	Runs        int       `json:"runs"`
+	Failures    int       `json:"failures"`
+	BytesGained int64     `json:"bytesGained"` // over all runs
+}
+
+var (
+	resultsMu sync.Mutex
+	results   = map[string]*mountResult{}
+)
+
+// recordResult records the outcome of a daemon run for mnt for the
+// node agent's status endpoints.
+func recordResult(mnt string, res runResult, err error) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	mr := results[mnt]
+	if mr == nil {
+		mr = &mountResult{}
+		results[mnt] = mr
+	}
+	res.Mountpoint = mnt
+	res.Success = err == nil
+	if err != nil && !errors.Is(err, errReported) {
+		res.Error = err.Error()
+	}
+	mr.Last, mr.LastRun = res, time.Now()
+	mr.Runs++
+	if err != nil {
+		mr.Failures++
+	}
+	mr.BytesGained += res.BytesGained
+	if st, err := resize.Stat(mnt); err == nil {
+		mr.SizeBytes = st.SizeBytes()
+	}
+}
+
+func serveResults(w http.ResponseWriter, r *http.Request) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(results)
+}
+
+// serveMetrics serves the results in the Prometheus text format.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	mnts := make([]string, 0, len(results))
+	for mnt := range results {
+		mnts = append(mnts, mnt)
+	}
+	sort.Strings(mnts)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range []struct {
+		name, typ, help string
+		val             func(*mountResult) float64
+	}{
+		{"embiggen_disk_runs_total", "counter", "Resize runs.", func(mr *mountResult) float64 { return float64(mr.Runs) }},
+		{"embiggen_disk_failures_total", "counter", "Failed resize runs.", func(mr *mountResult) float64 { return float64(mr.Failures) }},
+		{"embiggen_disk_bytes_gained_total", "counter", "Bytes the filesystem grew by.", func(mr *mountResult) float64 { return float64(mr.BytesGained) }},
+		{"embiggen_disk_filesystem_size_bytes", "gauge", "Filesystem size after the last run.", func(mr *mountResult) float64 { return float64(mr.SizeBytes) }},
+		{"embiggen_disk_last_run_timestamp_seconds", "gauge", "When the last run finished.", func(mr *mountResult) float64 { return float64(mr.LastRun.Unix()) }},
+		{"embiggen_disk_last_run_success", "gauge", "Whether the last run succeeded.", func(mr *mountResult) float64 {
+			if mr.Last.Success {
+				return 1
+			}
+			return 0
+		}},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, mnt := range mnts {
+			fmt.Fprintf(w, "%s{mountpoint=%q} %v\n", m.name, mnt, m.val(results[mnt]))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var (
+	notifyURL = flag.String("notify-url", "", "if non-empty, URL to POST a JSON summary of the run to when done")
+	notifyCmd = flag.String("notify-cmd", "", "if non-empty, shell command to run when done, with a JSON summary of the run on its stdin")
+)
+
+// runResult is the machine-readable summary of a run.
+type runResult struct {
+	Mountpoint    string          `json:"mountpoint"`
+	Success       bool            `json:"success"`
+	Error         string          `json:"error,omitempty"`
+	Changes       []string        `json:"changes"`
+	ChangeDetails []resize.Change `json:"changeDetails,omitempty"` // Changes, structured
+	BytesGained   int64           `json:"bytesGained"`             // by the filesystem
+	Layers        []layerResult   `json:"layers,omitempty"`        // each step run, bottom up
+	Resumed       *resumeInfo     `json:"resumed,omitempty"`       // if the last run of it failed
+	Version       string          `json:"version"`
+}
+
+// layerResult is the outcome of one layer's resize step in a run.
+type layerResult struct {
+	Stage       string `json:"stage"`
+	Device      string `json:"device,omitempty"`
+	BeforeBytes int64  `json:"beforeBytes"`
+	AfterBytes  int64  `json:"afterBytes,omitempty"` // only on success
+	DurationMs  int64  `json:"durationMs"`
+	Error       string `json:"error,omitempty"`
+}
+
+// notify sends res to --notify-url and --notify-cmd, if set.
+func notify(res runResult) error {
+	if *notifyURL == "" && *notifyCmd == "" {
+		return nil
+	}
+	payload, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if *dry {
+		if *notifyURL != "" {
+			dryRunf("would've run: POST %s with body %s", *notifyURL, payload)
+		}
+		if *notifyCmd != "" {
+			dryRunf("would've run: /bin/sh -c %s <<'EOF'\n%s\nEOF", shellQuote([]string{*notifyCmd}), payload)
+		}
+		return nil
+	}
+	if *notifyURL != "" {
+		c := &http.Client{Timeout: 30 * time.Second}
+		resp, err := c.Post(*notifyURL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return fmt.Errorf("notifying %s: %v", *notifyURL, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("notifying %s: %v", *notifyURL, resp.Status)
+		}
+	}
+	if *notifyCmd != "" {
+		cmd := exec.Command("/bin/sh", "-c", *notifyCmd)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := runConfigured(cmd); err != nil {
+			return fmt.Errorf("notify-cmd %q: %v", *notifyCmd, err)
+		}
+	}
+	return nil
+}
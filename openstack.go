@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var openstackRescan = flag.Duration("openstack-rescan", 0, "in daemon mode on OpenStack, if non-zero, rescan the SCSI bus this often, resizing when a volume grew; virtio-scsi guests don't otherwise see a cinder extend")
+
+const openstackMetadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
+
+// onOpenStack reports whether we're running on an OpenStack Nova
+// instance.
+func onOpenStack() bool {
+	return dmiField("product_name") == "OpenStack Nova" ||
+		dmiField("chassis_asset_tag") == "OpenStack Nova" ||
+		strings.HasPrefix(dmiField("sys_vendor"), "OpenStack")
+}
+
+// openstackDevice is one entry of the "devices" device hints in the
+// instance metadata, describing a tagged disk or NIC.
+type openstackDevice struct {
+	Type    string   `json:"type"`    // "disk" or "nic"
+	Bus     string   `json:"bus"`     // "scsi", "virtio", "pci", ...
+	Address string   `json:"address"` // "0:0:0:1" for SCSI, PCI address for virtio
+	Serial  string   `json:"serial"`  // the cinder volume ID, for volumes
+	Tags    []string `json:"tags"`
+}
+
+// openstackMain implements the "openstack" subcommand. It rescans the
+// SCSI bus, so virtio-scsi guests see any cinder extend that already
+// happened, and then enlarges the given mount points, or by default /
+// and every filesystem on a volume in the metadata's device hints.
+func openstackMain(args []string) {
+	if !onOpenStack() {
+		logger.Warn("this doesn't look like an OpenStack instance")
+	}
+	rescanSCSI()
+	time.Sleep(time.Second)
+	mnts := args
+	if len(mnts) == 0 {
+		devs, err := openstackDevices()
+		if err != nil {
+			logger.Warn("no device hints; resizing only /", "err", err)
+		}
+		disks := map[string]bool{}
+		for _, d := range devs {
+			if disk := d.localDisk(); disk != "" {
+				disks[disk] = true
+			}
+		}
+		mnts = rootAndMountsOnDisks(disks)
+	}
+	if !growAll(mnts) {
+		os.Exit(1)
+	}
+}
+
+// openstackDevices returns the disks in the instance metadata's device
+// hints, from the metadata service or else the config drive.
+func openstackDevices() ([]openstackDevice, error) {
+	var md struct {
+		Devices []openstackDevice `json:"devices"`
+	}
+	b, err := fetchOpenStackMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("parsing OpenStack metadata: %v", err)
+	}
+	var disks []openstackDevice
+	for _, d := range md.Devices {
+		if d.Type == "disk" {
+			disks = append(disks, d)
+		}
+	}
+	return disks, nil
+}
+
+func fetchOpenStackMetadata() ([]byte, error) {
+	c := &http.Client{Timeout: 5 * time.Second}
+	res, err := c.Get(openstackMetadataURL)
+	if err == nil {
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			return ioutil.ReadAll(res.Body)
+		}
+		err = fmt.Errorf("%s: %s", openstackMetadataURL, res.Status)
+	}
+	// No metadata service; try the config drive, if it's mounted
+	// where cloud-init leaves it.
+	for _, dir := range []string{"/mnt/config", "/run/cloud-init/config-drive", "/media/configdrive"} {
+		if b, cerr := ioutil.ReadFile(filepath.Join(dir, "openstack/latest/meta_data.json")); cerr == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// localDisk returns the name of the disk ("sdb", "vdc") d refers to,
+// or "" if it can't be found.
+func (d openstackDevice) localDisk() string {
+	var pattern string
+	switch d.Bus {
+	case "scsi":
+		pattern = filepath.Join("/sys/bus/scsi/devices", d.Address, "block", "*")
+	case "virtio", "pci":
+		pattern = filepath.Join("/sys/bus/pci/devices", d.Address, "virtio*", "block", "*")
+	}
+	if pattern != "" {
+		if m, _ := filepath.Glob(pattern); len(m) == 1 {
+			return filepath.Base(m[0])
+		}
+	}
+	// virtio-blk serials are truncated to 20 bytes.
+	if serial := d.Serial; serial != "" {
+		if len(serial) > 20 {
+			serial = serial[:20]
+		}
+		if dev, err := filepath.EvalSymlinks("/dev/disk/by-id/virtio-" + serial); err == nil {
+			return filepath.Base(dev)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"sort"
+	"sync"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var parallel = flag.Int("parallel", 1, "with several mount points, how many to enlarge at once; those sharing a disk or volume group still go one at a time")
+
+// growEach enlarges each of mnts, calling done with each one's result.
+// With --parallel, up to that many run at once, except in --dry-run
+// mode, whose plan output isn't per run. done may be called
+// concurrently. Once interrupted, it starts no more runs.
+func growEach(mnts []string, done func(mnt string, res runResult, err error)) {
+	if *parallel <= 1 || *dry || len(mnts) < 2 {
+		for _, mnt := range mnts {
+			if checkInterrupted() != nil {
+				return
+			}
+			res, err := grow(mnt)
+			done(mnt, res, err)
+		}
+		return
+	}
+
+	unlock, err := lockRun()
+	if err != nil {
+		for _, mnt := range mnts {
+			done(mnt, runResult{}, err)
+		}
+		return
+	}
+	defer unlock()
+
+	var (
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, *parallel)
+		locks diskLocks
+	)
+	for _, mnt := range mnts {
+		wg.Add(1)
+		go func(mnt string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if checkInterrupted() != nil {
+				return
+			}
+			ctx, cancel := runContext()
+			defer cancel()
+			disks, err := chainDisks(ctx, mnt)
+			if err != nil {
+				// Let grow report it.
+				vlogf("finding the disks below %s: %v", mnt, err)
+			}
+			defer locks.lock(disks)()
+			r := &run{ctx: ctx}
+			res, err := r.grow(mnt)
+			done(mnt, res, err)
+		}(mnt)
+	}
+	wg.Wait()
+}
+
+// chainDisks returns the devices resizing mnt changes: each layer's
+// device, and for partitions, their disk's, since writing one
+// partition table entry rewrites the whole table. Chains sharing any
+// mustn't run at once.
+func chainDisks(ctx context.Context, mnt string) ([]string, error) {
+	layers, err := chainLayers(ctx, mnt)
+	var devs []string
+	for _, r := range layers {
+		if dev := resize.Device(r); dev != "" {
+			devs = append(devs, dev)
+			if resize.KindOf(r) == resize.KindPartition {
+				disk, derr := resize.DiskOf(ctx, dev)
+				if derr != nil {
+					return nil, derr
+				}
+				devs = append(devs, disk)
+			}
+		}
+	}
+	return devs, err
+}
+
+// chainLayers returns the Resizers of each layer resizing mnt would
+// resize, from the filesystem down.
+func chainLayers(ctx context.Context, mnt string) ([]resize.Resizer, error) {
+	e, err := resize.FileSystem(ctx, mnt)
+	if err != nil {
+		return nil, err
+	}
+	var layers []resize.Resizer
+	var walk func(r resize.Resizer) error
+	walk = func(r resize.Resizer) error {
+		layers = append(layers, r)
+		deps, err := r.DepResizers(ctx)
+		if err != nil {
+			return err
+		}
+		for _, dep := range deps {
+			if err := walk(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return layers, walk(e)
+}
+
+// diskLocks are per-device locks.
+type diskLocks struct {
+	mu sync.Mutex
+	m  map[string]*sync.Mutex
+}
+
+// lock locks each of devs, in a fixed order so runs locking
+// overlapping sets can't deadlock, and returns the func unlocking
+// them.
+func (dl *diskLocks) lock(devs []string) (unlock func()) {
+	devs = append([]string(nil), devs...)
+	sort.Strings(devs)
+	var held []*sync.Mutex
+	for i, dev := range devs {
+		if i > 0 && dev == devs[i-1] {
+			continue
+		}
+		dl.mu.Lock()
+		if dl.m == nil {
+			dl.m = make(map[string]*sync.Mutex)
+		}
+		mu := dl.m[dev]
+		if mu == nil {
+			mu = new(sync.Mutex)
+			dl.m[dev] = mu
+		}
+		dl.mu.Unlock()
+		mu.Lock()
+		held = append(held, mu)
+	}
+	return func() {
+		for _, mu := range held {
+			mu.Unlock()
+		}
+	}
+}
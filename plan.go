@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var jsonOut = flag.Bool("json", false, "with --dry-run, print the plan as JSON instead of human-readable text")
+
+// planStep is one stage of a --dry-run plan.
+type planStep struct {
+	Stage         string   `json:"stage"`
+	Device        string   `json:"device"`
+	CurrentBytes  int64    `json:"currentBytes"`
+	ProposedBytes int64    `json:"proposedBytes"`
+	Estimated     bool     `json:"estimated"` // ProposedBytes is inferred from lower stages' growth
+	Commands      []string `json:"commands,omitempty"`
+}
+
+// runPlan is the plan --dry-run builds, in the order stages would run.
+type runPlan struct {
+	Mountpoint string      `json:"mountpoint"`
+	Stages     []*planStep `json:"stages"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// enterPlanStep notes that work on a stage has started. The stages
+// finished before its own are the ones below it.
+func (r *run) enterPlanStep() {
+	r.planBelow = append(r.planBelow, nil)
+}
+
+// beginPlanStep starts recording the plan for e, whose current size is n.
+func (r *run) beginPlanStep(e resize.Resizer, n int64) {
+	r.planCur = &planStep{
+		Stage:        e.String(),
+		Device:       resize.Device(e),
+		CurrentBytes: n,
+	}
+	r.plan.Stages = append(r.plan.Stages, r.planCur)
+}
+
+// endPlanStep finishes the current stage. If the stage didn't know its
+// own proposed size, it's estimated as growing by as much as the
+// stages directly below it did together.
+func (r *run) endPlanStep() {
+	st := r.planCur
+	var below []*planStep
+	if n := len(r.planBelow); n > 0 {
+		below, r.planBelow = r.planBelow[n-1], r.planBelow[:n-1]
+	}
+	if st.ProposedBytes == 0 {
+		st.ProposedBytes = st.CurrentBytes
+		for _, b := range below {
+			st.ProposedBytes += b.ProposedBytes - b.CurrentBytes
+			st.Estimated = true
+		}
+	}
+	if n := len(r.planBelow); n > 0 {
+		r.planBelow[n-1] = append(r.planBelow[n-1], st)
+	}
+	r.planCur = nil
+}
+
+// planCommand records a command line lastRun's current stage would
+// run.
+func planCommand(s string) {
+	if st := lastRun.planCur; st != nil {
+		st.Commands = append(st.Commands, s)
+	}
+}
+
+// planProposedSize records the size in bytes lastRun's current stage
+// would grow to.
+func planProposedSize(n int64) {
+	if st := lastRun.planCur; st != nil {
+		st.ProposedBytes = n
+	}
+}
+
+func (r *run) writePlanJSON(w io.Writer) error {
+	if r.plan.Stages == nil {
+		r.plan.Stages = []*planStep{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.plan)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// dmiField returns the named field of the machine's DMI data
+// ("sys_vendor", "product_name", ...), or "" if it can't be read.
+func dmiField(name string) string {
+	b, err := ioutil.ReadFile(filepath.Join("/sys/class/dmi/id", name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// rescanNVMe asks each NVMe controller whose model passes match to
+// rescan its namespaces, so the kernel notices any that changed size.
+// It returns the controllers rescanned.
+func rescanNVMe(match func(model string) bool) (ctrls []string) {
+	dirs, _ := filepath.Glob("/sys/class/nvme/nvme*")
+	for _, d := range dirs {
+		model, err := ioutil.ReadFile(filepath.Join(d, "model"))
+		if err != nil || !match(strings.TrimSpace(string(model))) {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(d, "rescan_controller"), []byte("1"), 0200); err != nil {
+			logger.Warn("NVMe rescan failed", "controller", filepath.Base(d), "err", err)
+			continue
+		}
+		ctrls = append(ctrls, filepath.Base(d))
+	}
+	return ctrls
+}
+
+// rescanSCSI has the kernel re-read the capacity of every SCSI disk and
+// probe each SCSI host for new ones, as hypervisors that add or grow
+// virtual SCSI disks don't always tell the guest.
+func rescanSCSI() {
+	devs, _ := filepath.Glob("/sys/class/scsi_device/*/device/rescan")
+	for _, f := range devs {
+		if err := ioutil.WriteFile(f, []byte("1"), 0200); err != nil {
+			logger.Warn("SCSI device rescan failed", "device", filepath.Base(filepath.Dir(filepath.Dir(f))), "err", err)
+		}
+	}
+	hosts, _ := filepath.Glob("/sys/class/scsi_host/host*/scan")
+	for _, f := range hosts {
+		if err := ioutil.WriteFile(f, []byte("- - -"), 0200); err != nil {
+			logger.Warn("SCSI host scan failed", "host", filepath.Base(filepath.Dir(f)), "err", err)
+		}
+	}
+}
+
+// backingDisks returns the whole disks ("sda") under the block device
+// dev, looking through partitions and device-mapper or md devices.
+func backingDisks(dev string) []string {
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = real
+	}
+	name := filepath.Base(dev)
+	sys, err := filepath.EvalSymlinks(filepath.Join("/sys/class/block", name))
+	if err != nil {
+		return nil
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(sys, "partition")); err == nil {
+		return []string{filepath.Base(filepath.Dir(sys))}
+	}
+	slaves, _ := filepath.Glob(filepath.Join(sys, "slaves", "*"))
+	if len(slaves) == 0 {
+		return []string{name}
+	}
+	var disks []string
+	for _, s := range slaves {
+		disks = append(disks, backingDisks("/dev/"+filepath.Base(s))...)
+	}
+	return disks
+}
+
+// mountsOnDisks returns the mount points of the filesystems backed by
+// any of disks, as named by backingDisks.
+func mountsOnDisks(disks map[string]bool) []string {
+	mounts, err := resize.Mounts()
+	if err != nil {
+		return nil
+	}
+	var mnts []string
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Source, "/dev/") || seen[m.Source] {
+			continue
+		}
+		for _, d := range backingDisks(m.Source) {
+			if disks[d] {
+				seen[m.Source] = true
+				if cm, ok, err := resize.DeviceMount(m.Source); err == nil && ok {
+					m = cm
+				}
+				mnts = append(mnts, m.Mountpoint)
+				break
+			}
+		}
+	}
+	return mnts
+}
+
+// rescanLoop calls rescan each interval and sends to c when that made
+// a disk grow or appear. name describes the rescan in the message.
+func rescanLoop(interval time.Duration, name string, rescan func(), c chan<- string) {
+	for range time.Tick(interval) {
+		before := blockSizes()
+		rescan()
+		// The kernel revalidates the disks asynchronously.
+		time.Sleep(time.Second)
+		for _, why := range diskGrowth(before, blockSizes()) {
+			c <- name + " rescan: " + why
+		}
+	}
+}
+
+// rootAndMountsOnDisks returns "/" followed by the other mount points
+// from mountsOnDisks(disks).
+func rootAndMountsOnDisks(disks map[string]bool) []string {
+	mnts := []string{"/"}
+	for _, mnt := range mountsOnDisks(disks) {
+		if mnt != "/" {
+			mnts = append(mnts, mnt)
+		}
+	}
+	return mnts
+}
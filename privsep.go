@@ -0,0 +1,787 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/findmnt"
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	privsep     = flag.Bool("privsep", false, "when enlarging mount points, resize each layer below them in a helper process keeping only the capabilities that needs, and drop to --privsep-user in this one, which parses the output of the read-only queries the helper runs for it; requires root")
+	privsepUser = flag.String("privsep-user", "nobody", "with --privsep, the user to run as once the helper is started")
+)
+
+// privsepHelperArg is the hidden subcommand that runs the --privsep
+// helper.
+const privsepHelperArg = "privsep-helper"
+
+// privsepQueries are the read-only commands the helper runs for the
+// parent, by name, the parent passing only their operands. "{dev}"
+// stands for a device of the mount points being enlarged, "{name}"
+// for a volume group name, and "{tag}" for a blkid NAME=value tag.
+var privsepQueries = map[string][]string{
+	"disk-ids":      {"lsblk", "-d", "-n", "-P", "-o", "NAME,SERIAL,WWN"},
+	"topology":      {"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"},
+	"mounts":        append([]string{"findmnt"}, findmnt.Args("--kernel")...),
+	"fs-type":       {"blkid", "-o", "value", "-s", "TYPE", "{dev}"},
+	"fs-by-tag":     {"blkid", "-l", "-o", "device", "-t", "{tag}"},
+	"probe":         {"blkid", "-p", "-o", "export", "{dev}"},
+	"table":         {"sfdisk", "-d", "{dev}"},
+	"table-sectors": {"sfdisk", "-d", "-uS", "{dev}"},
+	"ext-super":     {"dumpe2fs", "-h", "{dev}"},
+	"dm-table":      {"dmsetup", "table", "{dev}"},
+	"lv":            {"lvdisplay", "-c", "{dev}"},
+	"pvs":           {"pvdisplay", "-c"},
+	"pv":            {"pvdisplay", "-c", "{dev}"},
+	"pv-extents":    {"pvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "pe_start,vg_extent_size", "{dev}"},
+	"lv-vg-free":    {"lvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free", "{dev}"},
+	"vg-free":       {"vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free_count,vg_extent_size", "{name}"},
+}
+
+// matchQuery returns the name of the privsepQueries entry the command
+// line args, with the tool's name first, is, and its operands.
+func matchQuery(args []string) (name string, operands []string, ok bool) {
+	if len(args) > 0 && filepath.Base(args[0]) == "lvm" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return "", nil, false
+	}
+	args = append([]string{filepath.Base(args[0])}, args[1:]...)
+	for name, q := range privsepQueries {
+		if len(q) != len(args) {
+			continue
+		}
+		operands = operands[:0]
+		ok = true
+		for i, a := range q {
+			if strings.HasPrefix(a, "{") {
+				operands = append(operands, args[i])
+			} else if a != args[i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return name, operands, true
+		}
+	}
+	return "", nil, false
+}
+
+// A privsepConfig tells the helper, before the parent gives up root,
+// what it's to do: enlarge the mount points given, with the flags
+// given, which may also name files it may open and directories it may
+// create, and shell commands, from the hook and notify flags, it may
+// run.
+type privsepConfig struct {
+	Mountpoints []string
+	Flags       []string // the parent's command-line flags
+
+	Files []string
+	Dirs  []string
+	Shell []string
+
+	Sandbox *sandboxPolicy // with --sandbox
+}
+
+// A privsepLayer names a layer below a mount point being enlarged, as
+// resize.KindOf and resize.Device describe it.
+type privsepLayer struct {
+	Kind   resize.Kind
+	Device string
+}
+
+// A privsepRequest is one operation the parent asks the helper to do.
+type privsepRequest struct {
+	Op string // "query", "resize", "undo", "shell", "open", "mkdir", or "rename"
+
+	// For "query":
+	Query    string // a privsepQueries key
+	Operands []string
+
+	// For "resize" and "undo":
+	Layer    privsepLayer
+	Deadline time.Time // the parent's --timeout, if any
+
+	// For "shell":
+	Command string   // one of privsepConfig.Shell
+	Env     []string // only EMBIGGEN_* variables are passed on
+	Stdin   []byte
+
+	// For "open", "mkdir", and "rename":
+	Path    string
+	NewPath string // for "rename"
+	Flag    int
+	Perm    os.FileMode
+}
+
+// A privsepReply is the helper's answer to a privsepRequest. An opened
+// file is passed along with it.
+type privsepReply struct {
+	Stdout, Stderr []byte
+	Err            string
+	Errno          int // Err's syscall.Errno, if it was one
+	Sentinel       int // 1 + the index in privsepSentinels of an error Err wraps, if any
+}
+
+// privsepSentinels are the errors a reply can say its error wraps, so
+// the parent's exit status is as it would be without --privsep.
+var privsepSentinels = []error{
+	resize.ErrUnsupportedFilesystem,
+	resize.ErrNoFreeSpace,
+	resize.ErrDeviceNotFound,
+	resize.ErrToolMissing,
+	resize.ErrReadOnly,
+	resize.ErrFilesystemErrors,
+	resize.ErrWouldShrink,
+	resize.ErrImmutable,
+	resize.ErrNotLocalBlockFilesystem,
+	resize.ErrPartitionNotLast,
+}
+
+func (r privsepReply) err(op, path string) error {
+	if r.Err == "" {
+		return nil
+	}
+	if r.Errno != 0 {
+		return &os.PathError{Op: op, Path: path, Err: syscall.Errno(r.Errno)}
+	}
+	if r.Sentinel > 0 && r.Sentinel <= len(privsepSentinels) {
+		return privsepError{r.Err, privsepSentinels[r.Sentinel-1]}
+	}
+	return errors.New(r.Err)
+}
+
+// A privsepError is an error from the helper wrapping one of
+// privsepSentinels.
+type privsepError struct {
+	msg  string
+	wrap error
+}
+
+func (e privsepError) Error() string { return e.msg }
+func (e privsepError) Unwrap() error { return e.wrap }
+
+// maxPrivsepFrame bounds the messages between the parent and helper.
+const maxPrivsepFrame = 64 << 20
+
+// writeFrame sends v to c as a length-prefixed JSON message, passing
+// along f, if non-nil.
+func writeFrame(c *net.UnixConn, v interface{}, f *os.File) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(b)))
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	if _, _, err := c.WriteMsgUnix(hdr[:], oob, nil); err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
+
+// readFrame reads a message sent by writeFrame into v, returning the
+// file passed along with it, if any.
+func readFrame(c *net.UnixConn, v interface{}) (*os.File, error) {
+	var hdr [4]byte
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(hdr[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	var f *os.File
+	if oobn > 0 {
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			fds, err := unix.ParseUnixRights(&m)
+			if err != nil {
+				return nil, err
+			}
+			for _, fd := range fds {
+				if f == nil {
+					f = os.NewFile(uintptr(fd), "privsep")
+				} else {
+					unix.Close(fd)
+				}
+			}
+		}
+	}
+	if _, err := io.ReadFull(c, hdr[n:]); err != nil {
+		return f, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxPrivsepFrame {
+		return f, fmt.Errorf("privsep message of %d bytes is too large", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return f, err
+	}
+	return f, json.Unmarshal(b, v)
+}
+
+// A privsepClient is the parent's end of the connection to the helper.
+// It's the resize.Runner and resize.Privileged the parent uses once it
+// has given up root. The helper does one operation at a time.
+type privsepClient struct {
+	mu sync.Mutex
+	c  *net.UnixConn
+}
+
+// privsepHelper is the connection to the --privsep helper, once it's
+// started, or nil.
+var privsepHelper *privsepClient
+
+func (p *privsepClient) call(req privsepRequest) (privsepReply, *os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var rep privsepReply
+	if err := writeFrame(p.c, req, nil); err != nil {
+		return rep, nil, fmt.Errorf("privsep helper: %v", err)
+	}
+	f, err := readFrame(p.c, &rep)
+	if err != nil {
+		return rep, f, fmt.Errorf("privsep helper: %v", err)
+	}
+	return rep, f, nil
+}
+
+// Run runs cmd in the helper, which only runs the privsepQueries and
+// the shell commands in its config.
+func (p *privsepClient) Run(cmd *exec.Cmd) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	req := privsepRequest{Op: "query"}
+	var ok bool
+	if req.Query, req.Operands, ok = matchQuery(cmd.Args); !ok {
+		if len(cmd.Args) != 3 || cmd.Args[0] != "/bin/sh" || cmd.Args[1] != "-c" {
+			return fmt.Errorf("with --privsep, %s can't be run", filepath.Base(cmd.Args[0]))
+		}
+		req = privsepRequest{Op: "shell", Command: cmd.Args[2], Env: cmd.Env}
+		if cmd.Stdin != nil {
+			// As --notify-cmd's payload is.
+			b, err := io.ReadAll(cmd.Stdin)
+			if err != nil {
+				return err
+			}
+			req.Stdin = b
+		}
+	}
+	rep, _, err := p.call(req)
+	if err != nil {
+		return err
+	}
+	if cmd.Stdout != nil {
+		cmd.Stdout.Write(rep.Stdout)
+	}
+	if cmd.Stderr != nil {
+		cmd.Stderr.Write(rep.Stderr)
+	}
+	if rep.Err != "" {
+		return errors.New(rep.Err)
+	}
+	return nil
+}
+
+func (p *privsepClient) ResizeLayer(ctx context.Context, r resize.Resizer) error {
+	return p.layerOp(ctx, "resize", r)
+}
+
+func (p *privsepClient) UndoLayer(ctx context.Context, r resize.Resizer) error {
+	return p.layerOp(ctx, "undo", r)
+}
+
+func (p *privsepClient) layerOp(ctx context.Context, op string, r resize.Resizer) error {
+	req := privsepRequest{Op: op, Layer: privsepLayer{resize.KindOf(r), resize.Device(r)}}
+	req.Deadline, _ = ctx.Deadline()
+	rep, _, err := p.call(req)
+	if err != nil {
+		return err
+	}
+	if rep.Err == "" {
+		return nil
+	}
+	// Tell the user what the helper ran, as running it here would.
+	os.Stderr.Write(rep.Stderr)
+	return rep.err(op, r.String())
+}
+
+func (p *privsepClient) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	rep, f, err := p.call(privsepRequest{Op: "open", Path: name, Flag: flag, Perm: perm})
+	if err != nil {
+		return nil, err
+	}
+	if err := rep.err("open", name); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, err
+	}
+	if f == nil {
+		return nil, fmt.Errorf("open %s: privsep helper passed no file", name)
+	}
+	return f, nil
+}
+
+func (p *privsepClient) MkdirAll(path string, perm os.FileMode) error {
+	rep, _, err := p.call(privsepRequest{Op: "mkdir", Path: path, Perm: perm})
+	if err != nil {
+		return err
+	}
+	return rep.err("mkdir", path)
+}
+
+func (p *privsepClient) Rename(oldpath, newpath string) error {
+	rep, _, err := p.call(privsepRequest{Op: "rename", Path: oldpath, NewPath: newpath})
+	if err != nil {
+		return err
+	}
+	return rep.err("rename", oldpath)
+}
+
+// BLKPG isn't done for the parent; the helper does it as part of
+// resizing a partition.
+func (p *privsepClient) BLKPG(disk string, op, pno int32, start, length int64) error {
+	return fmt.Errorf("BLKPG %s: only done by the privsep helper, resizing a partition", disk)
+}
+
+// runConfigured runs cmd, a shell command from the hook or notify
+// flags: in the helper with --privsep, as this process has given up
+// root by then.
+func runConfigured(cmd *exec.Cmd) error {
+	if privsepHelper != nil {
+		return privsepHelper.Run(cmd)
+	}
+	return cmd.Run()
+}
+
+// startPrivsep, with --privsep, starts the helper for enlarging mnts,
+// points the resize package at it, and gives up root for
+// --privsep-user.
+func startPrivsep(mnts []string) {
+	if !*privsep {
+		return
+	}
+	if os.Geteuid() != 0 {
+		fatalf("--privsep requires running as root")
+	}
+	if resize.HostRoot != "" || resize.UDisks {
+		fatalf("--privsep can't be combined with container mode or --udisks")
+	}
+	uid, gid, err := lookupPrivsepUser(*privsepUser)
+	if err != nil {
+		fatalf("--privsep-user: %v", err)
+	}
+	c, err := startPrivsepHelper(privsepConfigFromFlags(mnts))
+	if err != nil {
+		fatalf("starting privsep helper: %v", err)
+	}
+	if err := dropToUser(uid, gid); err != nil {
+		fatalf("dropping privileges to %s: %v", *privsepUser, err)
+	}
+	privsepHelper = c
+	if rr, ok := resize.CommandRunner.(*resize.RecordRunner); ok {
+		rr.Runner = c
+	} else {
+		resize.CommandRunner = c
+	}
+	resize.Privileges = c
+	vlogf("privsep: running as %s (uid %d), with a helper for privileged work", *privsepUser, uid)
+}
+
+// privsepConfigFromFlags returns the helper's config for enlarging
+// mnts with the flags given.
+func privsepConfigFromFlags(mnts []string) privsepConfig {
+	cfg := privsepConfig{Mountpoints: mnts}
+	cfg.Flags = setFlagArgs()
+	for _, f := range []string{*lockFile, *historyFile} {
+		if f != "" {
+			cfg.Files = append(cfg.Files, f)
+		}
+	}
+	if *historyFile != "" {
+		cfg.Dirs = append(cfg.Dirs, filepath.Dir(*historyFile))
+	}
+	if *resultFile != "" {
+		cfg.Files = append(cfg.Files, *resultFile, resultTempFile(*resultFile))
+	}
+	for _, s := range append([]string{*preHook, *postHook, *notifyCmd}, stageHooks.commands()...) {
+		if s != "" {
+			cfg.Shell = append(cfg.Shell, s)
+		}
+	}
+	if *sandbox {
+		p := sandboxPolicyFromFlags()
+		cfg.Sandbox = &p
+	}
+	return cfg
+}
+
+// privsepHelperMain implements the hidden privsep-helper subcommand,
+// run by startPrivsep with its end of the connection as fd 3. It
+// reads its privsepConfig, takes the parent's flags, finds the layers
+// below the mount points it's to enlarge, drops the capabilities it
+// doesn't need, and then serves requests until the parent goes away.
+func privsepHelperMain() {
+	fc, err := net.FileConn(os.NewFile(3, "privsep"))
+	if err != nil {
+		fatalf("privsep helper: %v", err)
+	}
+	c := fc.(*net.UnixConn)
+	var cfg privsepConfig
+	if _, err := readFrame(c, &cfg); err != nil {
+		fatalf("privsep helper: reading config: %v", err)
+	}
+	// Interrupts are for the parent; the helper finishes what it's
+	// doing, like writing a partition table, and exits when the
+	// parent does.
+	ignoreInterrupts()
+	var ready privsepReply
+	s, err := newPrivsepServer(cfg)
+	if err != nil {
+		ready.Err = err.Error()
+	} else if err := dropHelperCapabilities(); err != nil {
+		ready.Err = err.Error()
+	} else if cfg.Sandbox != nil {
+		if err := applySandbox(*cfg.Sandbox); err != nil {
+			ready.Err = "sandbox: " + err.Error()
+		}
+	}
+	if err := writeFrame(c, ready, nil); err != nil || ready.Err != "" {
+		os.Exit(1)
+	}
+	s.serveConn(c)
+}
+
+// serveConn serves the requests read from c until it's closed.
+func (s *privsepServer) serveConn(c *net.UnixConn) {
+	for {
+		var req privsepRequest
+		if _, err := readFrame(c, &req); err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "privsep helper: %v\n", err)
+			}
+			return
+		}
+		rep, f := s.serve(req)
+		err := writeFrame(c, rep, f)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "privsep helper: %v\n", err)
+			return
+		}
+	}
+}
+
+// A privsepServer is the helper's state: its config, and the layers
+// below the mount points it's to enlarge, which are all it resizes.
+type privsepServer struct {
+	cfg    privsepConfig
+	layers map[privsepLayer]resize.Resizer
+	devs   map[string]bool // each layer's device, and partitions' disks, symlinks resolved
+}
+
+// newPrivsepServer configures the resize package with cfg's flags, as
+// the parent's is, and finds the layers below cfg's mount points.
+func newPrivsepServer(cfg privsepConfig) (*privsepServer, error) {
+	if err := setFlagsFromEnv(flag.CommandLine, ""); err != nil {
+		return nil, err
+	}
+	if err := flag.CommandLine.Parse(cfg.Flags); err != nil {
+		return nil, err
+	}
+	if err := initLogging(os.Stderr); err != nil {
+		return nil, err
+	}
+	resize.Logger = logger
+	setToolPaths()
+	if err := setDisks(); err != nil {
+		return nil, err
+	}
+	s := &privsepServer{cfg: cfg, layers: map[privsepLayer]resize.Resizer{}, devs: map[string]bool{}}
+	ctx := context.Background()
+	for _, mnt := range cfg.Mountpoints {
+		layers, err := chainLayers(ctx, mnt)
+		if err != nil {
+			// The parent reports it when it gets that far.
+			vlogf("privsep helper: finding the layers below %s: %v", mnt, err)
+		}
+		for _, r := range layers {
+			dev := resize.Device(r)
+			if dev == "" {
+				continue
+			}
+			s.layers[privsepLayer{resize.KindOf(r), dev}] = r
+			s.devs[realDev(dev)] = true
+			if resize.KindOf(r) == resize.KindPartition {
+				if disk, err := resize.DiskOf(ctx, dev); err == nil {
+					s.devs[realDev(disk)] = true
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// realDev returns dev with symlinks, such as /dev/mapper's, resolved.
+func realDev(dev string) string {
+	if real, err := filepath.EvalSymlinks(dev); err == nil {
+		return real
+	}
+	return dev
+}
+
+// checkDevice returns an error unless dev is a device of one of s's
+// layers or their disks, or a partition of such a disk, whose entries
+// are probed to read its partition table.
+func (s *privsepServer) checkDevice(dev string) error {
+	real := realDev(dev)
+	if strings.HasPrefix(real, "/dev/") {
+		if s.devs[real] {
+			return nil
+		}
+		parent, err := filepath.EvalSymlinks("/sys/class/block/" + filepath.Base(real) + "/..")
+		if err == nil && s.devs["/dev/"+filepath.Base(parent)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't below the mount points being enlarged", dev)
+}
+
+var (
+	// vgNameRx matches the volume group names a query may name.
+	vgNameRx = regexp.MustCompile(`^[A-Za-z0-9+_.][A-Za-z0-9+_.-]*$`)
+
+	// blkidTagRx matches the tags a query may look devices up by.
+	blkidTagRx = regexp.MustCompile(`^(LABEL|UUID|PARTLABEL|PARTUUID)=`)
+)
+
+// queryArgs returns the command line of the privsepQueries entry name
+// with operands, if they're allowed.
+func (s *privsepServer) queryArgs(name string, operands []string) ([]string, error) {
+	q, ok := privsepQueries[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown query %q", name)
+	}
+	args := append([]string(nil), q...)
+	for i, a := range args {
+		if !strings.HasPrefix(a, "{") {
+			continue
+		}
+		if len(operands) == 0 {
+			return nil, fmt.Errorf("query %q: too few operands", name)
+		}
+		v := operands[0]
+		operands = operands[1:]
+		switch a {
+		case "{dev}":
+			if err := s.checkDevice(v); err != nil {
+				return nil, err
+			}
+		case "{name}":
+			if !vgNameRx.MatchString(v) {
+				return nil, fmt.Errorf("query %q: bad volume group name %q", name, v)
+			}
+		case "{tag}":
+			if !blkidTagRx.MatchString(v) {
+				return nil, fmt.Errorf("query %q: bad tag %q", name, v)
+			}
+		}
+		args[i] = v
+	}
+	if len(operands) > 0 {
+		return nil, fmt.Errorf("query %q: too many operands", name)
+	}
+	return args, nil
+}
+
+// serve does req, if s allows it, returning the reply and any file
+// opened.
+func (s *privsepServer) serve(req privsepRequest) (rep privsepReply, f *os.File) {
+	var err error
+	defer func() {
+		if err != nil {
+			rep.Err = err.Error()
+			var errno syscall.Errno
+			if errors.As(err, &errno) {
+				rep.Errno = int(errno)
+			}
+			for i, e := range privsepSentinels {
+				if errors.Is(err, e) {
+					rep.Sentinel = i + 1
+					break
+				}
+			}
+		}
+	}()
+	switch req.Op {
+	case "query":
+		var args []string
+		if args, err = s.queryArgs(req.Query, req.Operands); err == nil {
+			err = s.run(resize.Command(context.Background(), args[0], args[1:]...), &rep)
+		}
+	case "shell":
+		if !contains(s.cfg.Shell, req.Command) {
+			err = errors.New("not allowed to run a shell command not given on the command line")
+		} else {
+			cmd := exec.Command("/bin/sh", "-c", req.Command)
+			cmd.Env = os.Environ()
+			for _, kv := range req.Env {
+				if strings.HasPrefix(kv, "EMBIGGEN_") {
+					cmd.Env = append(cmd.Env, kv)
+				}
+			}
+			cmd.Stdin = bytes.NewReader(req.Stdin)
+			err = s.run(cmd, &rep)
+		}
+	case "resize", "undo":
+		r := s.layers[req.Layer]
+		if r == nil || req.Layer.Kind == "" {
+			err = fmt.Errorf("not allowed to %s %s: not a layer below the mount points being enlarged", req.Op, req.Layer.Device)
+			break
+		}
+		ctx := context.Background()
+		if !req.Deadline.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, req.Deadline)
+			defer cancel()
+		}
+		if req.Op == "resize" {
+			err = r.Resize(ctx)
+		} else {
+			err = resize.Undo(ctx, r)
+		}
+	case "open":
+		if err = s.checkOpen(req.Path, req.Flag); err == nil {
+			f, err = os.OpenFile(req.Path, req.Flag, req.Perm)
+		}
+		if err == nil && req.Flag&os.O_CREATE != 0 {
+			// The parent can't chmod a file root owns.
+			if err = f.Chmod(req.Perm); err != nil {
+				f.Close()
+				f = nil
+			}
+		}
+	case "mkdir":
+		if !contains(s.cfg.Dirs, req.Path) {
+			err = fmt.Errorf("not allowed to create %s", req.Path)
+		} else {
+			err = os.MkdirAll(req.Path, req.Perm)
+		}
+	case "rename":
+		if !contains(s.cfg.Files, req.Path) || !contains(s.cfg.Files, req.NewPath) {
+			err = fmt.Errorf("not allowed to rename %s to %s", req.Path, req.NewPath)
+		} else {
+			err = os.Rename(req.Path, req.NewPath)
+		}
+	default:
+		err = fmt.Errorf("unknown privsep operation %q", req.Op)
+	}
+	return rep, f
+}
+
+// checkOpen returns an error unless the helper may open path with
+// flag: the devices below the mount points being enlarged only to
+// read, and otherwise only the files in s's config.
+func (s *privsepServer) checkOpen(path string, flag int) error {
+	switch {
+	case contains(s.cfg.Files, path):
+		return nil
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 && s.checkDevice(path) == nil:
+		return nil
+	}
+	return fmt.Errorf("not allowed to open %s with flags %#x", path, flag)
+}
+
+// run runs cmd, as installed by root, in its own process group, so a
+// ^C to the parent doesn't kill it partway through, recording its
+// output in rep.
+func (s *privsepServer) run(cmd *exec.Cmd, rep *privsepReply) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	if err := checkRootOwned(cmd.Path); err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	rep.Stdout, rep.Stderr = stdout.Bytes(), stderr.Bytes()
+	return err
+}
+
+// checkRootOwned returns an error unless path is an executable file
+// that only root can change.
+func checkRootOwned(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("not allowed to run %s: not an absolute path", path)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return err
+	}
+	if st.Uid != 0 || st.Mode&(unix.S_IWGRP|unix.S_IWOTH) != 0 || st.Mode&unix.S_IFMT != unix.S_IFREG {
+		return fmt.Errorf("not allowed to run %s: it's not a regular file only root can write", path)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
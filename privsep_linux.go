@@ -0,0 +1,162 @@
+//go:build linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// privsepCaps are the capabilities the --privsep helper keeps: to do
+// the partition, device-mapper, mount, and filesystem resize ioctls
+// (ext4's needs CAP_SYS_RESOURCE), and for LVM, to lock its memory.
+// Being uid 0, it owns the devices and files it opens without
+// CAP_DAC_OVERRIDE.
+var privsepCaps = []uintptr{
+	unix.CAP_SYS_ADMIN,
+	unix.CAP_SYS_RESOURCE,
+	unix.CAP_IPC_LOCK,
+}
+
+// startPrivsepHelper starts the --privsep helper, sends it cfg, and
+// waits for it to drop its capabilities.
+func startPrivsepHelper(cfg privsepConfig) (*privsepClient, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "privsep"), os.NewFile(uintptr(fds[1]), "privsep-helper")
+	defer theirs.Close()
+	cmd := exec.Command(exe, privsepHelperArg)
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stderr = os.Stderr
+	// Its own process group, so a ^C at the terminal reaches only us.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		ours.Close()
+		return nil, err
+	}
+	fc, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return nil, err
+	}
+	c := fc.(*net.UnixConn)
+	if err := writeFrame(c, cfg, nil); err != nil {
+		return nil, err
+	}
+	var ready privsepReply
+	if _, err := readFrame(c, &ready); err != nil {
+		return nil, err
+	}
+	if ready.Err != "" {
+		return nil, fmt.Errorf("helper: %s", ready.Err)
+	}
+	return &privsepClient{c: c}, nil
+}
+
+// lookupPrivsepUser returns the uid and primary gid of the user name.
+func lookupPrivsepUser(name string) (uid, gid int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	if gid, err = strconv.Atoi(u.Gid); err != nil {
+		return 0, 0, err
+	}
+	if uid == 0 {
+		return 0, 0, fmt.Errorf("%s is root", name)
+	}
+	return uid, gid, nil
+}
+
+// dropToUser gives up root for uid and gid, in every thread.
+func dropToUser(uid, gid int) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("still root after setuid(%d)", uid)
+	}
+	return nil
+}
+
+// dropHelperCapabilities limits the helper to privsepCaps, for itself
+// and everything it runs. Capabilities are per thread, so it locks the
+// serving goroutine to this one for good.
+func dropHelperCapabilities() error {
+	runtime.LockOSThread()
+	keep := map[uintptr]bool{}
+	var mask uint64
+	for _, c := range privsepCaps {
+		keep[c] = true
+		mask |= 1 << c
+	}
+	for c := uintptr(0); c <= unix.CAP_LAST_CAP; c++ {
+		if keep[c] {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("dropping capability %d: %v", c, err)
+		}
+	}
+	// Keep only those we have, as in a container that lacks some.
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var have [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &have[0]); err != nil {
+		return fmt.Errorf("capget: %v", err)
+	}
+	mask &= uint64(have[1].Permitted)<<32 | uint64(have[0].Permitted)
+	data := [2]unix.CapUserData{
+		{Effective: uint32(mask), Permitted: uint32(mask), Inheritable: uint32(mask)},
+		{Effective: uint32(mask >> 32), Permitted: uint32(mask >> 32), Inheritable: uint32(mask >> 32)},
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capset: %v", err)
+	}
+	return unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+}
+
+// ignoreInterrupts keeps the helper running through the signals that
+// stop the parent.
+func ignoreInterrupts() {
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+}
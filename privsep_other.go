@@ -0,0 +1,37 @@
+//go:build !linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "errors"
+
+var errPrivsepUnsupported = errors.New("--privsep is only supported on Linux")
+
+func startPrivsepHelper(cfg privsepConfig) (*privsepClient, error) {
+	return nil, errPrivsepUnsupported
+}
+
+func lookupPrivsepUser(name string) (uid, gid int, err error) {
+	return 0, 0, errPrivsepUnsupported
+}
+
+func dropToUser(uid, gid int) error { return errPrivsepUnsupported }
+
+func dropHelperCapabilities() error { return errPrivsepUnsupported }
+
+func ignoreInterrupts() {}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestPrivsep returns a client connected to a helper serving cfg
+// in this process.
+func newTestPrivsep(t *testing.T, cfg privsepConfig) *privsepClient {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "privsep")
+		fc, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = fc.(*net.UnixConn)
+	}
+	s := &privsepServer{cfg: cfg}
+	go s.serveConn(conns[1])
+	t.Cleanup(func() { conns[0].Close() })
+	return &privsepClient{c: conns[0]}
+}
+
+func TestPrivsepShellStdin(t *testing.T) {
+	if err := checkRootOwned("/bin/sh"); err != nil {
+		t.Skip(err)
+	}
+	const script = `read -r line && echo "got $line for $EMBIGGEN_TEST"`
+	p := newTestPrivsep(t, privsepConfig{Shell: []string{script}})
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = []string{"EMBIGGEN_TEST=notify", "OTHER=x"}
+	cmd.Stdin = strings.NewReader(`{"mountpoint":"/"}` + "\n")
+	cmd.Stdout = &stdout
+	if err := p.Run(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), `got {"mountpoint":"/"} for notify`+"\n"; got != want {
+		t.Errorf("stdout = %q; want %q", got, want)
+	}
+
+	// Without stdin, the command reads nothing rather than hanging.
+	stdout.Reset()
+	cmd = exec.Command("/bin/sh", "-c", script)
+	cmd.Stdout = &stdout
+	if err := p.Run(cmd); err == nil {
+		t.Errorf("read from empty stdin succeeded; output %q", stdout.String())
+	}
+
+	cmd = exec.Command("/bin/sh", "-c", "cat")
+	cmd.Stdin = strings.NewReader("x")
+	if err := p.Run(cmd); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("running a command not in the config: %v; want not allowed", err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// provisionMain implements the "provision" subcommand, which sets up
+// a newly attached blank disk for use: a GPT with one data partition
+// filling it, a filesystem on that, mounted at the given mount point
+// and added to /etc/fstab. It refuses disks with anything on them.
+func provisionMain(args []string) {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	fsType := fs.String("fs", "ext4", "filesystem to make: ext4, xfs, or btrfs")
+	label := fs.String("label", "", "filesystem label")
+	options := fs.String("options", "defaults", "mount options for the filesystem's /etc/fstab entry")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk provision:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] provision [--fs=ext4] [--label=<label>] [--options=defaults] <disk> <mount-point>\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+	}
+	if resize.Sysroot != "" {
+		fatalf("provision sets up disks for the running system; it can't be combined with --sysroot")
+	}
+	p := resize.Provision{
+		Disk:       fs.Arg(0),
+		FSType:     *fsType,
+		Mountpoint: fs.Arg(1),
+		Label:      *label,
+		Options:    *options,
+	}
+	ctx, end, err := beginRun()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer end()
+	if *dry {
+		a, err := p.Plan(ctx)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		for _, s := range a.Steps {
+			dryRunf("would've run: %s", s)
+		}
+		return
+	}
+	if err := p.Run(ctx); err != nil {
+		fatalf("error provisioning %s: %v", p.Disk, err)
+	}
+	fmt.Printf("%s\n", colorize(os.Stdout, colorGreen, fmt.Sprintf("Provisioned %s: made a %s filesystem on it, mounted it at %s, and added it to %s.", p.Disk, p.FSType, p.Mountpoint, resize.FstabPath)))
+}
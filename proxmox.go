@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// onProxmox reports whether we're running in a Proxmox VE (or other
+// QEMU) virtual machine. Proxmox doesn't brand its VMs' DMI data
+// beyond its OVMF build, so any QEMU machine qualifies.
+func onProxmox() bool {
+	return strings.Contains(dmiField("bios_vendor"), "Proxmox") ||
+		dmiField("sys_vendor") == "QEMU"
+}
+
+// proxmoxMain implements the "proxmox" subcommand, for running after
+// "qm resize", for instance with
+//
+//	qm guest exec <vmid> -- embiggen-disk proxmox
+//
+// It rescans the SCSI bus, as virtio-scsi guests don't always see the
+// new size on their own, and then enlarges the given mount points, or
+// by default / and every filesystem on a QEMU disk.
+func proxmoxMain(args []string) {
+	if !onProxmox() {
+		logger.Warn("this doesn't look like a Proxmox virtual machine")
+	}
+	rescanSCSI()
+	time.Sleep(time.Second)
+	mnts := args
+	if len(mnts) == 0 {
+		mnts = rootAndMountsOnDisks(qemuDisks())
+	}
+	if !growAll(mnts) {
+		os.Exit(1)
+	}
+}
+
+// qemuDisks returns the QEMU virtual disks: all virtio-blk disks, and
+// SCSI, SATA, or IDE disks with QEMU's vendor ID.
+func qemuDisks() map[string]bool {
+	disks := map[string]bool{}
+	vds, _ := filepath.Glob("/sys/block/vd*")
+	for _, d := range vds {
+		disks[filepath.Base(d)] = true
+	}
+	vendors, _ := filepath.Glob("/sys/block/*/device/vendor")
+	for _, f := range vendors {
+		if b, err := ioutil.ReadFile(f); err == nil && strings.TrimSpace(string(b)) == "QEMU" {
+			disks[filepath.Base(filepath.Dir(filepath.Dir(f)))] = true
+		}
+	}
+	return disks
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+var (
+	remoteHosts    = flag.String("remote", "", "comma-separated [user@]host list to enlarge the mount point on over ssh, instead of locally, printing one JSON result line per host")
+	remoteBinary   = flag.String("remote-binary", "", "with --remote, the path of embiggen-disk on the hosts; if empty, this binary is copied to each host for the run and removed afterwards")
+	remoteSudo     = flag.Bool("remote-sudo", false, "with --remote, run embiggen-disk on the hosts with sudo -n")
+	remoteSSH      = flag.String("remote-ssh", "ssh -o BatchMode=yes", "with --remote, the ssh command to use, with any options")
+	remoteParallel = flag.Int("remote-parallel", 8, "with --remote, how many hosts to run on at once")
+)
+
+// Flags that are about this invocation, not the remote ones.
+var remoteLocalFlags = []string{"remote", "remote-binary", "remote-sudo", "remote-ssh", "remote-parallel", "dry-run", "json", "events", "color", "version"}
+
+// unameArch maps GOARCH to a sh case pattern matching the "uname -m"
+// of hosts that can run a binary built for it.
+var unameArch = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "i[3-6]86|x86_64",
+	"arm64":   "aarch64|arm64",
+	"arm":     "arm*|aarch64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// remoteResult is one line of --remote output.
+type remoteResult struct {
+	Host   string          `json:"host"`
+	Result json.RawMessage `json:"result,omitempty"` // what "embiggen-disk agent" printed
+	Error  string          `json:"error,omitempty"`
+}
+
+// remoteMain implements --remote: it runs "embiggen-disk agent" over
+// ssh on each host to enlarge, or with --dry-run plan enlarging, mnt,
+// and prints each host's result as one JSON line on stdout as it
+// finishes. The hosts' logs are copied to stderr, prefixed by host.
+func remoteMain(args []string) {
+	if len(args) > 1 {
+		usage()
+	}
+	mnt := "/"
+	if len(args) == 1 {
+		mnt = args[0]
+	}
+	sshCmd := strings.Fields(*remoteSSH)
+	if len(sshCmd) == 0 {
+		fatalf("empty --remote-ssh")
+	}
+	var self []byte
+	if *remoteBinary == "" {
+		if runtime.GOOS != "linux" {
+			fatalf("can't copy this %s binary to Linux hosts; install embiggen-disk on them and use --remote-binary", runtime.GOOS)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			fatalf("finding our binary to copy: %v", err)
+		}
+		if self, err = os.ReadFile(exe); err != nil {
+			fatalf("reading our binary to copy: %v", err)
+		}
+	}
+	op := "resize"
+	if *dry {
+		op = "plan"
+	}
+	agentArgs := append(setFlagArgs(remoteLocalFlags...), "agent", op, mnt)
+
+	var hosts []string
+	for _, h := range strings.Split(*remoteHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	n := *remoteParallel
+	if n < 1 {
+		n = 1
+	}
+	var (
+		wg     sync.WaitGroup
+		outMu  sync.Mutex
+		failed bool
+		sem    = make(chan struct{}, n)
+		out    = json.NewEncoder(os.Stdout)
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			res := runRemote(sshCmd, host, self, agentArgs)
+			outMu.Lock()
+			defer outMu.Unlock()
+			if res.Error != "" {
+				failed = true
+				logger.Error("remote run failed", "host", host, "err", res.Error)
+			}
+			out.Encode(res)
+		}(host)
+	}
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runRemote runs embiggen-disk with args on host over sshCmd, first
+// copying bin there if it's non-nil.
+func runRemote(sshCmd []string, host string, bin []byte, args []string) remoteResult {
+	res := remoteResult{Host: host}
+	var script string
+	var stdin io.Reader
+	if bin == nil {
+		script = remoteCommand(shellQuote([]string{*remoteBinary}), args)
+	} else {
+		arch := unameArch[runtime.GOARCH]
+		if arch == "" {
+			arch = "*"
+		}
+		// One connection: stream the binary into a temp file, run it, and
+		// clean up, however it went.
+		script = fmt.Sprintf(`case "$(uname -s) $(uname -m)" in "Linux "%s) ;; *) echo "embiggen-disk: host is $(uname -s) $(uname -m), not linux/%s; use --remote-binary" >&2; exit 125;; esac
+f=$(mktemp /tmp/embiggen-disk.XXXXXX) || exit 125
+cat >"$f" && chmod 700 "$f" && %s
+rc=$?; rm -f "$f"; exit $rc`, strings.ReplaceAll(arch, "|", `|"Linux "`), runtime.GOARCH, remoteCommand(`"$f"`, args))
+		stdin = bytes.NewReader(bin)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(sshCmd[0], append(sshCmd[1:], host, script)...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	if err := cmd.Start(); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	sc := bufio.NewScanner(stderr)
+	for sc.Scan() {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", host, sc.Text())
+	}
+	err = cmd.Wait()
+
+	if b := bytes.TrimSpace(stdout.Bytes()); json.Valid(b) && len(b) > 0 {
+		res.Result = b
+	}
+	if err != nil {
+		var r struct{ Error string }
+		if json.Unmarshal(res.Result, &r) == nil && r.Error != "" {
+			res.Error = r.Error
+			return res
+		}
+		res.Error = err.Error()
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 255 {
+			res.Error = "ssh failed: " + res.Error
+		}
+	} else if res.Result == nil {
+		res.Error = "no result from the remote embiggen-disk"
+	}
+	return res
+}
+
+// remoteCommand returns the sh command running bin, already quoted,
+// with args, under sudo if --remote-sudo is set.
+func remoteCommand(bin string, args []string) string {
+	cmd := bin + " " + shellQuote(args)
+	if *remoteSudo {
+		cmd = "sudo -n " + cmd
+	}
+	return cmd
+}
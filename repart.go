@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// repartConfigMain implements the "repart-config" subcommand, which
+// writes systemd-repart definitions for the GPT disk holding a mount
+// point, so repart can take over growing it.
+func repartConfigMain(args []string) {
+	fs := flag.NewFlagSet("repart-config", flag.ExitOnError)
+	dir := fs.String("dir", "", "repart.d directory to write the definitions to, such as /etc/repart.d; default is to print them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk repart-config:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] repart-config [--dir=/etc/repart.d] [<mount-point>]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+	}
+	mnt := "/"
+	if fs.NArg() == 1 {
+		mnt = fs.Arg(0)
+	}
+	ctx := context.Background()
+	e, err := resize.FileSystem(ctx, mnt)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	part, err := chainPartition(ctx, e)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if part == "" {
+		fatalf("%s isn't on a partition", mnt)
+	}
+	files, err := resize.RepartDropIns(ctx, part)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if *dir == "" {
+			fmt.Printf("# %s\n%s\n", name, files[name])
+			continue
+		}
+		path := filepath.Join(*dir, name)
+		if *dry {
+			dryRunf("would've written %s", path)
+			continue
+		}
+		if err := os.MkdirAll(*dir, 0755); err != nil {
+			fatalf("%v", err)
+		}
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+}
+
+// chainPartition returns the device of the first partition in the
+// chain of Resizers from e, or "" if there's none.
+func chainPartition(ctx context.Context, e resize.Resizer) (string, error) {
+	if resize.KindOf(e) == resize.KindPartition {
+		return resize.Device(e), nil
+	}
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, dep := range deps {
+		if part, err := chainPartition(ctx, dep); part != "" || err != nil {
+			return part, err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+	"golang.org/x/sys/unix"
+)
+
+// replayMain implements the "replay" subcommand. Given a bundle from
+// collect-diagnostics, it does a --dry-run of the mount points against
+// the machine captured in it rather than this one: the mount table,
+// sysfs, /dev links, and fstab are read from the bundle, and the
+// commands are answered from the recording of them. Nothing on this
+// machine is read or changed, so a maintainer can reproduce how
+// embiggen-disk saw a reporter's disks, and try a fix, without access
+// to them. A command the fix runs that wasn't recorded fails with
+// resize.ErrNotRecorded.
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk replay:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] replay <diagnostics.tar.gz|dir> [<mount-point>...]\n\n")
+		fmt.Fprintf(os.Stderr, "The mount points default to those the diagnostics were collected for.\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+	}
+	dir := fs.Arg(0)
+	if fi, err := os.Stat(dir); err != nil {
+		fatalf("%v", err)
+	} else if !fi.IsDir() {
+		tmp, err := os.MkdirTemp("", "embiggen-disk-replay")
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer os.RemoveAll(tmp)
+		if err := extractBundle(fs.Arg(0), tmp); err != nil {
+			os.RemoveAll(tmp)
+			fatalf("extracting %s: %v", fs.Arg(0), err)
+		}
+		dir = tmp
+	}
+	var m diagManifest
+	if err := readJSONFile(filepath.Join(dir, "manifest.json"), &m); err != nil {
+		fatalf("%s isn't a diagnostics bundle: %v", fs.Arg(0), err)
+	}
+	if m.OS != runtime.GOOS {
+		fatalf("%s was collected on %s; replay it on %s", fs.Arg(0), m.OS, m.OS)
+	}
+	mnts := fs.Args()[1:]
+	if len(mnts) == 0 {
+		mnts = m.Mountpoints
+	}
+	if err := loadSnapshot(dir); err != nil {
+		fatalf("%v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Replaying diagnostics collected %s by %s (kernel %s).\n",
+		m.Time.Local().Format("2006-01-02 15:04:05"), m.Version, m.Kernel)
+	growMainAll(mnts)
+}
+
+// loadSnapshot points the resize package at the machine captured in
+// dir, an extracted diagnostics bundle, for a dry run.
+func loadSnapshot(dir string) error {
+	f, err := os.Open(filepath.Join(dir, "commands.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	recs, err := resize.ReadRecordings(f)
+	if err != nil {
+		return err
+	}
+	var statfs map[string]unix.Statfs_t
+	if err := readJSONFile(filepath.Join(dir, "statfs.json"), &statfs); err != nil {
+		return err
+	}
+	tools := map[string]string{}
+	if err := readJSONFile(filepath.Join(dir, "tools.json"), &tools); err != nil {
+		return err
+	}
+
+	*dry = true
+	*historyFile = ""
+	resize.Snapshot = dir
+	resize.HostRoot = ""
+	resize.Sysroot = ""
+	resize.MountinfoFile = filepath.Join(dir, "proc/self/mountinfo")
+	resize.MountsFile = filepath.Join(dir, "proc/mounts")
+	resize.FstabPath = filepath.Join(dir, "etc/fstab")
+	for i, d := range resize.RepartDirs {
+		resize.RepartDirs[i] = filepath.Join(dir, d)
+	}
+	resize.ToolPaths = tools
+	resize.CommandRunner = resize.NewReplayRunner(recs)
+	resize.Statfs = func(path string, st *unix.Statfs_t) error {
+		s, ok := statfs[path]
+		if !ok {
+			return fmt.Errorf("statfs %s: %w", path, resize.ErrNotRecorded)
+		}
+		*st = s
+		return nil
+	}
+	return nil
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// extractBundle extracts the diagnostics bundle at path into dir,
+// without the top directory its files are in. Only regular files and
+// relative symlinks within dir are extracted.
+func extractBundle(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, name, ok := strings.Cut(hdr.Name, "/")
+		if !ok || !filepath.IsLocal(name) {
+			continue
+		}
+		dst := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(dst, data, 0644); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if !filepath.IsLocal(filepath.Join(filepath.Dir(name), hdr.Linkname)) || filepath.IsAbs(hdr.Linkname) {
+				continue
+			}
+			if err := os.Symlink(hdr.Linkname, dst); err != nil {
+				return err
+			}
+		}
+	}
+}
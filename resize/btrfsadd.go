@@ -0,0 +1,309 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// BtrfsPolicy says how a btrfs filesystem on a partition is grown.
+// With "grow", the default, its partition is grown into the free space
+// after it, and the filesystem resized to fill it. With "add-device",
+// a new partition is created in the free space after the disk's last
+// partition and added to the filesystem with "btrfs device add",
+// leaving the existing partition entries as they are, for layouts
+// where rewriting them is risky.
+var BtrfsPolicy = "grow"
+
+// btrfsMinDevice is the smallest new partition worth adding to a
+// btrfs filesystem; btrfs refuses devices much smaller.
+const btrfsMinDevice = 256 << 20
+
+// A btrfsAddResizer is a btrfs filesystem grown, per BtrfsPolicy
+// "add-device", by adding a new partition on the disk of part, the
+// partition it's on.
+type btrfsAddResizer struct {
+	fs   FSStat
+	part partitionResizer
+}
+
+// btrfsResizer returns the Resizer for the btrfs filesystem fs, as
+// BtrfsPolicy has it.
+func btrfsResizer(ctx context.Context, fs FSStat) (Resizer, error) {
+	e := fsResizer{fs: fs, cmd: []string{"btrfs", "filesystem", "resize", "max", HostPath(fs.FSMountpoint)}}
+	switch BtrfsPolicy {
+	case "grow":
+		return e, nil
+	case "add-device":
+	default:
+		return nil, fmt.Errorf("unknown btrfs policy %q; want grow or add-device", BtrfsPolicy)
+	}
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(deps) == 1 {
+		if p, ok := deps[0].(partitionResizer); ok {
+			return btrfsAddResizer{fs: fs, part: p}, nil
+		}
+	}
+	return nil, fmt.Errorf("btrfs policy add-device: the btrfs filesystem at %s is on %s, not a partition", fs.Mountpoint, fs.Device)
+}
+
+func (e btrfsAddResizer) String() string {
+	return fmt.Sprintf("btrfs filesystem at %s", e.fs.Mountpoint)
+}
+
+func (e btrfsAddResizer) State(ctx context.Context) (string, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (e btrfsAddResizer) Size(ctx context.Context) (int64, error) {
+	st, err := Stat(e.fs.Mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	return st.SizeBytes(), nil
+}
+
+// DepResizers returns nothing: the partition e is on stays as it is.
+func (e btrfsAddResizer) DepResizers(ctx context.Context) ([]Resizer, error) { return nil, nil }
+
+func (e btrfsAddResizer) check(ctx context.Context) error {
+	if e.fs.ReadOnly() {
+		return fmt.Errorf("%v: %w; btrfs can't add a device to it", e, ErrReadOnly)
+	}
+	return nil
+}
+
+// deviceAddCommand returns the command adding dev to e's filesystem.
+func (e btrfsAddResizer) deviceAddCommand(ctx context.Context, dev string) *exec.Cmd {
+	return Command(ctx, "btrfs", "device", "add", dev, HostPath(e.fs.FSMountpoint))
+}
+
+func (e btrfsAddResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	diskDev, pt, part, ok, err := e.part.addedTable(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	if !ok {
+		return Action{CurrentBytes: n, ProposedBytes: n}, nil
+	}
+	var steps []string
+	for _, w := range pt.tool.writeCmds(ctx, diskDev, pt, part) {
+		steps = append(steps, cmdLine(w.cmd, w.stdin))
+	}
+	steps = append(steps, fmt.Sprintf("ioctl(%s, BLKPG, {op: BLKPG_ADD_PARTITION, pno: %d, start: %d, length: %d})",
+		diskDev, part.pno, part.Start()*512, part.Size()*512))
+	if cmd, ok := udevSettleCommand(ctx); ok {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	steps = append(steps, cmdLine(e.deviceAddCommand(ctx, part.dev), nil))
+	return Action{
+		Steps:         steps,
+		CurrentBytes:  n,
+		ProposedBytes: n + part.Size()*512,
+	}, nil
+}
+
+func (e btrfsAddResizer) Resize(ctx context.Context) error {
+	if err := e.check(ctx); err != nil {
+		return err
+	}
+	diskDev, pt, part, ok, err := e.part.addedTable(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	// Keep the table as it is on disk, to check the new one against
+	// and to put back if the kernel won't take the new partition.
+	backup, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return err
+	}
+	write := func(pt *partitionTable) error {
+		for _, w := range pt.tool.writeCmds(ctx, diskDev, pt, part) {
+			cmd := w.cmd
+			cmd.Stdin = bytes.NewReader(w.stdin)
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			if out, err := runCmd(e.String(), cmd); err != nil {
+				return toolError(cmd, out, err)
+			}
+		}
+		return nil
+	}
+	unlock, err := lockDisk(ctx, diskDev)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer unlock()
+		if err := write(pt); err != nil {
+			return err
+		}
+		err := verifyAddedTable(ctx, diskDev, backup, part)
+		if err == nil {
+			if err = addKernelPartition(diskDev, part); err != nil {
+				err = fmt.Errorf("adding %s to the kernel: %v", part.dev, err)
+			}
+		}
+		if err != nil {
+			if rerr := write(backup); rerr != nil {
+				return fmt.Errorf("%v; restoring the previous table also failed: %w", err, rerr)
+			}
+			return fmt.Errorf("%v; restored the previous table", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	if err := partitionResizer(part.dev).waitSettled(ctx, part); err != nil {
+		return err
+	}
+	cmd := e.deviceAddCommand(ctx, part.dev)
+	if out, err := runCmd(e.String(), cmd); err != nil {
+		return fmt.Errorf("new partition %s was created, but adding it to %s failed: %w", part.dev, e.fs.Mountpoint, toolError(cmd, out, err))
+	}
+	return nil
+}
+
+// addedTable returns the partition table of p's disk, diskDev, with a
+// new partition appended in the free space after the disk's last
+// partition, for a btrfs filesystem on p to add, and the new
+// partition's entry. If there's too little free space, ok is false.
+func (p partitionResizer) addedTable(ctx context.Context) (diskDev string, pt *partitionTable, part sfdiskLine, ok bool, err error) {
+	if diskDev, err = DiskOf(ctx, string(p)); err != nil {
+		return
+	}
+	pt, err = getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return
+	}
+	if _, isSfdisk := pt.tool.(sfdiskTool); !isSfdisk {
+		err = fmt.Errorf("adding a partition to %s needs sfdisk, not %s", diskDev, pt.tool.name())
+		return
+	}
+	isGPT, err := partitionTableIsGPT(ctx, diskDev, pt)
+	if err != nil {
+		return
+	}
+	if ss := pt.Meta("sector-size"); ss != "" && ss != "512" {
+		err = fmt.Errorf("%s has %s byte sectors; only 512 byte sectors are supported", diskDev, ss)
+		return
+	}
+	last, ok := pt.lastNonZeroPartition()
+	if !ok {
+		err = fmt.Errorf("no non-zero partition found on %s", diskDev)
+		return
+	}
+	pno := 0
+	for _, sl := range pt.parts {
+		pno = max(pno, sl.pno)
+	}
+	pno++
+	if !isGPT && pno > 4 {
+		err = fmt.Errorf("%s: no free primary partition slot in its MBR for a new partition", diskDev)
+		return
+	}
+	size, err := readInt64File(sysPath("/sys/block/" + filepath.Base(diskDev) + "/size"))
+	if err != nil {
+		return
+	}
+	maxEnd, err := pt.maxEnd(isGPT, size)
+	if err != nil {
+		return
+	}
+	// Start and end on 1 MiB boundaries, as partitioning tools align.
+	const align = (1 << 20) / 512
+	start := (last.Start() + last.Size() + align - 1) / align * align
+	end := maxEnd / align * align
+	if (end-start)*512 < btrfsMinDevice {
+		return diskDev, pt, part, false, nil
+	}
+	typ := "83"
+	if isGPT {
+		typ = linuxGPTTypeID
+	}
+	part = sfdiskLine{
+		dev:  partitionDevice(diskDev, pno),
+		attr: []string{"start=" + strconv.FormatInt(start, 10), "size=" + strconv.FormatInt(end-start, 10), pt.typeKey() + "=" + typ},
+		pno:  pno,
+	}
+	pt.parts = append(pt.parts, part)
+	pt.RemoveMeta("last-lba") // or sfdisk complains
+	return diskDev, pt, part, true, nil
+}
+
+// partitionDevice returns the device of partition pno of the disk
+// diskDev: "/dev/sda3", or, for disks whose names end in a number,
+// "/dev/nvme0n1p3".
+func partitionDevice(diskDev string, pno int) string {
+	if devEndsInNumber(diskDev) {
+		return diskDev + "p" + strconv.Itoa(pno)
+	}
+	return diskDev + strconv.Itoa(pno)
+}
+
+// verifyAddedTable reads back the partition table of diskDev, just
+// written with part added, and checks that it differs from old, the
+// table before the write, only in having part.
+func verifyAddedTable(ctx context.Context, diskDev string, old *partitionTable, part sfdiskLine) error {
+	pt, err := old.tool.readTable(ctx, diskDev)
+	if err != nil {
+		return fmt.Errorf("reading back partition table of %s: %w", diskDev, err)
+	}
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("partition table of %s read back after writing: %s", diskDev, fmt.Sprintf(format, args...))
+	}
+	if len(pt.parts) != len(old.parts)+1 {
+		return bad("has %d partitions, not %d", len(pt.parts), len(old.parts)+1)
+	}
+	if now, was := pt.Meta("label-id"), old.Meta("label-id"); now != was {
+		return bad("disk identifier is %s, not %s", now, was)
+	}
+	for _, was := range old.parts {
+		now, ok := pt.partition(was.dev)
+		if !ok {
+			return bad("lacks %s", was.dev)
+		}
+		if now.String() != was.String() {
+			return bad("%s changed from %q to %q", now.dev, was, now)
+		}
+	}
+	now, ok := pt.partition(part.dev)
+	if !ok {
+		return bad("lacks new partition %s", part.dev)
+	}
+	if now.Start() != part.Start() || now.Size() != part.Size() {
+		return bad("%s is sectors %d+%d, not %d+%d", now.dev, now.Start(), now.Size(), part.Start(), part.Size())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBtrfsAddedTable(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = t.TempDir()
+	dir := filepath.Join(Snapshot, "sys/block/vda")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 40 GiB, grown from the 20 GiB in repartDump.
+	if err := os.WriteFile(filepath.Join(dir, "size"), []byte("83886080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replayRecordings(t, []Recording{
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Err: "exit status 1"},
+		{Args: []string{"sfdisk", "-d", "/dev/vda"}, Stdout: repartDump},
+	})
+	diskDev, pt, part, ok, err := partitionResizer("/dev/vda2").addedTable(context.Background())
+	if err != nil || !ok {
+		t.Fatalf("addedTable = %v, %v", ok, err)
+	}
+	if diskDev != "/dev/vda" || len(pt.parts) != 3 {
+		t.Fatalf("addedTable gave %d partitions on %s; want 3 on /dev/vda", len(pt.parts), diskDev)
+	}
+	// After vda2, aligned, up to the last 1 MiB boundary before the
+	// backup GPT.
+	const start, end = 1050624 + 8388608, 83886080 - 2048
+	if got, want := part.String(), fmt.Sprintf("/dev/vda3 : start=%d, size=%d, type=%s", start, end-start, linuxGPTTypeID); got != want {
+		t.Errorf("new partition = %q; want %q", got, want)
+	}
+	if pt.Meta("last-lba") != "" {
+		t.Errorf("last-lba not removed")
+	}
+}
+
+func TestPartitionDevice(t *testing.T) {
+	for _, tt := range []struct {
+		disk string
+		pno  int
+		want string
+	}{
+		{"/dev/sda", 3, "/dev/sda3"},
+		{"/dev/vdb", 1, "/dev/vdb1"},
+		{"/dev/nvme0n1", 4, "/dev/nvme0n1p4"},
+		{"/dev/mmcblk0", 2, "/dev/mmcblk0p2"},
+	} {
+		if got := partitionDevice(tt.disk, tt.pno); got != tt.want {
+			t.Errorf("partitionDevice(%q, %d) = %q; want %q", tt.disk, tt.pno, got, tt.want)
+		}
+	}
+}
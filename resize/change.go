@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"fmt"
+	"time"
+)
+
+// What a Change did.
+const (
+	ActionGrow   = "grow"
+	ActionShrink = "shrink"
+)
+
+// A Change is one layer's size changing, as returned by Resize and
+// Shrink.
+type Change struct {
+	Resizer     string        `json:"resizer"` // its String, e.g. "LVM PV /dev/sda2"
+	Device      string        `json:"device"`  // see Device
+	Action      string        `json:"action"`  // ActionGrow or ActionShrink
+	BeforeBytes int64         `json:"beforeBytes"`
+	AfterBytes  int64         `json:"afterBytes"`
+	Duration    time.Duration `json:"duration"` // in nanoseconds in JSON
+
+	r Resizer
+
+	// above is the layer r is below in the run that made c, if any,
+	// and aboveSize its size in bytes before that run.
+	above     Resizer
+	aboveSize int64
+}
+
+func newChange(action string, r Resizer, before, after int64, d time.Duration) Change {
+	return Change{
+		Resizer:     r.String(),
+		Device:      Device(r),
+		Action:      action,
+		BeforeBytes: before,
+		AfterBytes:  after,
+		Duration:    d,
+		r:           r,
+	}
+}
+
+// String describes c, e.g. "LVM PV /dev/sda2: 10.0 GiB → 20.0 GiB (+10.0 GiB)".
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s → %s (%s)", c.Resizer, HumanBytes(c.BeforeBytes), HumanBytes(c.AfterBytes), HumanDelta(c.AfterBytes-c.BeforeBytes))
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// MoveSwap lets a partition grow past an encrypted swap partition
+// that follows it, last on its disk, if CrypttabPath sets the swap up
+// with a random key, so it holds nothing worth keeping: the swap is
+// turned off and closed, its partition moved to the end of the disk,
+// and the swap then opened with a new key, formatted, and turned back
+// on, before the partition grows into the space it left.
+var MoveSwap bool
+
+// CrypttabPath is where MoveSwap looks up encrypted swap.
+var CrypttabPath = "/etc/crypttab"
+
+// cryptSwap is a random-key encrypted swap device from crypttab.
+type cryptSwap struct {
+	name    string   // device mapper name, "cryptswap"
+	keyFile string   // "/dev/urandom"
+	opts    []string // "swap", "cipher=aes-xts-plain64", ...
+}
+
+func (s cryptSwap) mapper() string { return "/dev/mapper/" + s.name }
+
+// opt returns the value of crypttab option key, or "".
+func (s cryptSwap) opt(key string) string {
+	for _, o := range s.opts {
+		if v, ok := strings.CutPrefix(o, key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// findCryptSwap returns the crypttab entry setting up random-key swap
+// on the partition dev, if there is one.
+func findCryptSwap(ctx context.Context, dev string) (s cryptSwap, ok bool) {
+	all, err := os.ReadFile(CrypttabPath)
+	if err != nil {
+		return s, false
+	}
+	for _, line := range strings.Split(string(all), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		s := cryptSwap{name: f[0], keyFile: f[2], opts: strings.Split(f[3], ",")}
+		if s.keyFile != "/dev/urandom" && s.keyFile != "/dev/random" {
+			continue
+		}
+		if !slices.Contains(s.opts, "swap") || slices.Contains(s.opts, "luks") {
+			continue
+		}
+		if d, err := resolveDevSpec(ctx, UnescapeMount(f[1])); err == nil && d == dev {
+			return s, true
+		}
+	}
+	return s, false
+}
+
+// active reports whether s is in use as swap.
+func (s cryptSwap) active() bool {
+	all, err := os.ReadFile(sysPath("/proc/swaps"))
+	if err != nil {
+		return false
+	}
+	dm, err := evalSymlinks(s.mapper())
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(all), "\n")[1:] {
+		if f := strings.Fields(line); len(f) > 0 {
+			if d, err := evalSymlinks(UnescapeMount(f[0])); err == nil && d == dm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// closeCmds returns the commands turning off and closing s.
+func (s cryptSwap) closeCmds(ctx context.Context, active bool) []*exec.Cmd {
+	var cmds []*exec.Cmd
+	if active {
+		cmds = append(cmds, Command(ctx, "swapoff", s.mapper()))
+	}
+	return append(cmds, Command(ctx, "cryptsetup", "close", s.name))
+}
+
+// openCmds returns the commands opening s on dev with a new key from
+// its key file, as crypttab would, formatting it, and, if active,
+// turning it on.
+func (s cryptSwap) openCmds(ctx context.Context, dev string, active bool) []*exec.Cmd {
+	args := []string{"open", "--type", "plain", "--key-file", s.keyFile}
+	for _, o := range []struct{ opt, flag string }{
+		{"cipher", "--cipher"},
+		{"size", "--key-size"},
+		{"hash", "--hash"},
+		{"offset", "--offset"},
+		{"sector-size", "--sector-size"},
+	} {
+		if v := s.opt(o.opt); v != "" {
+			args = append(args, o.flag, v)
+		}
+	}
+	args = append(args, dev, s.name)
+	cmds := []*exec.Cmd{
+		Command(ctx, "cryptsetup", args...),
+		Command(ctx, "mkswap", s.mapper()),
+	}
+	if active {
+		cmds = append(cmds, Command(ctx, "swapon", s.mapper()))
+	}
+	return cmds
+}
+
+// A swapMove is the move of a random-key encrypted swap partition to
+// the end of its disk, out of the way of the partition before it.
+type swapMove struct {
+	swap    cryptSwap
+	diskDev string
+	pt      *partitionTable // with part moved
+	part    sfdiskLine      // the swap's entry, moved
+	active  bool            // whether the swap is on
+}
+
+// blockingSwap returns, if MoveSwap is set, the move of the encrypted
+// swap partition following p, last on its disk, to the end of the
+// disk, if that's one with a random key and p could then grow. It
+// returns nil otherwise.
+func (p partitionResizer) blockingSwap(ctx context.Context) (*swapMove, error) {
+	if !MoveSwap {
+		return nil, nil
+	}
+	diskDev, err := DiskOf(ctx, string(p))
+	if err != nil {
+		return nil, err
+	}
+	pt, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return nil, err
+	}
+	part, ok := pt.partition(string(p))
+	if !ok {
+		return nil, nil
+	}
+	next, ok := pt.nextPartition(part)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := pt.nextPartition(next); ok {
+		return nil, nil
+	}
+	sw, ok := findCryptSwap(ctx, next.dev)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := pt.tool.(sfdiskTool); !ok {
+		return nil, fmt.Errorf("moving swap partition %s needs sfdisk, not %s", next.dev, pt.tool.name())
+	}
+	isGPT, err := partitionTableIsGPT(ctx, diskDev, pt)
+	if err != nil {
+		return nil, err
+	}
+	if !isGPT && next.pno > 4 {
+		return nil, fmt.Errorf("can't move swap partition %s: it's an MBR logical partition", next.dev)
+	}
+	if isGPT {
+		if err := checkWritable(next); err != nil {
+			return nil, err
+		}
+	}
+	size, err := readInt64File(sysPath("/sys/block/" + filepath.Base(diskDev) + "/size"))
+	if err != nil {
+		return nil, err
+	}
+	maxEnd, err := pt.maxEnd(isGPT, size)
+	if err != nil {
+		return nil, err
+	}
+	const align = (1 << 20) / 512
+	start := (maxEnd - next.Size()) / align * align
+	if start <= next.Start() {
+		return nil, nil
+	}
+	if err := next.SetStart(start); err != nil {
+		return nil, err
+	}
+	pt.RemoveMeta("last-lba") // or sfdisk complains
+	return &swapMove{swap: sw, diskDev: diskDev, pt: pt, part: next, active: sw.active()}, nil
+}
+
+// steps describes m for an Action.
+func (m *swapMove) steps(ctx context.Context) []string {
+	var steps []string
+	for _, cmd := range m.swap.closeCmds(ctx, m.active) {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	for _, w := range m.pt.tool.writeCmds(ctx, m.diskDev, m.pt, m.part) {
+		steps = append(steps, cmdLine(w.cmd, w.stdin))
+	}
+	steps = append(steps, fmt.Sprintf("ioctl(%s, BLKPG, {op: BLKPG_DEL_PARTITION, pno: %d}), then BLKPG_ADD_PARTITION at %d, length %d",
+		m.diskDev, m.part.pno, m.part.Start()*512, m.part.Size()*512))
+	for _, cmd := range m.swap.openCmds(ctx, m.part.dev, m.active) {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	return steps
+}
+
+// move turns off and closes the swap, moves its partition, and opens
+// it again, even if the move failed.
+func (m *swapMove) move(ctx context.Context) (err error) {
+	stage := partitionResizer(m.part.dev).String()
+	run := func(cmds []*exec.Cmd, stdin []byte) error {
+		for _, cmd := range cmds {
+			if stdin != nil {
+				cmd.Stdin = bytes.NewReader(stdin)
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+			}
+			if out, err := runCmd(stage, cmd); err != nil {
+				return toolError(cmd, out, err)
+			}
+		}
+		return nil
+	}
+	if err := run(m.swap.closeCmds(ctx, m.active), nil); err != nil {
+		return err
+	}
+	defer func() {
+		if oerr := run(m.swap.openCmds(ctx, m.part.dev, m.active), nil); oerr != nil {
+			err = errors.Join(err, fmt.Errorf("re-establishing swap %s: %w", m.swap.name, oerr))
+		}
+	}()
+	// Keep the table as it is on disk, to put back if the kernel
+	// won't take the move.
+	backup, err := getPartitionTable(ctx, m.diskDev)
+	if err != nil {
+		return err
+	}
+	write := func(pt *partitionTable) error {
+		for _, w := range pt.tool.writeCmds(ctx, m.diskDev, pt, m.part) {
+			if err := run([]*exec.Cmd{w.cmd}, w.stdin); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	unlock, err := lockDisk(ctx, m.diskDev)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		defer unlock()
+		if err := write(m.pt); err != nil {
+			return err
+		}
+		if err := moveKernelPartition(m.diskDev, m.part); err != nil {
+			err = fmt.Errorf("moving %s in the kernel: %v", m.part.dev, err)
+			if rerr := write(backup); rerr != nil {
+				return fmt.Errorf("%v; restoring the previous table also failed: %w", err, rerr)
+			}
+			return fmt.Errorf("%v; restored the previous table", err)
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	return partitionResizer(m.part.dev).waitSettled(ctx, m.part)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindCryptSwap(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	defer func(old string) { CrypttabPath = old }(CrypttabPath)
+	Snapshot = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(Snapshot, "dev/disk/by-partuuid"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, dev := range []string{"vda2", "vda3"} {
+		if err := os.WriteFile(filepath.Join(Snapshot, "dev", dev), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../../vda3", filepath.Join(Snapshot, "dev/disk/by-partuuid/0fc63daf-3")); err != nil {
+		t.Fatal(err)
+	}
+	CrypttabPath = filepath.Join(t.TempDir(), "crypttab")
+	if err := os.WriteFile(CrypttabPath, []byte(`# <target> <source> <key file> <options>
+data      /dev/vda2               /etc/keys/data  luks
+tmpcrypt  /dev/vda3               /dev/urandom    tmp
+cryptswap PARTUUID=0FC63DAF-3     /dev/urandom    swap,cipher=aes-xts-plain64,size=512
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if s, ok := findCryptSwap(ctx, "/dev/vda2"); ok {
+		t.Errorf("findCryptSwap(/dev/vda2) = %+v; want none, as its key isn't random", s)
+	}
+	s, ok := findCryptSwap(ctx, "/dev/vda3")
+	if !ok || s.name != "cryptswap" {
+		t.Fatalf("findCryptSwap(/dev/vda3) = %+v, %v; want cryptswap", s, ok)
+	}
+	var got []string
+	for _, cmd := range s.openCmds(ctx, "/dev/vda3", true) {
+		got = append(got, strings.Join(cmd.Args, " "))
+	}
+	want := []string{
+		"cryptsetup open --type plain --key-file /dev/urandom --cipher aes-xts-plain64 --key-size 512 /dev/vda3 cryptswap",
+		"mkswap /dev/mapper/cryptswap",
+		"swapon /dev/mapper/cryptswap",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("openCmds =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// A blockDevClass is what the kernel says a block device is, found
+// from its device number rather than from its name, which may be a
+// symlink or something unusual like "/dev/rootfs".
+type blockDevClass struct {
+	name      string // kernel name, "sda3", "dm-0"
+	major     uint32
+	minor     uint32
+	driver    string // its major's in /proc/devices: "sd", "virtblk", "device-mapper", "blkext", ...
+	partition bool   // whether sysfs says it's a partition
+}
+
+// classifyBlockDevice returns the class of the block device dev, by
+// stat'ing it for its device number, or in a Snapshot, where /dev holds
+// only placeholders, by its sysfs dev attribute.
+func classifyBlockDevice(dev string) (c blockDevClass, err error) {
+	if Snapshot == "" {
+		var st unix.Stat_t
+		if err := unix.Stat(dev, &st); err != nil {
+			return c, err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+			return c, fmt.Errorf("%s isn't a block device", dev)
+		}
+		c.major, c.minor = unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	} else {
+		if d, err := evalSymlinks(dev); err == nil {
+			dev = d
+		}
+		b, err := os.ReadFile(sysPath("/sys/class/block/" + filepath.Base(dev) + "/dev"))
+		if err != nil {
+			return c, err
+		}
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &c.major, &c.minor); err != nil {
+			return c, fmt.Errorf("bogus device number %q for %s", b, dev)
+		}
+	}
+	sys, err := evalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", c.major, c.minor))
+	if err != nil {
+		return c, fmt.Errorf("%w: no block device %d:%d in /sys/dev/block: %v", ErrDeviceNotFound, c.major, c.minor, err)
+	}
+	c.name = filepath.Base(sys)
+	_, err = os.Stat(sysPath(sys + "/partition"))
+	c.partition = err == nil
+	devices, err := os.ReadFile(sysPath("/proc/devices"))
+	if err != nil {
+		return c, err
+	}
+	c.driver = blockDriver(devices, c.major)
+	return c, nil
+}
+
+// blockDriver returns the name /proc/devices, given as devices, lists
+// for the block device major number major, or "" if there's none.
+func blockDriver(devices []byte, major uint32) string {
+	block := false
+	bs := bufio.NewScanner(bytes.NewReader(devices))
+	for bs.Scan() {
+		line := strings.TrimSpace(bs.Text())
+		if strings.HasSuffix(line, "devices:") {
+			block = line == "Block devices:"
+			continue
+		}
+		f := strings.Fields(line)
+		if !block || len(f) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseUint(f[0], 10, 32); err == nil && uint32(n) == major {
+			return f[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const procDevices = `Character devices:
+  1 mem
+  4 tty
+254 gpiochip
+
+Block devices:
+  8 sd
+  9 md
+ 43 nbd
+253 device-mapper
+254 virtblk
+259 blkext
+`
+
+func TestBlockDriver(t *testing.T) {
+	for major, want := range map[uint32]string{8: "sd", 253: "device-mapper", 254: "virtblk", 1: "", 7: ""} {
+		if got := blockDriver([]byte(procDevices), major); got != want {
+			t.Errorf("blockDriver(%d) = %q; want %q", major, got, want)
+		}
+	}
+}
+
+func TestClassifyBlockDevice(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = writeSnapshot(t)
+	files := map[string]string{
+		"proc/devices":                                 procDevices,
+		"sys/devices/virtio1/block/vda/dev":            "254:0\n",
+		"sys/devices/virtio1/block/vda/vda1/dev":       "254:1\n",
+		"sys/devices/virtio1/block/vda/vda1/partition": "1\n",
+	}
+	for name, data := range files {
+		p := filepath.Join(Snapshot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"sys/dev/block/254:0": "../../devices/virtio1/block/vda",
+		"sys/dev/block/254:1": "../../devices/virtio1/block/vda/vda1",
+		"dev/rootfs":          "vda1",
+	}
+	for name, target := range links {
+		p := filepath.Join(Snapshot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := classifyBlockDevice("/dev/rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (blockDevClass{name: "vda1", major: 254, minor: 1, driver: "virtblk", partition: true}); c != want {
+		t.Errorf("classifyBlockDevice(/dev/rootfs) = %+v; want %+v", c, want)
+	}
+	c, err = classifyBlockDevice("/dev/vda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.name != "vda" || c.partition {
+		t.Errorf("classifyBlockDevice(/dev/vda) = %+v; want the whole disk vda", c)
+	}
+	deps, err := fsResizer{fs: FSStat{Device: "/dev/disk/by-uuid/f00d"}}.DepResizers(context.Background())
+	if err != nil || len(deps) != 1 || deps[0] != partitionResizer("/dev/vda1") {
+		t.Errorf("DepResizers = %v, %v; want partition /dev/vda1", deps, err)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Disks, if non-empty, are the whole disks, like "/dev/sdb", whose
+// free space growing may use, when several qualify, as with the PVs of
+// a volume group spanning disks: only the PVs on them are grown, and
+// lvextend allocates only from those. Set it with ResolveDisk's
+// results.
+var Disks []string
+
+// ResolveDisk returns the whole disk named by spec: a path in /dev,
+// such as a /dev/disk/by-id link, or the disk's WWN or serial number
+// as lsblk reports them.
+func ResolveDisk(ctx context.Context, spec string) (string, error) {
+	if strings.HasPrefix(spec, "/dev/") {
+		dev, err := evalSymlinks(spec)
+		if err != nil {
+			return "", fmt.Errorf("disk %s: %w", spec, ErrDeviceNotFound)
+		}
+		if d := lookupBlockDevice(ctx, dev); d != nil && d.Type != "disk" {
+			return "", fmt.Errorf("%s is a %s, not a whole disk", spec, d.Type)
+		}
+		return dev, nil
+	}
+	out, err := query(ctx, Command(ctx, "lsblk", "-d", "-n", "-P", "-o", "NAME,SERIAL,WWN"))
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, d := range parseLsblkPairs(out) {
+		if d["NAME"] == "" {
+			continue
+		}
+		if sameWWN(d["WWN"], spec) || d["SERIAL"] != "" && d["SERIAL"] == spec {
+			found = append(found, "/dev/"+d["NAME"])
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no disk has WWN or serial number %q: %w", spec, ErrDeviceNotFound)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("several disks have WWN or serial number %q: %s", spec, strings.Join(found, ", "))
+}
+
+// sameWWN reports whether a, a WWN as lsblk reports it, like
+// "0x5000c500a1b2c3d4", is the WWN b, which may be written with or
+// without the "0x", or with a "naa." or "eui." prefix as in some
+// /dev/disk/by-id names.
+func sameWWN(a, b string) bool {
+	norm := func(s string) string {
+		s = strings.ToLower(s)
+		for _, p := range []string{"0x", "naa.", "eui.", "wwn-0x"} {
+			s = strings.TrimPrefix(s, p)
+		}
+		return s
+	}
+	return a != "" && norm(a) == norm(b)
+}
+
+// parseLsblkPairs parses the output of lsblk -P: a line per device
+// of KEY="value" pairs.
+func parseLsblkPairs(out []byte) []map[string]string {
+	var devs []map[string]string
+	for _, line := range strings.Split(string(out), "\n") {
+		d := map[string]string{}
+		for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+			k, rest, ok := strings.Cut(line, `="`)
+			if !ok {
+				break
+			}
+			v, rest, ok := strings.Cut(rest, `"`)
+			if !ok {
+				break
+			}
+			d[k], line = v, rest
+		}
+		if len(d) > 0 {
+			devs = append(devs, d)
+		}
+	}
+	return devs
+}
+
+// onSelectedDisk reports whether dev, such as a PV, is on one of
+// Disks, or true if Disks is empty.
+func onSelectedDisk(ctx context.Context, dev string) bool {
+	if len(Disks) == 0 {
+		return true
+	}
+	for _, disk := range disksUnder(ctx, dev) {
+		for _, sel := range Disks {
+			if disk == sel {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// disksUnder returns the whole disks dev is on: itself if it's a disk,
+// the disk holding it if it's a partition, or, per lsblk, those below
+// it if it's built on others, as a dm-crypt or RAID device is.
+func disksUnder(ctx context.Context, dev string) []string {
+	if d, err := evalSymlinks(dev); err == nil {
+		dev = d
+	}
+	devs, err := Topology(ctx)
+	if err != nil {
+		if disk, ok := sysfsDiskOf(dev); ok {
+			return []string{disk}
+		}
+		if isPartitionDev(dev) {
+			if disk, err := DiskDevice(dev); err == nil {
+				return []string{disk}
+			}
+		}
+		return []string{dev}
+	}
+	kname := filepath.Base(dev)
+	var disks []string
+	for _, d := range devs {
+		if d.KName == kname || findBlockDevice(d.Children, kname) != nil {
+			disks = append(disks, "/dev/"+d.KName)
+		}
+	}
+	if len(disks) == 0 {
+		return []string{dev}
+	}
+	return disks
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const lsblkDisksSerialWWN = `NAME="vda" SERIAL="boot-disk" WWN=""
+NAME="sdb" SERIAL="data-1" WWN="0x5000c500a1b2c3d4"
+NAME="sdc" SERIAL="data-2" WWN="0x5000c500a1b2c3d5"
+NAME="sdd" SERIAL="data-2" WWN=""
+`
+
+func TestResolveDisk(t *testing.T) {
+	lsblk := Recording{Args: []string{"lsblk", "-d", "-n", "-P", "-o", "NAME,SERIAL,WWN"}, Stdout: lsblkDisksSerialWWN}
+	replayRecordings(t, []Recording{lsblk, lsblk, lsblk, lsblk, lsblk})
+	ctx := context.Background()
+	for spec, want := range map[string]string{
+		"data-1":               "/dev/sdb",
+		"0x5000c500a1b2c3d5":   "/dev/sdc",
+		"5000C500A1B2C3D5":     "/dev/sdc",
+		"naa.5000c500a1b2c3d4": "/dev/sdb",
+	} {
+		if got, err := ResolveDisk(ctx, spec); err != nil || got != want {
+			t.Errorf("ResolveDisk(%q) = %q, %v; want %q", spec, got, err, want)
+		}
+	}
+	if got, err := ResolveDisk(ctx, "data-2"); err == nil {
+		t.Errorf("ResolveDisk(data-2) = %q; want an error, as two disks have that serial", got)
+	}
+	if _, err := ResolveDisk(ctx, "/dev/disk/by-id/no-such-disk"); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("ResolveDisk(missing link) = %v; want ErrDeviceNotFound", err)
+	}
+}
+
+// lsblkTwoPVDisks is lsblk -J output for a VM whose datavg spans the
+// whole disks vdb and vdc.
+const lsblkTwoPVDisks = `{
+   "blockdevices": [
+      {"name":"vda", "kname":"vda", "pkname":null, "type":"disk", "maj:min":"254:0", "fstype":null, "mountpoint":null,
+         "children": [
+            {"name":"vda2", "kname":"vda2", "pkname":"vda", "type":"part", "maj:min":"254:2", "fstype":"LVM2_member", "mountpoint":null}
+         ]
+      },
+      {"name":"vdb", "kname":"vdb", "pkname":null, "type":"disk", "maj:min":"254:16", "fstype":"LVM2_member", "mountpoint":null,
+         "children": [
+            {"name":"datavg-data", "kname":"dm-1", "pkname":"vdb", "type":"lvm", "maj:min":"253:1", "fstype":"ext4", "mountpoint":"/data"}
+         ]
+      },
+      {"name":"vdc", "kname":"vdc", "pkname":null, "type":"disk", "maj:min":"254:32", "fstype":"LVM2_member", "mountpoint":null,
+         "children": [
+            {"name":"datavg-data", "kname":"dm-1", "pkname":"vdc", "type":"lvm", "maj:min":"253:1", "fstype":"ext4", "mountpoint":"/data"}
+         ]
+      }
+   ]
+}`
+
+func TestLVExtendSelectedDisks(t *testing.T) {
+	defer func(old []string) { Disks = old }(Disks)
+	Disks = []string{"/dev/vdc"}
+	replayRecordings(t, []Recording{
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-data"}, Stdout: "  /dev/datavg/data:datavg:3:1:-1:1:41926656:5118:-1:0:-1:254:0\n"},
+		{Args: []string{"pvdisplay", "-c"}, Stdout: "  /dev/vda2:rootvg:20969472:-1:8:8:-1:4096:2559:0:2559:x\n" +
+			"  /dev/vdb:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:y\n" +
+			"  /dev/vdc:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:z\n"},
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Stdout: lsblkTwoPVDisks},
+	})
+	ctx := withQueryCache(context.Background())
+	r := lvResizer("/dev/mapper/datavg-data")
+	deps, err := r.DepResizers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0] != pvResizer("/dev/vdc") {
+		t.Errorf("DepResizers = %v; want only the PV on /dev/vdc", deps)
+	}
+	cmd, err := r.extendCmd(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(cmd.Args[1:], " "), "-l +100%PVS /dev/mapper/datavg-data /dev/vdc"; got != want {
+		t.Errorf("lvextend args = %q; want %q", got, want)
+	}
+
+	Disks = []string{"/dev/vda"}
+	if _, err := r.DepResizers(ctx); !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("with no PV on the disk, DepResizers error = %v; want ErrDeviceNotFound", err)
+	}
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A Share is one filesystem's part of the space its LVM volume group
+// gains, for Distribute: a fixed number of bytes, a percentage of the
+// VG's free space, or a weight by which it splits what the VG's other
+// shares leave.
+type Share struct {
+	// Resizer is the filesystem, from FileSystem, on an LV, or the
+	// LV itself, from NewLVResizer, if it has none.
+	Resizer Resizer
+
+	Bytes   int64   // rounded down to whole extents
+	Percent float64 // 0 to 100; used if Bytes is 0
+	Weight  float64 // used if Bytes and Percent are 0
+}
+
+// Distribute grows the PVs, and the partitions below them, of the
+// volume groups of shares' LVs, and then splits each VG's free extents
+// among its LVs by their shares, growing each LV by its part and its
+// filesystem to fill it. A VG's fixed and percentage shares must fit
+// in its free space; what they leave is split among its weighted
+// shares, if any, or else left free. It calls h's hooks along the way and returns each
+// change made. Unlike Resize, it doesn't undo the PVs' growth if a
+// later layer fails.
+func Distribute(ctx context.Context, shares []Share, h *Hooks) (changes []Change, err error) {
+	ctx = withQueryCache(ctx)
+	type vgShares struct {
+		lvs            []lvResizer
+		shares         []Share
+		percent, total float64 // sums of the percents and weights
+	}
+	byVG := map[string]*vgShares{}
+	var vgs []string // in order
+	for _, s := range shares {
+		lv, err := shareLV(ctx, s.Resizer)
+		if err != nil {
+			return nil, err
+		}
+		st, err := lv.state(ctx)
+		if err != nil {
+			return nil, err
+		}
+		g := byVG[st.vg]
+		if g == nil {
+			g = new(vgShares)
+			byVG[st.vg] = g
+			vgs = append(vgs, st.vg)
+		}
+		if slices.Contains(g.lvs, lv) {
+			return nil, fmt.Errorf("%v is given more than one share", lv)
+		}
+		g.lvs = append(g.lvs, lv)
+		g.shares = append(g.shares, s)
+		switch {
+		case s.Bytes > 0:
+		case s.Percent > 0:
+			g.percent += s.Percent
+		default:
+			g.total += s.Weight
+		}
+	}
+	for _, vg := range vgs {
+		g := byVG[vg]
+		if g.percent > 100.01 {
+			return nil, fmt.Errorf("shares of volume group %s add up to %.0f%%, over 100%%", vg, g.percent)
+		}
+	}
+	for _, vg := range vgs {
+		g := byVG[vg]
+		// Every LV in the VG has the same PVs below it.
+		pvs, err := g.lvs[0].DepResizers(ctx)
+		if err != nil {
+			return changes, err
+		}
+		for _, pv := range pvs {
+			c, err := resize(ctx, pv, h)
+			changes = append(changes, c...)
+			if err != nil {
+				return changes, err
+			}
+		}
+		free, extentBytes, err := vgFree(ctx, vg)
+		if err != nil {
+			return changes, err
+		}
+		if DryRun {
+			// The PVs didn't grow; count what they would've.
+			for _, pv := range pvs {
+				if grow, err := pvGrowth(ctx, Device(pv)); err == nil && extentBytes > 0 {
+					free += grow / extentBytes
+				}
+			}
+		}
+		extents := make([]int64, len(g.shares))
+		var used int64 // by the fixed and percentage shares
+		for i, s := range g.shares {
+			switch {
+			case s.Bytes > 0:
+				extents[i] = s.Bytes / extentBytes
+			case s.Percent > 0:
+				extents[i] = int64(float64(free) * s.Percent / 100)
+			}
+			used += extents[i]
+		}
+		if used > free {
+			return changes, fmt.Errorf("%w: shares of volume group %s need %s, but it has %s free", ErrNoFreeSpace, vg, HumanBytes(used*extentBytes), HumanBytes(free*extentBytes))
+		}
+		for i, s := range g.shares {
+			if s.Bytes == 0 && s.Percent == 0 && g.total > 0 {
+				extents[i] = int64(float64(free-used) * s.Weight / g.total)
+			}
+		}
+		for i, s := range g.shares {
+			lv := lvShareResizer{lv: g.lvs[i], extents: extents[i], extentBytes: extentBytes}
+			if lv.extents > 0 {
+				c, err := resizeAlone(ctx, lv, h)
+				changes = append(changes, c...)
+				if err != nil {
+					return changes, err
+				}
+			}
+			if _, raw := s.Resizer.(lvResizer); raw {
+				continue
+			}
+			c, err := resizeAlone(ctx, s.Resizer, h)
+			changes = append(changes, c...)
+			if err != nil {
+				return changes, err
+			}
+		}
+	}
+	return changes, nil
+}
+
+// resizeAlone resizes e but not its dependencies, like resize.
+func resizeAlone(ctx context.Context, e Resizer, h *Hooks) ([]Change, error) {
+	h.enter(e)
+	if c, ok := e.(checker); ok {
+		if err := c.check(ctx); err != nil {
+			return nil, err
+		}
+	}
+	n0, err := e.Size(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resizeOne(ctx, e, h, n0)
+}
+
+// shareLV returns the LV below the filesystem e, or e itself if it's
+// an LV.
+func shareLV(ctx context.Context, e Resizer) (lvResizer, error) {
+	if lv, ok := e.(lvResizer); ok {
+		return lv, nil
+	}
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(deps) == 1 {
+		if lv, ok := deps[0].(lvResizer); ok {
+			return lv, nil
+		}
+	}
+	return "", fmt.Errorf("%v isn't on an LVM logical volume, so can't be given a share of one's volume group", e)
+}
+
+// vgFree returns the number of free extents in the volume group vg,
+// and their size in bytes.
+func vgFree(ctx context.Context, vg string) (free, extentBytes int64, err error) {
+	out, err := query(ctx, Command(ctx, "vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free_count,vg_extent_size", vg))
+	if err != nil {
+		return 0, 0, err
+	}
+	f := strings.Fields(string(out))
+	if len(f) < 2 {
+		return 0, 0, fmt.Errorf("unexpected vgs output for %s: %q", vg, out)
+	}
+	free, err = strconv.ParseInt(f[len(f)-2], 10, 64)
+	if err == nil {
+		extentBytes, err = strconv.ParseInt(f[len(f)-1], 10, 64)
+	}
+	if err != nil || extentBytes <= 0 {
+		return 0, 0, fmt.Errorf("unexpected vgs output for %s: %q", vg, out)
+	}
+	return free, extentBytes, nil
+}
+
+// lvShareResizer grows an LV by a fixed number of extents, its share
+// of its VG's free space, and nothing below it.
+type lvShareResizer struct {
+	lv          lvResizer
+	extents     int64
+	extentBytes int64
+}
+
+func (r lvShareResizer) String() string { return r.lv.String() }
+
+func (r lvShareResizer) State(ctx context.Context) (string, error) { return r.lv.State(ctx) }
+
+func (r lvShareResizer) Size(ctx context.Context) (int64, error) { return r.lv.Size(ctx) }
+
+func (r lvShareResizer) DepResizers(ctx context.Context) ([]Resizer, error) { return nil, nil }
+
+func (r lvShareResizer) check(ctx context.Context) error { return r.lv.check(ctx) }
+
+func (r lvShareResizer) command(ctx context.Context) []string {
+	return []string{"lvextend", "-l", fmt.Sprintf("+%d", r.extents), string(r.lv)}
+}
+
+func (r lvShareResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	args := r.command(ctx)
+	return Action{
+		Steps:         []string{cmdLine(Command(ctx, args[0], args[1:]...), nil)},
+		CurrentBytes:  n,
+		ProposedBytes: n + r.extents*r.extentBytes,
+	}, nil
+}
+
+func (r lvShareResizer) Resize(ctx context.Context) error {
+	args := r.command(ctx)
+	cmd := Command(ctx, args[0], args[1:]...)
+	out, err := runCmd(r.String(), cmd)
+	if err != nil {
+		if strings.Contains(string(out), "Insufficient free space") {
+			return fmt.Errorf("%w in volume group of %s: %w", ErrNoFreeSpace, string(r.lv), toolError(cmd, out, err))
+		}
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+// ParseShares parses a --distribute spec, comma-separated
+// mountpoint=share pairs, each share a percentage like "60%" or a
+// weight like "3", into the mount points and their shares, whose
+// Resizers are left for the caller to fill in.
+func ParseShares(spec string) (mnts []string, shares []Share, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		mnt, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		num, isPct := strings.CutSuffix(v, "%")
+		f, err := strconv.ParseFloat(num, 64)
+		if !ok || mnt == "" || err != nil || f <= 0 || isPct && f > 100 {
+			return nil, nil, fmt.Errorf("bad share %q; want mountpoint=percent%% or mountpoint=weight", part)
+		}
+		var s Share
+		if isPct {
+			s.Percent = f
+		} else {
+			s.Weight = f
+		}
+		mnts = append(mnts, mnt)
+		shares = append(shares, s)
+	}
+	return mnts, shares, nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeFS is a filesystem on the LV lv that grows with it.
+type fakeFS struct{ lv string }
+
+func (f fakeFS) String() string                            { return "filesystem on " + f.lv }
+func (f fakeFS) State(ctx context.Context) (string, error) { return "", nil }
+func (f fakeFS) Size(ctx context.Context) (int64, error)   { return NewLVResizer(f.lv).Size(ctx) }
+func (f fakeFS) Plan(ctx context.Context) (Action, error)  { return Action{}, nil }
+func (f fakeFS) Resize(ctx context.Context) error          { return nil }
+func (f fakeFS) DepResizers(ctx context.Context) ([]Resizer, error) {
+	return []Resizer{NewLVResizer(f.lv)}, nil
+}
+
+func TestDistribute(t *testing.T) {
+	const (
+		pvBefore = "  /dev/vdb:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:x\n"
+		pvAfter  = "  /dev/vdb:datavg:41943040:-1:8:8:-1:4096:5119:2560:2559:x\n"
+		aBefore  = "  /dev/datavg/a:datavg:3:1:-1:1:8388608:1024:-1:0:-1:254:0\n"
+		aAfter   = "  /dev/datavg/a:datavg:3:1:-1:1:24117248:2944:-1:0:-1:254:0\n"
+		bBefore  = "  /dev/datavg/b:datavg:3:1:-1:1:8388608:1024:-1:0:-1:254:1\n"
+		bAfter   = "  /dev/datavg/b:datavg:3:1:-1:1:13631488:1664:-1:0:-1:254:1\n"
+	)
+	replayRecordings(t, []Recording{
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-a"}, Stdout: aBefore},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-b"}, Stdout: bBefore},
+		{Args: []string{"pvdisplay", "-c"}, Stdout: pvBefore},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pvBefore},
+		{Args: []string{"pvresize", "/dev/vdb"}},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pvAfter},
+		{Args: []string{"vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free_count,vg_extent_size", "datavg"}, Stdout: "  2560 4194304\n"},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-a"}, Stdout: aBefore},
+		{Args: []string{"lvextend", "-l", "+1920", "/dev/mapper/datavg-a"}},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-a"}, Stdout: aAfter},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-b"}, Stdout: bBefore},
+		{Args: []string{"lvextend", "-l", "+640", "/dev/mapper/datavg-b"}},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-b"}, Stdout: bAfter},
+	})
+	changes, err := Distribute(context.Background(), []Share{
+		{Resizer: fakeFS{"/dev/mapper/datavg-a"}, Weight: 3},
+		{Resizer: fakeFS{"/dev/mapper/datavg-b"}, Percent: 25},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"LVM PV /dev/vdb: 10.0 GiB → 20.0 GiB (+10.0 GiB)",
+		"LVM LV /dev/mapper/datavg-a: 4.0 GiB → 11.5 GiB (+7.5 GiB)",
+		"LVM LV /dev/mapper/datavg-b: 4.0 GiB → 6.5 GiB (+2.5 GiB)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDistributeBytesToRawLV(t *testing.T) {
+	const (
+		pv     = "  /dev/vdb:datavg:41943040:-1:8:8:-1:4096:5119:2560:2559:x\n"
+		before = "  /dev/datavg/vm1:datavg:3:1:-1:1:8388608:1024:-1:0:-1:254:0\n"
+		after  = "  /dev/datavg/vm1:datavg:3:1:-1:1:9437184:1152:-1:0:-1:254:0\n"
+	)
+	replayRecordings(t, []Recording{
+		{Args: []string{"lvdisplay", "-c", "/dev/datavg/vm1"}, Stdout: before},
+		{Args: []string{"pvdisplay", "-c"}, Stdout: pv},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pv},
+		{Args: []string{"pvresize", "/dev/vdb"}},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pv},
+		{Args: []string{"vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free_count,vg_extent_size", "datavg"}, Stdout: "  2560 4194304\n"},
+		{Args: []string{"lvdisplay", "-c", "/dev/datavg/vm1"}, Stdout: before},
+		{Args: []string{"lvextend", "-l", "+128", "/dev/datavg/vm1"}},
+		{Args: []string{"lvdisplay", "-c", "/dev/datavg/vm1"}, Stdout: after},
+	})
+	// 512 MiB and a bit, which rounds down to 128 extents.
+	changes, err := Distribute(context.Background(), []Share{
+		{Resizer: NewLVResizer("/dev/datavg/vm1"), Bytes: 512<<20 + 1},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].String() != "LVM LV /dev/datavg/vm1: 4.0 GiB → 4.5 GiB (+512.0 MiB)" {
+		t.Errorf("changes = %q", changes)
+	}
+}
+
+func TestDistributeOverCommitted(t *testing.T) {
+	const pv = "  /dev/vdb:datavg:41943040:-1:8:8:-1:4096:5119:2560:2559:x\n"
+	replayRecordings(t, []Recording{
+		{Args: []string{"lvdisplay", "-c", "/dev/datavg/vm1"}, Stdout: "  /dev/datavg/vm1:datavg:3:1:-1:1:8388608:1024:-1:0:-1:254:0\n"},
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-a"}, Stdout: "  /dev/datavg/a:datavg:3:1:-1:1:8388608:1024:-1:0:-1:254:0\n"},
+		{Args: []string{"pvdisplay", "-c"}, Stdout: pv},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pv},
+		{Args: []string{"pvresize", "/dev/vdb"}},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: pv},
+		{Args: []string{"vgs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free_count,vg_extent_size", "datavg"}, Stdout: "  2560 4194304\n"},
+	})
+	_, err := Distribute(context.Background(), []Share{
+		{Resizer: NewLVResizer("/dev/datavg/vm1"), Bytes: 5 << 30},
+		{Resizer: fakeFS{"/dev/mapper/datavg-a"}, Percent: 60},
+	}, nil)
+	if !errors.Is(err, ErrNoFreeSpace) {
+		t.Errorf("Distribute error = %v; want ErrNoFreeSpace", err)
+	}
+}
+
+func TestParseShares(t *testing.T) {
+	mnts, shares, err := ParseShares("/var=60%, /home=2,/srv=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/var", "/home", "/srv"}; !reflect.DeepEqual(mnts, want) {
+		t.Errorf("mount points = %q; want %q", mnts, want)
+	}
+	if want := []Share{{Percent: 60}, {Weight: 2}, {Weight: 1}}; !reflect.DeepEqual(shares, want) {
+		t.Errorf("shares = %+v; want %+v", shares, want)
+	}
+	for _, bad := range []string{"", "/var", "/var=", "=50%", "/var=-1", "/var=150%", "/var=x%"} {
+		if _, _, err := ParseShares(bad); err == nil {
+			t.Errorf("ParseShares(%q) succeeded", bad)
+		}
+	}
+}
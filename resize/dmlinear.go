@@ -0,0 +1,261 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A dmLinearResizer grows a device mapper device made only of linear
+// targets, as some appliances set up by hand with dmsetup rather than
+// with LVM, by extending its last target to the end of the device
+// below it and swapping in the new table with dmsetup load and resume.
+type dmLinearResizer string // "/dev/mapper/appliance-root"
+
+func (r dmLinearResizer) String() string { return fmt.Sprintf("dm-linear device %s", string(r)) }
+
+// A dmTarget is one line of a device mapper table.
+type dmTarget struct {
+	start, length int64    // in 512-byte sectors
+	typ           string   // "linear"
+	args          []string // for linear, the device ("8:3") and its offset in sectors
+}
+
+func (t dmTarget) String() string {
+	return fmt.Sprintf("%d %d %s %s", t.start, t.length, t.typ, strings.Join(t.args, " "))
+}
+
+// parseDMTable parses the output of dmsetup table dev.
+func parseDMTable(dev string, out []byte) ([]dmTarget, error) {
+	var tt []dmTarget
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 3 {
+			return nil, fmt.Errorf("bogus line in dmsetup table %s output: %q", dev, line)
+		}
+		t := dmTarget{typ: f[2], args: f[3:]}
+		var err error
+		if t.start, err = strconv.ParseInt(f[0], 10, 64); err != nil || t.start < 0 {
+			return nil, fmt.Errorf("bogus start in dmsetup table %s output: %q", dev, line)
+		}
+		if t.length, err = strconv.ParseInt(f[1], 10, 64); err != nil || t.length <= 0 {
+			return nil, fmt.Errorf("bogus length in dmsetup table %s output: %q", dev, line)
+		}
+		if len(tt) > 0 {
+			if prev := tt[len(tt)-1]; t.start != prev.start+prev.length {
+				return nil, fmt.Errorf("dmsetup table %s output has a gap or overlap at sector %d", dev, t.start)
+			}
+		}
+		tt = append(tt, t)
+	}
+	if len(tt) == 0 {
+		return nil, fmt.Errorf("dmsetup table %s reported no targets", dev)
+	}
+	return tt, nil
+}
+
+// linearOffset returns the offset in sectors of linear target t on its
+// device.
+func (t dmTarget) linearOffset() (int64, error) {
+	if t.typ != "linear" || len(t.args) != 2 {
+		return 0, fmt.Errorf("not a linear target: %q", t)
+	}
+	off, err := strconv.ParseInt(t.args[1], 10, 64)
+	if err != nil || off < 0 {
+		return 0, fmt.Errorf("bogus offset in linear target %q", t)
+	}
+	return off, nil
+}
+
+func (r dmLinearResizer) table(ctx context.Context) ([]dmTarget, error) {
+	dev := string(r)
+	out, err := query(ctx, Command(ctx, "dmsetup", "table", dev))
+	if err != nil {
+		return nil, err
+	}
+	return parseDMTable(dev, out)
+}
+
+// isDMLinear reports whether dmsetup says the device mapper device dev
+// is made only of linear targets.
+func isDMLinear(ctx context.Context, dev string) bool {
+	tt, err := dmLinearResizer(dev).table(ctx)
+	if err != nil {
+		vlogf("isDMLinear(%q): %v", dev, err)
+		return false
+	}
+	for _, t := range tt {
+		if _, err := t.linearOffset(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// backing returns the device below the last of targets tt, which
+// dmsetup names by its "major:minor" numbers, as a /dev path.
+func backing(tt []dmTarget) (string, error) {
+	dev := tt[len(tt)-1].args[0]
+	if strings.HasPrefix(dev, "/dev/") {
+		return dev, nil
+	}
+	link, err := os.Readlink(sysPath("/sys/dev/block/" + dev))
+	if err != nil {
+		return "", fmt.Errorf("finding block device %s: %w", dev, err)
+	}
+	return "/dev/" + filepath.Base(link), nil
+}
+
+func (r dmLinearResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r dmLinearResizer) Size(ctx context.Context) (int64, error) { return blockDevSize(string(r)) }
+
+func (r dmLinearResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	tt, err := r.table(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := backing(tt)
+	if err != nil {
+		return nil, err
+	}
+	if dep, err := registeredDevice(ctx, dev); dep != nil || err != nil {
+		return deps(dep), err
+	}
+	if d := lookupBlockDevice(ctx, dev); d != nil {
+		switch d.Type {
+		case "part":
+			return []Resizer{partitionResizer(dev)}, nil
+		case "disk":
+			return deps(hypervDisk(dev)), nil
+		}
+		return nil, nil
+	}
+	if isPartitionDev(dev) {
+		return []Resizer{partitionResizer(dev)}, nil
+	}
+	return nil, nil
+}
+
+// growth returns the commands loading and resuming the table with the
+// last target extended to the end of its device, the table, and the
+// device's size after, or ok false if the device below has no more
+// room.
+func (r dmLinearResizer) growth(ctx context.Context) (cmds []*exec.Cmd, table []byte, newSize int64, ok bool, err error) {
+	tt, err := r.table(ctx)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	last := &tt[len(tt)-1]
+	off, err := last.linearOffset()
+	if err != nil {
+		return nil, nil, 0, false, fmt.Errorf("%v: %w", r, err)
+	}
+	dev, err := backing(tt)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	n, err := blockDevSize(dev)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	length := n/512 - off
+	if length <= last.length {
+		return nil, nil, 0, false, nil
+	}
+	last.length = length
+	var buf bytes.Buffer
+	for _, t := range tt {
+		fmt.Fprintln(&buf, t)
+	}
+	cmds = []*exec.Cmd{
+		Command(ctx, "dmsetup", "load", string(r)),
+		Command(ctx, "dmsetup", "resume", string(r)),
+	}
+	return cmds, buf.Bytes(), (last.start + length) * 512, true, nil
+}
+
+func (r dmLinearResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	cmds, table, newSize, ok, err := r.growth(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	if !ok {
+		return Action{CurrentBytes: n, ProposedBytes: n}, nil
+	}
+	return Action{
+		Steps:         []string{cmdLine(cmds[0], table), cmdLine(cmds[1], nil)},
+		CurrentBytes:  n,
+		ProposedBytes: newSize,
+	}, nil
+}
+
+func (r dmLinearResizer) Resize(ctx context.Context) error {
+	cmds, table, newSize, ok, err := r.growth(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	n, err := r.Size(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkGrowth(r, n, newSize); err != nil {
+		return err
+	}
+	load, resume := cmds[0], cmds[1]
+	load.Stdin = bytes.NewReader(table)
+	if out, err := runCmd(r.String(), load); err != nil {
+		return toolError(load, out, err)
+	}
+	if out, err := runCmd(r.String(), resume); err != nil {
+		// Don't leave the new table waiting to be swapped in by
+		// whoever resumes the device next.
+		clear := Command(ctx, "dmsetup", "clear", string(r))
+		if cout, cerr := runCmd(r.String(), clear); cerr != nil {
+			Logger.Warn("couldn't clear inactive device mapper table", "device", string(r), "err", toolError(clear, cout, cerr))
+		}
+		return toolError(resume, out, err)
+	}
+	return nil
+}
+
+func (r dmLinearResizer) check(ctx context.Context) error {
+	if UDisks {
+		return fmt.Errorf("%v: %w", r, errUDisksUnsupported)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDMLinearSnapshot lays out a snapshot of a dm-linear device,
+// dm-0, mapping all of partition vda1, which has since grown from
+// 20969472 to 41940992 sectors.
+func writeDMLinearSnapshot(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/devices/virtio1/block/vda/size":      "41943040\n",
+		"sys/devices/virtio1/block/vda/vda1/size": "41940992\n",
+		"sys/devices/virtual/block/dm-0/size":     "20969472\n",
+		"dev/vda1":                                "",
+		"dev/dm-0":                                "",
+	}
+	links := map[string]string{
+		"sys/class/block/vda1":      "../../devices/virtio1/block/vda/vda1",
+		"sys/class/block/dm-0":      "../../devices/virtual/block/dm-0",
+		"sys/dev/block/254:1":       "../../devices/virtio1/block/vda/vda1",
+		"dev/mapper/appliance-root": "../dm-0",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDMLinearResize(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = writeDMLinearSnapshot(t)
+	const dev = "/dev/mapper/appliance-root"
+	table := "0 2048 linear 254:1 0\n2048 20967424 linear 254:1 2048\n"
+	replayRecordings(t, []Recording{
+		{Args: []string{"dmsetup", "table", dev}, Stdout: table},
+		{Args: []string{"dmsetup", "table", dev}, Stdout: table},
+		{Args: []string{"dmsetup", "table", dev}, Stdout: table},
+		{Args: []string{"dmsetup", "load", dev}, Stdin: "0 2048 linear 254:1 0\n2048 41938944 linear 254:1 2048\n"},
+		{Args: []string{"dmsetup", "resume", dev}},
+	})
+	ctx := context.Background()
+	r := dmLinearResizer(dev)
+	if !isDMLinear(ctx, dev) {
+		t.Fatalf("isDMLinear(%s) = false", dev)
+	}
+	deps, err := r.DepResizers(ctx)
+	if err != nil || len(deps) != 1 || deps[0] != partitionResizer("/dev/vda1") {
+		t.Fatalf("DepResizers = %v, %v; want partition /dev/vda1", deps, err)
+	}
+	if err := r.Resize(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDMTable(t *testing.T) {
+	for _, out := range []string{
+		"",
+		"0 2048\n",
+		"0 2048 linear 8:3 0\n4096 2048 linear 8:3 2048\n", // gap
+		"0 0 linear 8:3 0\n",
+	} {
+		if tt, err := parseDMTable("/dev/dm-0", []byte(out)); err == nil {
+			t.Errorf("parseDMTable(%q) = %v; want error", out, tt)
+		}
+	}
+	tt, err := parseDMTable("/dev/dm-0", []byte("0 2048 linear 8:3 0\n2048 8192 crypt aes-xts-plain64 - 0 8:4 4096\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tt[1].linearOffset(); err == nil {
+		t.Errorf("linearOffset of crypt target succeeded")
+	}
+	if off, err := tt[0].linearOffset(); err != nil || off != 0 {
+		t.Errorf("linearOffset = %d, %v; want 0", off, err)
+	}
+}
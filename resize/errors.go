@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// Errors wrapped by those the package returns, for use with errors.Is.
+var (
+	// ErrUnsupportedFilesystem means a filesystem's type can't be
+	// resized, or can't be resized the way that was asked.
+	ErrUnsupportedFilesystem = errors.New("unsupported filesystem")
+
+	// ErrNoFreeSpace means a layer needed more room than the layer
+	// below it has free.
+	ErrNoFreeSpace = errors.New("no free space")
+
+	// ErrDeviceNotFound means a device, or its entry in a partition
+	// table, couldn't be found.
+	ErrDeviceNotFound = errors.New("device not found")
+
+	// ErrToolMissing means an external tool couldn't be found. See
+	// ToolPath.
+	ErrToolMissing = errors.New("tool not found")
+
+	// ErrReadOnly means a filesystem is mounted read-only and
+	// RemountRW isn't set.
+	ErrReadOnly = errors.New("filesystem is mounted read-only")
+
+	// ErrFilesystemErrors means a filesystem has errors recorded in
+	// it and should be checked before it's grown. See Force.
+	ErrFilesystemErrors = errors.New("filesystem has errors")
+
+	// ErrWouldShrink means a layer being grown would have ended up
+	// smaller than it is, which is never intended and could destroy
+	// data, so nothing was changed.
+	ErrWouldShrink = errors.New("new size is smaller than the current size")
+
+	// ErrImmutable means a filesystem sits on something that can't
+	// be resized at all, such as a read-only image or dm-verity.
+	ErrImmutable = errors.New("storage stack is immutable")
+
+	// ErrNotLocalBlockFilesystem means a filesystem isn't on a local
+	// block device at all, as with NFS, CIFS, FUSE, or tmpfs, so
+	// there's nothing below it to grow. See LocalBlockFilesystem.
+	ErrNotLocalBlockFilesystem = errors.New("not a resizable local block filesystem")
+
+	// ErrPartitionNotLast means a partition can't grow because
+	// another follows it on the disk.
+	ErrPartitionNotLast = errors.New("partition is not the last on its disk")
+)
+
+// A ToolError is an external tool failing.
+type ToolError struct {
+	Stage  string   // the Resizer it ran for, e.g. "LVM PV /dev/sda2"
+	Args   []string // the command line
+	Output []byte   // its output, if any
+	Err    error
+}
+
+func (e *ToolError) Error() string {
+	msg := fmt.Sprintf("running %s: %v", shellQuote(e.Args), e.Err)
+	if out := bytes.TrimSpace(e.Output); len(out) > 0 {
+		msg += "; output: " + string(out)
+	}
+	return msg
+}
+
+func (e *ToolError) Unwrap() error { return e.Err }
+
+// toolError returns a *ToolError for cmd having failed with err after
+// writing out. Resize and Shrink fill in its Stage.
+func toolError(cmd *exec.Cmd, out []byte, err error) error {
+	return &ToolError{Args: cmd.Args, Output: out, Err: err}
+}
+
+// setStage records r as the Stage of the *ToolError in err's chain, if
+// there is one and it lacks a Stage.
+func setStage(err error, r Resizer) {
+	var te *ToolError
+	if errors.As(err, &te) && te.Stage == "" {
+		te.Stage = r.String()
+	}
+}
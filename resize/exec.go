@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+func vlogf(format string, args ...interface{}) {
+	if Verbose {
+		Logger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// errDryRunChange is returned instead of running a command or ioctl
+// that may change a device in dry-run mode. Plan methods describe such
+// steps rather than taking them, so this only stops a bug from
+// changing anything.
+var errDryRunChange = errors.New("refusing to change a device in dry-run mode")
+
+// checkNotDryRun returns an error wrapping errDryRunChange if DryRun
+// is set. what describes the change.
+func checkNotDryRun(what string) error {
+	if DryRun {
+		return fmt.Errorf("%w: %s", errDryRunChange, what)
+	}
+	return nil
+}
+
+// runCmd runs cmd, which may change a device, and returns its combined
+// stdout and stderr. Read-only commands use output or query instead.
+//
+// In verbose mode the output is also streamed to stderr as it arrives,
+// one line at a time, each prefixed with stage.
+func runCmd(stage string, cmd *exec.Cmd) ([]byte, error) {
+	if err := checkNotDryRun(cmdLine(cmd, nil)); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if Verbose {
+		pw := &linePrefixWriter{w: os.Stderr, prefix: "[" + stage + "] "}
+		defer pw.Flush()
+		w = io.MultiWriter(w, pw)
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = w
+	} else {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, w)
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = w
+	} else {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, w)
+	}
+	err := CommandRunner.Run(cmd)
+	// Even a failed command may have changed something.
+	deviceChanges.Add(1)
+	return buf.Bytes(), err
+}
+
+// shellQuote returns args quoted as a /bin/sh command line.
+func shellQuote(args []string) string {
+	var buf bytes.Buffer
+	for i, a := range args {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:+%,@") == "" {
+			buf.WriteString(a)
+			continue
+		}
+		buf.WriteByte('\'')
+		buf.WriteString(strings.ReplaceAll(a, "'", `'\''`))
+		buf.WriteByte('\'')
+	}
+	return buf.String()
+}
+
+// dryRunCmd describes the command line cmd would run, and its standard
+// input if non-nil, in a form that can be reviewed and replayed by hand.
+func dryRunCmd(cmd *exec.Cmd, stdin []byte) {
+	DryRunf("would've run: %s", cmdLine(cmd, stdin))
+}
+
+// cmdLine returns cmd's command line, shell-quoted, followed by stdin
+// as a here-document if it's non-nil.
+func cmdLine(cmd *exec.Cmd, stdin []byte) string {
+	args := append([]string{cmd.Path}, cmd.Args[1:]...)
+	if stdin == nil {
+		return shellQuote(args)
+	}
+	return fmt.Sprintf("%s <<'EOF'\n%sEOF", shellQuote(args), stdin)
+}
+
+// linePrefixWriter is an io.Writer that writes each complete line
+// written to it to w, prefixed with prefix.
+type linePrefixWriter struct {
+	w      io.Writer
+	prefix string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (p *linePrefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf[:i]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes any final unterminated line.
+func (p *linePrefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+		p.buf = nil
+	}
+}
@@ -0,0 +1,752 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var errMountNotFound = errors.New("mount point not found")
+
+func init() {
+	ext := func(ctx context.Context, fs FSStat) (Resizer, error) {
+		return fsResizer{fs: fs, cmd: []string{"resize2fs", "-p", fs.Device}}, nil
+	}
+	RegisterFilesystem("ext2", ext)
+	RegisterFilesystem("ext3", ext)
+	RegisterFilesystem("ext4", ext)
+	RegisterFilesystem("xfs", func(ctx context.Context, fs FSStat) (Resizer, error) {
+		return fsResizer{fs: fs, cmd: []string{"xfs_growfs", "-d", HostPath(fs.FSMountpoint)}}, nil
+	})
+	RegisterFilesystem("btrfs", btrfsResizer)
+}
+
+// FileSystem returns the Resizer for the filesystem mounted at mnt,
+// which depends on the Resizers for the layers below it. If nothing is
+// mounted at mnt but it's in FstabPath, the Resizer is for the layers
+// below its filesystem, or with Offline, for the unmounted filesystem.
+// With Sysroot set, mnt is a mount point within it.
+//
+// Filesystem types are handled by the funcs given to
+// RegisterFilesystem.
+func FileSystem(ctx context.Context, mnt string) (Resizer, error) {
+	if Sysroot != "" {
+		return sysrootFileSystem(ctx, mnt)
+	}
+	fs, err := Stat(mnt)
+	if err == errMountNotFound {
+		return getUnmountedResizer(ctx, mnt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mountedFileSystem(ctx, mnt, fs)
+}
+
+// mountedFileSystem returns the Resizer for fs, mounted at mnt.
+func mountedFileSystem(ctx context.Context, mnt string, fs FSStat) (Resizer, error) {
+	if err := overlayError(fs); err != nil {
+		return nil, err
+	}
+	if !LocalBlockFilesystem(fs.Type, fs.Device) {
+		return nil, fmt.Errorf("%w: %s is a %s filesystem from %s", ErrNotLocalBlockFilesystem, mnt, fs.Type, fs.Device)
+	}
+	if why := immutableReason(fs.Type, fs.Device); why != "" {
+		return nil, fmt.Errorf("%w: the %s filesystem at %s is %s", ErrImmutable, fs.Type, mnt, why)
+	}
+	if fn := filesystemFunc(fs.Type); fn != nil {
+		return fn(ctx, fs)
+	}
+	return nil, fmt.Errorf("%w type %q", ErrUnsupportedFilesystem, fs.Type)
+}
+
+// nonLocalTypes are the filesystem types that are never on a local
+// block device: network filesystems, FUSE, and those in memory.
+var nonLocalTypes = map[string]bool{
+	"nfs":       true,
+	"nfs4":      true,
+	"cifs":      true,
+	"smb3":      true,
+	"smbfs":     true,
+	"9p":        true,
+	"virtiofs":  true,
+	"ceph":      true,
+	"glusterfs": true,
+	"fuse":      true,
+	"tmpfs":     true,
+	"ramfs":     true,
+	"devtmpfs":  true,
+}
+
+// LocalBlockFilesystem reports whether a filesystem of type fstype,
+// mounted from source, as the mount table names them, is on a local
+// block device, unlike NFS, CIFS, FUSE filesystems ("fuse.sshfs"), and
+// tmpfs, or kernel filesystems like proc, whose sources aren't device
+// paths. Types with a registered FilesystemFunc, such as UBIFS
+// ("ubi0:rootfs"), are local whatever their source.
+func LocalBlockFilesystem(fstype, source string) bool {
+	if nonLocalTypes[fstype] || strings.HasPrefix(fstype, "fuse.") {
+		return false
+	}
+	if filesystemFunc(fstype) != nil {
+		return true
+	}
+	return strings.HasPrefix(source, "/")
+}
+
+type fsResizer struct {
+	fs      FSStat
+	cmd     []string // the resize command and its arguments
+	offline bool     // fs isn't mounted; fs.statfs is unset
+}
+
+// NewExtResizer returns the Resizer for the ext2, ext3, or ext4
+// filesystem on the block device dev, which needn't be mounted. If it
+// isn't, resizing it checks it first, and the Resizer's
+// dependencies are those of dev.
+func NewExtResizer(ctx context.Context, dev string) (Resizer, error) {
+	m, ok, err := DeviceMount(dev)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return mountedResizer(m.Mountpoint, "ext2", "ext3", "ext4")
+	}
+	out, err := output(Command(ctx, "blkid", "-o", "value", "-s", "TYPE", dev))
+	if err != nil {
+		return nil, err
+	}
+	switch typ := strings.TrimSpace(string(out)); typ {
+	case "ext2", "ext3", "ext4":
+		return fsResizer{
+			fs:      FSStat{Device: dev, Type: typ},
+			cmd:     []string{"resize2fs", "-p", dev},
+			offline: true,
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s has a %q filesystem, not ext2/3/4", ErrUnsupportedFilesystem, dev, typ)
+	}
+}
+
+// NewUnmountedResizer returns the Resizer for the unmounted filesystem
+// on the block device dev, as from an initramfs before the root is
+// mounted. An ext2/3/4 filesystem is resized itself, after it's
+// checked; for other types, which only grow while mounted, the
+// Resizer is for the layers below it, so the filesystem can grow to
+// fill them once it's mounted.
+func NewUnmountedResizer(ctx context.Context, dev string) (Resizer, error) {
+	out, err := output(Command(ctx, "blkid", "-o", "value", "-s", "TYPE", dev))
+	if err != nil {
+		return nil, err
+	}
+	typ := strings.TrimSpace(string(out))
+	fs := fsResizer{fs: FSStat{Device: dev, Type: typ}, offline: true}
+	switch typ {
+	case "ext2", "ext3", "ext4":
+		fs.cmd = []string{"resize2fs", "-p", dev}
+		return fs, nil
+	}
+	deps, err := fs.DepResizers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(deps) == 0 {
+		return nil, fmt.Errorf("%w: %s filesystems only grow while mounted, and %s has nothing below it to resize", ErrUnsupportedFilesystem, typ, dev)
+	}
+	return deps[0], nil
+}
+
+// RootDevice returns the device of the root filesystem given by spec,
+// a device path or fstab-style spec like "UUID=...", or if spec is
+// empty, by root= on the kernel command line.
+func RootDevice(ctx context.Context, spec string) (string, error) {
+	if spec == "" {
+		return cmdlineRoot(ctx)
+	}
+	return resolveDevSpec(ctx, spec)
+}
+
+// NewXFSResizer returns the Resizer for the XFS filesystem mounted at
+// mnt.
+func NewXFSResizer(mnt string) (Resizer, error) { return mountedResizer(mnt, "xfs") }
+
+// NewBtrfsResizer returns the Resizer for the btrfs filesystem mounted
+// at mnt.
+func NewBtrfsResizer(mnt string) (Resizer, error) { return mountedResizer(mnt, "btrfs") }
+
+// mountedResizer returns the Resizer for the filesystem mounted at mnt,
+// which must be one of types.
+func mountedResizer(mnt string, types ...string) (Resizer, error) {
+	fs, err := Stat(mnt)
+	if err == errMountNotFound {
+		return nil, fmt.Errorf("nothing is mounted at %s", mnt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(types, fs.Type) {
+		return nil, fmt.Errorf("%w: %s has a %s filesystem, not %s", ErrUnsupportedFilesystem, mnt, fs.Type, strings.Join(types, "/"))
+	}
+	return filesystemFunc(fs.Type)(context.Background(), fs)
+}
+
+func (e fsResizer) String() string {
+	if e.offline && e.fs.Mountpoint == "" {
+		return fmt.Sprintf("unmounted %s filesystem on %s", e.fs.Type, e.fs.Device)
+	}
+	if e.offline {
+		return fmt.Sprintf("unmounted %s filesystem for %s", e.fs.Type, e.fs.Mountpoint)
+	}
+	return fmt.Sprintf("%s filesystem at %s", e.fs.Type, e.fs.Mountpoint)
+}
+
+func (e fsResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	dev := e.fs.Device
+	if dev == "/dev/root" {
+		return nil, errors.New("unexpected device /dev/root from statFS")
+	}
+	if r, err := registeredDevice(ctx, dev); r != nil || err != nil {
+		return deps(r), err
+	}
+	if IsMMCHardwarePartition(dev) {
+		return nil, fmt.Errorf("%w: %s is an eMMC boot or RPMB area, whose size is fixed", ErrImmutable, dev)
+	}
+	c, err := classifyBlockDevice(dev)
+	if err != nil {
+		vlogf("fsResizer.DepResizers: classifying %s by device number: %v", dev, err)
+		return e.depResizersByName(ctx, dev)
+	}
+	vlogf("fsResizer.DepResizers: %s is %s (%d:%d, %q, partition=%v)", dev, c.name, c.major, c.minor, c.driver, c.partition)
+	switch {
+	case c.partition:
+		return []Resizer{partitionResizer("/dev/" + c.name)}, nil
+	case c.driver == "device-mapper":
+		return dmResizers(ctx, dev)
+	}
+	return nil, fmt.Errorf("don't know how to resize block device %q (%s, major %d)", dev, c.driver, c.major)
+}
+
+// depResizersByName is DepResizers for a device that can't be
+// classified by its device number, as when /proc or sysfs is missing.
+// It asks lsblk, and failing that, goes by the device's name.
+func (e fsResizer) depResizersByName(ctx context.Context, dev string) ([]Resizer, error) {
+	if d := lookupBlockDevice(ctx, dev); d != nil {
+		switch d.Type {
+		case "part":
+			vlogf("fsResizer.DepResizers: lsblk says %s is a partition", dev)
+			return []Resizer{partitionResizer(dev)}, nil
+		case "lvm":
+			return []Resizer{lvResizer(dev)}, nil
+		}
+	}
+	if (strings.HasPrefix(dev, "/dev/sd") ||
+		strings.HasPrefix(dev, "/dev/vd") ||
+		strings.HasPrefix(dev, "/dev/mmcblk") ||
+		strings.HasPrefix(dev, "/dev/nvme")) &&
+		isPartitionDev(dev) {
+		vlogf("fsResizer.DepResizers: returning partitionResizer(%q)", dev)
+		return []Resizer{partitionResizer(dev)}, nil
+	}
+	if strings.HasPrefix(dev, "/dev/mapper") ||
+		strings.HasPrefix(filepath.Base(dev), "dm-") {
+		return dmResizers(ctx, dev)
+	}
+	return nil, fmt.Errorf("don't know how to resize block device %q", dev)
+}
+
+// dmResizers returns the Resizer for the device mapper device dev: an
+// LVM LV or a plain dm-linear device.
+func dmResizers(ctx context.Context, dev string) ([]Resizer, error) {
+	// Only an LVM LV needs the LVM tools, which minimal images may
+	// not have, so rule out other device mapper targets first.
+	if uuid, ok := dmUUID(dev); ok && !strings.HasPrefix(uuid, "LVM-") {
+		if isDMLinear(ctx, dev) {
+			vlogf("fsResizer.DepResizers: %s is a plain dm-linear device", dev)
+			return []Resizer{dmLinearResizer(dev)}, nil
+		}
+		return nil, fmt.Errorf("don't know how to resize device mapper device %q (uuid %q); it's neither an LVM LV nor made of linear targets", dev, uuid)
+	}
+	return []Resizer{lvResizer(dev)}, nil
+}
+
+func (e fsResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	a := Action{CurrentBytes: n}
+	if err := e.checkGrowth(ctx, n); err != nil {
+		return Action{}, err
+	}
+	if e.offline {
+		a.Steps = append(a.Steps, cmdLine(e.fsckCommand(ctx), nil))
+	}
+	remount := !e.offline && e.fs.ReadOnly()
+	if remount {
+		a.Steps = append(a.Steps, cmdLine(e.remountCommand(ctx, "rw"), nil))
+	}
+	a.Steps = append(a.Steps, cmdLine(Command(ctx, e.cmd[0], e.cmd[1:]...), nil))
+	if remount {
+		a.Steps = append(a.Steps, cmdLine(e.remountCommand(ctx, e.fs.Options), nil))
+	}
+	return a, nil
+}
+
+func (e fsResizer) check(ctx context.Context) error {
+	if err := e.checkErrors(ctx); err != nil {
+		return err
+	}
+	if !e.offline && e.fs.ReadOnly() && !RemountRW {
+		return fmt.Errorf("%v: %w; remount it read-write or use --remount-rw", e, ErrReadOnly)
+	}
+	return nil
+}
+
+// checkErrors returns an error if e is an ext2/3/4 filesystem whose
+// superblock records errors, as when the kernel has remounted it
+// read-only under errors=remount-ro. Growing it could make things
+// worse, so it should be checked first, unless Force is set.
+func (e fsResizer) checkErrors(ctx context.Context) error {
+	switch e.fs.Type {
+	case "ext2", "ext3", "ext4":
+	default:
+		return nil
+	}
+	if Force || UDisks {
+		return nil
+	}
+	h, err := dumpe2fs(ctx, e.fs.Device)
+	if err != nil {
+		return err
+	}
+	state := h["Filesystem state"]
+	nerr, _ := strconv.Atoi(h["FS Error count"])
+	if !strings.Contains(state, "error") && nerr == 0 {
+		return nil
+	}
+	fix := "unmount it and run e2fsck -f " + e.fs.Device
+	if e.fs.Mountpoint == "/" {
+		fix = "boot with fsck.mode=force, or run e2fsck -f " + e.fs.Device + " from a rescue system"
+	}
+	return fmt.Errorf("%v: %w (state %q, %d errors recorded); %s, or use --force", e, ErrFilesystemErrors, state, nerr, fix)
+}
+
+// checkGrowth checks that growing e, now cur bytes, won't shrink it.
+// resize2fs, given no size, resizes to fit the device, even if that
+// means shrinking, so the device mustn't be smaller than the
+// filesystem. The other tools only grow.
+func (e fsResizer) checkGrowth(ctx context.Context, cur int64) error {
+	if !strings.HasPrefix(e.fs.Type, "ext") {
+		return nil
+	}
+	n, err := blockDevSize(e.fs.Device)
+	if err != nil {
+		return err
+	}
+	return checkGrowth(e, cur, n)
+}
+
+// warnQuotas warns, after e has grown, if its filesystem keeps quotas
+// in quota files, as with ext2/3/4's usrquota and grpquota options.
+// Their accounting isn't updated for the new blocks until quotacheck
+// is run. Quotas kept by the filesystem itself, like ext4's quota
+// feature and XFS's quotas, need nothing.
+func (e fsResizer) warnQuotas() {
+	if e.offline || !strings.HasPrefix(e.fs.Type, "ext") {
+		return
+	}
+	var opts []string
+	for _, o := range strings.Split(e.fs.SuperOptions, ",") {
+		k, _, _ := strings.Cut(o, "=")
+		switch k {
+		case "quota", "usrquota", "grpquota", "usrjquota", "grpjquota":
+			opts = append(opts, o)
+		}
+	}
+	if len(opts) == 0 {
+		return
+	}
+	Logger.Warn("filesystem uses quota files; run quotacheck to update them for its new size",
+		"mountpoint", e.fs.Mountpoint, "options", strings.Join(opts, ","),
+		"command", "quotacheck -ugm "+e.fs.Mountpoint)
+}
+
+// remountCommand returns the command remounting e's filesystem with
+// the mount options opts.
+func (e fsResizer) remountCommand(ctx context.Context, opts string) *exec.Cmd {
+	if runtime.GOOS == "freebsd" {
+		return Command(ctx, "mount", "-u", "-o", opts, HostPath(e.fs.FSMountpoint))
+	}
+	return Command(ctx, "mount", "-o", "remount,"+opts, HostPath(e.fs.FSMountpoint))
+}
+
+// remountRW remounts e's read-only filesystem read-write and returns a
+// func restoring its original mount options.
+func (e fsResizer) remountRW(ctx context.Context) (restore func() error, err error) {
+	cmd := e.remountCommand(ctx, "rw")
+	if out, err := runCmd(e.String(), cmd); err != nil {
+		return nil, fmt.Errorf("remounting %s read-write: %w", e.fs.Mountpoint, toolError(cmd, out, err))
+	}
+	return func() error {
+		// Restore the options even if ctx is done.
+		cmd := e.remountCommand(context.WithoutCancel(ctx), e.fs.Options)
+		if out, err := runCmd(e.String(), cmd); err != nil {
+			return fmt.Errorf("restoring mount options of %s: %w", e.fs.Mountpoint, toolError(cmd, out, err))
+		}
+		return nil
+	}, nil
+}
+
+// fsckCommand returns the command checking e's filesystem before an
+// offline resize, which resize2fs insists on.
+func (e fsResizer) fsckCommand(ctx context.Context) *exec.Cmd {
+	return Command(ctx, "e2fsck", "-f", "-p", e.fs.Device)
+}
+
+func (e fsResizer) Resize(ctx context.Context) (err error) {
+	if err := e.check(ctx); err != nil {
+		return err
+	}
+	n, err := e.Size(ctx)
+	if err != nil {
+		return err
+	}
+	if err := e.checkGrowth(ctx, n); err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			e.warnQuotas()
+		}
+	}()
+	if UDisks {
+		return udisksGrow(ctx, e.fs.Device, "Filesystem")
+	}
+	if !e.offline && e.fs.ReadOnly() {
+		restore, err := e.remountRW(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if rerr := restore(); err == nil {
+				err = rerr
+			}
+		}()
+	}
+	if e.offline {
+		fsck := e.fsckCommand(ctx)
+		if out, err := runCmd(e.String(), fsck); err != nil {
+			return fmt.Errorf("checking %s before offline resize: %w", e.fs.Device, toolError(fsck, out, err))
+		}
+	}
+	cmd := Command(ctx, e.cmd[0], e.cmd[1:]...)
+	if Progress != nil && strings.HasPrefix(e.fs.Type, "ext") {
+		return e.resizeWithProgress(cmd)
+	}
+	out, err := runCmd(e.String(), cmd)
+	if err != nil {
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+// resizeWithProgress resizes e by running cmd, reporting to Progress
+// as it goes. resize2fs prints progress only for offline resizes, so
+// growing a mounted filesystem reports none.
+func (e fsResizer) resizeWithProgress(cmd *exec.Cmd) error {
+	pw := &resize2fsProgress{
+		report: func(pass int, percent float64, eta time.Duration) {
+			Progress(e, pass, percent, eta)
+		},
+	}
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if _, err := runCmd(e.String(), cmd); err != nil {
+		return toolError(cmd, pw.out.Bytes(), err)
+	}
+	return nil
+}
+
+func (e fsResizer) State(ctx context.Context) (string, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (e fsResizer) Size(ctx context.Context) (int64, error) {
+	if e.offline {
+		return ext2OfflineSize(ctx, e.fs.Device)
+	}
+	st, err := Stat(e.fs.Mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	return st.SizeBytes(), nil
+}
+
+// ext2OfflineSize returns the size of the unmounted ext2/3/4
+// filesystem on dev, from its superblock.
+func ext2OfflineSize(ctx context.Context, dev string) (int64, error) {
+	count, size, err := ext2Superblock(ctx, dev)
+	return count * size, err
+}
+
+// ext2Superblock returns the block count and block size of the
+// ext2/3/4 filesystem on dev.
+func ext2Superblock(ctx context.Context, dev string) (count, size int64, err error) {
+	h, err := dumpe2fs(ctx, dev)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, _ = strconv.ParseInt(h["Block count"], 10, 64)
+	size, _ = strconv.ParseInt(h["Block size"], 10, 64)
+	if count == 0 || size == 0 {
+		return 0, 0, fmt.Errorf("dumpe2fs -h %s lacked block count or size", dev)
+	}
+	return count, size, nil
+}
+
+// dumpe2fs returns the superblock fields of the ext2/3/4 filesystem on
+// dev, as printed by dumpe2fs -h, such as "Block count".
+func dumpe2fs(ctx context.Context, dev string) (map[string]string, error) {
+	out, err := query(ctx, Command(ctx, "dumpe2fs", "-h", dev))
+	if err != nil {
+		return nil, err
+	}
+	h := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			h[k] = strings.TrimSpace(v)
+		}
+	}
+	return h, nil
+}
+
+// FSStat describes a mounted filesystem.
+type FSStat struct {
+	Mountpoint string
+	Device     string // "/dev/sda1"
+	Type       string // "ext4"
+
+	// Root is the directory within the filesystem mounted at
+	// Mountpoint: "/" unless it's a bind mount, or "" if not known.
+	Root string
+
+	// Options are the per-mount options, such as "rw,relatime".
+	Options string
+
+	// SuperOptions are the filesystem's own mount options, such as
+	// "rw,errors=remount-ro,usrquota", or all its options if the
+	// mount table doesn't separate them.
+	SuperOptions string
+
+	// FSMountpoint is where tools that want the filesystem's root
+	// are pointed: Mountpoint unless that's a bind mount of a
+	// directory in it. If the filesystem is mounted several times, it's
+	// the mount with the shortest root (the filesystem's own root, if
+	// that's mounted), then a read-write mount over a read-only one,
+	// then Mountpoint itself.
+	FSMountpoint string
+
+	statfs unix.Statfs_t
+}
+
+// ReadOnly reports whether the filesystem is mounted read-only.
+func (fs FSStat) ReadOnly() bool {
+	return Mount{Options: fs.Options}.readOnly()
+}
+
+// BlockSize returns the filesystem's fundamental block size in bytes.
+func (fs FSStat) BlockSize() int64 {
+	return statfsBlockSize(&fs.statfs)
+}
+
+// SizeBytes returns the total size of the filesystem in bytes.
+func (fs FSStat) SizeBytes() int64 { return int64(fs.statfs.Blocks) * fs.BlockSize() }
+
+// UsedBytes returns the number of bytes in use, as df reports it.
+func (fs FSStat) UsedBytes() int64 {
+	return int64(fs.statfs.Blocks-fs.statfs.Bfree) * fs.BlockSize()
+}
+
+// AvailBytes returns the number of bytes available to unprivileged users.
+func (fs FSStat) AvailBytes() int64 { return int64(fs.statfs.Bavail) * fs.BlockSize() }
+
+// Stat returns the filesystem mounted at mnt, a mount point in the
+// mount table from Mounts.
+func Stat(mnt string) (fs FSStat, err error) {
+	mnt = filepath.Clean(mnt)
+	err = Statfs(HostPath(mnt), &fs.statfs)
+	if err != nil {
+		return
+	}
+	mounts, err := Mounts()
+	if err != nil {
+		return
+	}
+	// The last mount at mnt hides any earlier ones.
+	var m *Mount
+	for i := range mounts {
+		if mounts[i].Source == "rootfs" {
+			// See https://github.com/google/embiggen-disk/issues/6
+			continue
+		}
+		if mounts[i].Mountpoint == mnt {
+			m = &mounts[i]
+		}
+	}
+	if m == nil {
+		return fs, errMountNotFound
+	}
+	fs.Mountpoint = mnt
+	fs.Root = m.Root
+	fs.Options = m.Options
+	fs.SuperOptions = m.SuperOptions
+	fs.FSMountpoint = fsMountpoint(mounts, *m)
+	fs.Device = m.Source
+	fs.Type = m.Type
+	if fs.Device == "/dev/root" {
+		dev, err := findDevRoot(*m, mnt)
+		if err != nil {
+			return fs, fmt.Errorf("failed to map /dev/root to real device: %v", err)
+		}
+		fs.Device = dev
+	}
+	return fs, checkHostDev(fs.Device)
+}
+
+// fsMountpoint returns where the whole filesystem mounted by m is
+// mounted: m's own mount point unless m bind mounts a directory within
+// the filesystem and the canonical mount of the filesystem is
+// elsewhere.
+func fsMountpoint(mounts []Mount, m Mount) string {
+	if m.Root == "/" || m.Root == "" {
+		return m.Mountpoint
+	}
+	same := []Mount{m}
+	for _, o := range mounts {
+		if sameFilesystem(o, m) {
+			same = append(same, o)
+		}
+	}
+	return canonicalMount(same).Mountpoint
+}
+
+// canonicalMount returns the mount among ms, all of one filesystem,
+// that resizing tools should be pointed at. The rule is: the mount
+// with the shortest root, so the filesystem's own root if it's mounted
+// anywhere; then a read-write mount over a read-only one; then the
+// earliest in ms.
+func canonicalMount(ms []Mount) Mount {
+	best := ms[0]
+	for _, m := range ms[1:] {
+		if len(m.Root) < len(best.Root) ||
+			len(m.Root) == len(best.Root) && !m.readOnly() && best.readOnly() {
+			best = m
+		}
+	}
+	return best
+}
+
+// DeviceMount returns the canonical mount of the filesystem on the
+// block device dev, by the rule of FSStat.FSMountpoint, preferring the
+// first mounted on a tie, or false if it's not mounted.
+func DeviceMount(dev string) (m Mount, ok bool, err error) {
+	mounts, err := Mounts()
+	if err != nil {
+		return Mount{}, false, err
+	}
+	var same []Mount
+	for _, m := range mounts {
+		if m.Source == dev {
+			same = append(same, m)
+		}
+	}
+	if len(same) == 0 {
+		return Mount{}, false, nil
+	}
+	return canonicalMount(same), true, nil
+}
+
+// sameFilesystem reports whether a and b mount the same filesystem.
+func sameFilesystem(a, b Mount) bool {
+	if a.Major != 0 || a.Minor != 0 {
+		return a.Major == b.Major && a.Minor == b.Minor
+	}
+	return a.Source == b.Source && a.Type == b.Type
+}
+
+// findDevRoot finds which block device (e.g. "/dev/nvme0n1p1") is the
+// /dev/root mounted by m at mnt, from the kernel's name for its device
+// number in /sys/dev/block. That works even when /dev lacks the device
+// or /dev/root, as in containers and minimal devtmpfs setups.
+func findDevRoot(m Mount, mnt string) (string, error) {
+	major, minor := m.Major, m.Minor
+	if major == 0 && minor == 0 {
+		// The mount table didn't say; ask the filesystem.
+		var st unix.Stat_t
+		if err := unix.Stat(HostPath(mnt), &st); err != nil {
+			return "", err
+		}
+		major, minor = unix.Major(st.Dev), unix.Minor(st.Dev)
+	}
+	link := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	target, err := os.Readlink(sysPath(link))
+	if err != nil {
+		// As a last resort, go by what the kernel was told to
+		// mount.
+		if dev, cerr := cmdlineRoot(context.Background()); cerr == nil {
+			return dev, nil
+		}
+		return "", fmt.Errorf("%w: no block device %d:%d in /sys/dev/block: %v", ErrDeviceNotFound, major, minor, err)
+	}
+	return "/dev/" + filepath.Base(target), nil
+}
+
+// cmdlineRoot returns the root device given by root= on the kernel
+// command line, such as "root=PARTUUID=...", resolved to a device
+// path.
+func cmdlineRoot(ctx context.Context) (string, error) {
+	cmdline, err := os.ReadFile(sysPath("/proc/cmdline"))
+	if err != nil {
+		return "", err
+	}
+	var spec string
+	for _, f := range strings.Fields(string(cmdline)) {
+		if v, ok := strings.CutPrefix(f, "root="); ok {
+			spec = v // the last one wins, as with the kernel
+		}
+	}
+	if spec == "" {
+		return "", fmt.Errorf("no root= on the kernel command line")
+	}
+	return resolveDevSpec(ctx, spec)
+}
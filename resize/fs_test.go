@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLocalBlockFilesystem(t *testing.T) {
+	for _, tt := range []struct {
+		fstype, source string
+		want           bool
+	}{
+		{"ext4", "/dev/sda1", true},
+		{"xfs", "/dev/mapper/vg-root", true},
+		{"ubifs", "ubi0:rootfs", true},
+		{"nfs4", "server:/export/home", false},
+		{"cifs", "//server/share", false},
+		{"fuse.sshfs", "user@host:/srv", false},
+		{"tmpfs", "tmpfs", false},
+		{"proc", "proc", false},
+		{"cgroup2", "cgroup2", false},
+	} {
+		if got := LocalBlockFilesystem(tt.fstype, tt.source); got != tt.want {
+			t.Errorf("LocalBlockFilesystem(%q, %q) = %v; want %v", tt.fstype, tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestNotLocalBlockFilesystemError(t *testing.T) {
+	_, err := mountedFileSystem(context.Background(), "/home", FSStat{Mountpoint: "/home", Device: "server:/export/home", Type: "nfs4"})
+	if !errors.Is(err, ErrNotLocalBlockFilesystem) {
+		t.Errorf("mountedFileSystem of NFS = %v; want ErrNotLocalBlockFilesystem", err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FstabPath is where FileSystem looks up targets that aren't mounted.
+var FstabPath = "/etc/fstab"
+
+// fstabEntry is one line of /etc/fstab.
+type fstabEntry struct {
+	spec    string // "UUID=...", "LABEL=...", "/dev/sda1"
+	file    string // mount point
+	vfstype string
+	opts    string
+}
+
+// readFstab parses the fstab file at path.
+func readFstab(path string) ([]fstabEntry, error) {
+	all, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ents []fstabEntry
+	for _, line := range strings.Split(string(all), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			continue
+		}
+		e := fstabEntry{spec: UnescapeMount(f[0]), file: UnescapeMount(f[1]), vfstype: f[2]}
+		if len(f) > 3 {
+			e.opts = f[3]
+		}
+		ents = append(ents, e)
+	}
+	return ents, nil
+}
+
+var octalEscapeRx = regexp.MustCompile(`\\[0-7]{3}`)
+
+// UnescapeMount decodes the octal escapes (like "\040" for a space)
+// used in fstab and /proc/mounts fields.
+func UnescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return octalEscapeRx.ReplaceAllStringFunc(s, func(esc string) string {
+		n, _ := strconv.ParseUint(esc[1:], 8, 8)
+		return string([]byte{byte(n)})
+	})
+}
+
+// escapeMount encodes s as an fstab field, escaping the characters
+// UnescapeMount decodes.
+func escapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', '\\':
+			fmt.Fprintf(&b, `\%03o`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// fstabLookup returns the entry for mount point mnt in the fstab file
+// at path.
+func fstabLookup(path, mnt string) (fstabEntry, bool) {
+	ents, err := readFstab(path)
+	if err != nil {
+		return fstabEntry{}, false
+	}
+	mnt = filepath.Clean(mnt)
+	for _, e := range ents {
+		if filepath.Clean(e.file) == mnt {
+			return e, true
+		}
+	}
+	return fstabEntry{}, false
+}
+
+// resolveDevSpec maps an fstab-style device spec (a path, or
+// UUID=, LABEL=, PARTUUID=, or PARTLABEL=) to a device path.
+func resolveDevSpec(ctx context.Context, spec string) (string, error) {
+	k, v, ok := strings.Cut(spec, "=")
+	if !ok {
+		if !strings.HasPrefix(spec, "/dev/") {
+			return "", fmt.Errorf("unsupported device %q", spec)
+		}
+		return evalSymlinks(spec)
+	}
+	v = strings.Trim(v, `"`)
+	dir := map[string]string{
+		"UUID":      "by-uuid",
+		"LABEL":     "by-label",
+		"PARTUUID":  "by-partuuid",
+		"PARTLABEL": "by-partlabel",
+	}[k]
+	if dir == "" {
+		return "", fmt.Errorf("unsupported device spec %q", spec)
+	}
+	if k == "PARTUUID" || k == "UUID" {
+		// udev names these links in lowercase.
+		v = strings.ToLower(v)
+	}
+	if dev, err := evalSymlinks(filepath.Join("/dev/disk", dir, v)); err == nil {
+		return dev, nil
+	}
+	out, err := output(Command(ctx, "blkid", "-l", "-o", "device", "-t", spec))
+	if err != nil {
+		return "", fmt.Errorf("%w for %s", ErrDeviceNotFound, spec)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// getUnmountedResizer returns a Resizer for the filesystem fstab says
+// belongs at mnt, which isn't mounted. Unless Offline is set, it
+// only resizes the layers below the filesystem.
+func getUnmountedResizer(ctx context.Context, mnt string) (Resizer, error) {
+	ent, ok := fstabLookup(FstabPath, mnt)
+	if !ok {
+		return nil, fmt.Errorf("%s is not mounted and not in %s", mnt, FstabPath)
+	}
+	dev, err := resolveDevSpec(ctx, ent.spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not mounted; resolving its %s entry: %v", mnt, FstabPath, err)
+	}
+	return unmountedResizer(ctx, mnt, dev, ent.vfstype)
+}
+
+// unmountedResizer returns a Resizer for the unmounted filesystem of
+// type vfstype on dev that belongs at mnt, or without Offline, for the
+// layers below it.
+func unmountedResizer(ctx context.Context, mnt, dev, vfstype string) (Resizer, error) {
+	fs := fsResizer{fs: FSStat{Mountpoint: mnt, Device: dev, Type: vfstype, FSMountpoint: mnt}, offline: true}
+	if !Offline {
+		Logger.Warn("target not mounted; resizing only the layers below its filesystem (use --offline to resize the filesystem too)",
+			"mountpoint", mnt, "device", dev)
+		deps, err := fs.DepResizers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(deps) == 0 {
+			return nil, fmt.Errorf("%s is not mounted and %s has nothing below it to resize", mnt, dev)
+		}
+		return deps[0], nil
+	}
+	switch vfstype {
+	case "ext2", "ext3", "ext4":
+		fs.cmd = []string{"resize2fs", "-p", dev}
+		return fs, nil
+	}
+	return nil, fmt.Errorf("%w: %s filesystems can't be resized offline; mount %s and run again", ErrUnsupportedFilesystem, vfstype, mnt)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	RegisterFilesystem("ufs", func(ctx context.Context, fs FSStat) (Resizer, error) {
+		// growfs grows a mounted UFS filesystem since FreeBSD 10.
+		return fsResizer{fs: fs, cmd: []string{"growfs", "-y", fs.Device}}, nil
+	})
+	RegisterDevice(geomDevice)
+}
+
+// A geomProvider is a provider, something with a /dev node, in the
+// GEOM tree, as listed by the kern.geom.conftxt sysctl.
+type geomProvider struct {
+	class  string            // class of the geom providing it: "DISK", "PART", "LABEL", ...
+	name   string            // "ada0p2", "gpt/rootfs"
+	size   int64             // in bytes
+	attrs  map[string]string // class-specific: for PART, "i" (index) and "xs" (scheme)
+	parent *geomProvider     // the provider it's built on, or nil for a disk
+}
+
+// parseConftxt parses the kern.geom.conftxt sysctl, in which each line
+// is a provider, indented by its depth in the tree below the line of
+// its parent:
+//
+//	0 DISK ada0 21474836480 512 hd 16 sc 63
+//	1 PART ada0p2 21474754560 512 i 2 o 65536 ty freebsd-ufs xs GPT xt 516e7cb6-6ecf-11d6-8ff8-00022d09712b
+//	2 LABEL gpt/rootfs 21474754560 512 i 0 o 0
+func parseConftxt(data []byte) ([]*geomProvider, error) {
+	var ps []*geomProvider
+	var stack []*geomProvider // by depth, the last provider seen
+	bs := bufio.NewScanner(bytes.NewReader(data))
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		if len(f) == 0 {
+			continue
+		}
+		depth, err := strconv.Atoi(f[0])
+		if err != nil || len(f) < 5 || len(f)%2 == 0 || depth > len(stack) {
+			return nil, fmt.Errorf("malformed kern.geom.conftxt line %q", bs.Text())
+		}
+		size, err := strconv.ParseInt(f[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed kern.geom.conftxt line %q", bs.Text())
+		}
+		p := &geomProvider{class: f[1], name: f[2], size: size, attrs: map[string]string{}}
+		for i := 5; i+1 < len(f); i += 2 {
+			p.attrs[f[i]] = f[i+1]
+		}
+		if depth > 0 {
+			p.parent = stack[depth-1]
+		}
+		stack = append(stack[:depth], p)
+		ps = append(ps, p)
+	}
+	return ps, bs.Err()
+}
+
+// geomProviders returns the providers in the GEOM tree.
+func geomProviders() ([]*geomProvider, error) {
+	s, err := unix.Sysctl("kern.geom.conftxt")
+	if err != nil {
+		return nil, fmt.Errorf("reading kern.geom.conftxt: %v", err)
+	}
+	return parseConftxt([]byte(s))
+}
+
+// findGeomProvider returns the provider named name in ps, or nil.
+func findGeomProvider(ps []*geomProvider, name string) *geomProvider {
+	for _, p := range ps {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// geomDevice is the DeviceFunc for FreeBSD. It returns a gpartResizer
+// for dev if it's a partition or a label on one, as with
+// "/dev/gpt/rootfs".
+func geomDevice(ctx context.Context, dev string) (Resizer, error) {
+	name, ok := strings.CutPrefix(dev, "/dev/")
+	if !ok {
+		return nil, nil
+	}
+	ps, err := geomProviders()
+	if err != nil {
+		return nil, err
+	}
+	p := findGeomProvider(ps, name)
+	for p != nil && p.class == "LABEL" {
+		p = p.parent
+	}
+	if p == nil || p.class != "PART" {
+		return nil, nil
+	}
+	return newGpartResizer(p)
+}
+
+func newGpartResizer(p *geomProvider) (Resizer, error) {
+	if p.parent == nil || p.attrs["i"] == "" {
+		return nil, fmt.Errorf("GEOM partition %s has no index or parent", p.name)
+	}
+	return gpartResizer{name: p.name, geom: p.parent.name, index: p.attrs["i"], scheme: p.attrs["xs"]}, nil
+}
+
+// A gpartResizer grows a partition with gpart, which, unlike on Linux,
+// both rewrites the table and tells the kernel.
+type gpartResizer struct {
+	name   string // the partition's provider, "ada0p2"
+	geom   string // the partitioned provider, "ada0", or "ada0s1" for a BSD label in an MBR slice
+	index  string // of the partition in geom's table
+	scheme string // "GPT", "MBR", "BSD", ...
+}
+
+func (p gpartResizer) String() string { return fmt.Sprintf("partition /dev/%s", p.name) }
+
+func (p gpartResizer) State(ctx context.Context) (string, error) {
+	n, err := p.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (p gpartResizer) Size(ctx context.Context) (int64, error) {
+	ps, err := geomProviders()
+	if err != nil {
+		return 0, err
+	}
+	if gp := findGeomProvider(ps, p.name); gp != nil {
+		return gp.size, nil
+	}
+	return 0, fmt.Errorf("%w: no GEOM provider %s", ErrDeviceNotFound, p.name)
+}
+
+// DepResizers returns, for a partition in a BSD label or MBR slice
+// that's itself a partition, the Resizer of that, which must grow
+// first.
+func (p gpartResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	ps, err := geomProviders()
+	if err != nil {
+		return nil, err
+	}
+	if gp := findGeomProvider(ps, p.geom); gp != nil && gp.class == "PART" {
+		r, err := newGpartResizer(gp)
+		return deps(r), err
+	}
+	return nil, nil
+}
+
+// commands returns the gpart commands growing p, or none if there's
+// no free space after it. A GPT whose backup header isn't at the end
+// of the grown disk, which GEOM marks CORRUPT, is recovered first,
+// which moves the header and frees the space before it.
+func (p gpartResizer) commands(ctx context.Context) ([]*exec.Cmd, error) {
+	out, err := query(ctx, Command(ctx, "gpart", "show", "-p", p.geom))
+	if err != nil {
+		return nil, err
+	}
+	resize := Command(ctx, "gpart", "resize", "-i", p.index, p.geom)
+	if p.scheme == "GPT" && bytes.Contains(out, []byte("CORRUPT")) {
+		return []*exec.Cmd{Command(ctx, "gpart", "recover", p.geom), resize}, nil
+	}
+	if !gpartFreeAfter(out, p.name) {
+		return nil, nil
+	}
+	return []*exec.Cmd{resize}, nil
+}
+
+// gpartFreeAfter reports whether, in the output of gpart show -p, the
+// partition name is followed by free space:
+//
+//	=>      40  41942960  ada0  GPT  (20G)
+//	        40      1024  ada0p1  freebsd-boot  (512K)
+//	      1064  20970496  ada0p2  freebsd-ufs  (10G)
+//	  20971560  20971440        - free -  (10G)
+func gpartFreeAfter(out []byte, name string) bool {
+	var prev string
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			continue
+		}
+		if prev == name {
+			return len(f) >= 4 && f[2] == "-" && f[3] == "free"
+		}
+		prev = f[2]
+	}
+	return false
+}
+
+func (p gpartResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := p.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	cmds, err := p.commands(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	a := Action{CurrentBytes: n}
+	if len(cmds) == 0 {
+		a.ProposedBytes = n
+	}
+	for _, cmd := range cmds {
+		a.Steps = append(a.Steps, cmdLine(cmd, nil))
+	}
+	return a, nil
+}
+
+func (p gpartResizer) Resize(ctx context.Context) error {
+	cmds, err := p.commands(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if out, err := runCmd(p.String(), cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+	}
+	return nil
+}
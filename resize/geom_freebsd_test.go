@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"reflect"
+	"testing"
+)
+
+// conftxtMBR is kern.geom.conftxt from FreeBSD 13 with a UFS root on
+// a BSD label in the first MBR slice of ada0, and a GPT on ada1 with a
+// labeled partition.
+const conftxtMBR = `0 DISK ada1 21474836480 512 hd 16 sc 63
+1 PART ada1p1 21474770944 512 i 1 o 20480 ty freebsd-zfs xs GPT xt 516e7cba-6ecf-11d6-8ff8-00022d09712b
+2 LABEL gpt/zfs0 21474770944 512 i 0 o 0
+0 DISK ada0 10737418240 512 hd 16 sc 63
+1 PART ada0s1 10737385472 512 i 1 o 32256 ty freebsd xs MBR xt 165
+2 PART ada0s1a 10737385472 512 i 1 o 0 ty freebsd-ufs xs BSD xt 7
+`
+
+func TestParseConftxt(t *testing.T) {
+	ps, err := parseConftxt([]byte(conftxtMBR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 6 {
+		t.Fatalf("got %d providers; want 6", len(ps))
+	}
+	label := findGeomProvider(ps, "gpt/zfs0")
+	if label == nil || label.class != "LABEL" || label.parent == nil || label.parent.name != "ada1p1" {
+		t.Fatalf("gpt/zfs0 = %+v; want a LABEL on ada1p1", label)
+	}
+	part := findGeomProvider(ps, "ada0s1a")
+	if part == nil || part.parent == nil || part.parent.name != "ada0s1" || part.parent.parent.name != "ada0" {
+		t.Fatalf("ada0s1a = %+v; want a partition of ada0s1 on ada0", part)
+	}
+	r, err := newGpartResizer(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := gpartResizer{name: "ada0s1a", geom: "ada0s1", index: "1", scheme: "BSD"}
+	if r != want {
+		t.Errorf("newGpartResizer(ada0s1a) = %+v; want %+v", r, want)
+	}
+	if part.size != 10737385472 {
+		t.Errorf("ada0s1a size = %d; want 10737385472", part.size)
+	}
+}
+
+func TestParseConftxtMalformed(t *testing.T) {
+	if _, err := parseConftxt([]byte("1 PART ada0p1 1024 512 i 1\n")); err == nil {
+		t.Error("parsing a provider without a parent succeeded")
+	}
+}
+
+func TestGpartFreeAfter(t *testing.T) {
+	const out = `=>      40  41942960  ada0  GPT  (20G)
+        40      1024  ada0p1  freebsd-boot  (512K)
+      1064  20970496  ada0p2  freebsd-ufs  (10G)
+  20971560  20971440        - free -  (10G)
+`
+	if gpartFreeAfter([]byte(out), "ada0p1") {
+		t.Error("gpartFreeAfter(ada0p1) = true; want false")
+	}
+	if !gpartFreeAfter([]byte(out), "ada0p2") {
+		t.Error("gpartFreeAfter(ada0p2) = false; want true")
+	}
+}
+
+func TestParseZpoolVdevs(t *testing.T) {
+	const out = "zroot\t39.5G\t1.21G\t38.3G\t-\t-\t1%\t3%\t1.00x\tONLINE\t-\n" +
+		"\tmirror-0\t19.5G\t1.21G\t18.3G\t-\t-\t1%\t6.19%\t-\tONLINE\n" +
+		"\t\t/dev/gpt/zfs0\t-\t-\t-\t-\t-\t-\t-\t-\tONLINE\n" +
+		"\t\t/dev/gpt/zfs1\t-\t-\t-\t-\t-\t-\t-\t-\tONLINE\n" +
+		"logs\t-\t-\t-\t-\t-\t-\t-\t-\t-\n" +
+		"\t/dev/ada2p1\t1.50G\t0\t1.50G\t-\t-\t0%\t0.00%\t-\tONLINE\n"
+	got := parseZpoolVdevs([]byte(out))
+	want := []string{"/dev/gpt/zfs0", "/dev/gpt/zfs1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseZpoolVdevs = %q; want %q", got, want)
+	}
+}
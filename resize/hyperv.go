@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// onHyperV reports whether this is a Hyper-V guest, per its DMI data.
+func onHyperV() bool {
+	field := func(name string) string {
+		b, _ := os.ReadFile(sysPath("/sys/class/dmi/id/" + name))
+		return strings.TrimSpace(string(b))
+	}
+	return field("sys_vendor") == "Microsoft Corporation" && field("product_name") == "Virtual Machine"
+}
+
+// A hypervDiskResizer rescans a Hyper-V virtual disk, as the guest
+// doesn't see a dynamic VHDX expansion until its storvsc SCSI host is
+// rescanned. It's the first step of a chain on such a disk, so the
+// layers above it see the disk's new size.
+type hypervDiskResizer string // "/dev/sda"
+
+func (r hypervDiskResizer) String() string { return fmt.Sprintf("Hyper-V disk %s", string(r)) }
+
+// hypervDisk returns the Resizer rescanning disk, a whole disk like
+// "/dev/sda", or nil if this isn't a Hyper-V guest or disk isn't on
+// one of its storvsc SCSI hosts.
+func hypervDisk(disk string) Resizer {
+	if UDisks || !onHyperV() {
+		return nil
+	}
+	r := hypervDiskResizer(disk)
+	if _, _, err := r.scsiPaths(); err != nil {
+		vlogf("hypervDisk(%q): %v", disk, err)
+		return nil
+	}
+	return r
+}
+
+var scsiHostDir = regexp.MustCompile(`^host[0-9]+$`)
+
+// scsiPaths returns the sysfs files rescanning the disk's SCSI device
+// and scanning its SCSI host, which must be a storvsc one.
+func (r hypervDiskResizer) scsiPaths() (rescan, scan string, err error) {
+	disk := string(r)
+	if d, err := evalSymlinks(disk); err == nil {
+		disk = d
+	}
+	name := filepath.Base(disk)
+	dev, err := evalSymlinks("/sys/block/" + name + "/device")
+	if err != nil {
+		return "", "", fmt.Errorf("%s isn't a SCSI disk: %w", name, err)
+	}
+	// The device is in its host's directory, as in
+	// .../host0/target0:0:0/0:0:0:0.
+	host := ""
+	for _, dir := range strings.Split(dev, "/") {
+		if scsiHostDir.MatchString(dir) {
+			host = dir
+		}
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("no SCSI host in %s", dev)
+	}
+	proc, err := os.ReadFile(sysPath("/sys/class/scsi_host/" + host + "/proc_name"))
+	if err != nil {
+		return "", "", err
+	}
+	if p := strings.TrimSpace(string(proc)); p != "storvsc" {
+		return "", "", fmt.Errorf("SCSI host %s of %s is %s, not storvsc", host, name, p)
+	}
+	return "/sys/block/" + name + "/device/rescan", "/sys/class/scsi_host/" + host + "/scan", nil
+}
+
+func (r hypervDiskResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r hypervDiskResizer) Size(ctx context.Context) (int64, error) { return blockDevSize(string(r)) }
+
+func (r hypervDiskResizer) DepResizers(ctx context.Context) ([]Resizer, error) { return nil, nil }
+
+// mayGrow is always true, as the disk's size in sysfs is stale until
+// it's rescanned.
+func (r hypervDiskResizer) mayGrow(ctx context.Context) (bool, error) { return true, nil }
+
+func (r hypervDiskResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	rescan, scan, err := r.scsiPaths()
+	if err != nil {
+		return Action{}, err
+	}
+	return Action{
+		Steps:        []string{"echo 1 > " + rescan, "echo '- - -' > " + scan},
+		CurrentBytes: n,
+	}, nil
+}
+
+func (r hypervDiskResizer) Resize(ctx context.Context) error {
+	rescan, scan, err := r.scsiPaths()
+	if err != nil {
+		return err
+	}
+	if err := checkNotDryRun("rescan of " + string(r)); err != nil {
+		return err
+	}
+	defer deviceChanges.Add(1)
+	// Rescanning the device re-reads its capacity; scanning the
+	// host too is what storvsc needs on older kernels.
+	if err := writeSysfs(sysPath(rescan), "1"); err != nil {
+		return fmt.Errorf("rescanning %s: %w", string(r), err)
+	}
+	if err := writeSysfs(sysPath(scan), "- - -"); err != nil {
+		return fmt.Errorf("scanning SCSI host of %s: %w", string(r), err)
+	}
+	return nil
+}
+
+// writeSysfs writes s to the sysfs attribute file f, through
+// Privileges.
+func writeSysfs(f, s string) error {
+	w, err := Privileges.OpenFile(f, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteString(s); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHyperVDisk(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = t.TempDir()
+	const scsi = "sys/devices/LNXSYSTM:00/VMBUS:00/f8b3781b/host0/target0:0:0/0:0:0:0"
+	files := map[string]string{
+		"sys/class/dmi/id/sys_vendor":         "Microsoft Corporation\n",
+		"sys/class/dmi/id/product_name":       "Virtual Machine\n",
+		"sys/class/scsi_host/host0/proc_name": "storvsc\n",
+		"sys/class/scsi_host/host0/scan":      "",
+		"sys/devices/vmbus/block/sda/size":    "62914560\n",
+		scsi + "/rescan":                      "",
+		"dev/sda":                             "",
+		"dev/sda1":                            "",
+	}
+	links := map[string]string{
+		"sys/block/sda":                      "../devices/vmbus/block/sda",
+		"sys/class/block/sda":                "../../devices/vmbus/block/sda",
+		"sys/devices/vmbus/block/sda/device": "../../../LNXSYSTM:00/VMBUS:00/f8b3781b/host0/target0:0:0/0:0:0:0",
+	}
+	for name, data := range files {
+		p := filepath.Join(Snapshot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		p := filepath.Join(Snapshot, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replayRecordings(t, nil) // lsblk fails, so DiskOf goes by name
+	ctx := context.Background()
+
+	deps, err := partitionResizer("/dev/sda1").DepResizers(ctx)
+	if err != nil || len(deps) != 1 || deps[0] != hypervDiskResizer("/dev/sda") {
+		t.Fatalf("DepResizers = %v, %v; want Hyper-V disk /dev/sda", deps, err)
+	}
+	if err := deps[0].Resize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for f, want := range map[string]string{scsi + "/rescan": "1", "sys/class/scsi_host/host0/scan": "- - -"} {
+		if got, _ := os.ReadFile(filepath.Join(Snapshot, f)); string(got) != want {
+			t.Errorf("%s = %q; want %q", f, got, want)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(Snapshot, "sys/class/scsi_host/host0/proc_name"), []byte("ata_piix\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if r := hypervDisk("/dev/sda"); r != nil {
+		t.Errorf("hypervDisk of a non-storvsc disk = %v; want nil", r)
+	}
+}
@@ -0,0 +1,397 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Image is a disk image file attached as a block device, a loop
+// device for a raw image or an NBD device for a qcow2 one, so the
+// partitions, LVM volumes, and filesystems in it can be grown as on a
+// disk. Its LVM volume groups mustn't share a name with the host's.
+type Image struct {
+	Path   string // the image file
+	Format string // "raw" or "qcow2"
+	Device string // where it's attached, "/dev/loop0" or "/dev/nbd0"
+
+	vgs []string // volume groups activated by Filesystem
+}
+
+// qcow2Magic starts a qcow2 image. Its header has the virtual disk's
+// size, in bytes, at offset 24.
+const qcow2Magic = "QFI\xfb"
+
+// ImageSize returns the format of the disk image at path, "qcow2" or
+// else "raw", and the size of the disk it holds.
+func ImageSize(path string) (format string, size int64, err error) {
+	hdr := make([]byte, 32)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	if n, _ := f.ReadAt(hdr, 0); n == len(hdr) && string(hdr[:4]) == qcow2Magic {
+		return "qcow2", int64(binary.BigEndian.Uint64(hdr[24:])), nil
+	}
+	return "raw", fi.Size(), nil
+}
+
+// GrowImage enlarges the disk in the image file at path to size bytes,
+// with qemu-img for a qcow2 image or truncate for a raw one. It
+// reports whether the image grew: not if it was already size bytes.
+func GrowImage(ctx context.Context, path string, size int64) (grew bool, err error) {
+	format, cur, err := ImageSize(path)
+	if err != nil {
+		return false, err
+	}
+	if size < cur {
+		return false, fmt.Errorf("%w: image %s is %s, more than %s", ErrWouldShrink, path, HumanBytes(cur), HumanBytes(size))
+	}
+	if size == cur {
+		return false, nil
+	}
+	cmd := Command(ctx, "truncate", "-s", strconv.FormatInt(size, 10), path)
+	if format == "qcow2" {
+		cmd = Command(ctx, "qemu-img", "resize", "-f", "qcow2", path, strconv.FormatInt(size, 10))
+	}
+	if out, err := runCmd("image "+path, cmd); err != nil {
+		return false, toolError(cmd, out, err)
+	}
+	return true, nil
+}
+
+// AttachImage attaches the disk image at path: a raw image to a loop
+// device with losetup, or a qcow2 one to an NBD device with qemu-nbd.
+// Either way, the kernel scans it for partitions. The caller must
+// Detach it.
+func AttachImage(ctx context.Context, path string) (*Image, error) {
+	format, _, err := ImageSize(path)
+	if err != nil {
+		return nil, err
+	}
+	im := &Image{Path: path, Format: format}
+	stage := "image " + path
+	if format == "raw" {
+		cmd := Command(ctx, "losetup", "--find", "--show", "--partscan", path)
+		out, err := runCmd(stage, cmd)
+		if err != nil {
+			return nil, toolError(cmd, out, err)
+		}
+		im.Device = strings.TrimSpace(string(out))
+	} else {
+		// Without max_part, NBD devices have no partitions. If the
+		// module's already loaded, it keeps its settings.
+		cmd := Command(ctx, "modprobe", "nbd", "max_part=16")
+		if out, err := runCmd(stage, cmd); err != nil {
+			return nil, toolError(cmd, out, err)
+		}
+		if im.Device, err = freeNBD(); err != nil {
+			return nil, err
+		}
+		cmd = Command(ctx, "qemu-nbd", "--connect="+im.Device, "--format=qcow2", path)
+		if out, err := runCmd(stage, cmd); err != nil {
+			return nil, toolError(cmd, out, err)
+		}
+	}
+	if err := im.waitReady(ctx); err != nil {
+		im.Detach(ctx)
+		return nil, err
+	}
+	return im, nil
+}
+
+// freeNBD returns an NBD device that's not connected: one without a
+// pid file in sysfs.
+func freeNBD() (string, error) {
+	devs, _ := filepath.Glob("/sys/block/nbd*")
+	for _, d := range devs {
+		if _, err := os.Stat(filepath.Join(d, "pid")); os.IsNotExist(err) {
+			return "/dev/" + filepath.Base(d), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no free NBD device; is the nbd module loaded?", ErrDeviceNotFound)
+}
+
+// waitReady waits for im's device to have a size and for udev to have
+// made the device nodes for its partitions.
+func (im *Image) waitReady(ctx context.Context) error {
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		n, err := blockDevSize(im.Device)
+		if err == nil && n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s attached to %s but has no size after %v", im.Path, im.Device, settleTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if cmd, ok := udevSettleCommand(ctx); ok {
+		if out, err := output(cmd); err != nil {
+			Logger.Warn("waiting for udev failed", "err", toolError(cmd, out, err))
+		}
+	}
+	return nil
+}
+
+// Detach deactivates the LVM volume groups Filesystem activated and
+// detaches im's device.
+func (im *Image) Detach(ctx context.Context) error {
+	var errs []error
+	stage := "image " + im.Path
+	for _, vg := range im.vgs {
+		cmd := Command(ctx, "vgchange", "-an", vg)
+		if out, err := runCmd(stage, cmd); err != nil {
+			errs = append(errs, toolError(cmd, out, err))
+		}
+	}
+	im.vgs = nil
+	cmd := Command(ctx, "losetup", "-d", im.Device)
+	if im.Format == "qcow2" {
+		cmd = Command(ctx, "qemu-nbd", "--disconnect", im.Device)
+	}
+	if out, err := runCmd(stage, cmd); err != nil {
+		errs = append(errs, toolError(cmd, out, err))
+	}
+	return errors.Join(errs...)
+}
+
+// blockDevicesBelow returns dev and all the devices below it in the
+// block device topology, such as its partitions and the LVs on them.
+func blockDevicesBelow(ctx context.Context, dev string) ([]*BlockDevice, error) {
+	devs, err := Topology(ctx)
+	if err != nil {
+		return nil, err
+	}
+	root := findBlockDevice(devs, filepath.Base(dev))
+	if root == nil {
+		return nil, fmt.Errorf("%w: lsblk doesn't list %s", ErrDeviceNotFound, dev)
+	}
+	var all []*BlockDevice
+	var walk func(d *BlockDevice)
+	walk = func(d *BlockDevice) {
+		all = append(all, d)
+		for _, c := range d.Children {
+			walk(c)
+		}
+	}
+	walk(root)
+	return all, nil
+}
+
+// growableFilesystems returns those of devs holding a filesystem
+// that might be in an fstab and be grown.
+func growableFilesystems(devs []*BlockDevice) []*BlockDevice {
+	var fss []*BlockDevice
+	for _, d := range devs {
+		if growableFS(d.FSType) {
+			fss = append(fss, d)
+		}
+	}
+	return fss
+}
+
+// activateLVM activates the volume groups on im's PVs.
+func (im *Image) activateLVM(ctx context.Context, devs []*BlockDevice) error {
+	for _, d := range devs {
+		if d.FSType != "LVM2_member" {
+			continue
+		}
+		out, err := query(ctx, Command(ctx, "pvs", "--noheadings", "-o", "vg_name", "/dev/"+d.KName))
+		if err != nil {
+			return err
+		}
+		vg := strings.TrimSpace(string(out))
+		if vg == "" || slices.Contains(im.vgs, vg) {
+			continue
+		}
+		cmd := Command(ctx, "vgchange", "-ay", vg)
+		if out, err := runCmd("image "+im.Path, cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+		im.vgs = append(im.vgs, vg)
+	}
+	return nil
+}
+
+// growableFS reports whether fstype is a filesystem type that might
+// hold an fstab, and can be grown.
+func growableFS(fstype string) bool {
+	switch fstype {
+	case "ext2", "ext3", "ext4", "xfs", "btrfs":
+		return true
+	}
+	return false
+}
+
+// Filesystem returns the device in im holding the filesystem that the
+// image's own /etc/fstab mounts at mnt, and its type. It activates any
+// LVM volume groups in the image to find it, and mounts the image's
+// filesystems read-only, one at a time, to find the fstab. An image
+// without an fstab but with only one filesystem has that at "/".
+func (im *Image) Filesystem(ctx context.Context, mnt string) (dev, fstype string, err error) {
+	devs, err := blockDevicesBelow(ctx, im.Device)
+	if err != nil {
+		return "", "", err
+	}
+	if err := im.activateLVM(ctx, devs); err != nil {
+		return "", "", err
+	}
+	if len(im.vgs) > 0 {
+		if devs, err = blockDevicesBelow(ctx, im.Device); err != nil {
+			return "", "", err
+		}
+	}
+	fss := growableFilesystems(devs)
+	ents, err := im.readFstab(ctx, fss)
+	if err != nil {
+		return "", "", err
+	}
+	if ents == nil {
+		if filepath.Clean(mnt) == "/" && len(fss) == 1 {
+			return "/dev/" + fss[0].KName, fss[0].FSType, nil
+		}
+		return "", "", fmt.Errorf("%w: no /etc/fstab found in image %s", ErrDeviceNotFound, im.Path)
+	}
+	for _, e := range ents {
+		if filepath.Clean(e.file) != filepath.Clean(mnt) {
+			continue
+		}
+		if d := matchSpec(ctx, fss, e.spec); d != nil {
+			return "/dev/" + d.KName, d.FSType, nil
+		}
+		return "", "", fmt.Errorf("%w: image %s has no filesystem matching %s, its fstab entry for %s", ErrDeviceNotFound, im.Path, e.spec, mnt)
+	}
+	return "", "", fmt.Errorf("%w: %s isn't in the /etc/fstab of image %s", ErrDeviceNotFound, mnt, im.Path)
+}
+
+// readFstab returns the entries of the first /etc/fstab found on the
+// filesystems fss, or nil if there's none.
+func (im *Image) readFstab(ctx context.Context, fss []*BlockDevice) ([]fstabEntry, error) {
+	for _, d := range fss {
+		dir, unmount, err := im.Mount(ctx, "/dev/"+d.KName, "ro")
+		if err != nil {
+			return nil, err
+		}
+		ents, ferr := readFstab(filepath.Join(dir, "etc/fstab"))
+		if err := unmount(); err != nil {
+			return nil, err
+		}
+		if ferr == nil {
+			return ents, nil
+		}
+	}
+	return nil, nil
+}
+
+// matchSpec returns the filesystem in fss that the fstab device spec
+// names, or nil. Device paths, which name devices as the system the
+// fstab is for sees them, are matched by partition number or LV name.
+func matchSpec(ctx context.Context, fss []*BlockDevice, spec string) *BlockDevice {
+	if dir, v, ok := strings.Cut(strings.TrimPrefix(spec, "/dev/disk/by-"), "/"); ok && strings.HasPrefix(spec, "/dev/disk/by-") {
+		spec = strings.ToUpper(dir) + "=" + v // "/dev/disk/by-uuid/x" is "UUID=x"
+	}
+	k, v, ok := strings.Cut(spec, "=")
+	if !ok {
+		return matchDevPath(fss, spec)
+	}
+	key := map[string]string{
+		"UUID":      "UUID",
+		"LABEL":     "LABEL",
+		"PARTUUID":  "PART_ENTRY_UUID",
+		"PARTLABEL": "PART_ENTRY_NAME",
+	}[k]
+	v = strings.Trim(v, `"`)
+	for _, d := range fss {
+		out, err := query(ctx, Command(ctx, "blkid", "-p", "-o", "export", "/dev/"+d.KName))
+		if err != nil {
+			continue
+		}
+		got := parseBlkidExport(out)[key]
+		if got == v || (k == "UUID" || k == "PARTUUID") && strings.EqualFold(got, v) {
+			return d
+		}
+	}
+	return nil
+}
+
+// matchDevPath returns the filesystem in fss on the device path names
+// as the image sees it: "/dev/mapper/vg-root" or "/dev/vg/root" for
+// an LV, or a partition like "/dev/sda2" or "/dev/nvme0n1p2" by its
+// number.
+func matchDevPath(fss []*BlockDevice, path string) *BlockDevice {
+	name := strings.TrimPrefix(path, "/dev/")
+	if vg, lv, ok := strings.Cut(strings.TrimPrefix(name, "mapper/"), "/"); ok {
+		// Device mapper doubles the dashes in VG and LV names.
+		name = strings.ReplaceAll(vg, "-", "--") + "-" + strings.ReplaceAll(lv, "-", "--")
+	} else {
+		name = strings.TrimPrefix(name, "mapper/")
+	}
+	for _, d := range fss {
+		if d.Type == "lvm" && d.Name == name {
+			return d
+		}
+	}
+	if !isPartitionDev("/dev/" + name) {
+		return nil
+	}
+	num := name[len(strings.TrimRight(name, "0123456789")):]
+	for _, d := range fss {
+		// The image's partitions are named like "loop0p2" or "nbd0p2".
+		if d.Type == "part" && strings.HasSuffix(d.KName, "p"+num) {
+			return d
+		}
+	}
+	return nil
+}
+
+// Mount mounts the filesystem on dev, a device in im, with the mount
+// options opts on a new temporary directory, and returns the directory
+// and a func unmounting it and removing the directory.
+func (im *Image) Mount(ctx context.Context, dev, opts string) (dir string, unmount func() error, err error) {
+	dir, err = os.MkdirTemp("", "embiggen-image-")
+	if err != nil {
+		return "", nil, err
+	}
+	stage := "image " + im.Path
+	cmd := Command(ctx, "mount", "-o", opts, dev, dir)
+	if out, err := runCmd(stage, cmd); err != nil {
+		os.Remove(dir)
+		return "", nil, toolError(cmd, out, err)
+	}
+	return dir, func() error {
+		cmd := Command(context.Background(), "umount", dir)
+		if out, err := runCmd(stage, cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+		return os.Remove(dir)
+	}, nil
+}
@@ -0,0 +1,395 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// An imagePart is a partition for writeMBR or writeGPT to put in a
+// disk image.
+type imagePart struct {
+	start, size int64  // in 512 byte sectors
+	typ         string // MBR type in hex, like "83", or GPT type GUID
+	name        string // GPT partition name
+}
+
+// newImage returns the path of a new sparse disk image of size bytes.
+func newImage(t *testing.T, size int64) string {
+	t.Helper()
+	img := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// writeSectors writes b to img at sector lba.
+func writeSectors(t *testing.T, img string, lba int64, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(img, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(b, lba*512); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func imageSectors(t *testing.T, img string) int64 {
+	t.Helper()
+	fi, err := os.Stat(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size() / 512
+}
+
+// mbr returns a master boot record with up to four primary
+// partitions.
+func mbr(t *testing.T, parts []imagePart) []byte {
+	t.Helper()
+	b := make([]byte, 512)
+	for i, p := range parts {
+		typ, err := strconv.ParseUint(p.typ, 16, 8)
+		if err != nil {
+			t.Fatalf("bad MBR type %q", p.typ)
+		}
+		e := b[446+16*i:]
+		e[4] = byte(typ)
+		binary.LittleEndian.PutUint32(e[8:], uint32(p.start))
+		binary.LittleEndian.PutUint32(e[12:], uint32(p.size))
+	}
+	b[510], b[511] = 0x55, 0xAA
+	return b
+}
+
+// writeMBR gives img an MBR partition table with parts.
+func writeMBR(t *testing.T, img string, parts []imagePart) {
+	t.Helper()
+	writeSectors(t, img, 0, mbr(t, parts))
+}
+
+// guid returns the on-disk form of a GUID, whose first three fields
+// are little-endian.
+func guid(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		t.Fatalf("bad GUID %q", s)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// writeGPT gives img a GPT partition table with parts, and its
+// protective MBR, as sfdisk would: 128 entries, with the backup
+// header and entries at the end of the image.
+func writeGPT(t *testing.T, img string, parts []imagePart) {
+	t.Helper()
+	sectors := imageSectors(t, img)
+	writeSectors(t, img, 0, mbr(t, []imagePart{{start: 1, size: min(sectors-1, 1<<32-1), typ: "ee"}}))
+
+	const numEntries, entrySize = 128, 128
+	entries := make([]byte, numEntries*entrySize)
+	for i, p := range parts {
+		e := entries[i*entrySize:]
+		copy(e[0:], guid(t, p.typ))
+		copy(e[16:], guid(t, "5A4C4B49-2D0E-4E5B-8C61-AB5F1C0E2E"+strconv.Itoa(10+i)))
+		binary.LittleEndian.PutUint64(e[32:], uint64(p.start))
+		binary.LittleEndian.PutUint64(e[40:], uint64(p.start+p.size-1))
+		for j, c := range utf16.Encode([]rune(p.name)) {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	entrySectors := int64(len(entries) / 512)
+	header := func(cur, backup, entriesLBA int64) []byte {
+		h := make([]byte, 512)
+		copy(h, "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:], 92)
+		binary.LittleEndian.PutUint64(h[24:], uint64(cur))
+		binary.LittleEndian.PutUint64(h[32:], uint64(backup))
+		binary.LittleEndian.PutUint64(h[40:], uint64(2+entrySectors))
+		binary.LittleEndian.PutUint64(h[48:], uint64(sectors-2-entrySectors))
+		copy(h[56:], guid(t, "841DBE6B-6A8D-43E1-93E1-D765373DDE3B"))
+		binary.LittleEndian.PutUint64(h[72:], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(h[80:], numEntries)
+		binary.LittleEndian.PutUint32(h[84:], entrySize)
+		binary.LittleEndian.PutUint32(h[88:], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+	last := sectors - 1
+	writeSectors(t, img, 1, header(1, last, 2))
+	writeSectors(t, img, 2, entries)
+	writeSectors(t, img, last-entrySectors, entries)
+	writeSectors(t, img, last, header(last, 1, last-entrySectors))
+}
+
+func TestImagePartitionTable(t *testing.T) {
+	if _, err := ToolPath("sfdisk"); err != nil {
+		t.Skip(err)
+	}
+	const size = 64 << 20
+	tests := []struct {
+		name  string
+		write func(*testing.T, string, []imagePart)
+		label string
+		parts []imagePart
+	}{
+		{"mbr", writeMBR, "dos", []imagePart{
+			{start: 2048, size: 16384, typ: "c"},
+			{start: 18432, size: 32768, typ: "83"},
+		}},
+		{"gpt", writeGPT, "gpt", []imagePart{
+			{start: 2048, size: 16384, typ: "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", name: "EFI System Partition"},
+			{start: 18432, size: 32768, typ: linuxGPTTypeID, name: "root"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newImage(t, size)
+			tt.write(t, img, tt.parts)
+			ctx := withQueryCache(context.Background())
+			pt, err := getPartitionTable(ctx, img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pt.Meta("label"); got != tt.label {
+				t.Errorf("label = %q; want %q", got, tt.label)
+			}
+			if len(pt.parts) != len(tt.parts) {
+				t.Fatalf("got %d partitions; want %d", len(pt.parts), len(tt.parts))
+			}
+			for i, p := range pt.parts {
+				want := tt.parts[i]
+				if p.pno != i+1 || p.Start() != want.start || p.Size() != want.size || !strings.EqualFold(p.Type(), want.typ) {
+					t.Errorf("partition %d = %v; want %+v", i+1, p, want)
+				}
+			}
+			if tt.label == "gpt" {
+				if got, want := pt.Meta("last-lba"), strconv.Itoa(size/512-34); got != want {
+					t.Errorf("last-lba = %s; want %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestImageOldSfdisk checks that with an sfdisk too old to say what
+// kind of partition table it read, only an MBR is trusted.
+func TestImageOldSfdisk(t *testing.T) {
+	ctx := withQueryCache(context.Background())
+	oldSfdisk := &partitionTable{meta: []string{"unit: sectors"}}
+
+	img := newImage(t, 64<<20)
+	writeMBR(t, img, []imagePart{{start: 2048, size: 16384, typ: "83"}})
+	if isGPT, err := partitionTableIsGPT(ctx, img, oldSfdisk); isGPT || err != nil {
+		t.Errorf("MBR image: partitionTableIsGPT = %v, %v; want false, nil", isGPT, err)
+	}
+
+	img = newImage(t, 64<<20)
+	writeGPT(t, img, []imagePart{{start: 2048, size: 16384, typ: linuxGPTTypeID}})
+	if _, err := partitionTableIsGPT(ctx, img, oldSfdisk); err == nil || !strings.Contains(err.Error(), "unexpected gpt") {
+		t.Errorf("GPT image: partitionTableIsGPT error = %v; want unexpected gpt", err)
+	}
+}
+
+func TestImageProbePTType(t *testing.T) {
+	tests := []struct {
+		name    string
+		write   func(t *testing.T, img string)
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "mbr",
+			write: func(t *testing.T, img string) { writeMBR(t, img, []imagePart{{start: 2048, size: 16384, typ: "83"}}) },
+			want:  "dos",
+		},
+		{
+			name: "gpt",
+			write: func(t *testing.T, img string) {
+				writeGPT(t, img, []imagePart{{start: 2048, size: 16384, typ: linuxGPTTypeID}})
+			},
+			want: "gpt",
+		},
+		{
+			name: "gpt-4k",
+			write: func(t *testing.T, img string) {
+				writeGPT(t, img, []imagePart{{start: 2048, size: 16384, typ: linuxGPTTypeID}})
+				// Move the header from the second 512 byte sector
+				// to the second 4096 byte one.
+				b := make([]byte, 512)
+				f, err := os.OpenFile(img, os.O_RDWR, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				f.ReadAt(b, 512)
+				f.WriteAt(make([]byte, 512), 512)
+				f.WriteAt(b, 4096)
+			},
+			want: "gpt",
+		},
+		{
+			name: "protective-mbr-only",
+			write: func(t *testing.T, img string) {
+				writeGPT(t, img, []imagePart{{start: 2048, size: 16384, typ: linuxGPTTypeID}})
+				writeSectors(t, img, 1, make([]byte, 512))
+			},
+			wantErr: "protective MBR",
+		},
+		{
+			name: "bad-gpt-crc",
+			write: func(t *testing.T, img string) {
+				writeGPT(t, img, []imagePart{{start: 2048, size: 16384, typ: linuxGPTTypeID}})
+				writeSectors(t, img, 1, append([]byte("EFI PART"), make([]byte, 504)...))
+			},
+			wantErr: "GPT header",
+		},
+		{
+			name:    "blank",
+			write:   func(t *testing.T, img string) {},
+			wantErr: "no MBR or GPT",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := newImage(t, 64<<20)
+			tt.write(t, img)
+			got, err := probePTType(img)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("probePTType = %q, %v; want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("probePTType = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageExtSuperblock(t *testing.T) {
+	if _, err := ToolPath("mke2fs"); err != nil {
+		t.Skip(err)
+	}
+	// The filesystem fills only half of the image, as after the
+	// layers below it grow.
+	img := newImage(t, 64<<20)
+	out, err := Command(context.Background(), "mke2fs", "-q", "-F", "-t", "ext4", "-b", "4096", img, "8192").CombinedOutput()
+	if err != nil {
+		t.Fatalf("mke2fs: %v, %s", err, out)
+	}
+	fsBytes, blockSize, ok, err := superblockSize(img, "ext4")
+	if !ok || err != nil {
+		t.Fatalf("superblockSize = %v, %v", ok, err)
+	}
+	if fsBytes != 32<<20 || blockSize != 4096 {
+		t.Errorf("superblockSize = %d bytes, %d byte blocks; want %d, 4096", fsBytes, blockSize, 32<<20)
+	}
+
+	// An MBR image isn't ext4.
+	img = newImage(t, 64<<20)
+	writeMBR(t, img, []imagePart{{start: 2048, size: 16384, typ: "83"}})
+	if _, _, _, err := superblockSize(img, "ext4"); err == nil {
+		t.Error("superblockSize of an MBR image succeeded")
+	}
+}
+
+func TestImageSize(t *testing.T) {
+	raw := newImage(t, 10<<20)
+	if format, size, err := ImageSize(raw); err != nil || format != "raw" || size != 10<<20 {
+		t.Errorf("ImageSize(raw) = %q, %d, %v; want raw, %d", format, size, err, 10<<20)
+	}
+	// A qcow2 header for a 20 GiB disk; the file itself is small.
+	qcow := newImage(t, 64<<10)
+	hdr := make([]byte, 512)
+	copy(hdr, qcow2Magic)
+	binary.BigEndian.PutUint32(hdr[4:], 3)
+	binary.BigEndian.PutUint64(hdr[24:], 20<<30)
+	writeSectors(t, qcow, 0, hdr)
+	if format, size, err := ImageSize(qcow); err != nil || format != "qcow2" || size != 20<<30 {
+		t.Errorf("ImageSize(qcow2) = %q, %d, %v; want qcow2, %d", format, size, err, int64(20<<30))
+	}
+}
+
+func TestGrowImageRaw(t *testing.T) {
+	if _, err := ToolPath("truncate"); err != nil {
+		t.Skip(err)
+	}
+	img := newImage(t, 10<<20)
+	ctx := context.Background()
+	if grew, err := GrowImage(ctx, img, 30<<20); err != nil || !grew {
+		t.Fatalf("GrowImage = %v, %v; want true, nil", grew, err)
+	}
+	if _, size, _ := ImageSize(img); size != 30<<20 {
+		t.Errorf("size after GrowImage = %d; want %d", size, 30<<20)
+	}
+	if grew, err := GrowImage(ctx, img, 30<<20); err != nil || grew {
+		t.Errorf("second GrowImage = %v, %v; want false, nil", grew, err)
+	}
+	if _, err := GrowImage(ctx, img, 20<<20); !errors.Is(err, ErrWouldShrink) {
+		t.Errorf("shrinking GrowImage error = %v; want ErrWouldShrink", err)
+	}
+}
+
+func TestMatchDevPath(t *testing.T) {
+	fss := []*BlockDevice{
+		{Name: "loop0p1", KName: "loop0p1", Type: "part", FSType: "vfat"},
+		{Name: "loop0p2", KName: "loop0p2", Type: "part", FSType: "ext4"},
+		{Name: "my--vg-root", KName: "dm-3", Type: "lvm", FSType: "xfs"},
+	}
+	for path, want := range map[string]string{
+		"/dev/sda2":               "loop0p2",
+		"/dev/vda1":               "loop0p1",
+		"/dev/nvme0n1p2":          "loop0p2",
+		"/dev/mapper/my--vg-root": "dm-3",
+		"/dev/my-vg/root":         "dm-3",
+		"/dev/sda3":               "",
+		"/dev/nvme0n1":            "",
+	} {
+		got := ""
+		if d := matchDevPath(fss, path); d != nil {
+			got = d.KName
+		}
+		if got != want {
+			t.Errorf("matchDevPath(%q) = %q; want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readOnlyFSTypes are filesystem types that are read-only images,
+// never resizable in place.
+var readOnlyFSTypes = map[string]bool{
+	"squashfs": true,
+	"erofs":    true,
+	"cramfs":   true,
+	"iso9660":  true,
+	"romfs":    true,
+}
+
+// overlayError returns an error wrapping ErrImmutable if fs is an
+// overlay, or a root filesystem in memory, as on live media: a
+// read-only image with changes kept in memory or elsewhere. If the
+// changes are kept on a block device, the error points there, as
+// that's what to grow instead. Otherwise it returns nil.
+func overlayError(fs FSStat) error {
+	switch fs.Type {
+	case "overlay":
+	case "tmpfs", "ramfs":
+		if fs.Mountpoint != "/" {
+			return nil
+		}
+		return fmt.Errorf("%w: / is a %s filesystem in memory, as on a live system; there's nothing on disk to grow", ErrImmutable, fs.Type)
+	default:
+		return nil
+	}
+	var upper string
+	for _, o := range strings.Split(fs.SuperOptions, ",") {
+		if v, ok := strings.CutPrefix(o, "upperdir="); ok {
+			upper = UnescapeMount(v)
+		}
+	}
+	if upper == "" {
+		return fmt.Errorf("%w: %s is a read-only overlay filesystem", ErrImmutable, fs.Mountpoint)
+	}
+	mounts, err := Mounts()
+	if err != nil {
+		return err
+	}
+	m, ok := containingMount(mounts, upper)
+	if !ok || !strings.HasPrefix(m.Source, "/dev/") {
+		return fmt.Errorf("%w: %s is an overlay filesystem whose changes are kept in memory, as on a live system; there's nothing on disk to grow", ErrImmutable, fs.Mountpoint)
+	}
+	return fmt.Errorf("%w: %s is an overlay filesystem whose changes are stored in %s on %s; grow the filesystem at %s instead", ErrImmutable, fs.Mountpoint, upper, m.Source, m.Mountpoint)
+}
+
+// containingMount returns the mount that path, in the mount table's
+// namespace, is in: the last mounted of those with the longest mount
+// point containing it.
+func containingMount(mounts []Mount, path string) (m Mount, ok bool) {
+	path = filepath.Clean(path)
+	for _, mm := range mounts {
+		mp := mm.Mountpoint
+		if path != mp && mp != "/" && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if !ok || len(mp) >= len(m.Mountpoint) {
+			m, ok = mm, true
+		}
+	}
+	return m, ok
+}
+
+// immutableReason returns why the filesystem of type fstype on the
+// block device dev sits on a stack that can't be resized at all, such
+// as a read-only image or dm-verity, or the empty string if it
+// doesn't.
+func immutableReason(fstype, dev string) string {
+	if readOnlyFSTypes[fstype] {
+		return "a read-only image"
+	}
+	name := dev
+	if d, err := evalSymlinks(dev); err == nil {
+		name = d
+	}
+	name = filepath.Base(name)
+	sys := sysPath("/sys/class/block/" + name)
+	if _, err := os.Stat(sys); err != nil {
+		return ""
+	}
+	if strings.HasPrefix(name, "dm-") {
+		uuid, _ := os.ReadFile(sys + "/dm/uuid")
+		if strings.HasPrefix(string(uuid), "CRYPT-VERITY-") {
+			return fmt.Sprintf("on the dm-verity device %s, whose size is fixed by its hash tree", dev)
+		}
+	}
+	if strings.HasPrefix(name, "loop") {
+		if ro, _ := readInt64File(sys + "/ro"); ro == 1 {
+			if backing, err := os.ReadFile(sys + "/loop/backing_file"); err == nil {
+				return fmt.Sprintf("on the read-only loop device %s, backed by %s", dev, strings.TrimSpace(string(backing)))
+			}
+			return fmt.Sprintf("on the read-only loop device %s", dev)
+		}
+	}
+	if ro, _ := readInt64File(sys + "/ro"); ro == 1 {
+		return fmt.Sprintf("on %s, which the kernel has read-only", dev)
+	}
+	return ""
+}
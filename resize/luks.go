@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// LUKSHeaderBackupDir, if non-empty, is where Resize saves the header
+// of a LUKS container on a partition, with cryptsetup
+// luksHeaderBackup, before changing the partition, so a resize gone
+// wrong can't leave the container's data unrecoverable. Each backup
+// is named for the partition and the time, like
+// "sda3-20260102T150405Z.luksheader".
+var LUKSHeaderBackupDir string
+
+// luksBackupCommand returns the command saving the LUKS header of the
+// partition dev to LUKSHeaderBackupDir at time t, if that's set and
+// lsblk says dev holds a LUKS container.
+func luksBackupCommand(ctx context.Context, dev string, t time.Time) (cmd *exec.Cmd, ok bool) {
+	if LUKSHeaderBackupDir == "" {
+		return nil, false
+	}
+	if d := lookupBlockDevice(ctx, dev); d == nil || d.FSType != "crypto_LUKS" {
+		return nil, false
+	}
+	file := filepath.Join(LUKSHeaderBackupDir, fmt.Sprintf("%s-%s.luksheader", filepath.Base(dev), t.UTC().Format("20060102T150405Z")))
+	return Command(ctx, "cryptsetup", "luksHeaderBackup", dev, "--header-backup-file", file), true
+}
+
+// backupLUKSHeader saves the header of the LUKS container on the
+// partition dev, if LUKSHeaderBackupDir is set and it has one.
+func backupLUKSHeader(ctx context.Context, dev string) error {
+	cmd, ok := luksBackupCommand(ctx, dev, time.Now())
+	if !ok {
+		return nil
+	}
+	if err := Privileges.MkdirAll(LUKSHeaderBackupDir, 0700); err != nil {
+		return fmt.Errorf("backing up LUKS header of %s: %v", dev, err)
+	}
+	if out, err := runCmd(partitionResizer(dev).String(), cmd); err != nil {
+		return fmt.Errorf("backing up LUKS header of %s before resizing it: %w", dev, toolError(cmd, out, err))
+	}
+	Logger.Info("backed up LUKS header", "device", dev, "file", cmd.Args[len(cmd.Args)-1])
+	return nil
+}
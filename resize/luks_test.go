@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const lsblkLUKSOnPartition = `{
+   "blockdevices": [
+      {"name":"vda", "kname":"vda", "pkname":null, "type":"disk", "maj:min":"254:0", "fstype":null, "mountpoint":null,
+         "children": [
+            {"name":"vda1", "kname":"vda1", "pkname":"vda", "type":"part", "maj:min":"254:1", "fstype":"ext4", "mountpoint":"/boot"},
+            {"name":"vda2", "kname":"vda2", "pkname":"vda", "type":"part", "maj:min":"254:2", "fstype":"crypto_LUKS", "mountpoint":null,
+               "children": [
+                  {"name":"luks-root", "kname":"dm-0", "pkname":"vda2", "type":"crypt", "maj:min":"253:0", "fstype":"ext4", "mountpoint":"/"}
+               ]
+            }
+         ]
+      }
+   ]
+}`
+
+func TestLUKSBackupCommand(t *testing.T) {
+	defer func(old string) { LUKSHeaderBackupDir = old }(LUKSHeaderBackupDir)
+	ctx := withQueryCache(context.Background())
+	replayRecordings(t, []Recording{
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Stdout: lsblkLUKSOnPartition},
+	})
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	LUKSHeaderBackupDir = ""
+	if cmd, ok := luksBackupCommand(ctx, "/dev/vda2", at); ok {
+		t.Errorf("without LUKSHeaderBackupDir, got %q", cmd.Args)
+	}
+
+	LUKSHeaderBackupDir = "/var/backups/luks"
+	if cmd, ok := luksBackupCommand(ctx, "/dev/vda1", at); ok {
+		t.Errorf("for non-LUKS /dev/vda1, got %q", cmd.Args)
+	}
+	cmd, ok := luksBackupCommand(ctx, "/dev/vda2", at)
+	if !ok {
+		t.Fatal("no command for LUKS /dev/vda2")
+	}
+	got := strings.Join(cmd.Args, " ")
+	want := "cryptsetup luksHeaderBackup /dev/vda2 --header-backup-file /var/backups/luks/vda2-20260102T150405Z.luksheader"
+	if got != want {
+		t.Errorf("command = %q; want %q", got, want)
+	}
+}
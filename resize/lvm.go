@@ -0,0 +1,352 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dmUUID returns the device mapper UUID of dev, such as "LVM-" and
+// the VG and LV UUIDs for an LVM LV or "CRYPT-LUKS2-..." for dm-crypt,
+// as the kernel reports it in sysfs. It returns false if sysfs doesn't
+// say, as when dev isn't a device mapper device.
+func dmUUID(dev string) (string, bool) {
+	if d, err := evalSymlinks(dev); err == nil {
+		dev = d
+	}
+	b, err := os.ReadFile(sysPath("/sys/class/block/" + filepath.Base(dev) + "/dm/uuid"))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
+
+type lvResizer string // /dev/mapper/debianvg-root
+
+// NewLVResizer returns the Resizer for the LVM logical volume lv, such
+// as "/dev/mapper/vg-root". Its dependencies are its volume group's
+// PVs.
+func NewLVResizer(lv string) Resizer { return lvResizer(lv) }
+
+func (r lvResizer) String() string { return fmt.Sprintf("LVM LV %s", string(r)) }
+
+type lvState struct {
+	dev        string // 0th element in lvdisplay -c
+	vg         string // 1
+	numSectors int64  // 6
+}
+
+func (r lvResizer) state(ctx context.Context) (s lvState, err error) {
+	s.dev = string(r)
+	// # lvdisplay -c /dev/mapper/debvg-root
+	//   /dev/debvg/root:debvg:3:1:-1:1:8434778112:1029636:-1:0:-1:254:0
+	cmd := Command(ctx, "lvdisplay", "-c", s.dev)
+	outb, err := query(ctx, cmd)
+	if err != nil {
+		return s, err
+	}
+	return parseLVDisplay(s.dev, outb)
+}
+
+// parseLVDisplay parses the output of lvdisplay -c dev.
+func parseLVDisplay(dev string, out []byte) (s lvState, err error) {
+	s.dev = dev
+	f, ok := colonRecord(out, 13)
+	if !ok {
+		return s, fmt.Errorf("too few expected fields in lvdisplay -c %s output: %q", dev, out)
+	}
+	s.vg = f[1]
+	s.numSectors, err = strconv.ParseInt(f[6], 10, 64)
+	if err != nil || s.numSectors < 0 || s.numSectors > math.MaxInt64/512 || s.vg == "" {
+		return s, fmt.Errorf("bogus field at index 6 in lvdisplay -c %s output: %q: %v", dev, out, err)
+	}
+	return s, nil
+}
+
+func (r lvResizer) check(ctx context.Context) error {
+	if UDisks {
+		return fmt.Errorf("%v: %w", r, errUDisksUnsupported)
+	}
+	return nil
+}
+
+func (r lvResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	pvs, err := r.pvs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var deps []Resizer
+	for _, pv := range pvs {
+		deps = append(deps, pvResizer(pv))
+	}
+	return deps, nil
+}
+
+// pvs returns the PVs of r's volume group to grow: every one, since
+// lvextend can allocate from any of them, or with Disks, those on
+// them.
+func (r lvResizer) pvs(ctx context.Context) ([]string, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := Command(ctx, "pvdisplay", "-c")
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	all := vgPVs(out, lvs.vg)
+	if len(Disks) == 0 {
+		return all, nil
+	}
+	var pvs []string
+	for _, pv := range all {
+		if onSelectedDisk(ctx, pv) {
+			pvs = append(pvs, pv)
+		}
+	}
+	if len(pvs) == 0 {
+		return nil, fmt.Errorf("no PV of volume group %s (%s) is on %s: %w", lvs.vg, strings.Join(all, ", "), strings.Join(Disks, ", "), ErrDeviceNotFound)
+	}
+	return pvs, nil
+}
+
+// extendCmd returns the lvextend command growing r into its volume
+// group's free space, or with Disks, the free space of its PVs on them.
+func (r lvResizer) extendCmd(ctx context.Context) (*exec.Cmd, error) {
+	if len(Disks) == 0 {
+		return Command(ctx, "lvextend", "-l", "+100%FREE", string(r)), nil
+	}
+	pvs, err := r.pvs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return Command(ctx, "lvextend", append([]string{"-l", "+100%PVS", string(r)}, pvs...)...), nil
+}
+
+// vgPVs returns the PVs in the volume group vg, given the output of
+// pvdisplay -c.
+func vgPVs(out []byte, vg string) []string {
+	var pvs []string
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		f := strings.Split(strings.TrimSpace(bs.Text()), ":")
+		if len(f) < 2 || f[1] != vg || !strings.HasPrefix(f[0], "/dev/") {
+			continue
+		}
+		pvs = append(pvs, f[0])
+	}
+	return pvs
+}
+
+func (r lvResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r lvResizer) Size(ctx context.Context) (int64, error) {
+	lvs, err := r.state(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return lvs.numSectors * 512, nil
+}
+
+func (r lvResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	cmd, err := r.extendCmd(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	return Action{
+		Steps:        []string{cmdLine(cmd, nil)},
+		CurrentBytes: n,
+	}, nil
+}
+
+func (r lvResizer) Resize(ctx context.Context) error {
+	lvDev := string(r)
+	// The size is relative to the current one, so lvextend can only
+	// grow the LV, never shrink it.
+	cmd, err := r.extendCmd(ctx)
+	if err != nil {
+		return err
+	}
+	out, err := runCmd(r.String(), cmd)
+	if err != nil {
+		if strings.Contains(string(out), "matches existing size") {
+			return nil
+		}
+		if strings.Contains(string(out), "Insufficient free space") {
+			return fmt.Errorf("%w in volume group of %s: %w", ErrNoFreeSpace, lvDev, toolError(cmd, out, err))
+		}
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+// colonRecord returns the fields of the first line of LVM "-c"
+// (colon-separated) output having at least minFields fields, skipping
+// blank lines and any warnings mixed into the output.
+func colonRecord(out []byte, minFields int) (f []string, ok bool) {
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "/") {
+			continue
+		}
+		if f := strings.Split(line, ":"); len(f) >= minFields {
+			for i := range f {
+				f[i] = strings.TrimSpace(f[i])
+			}
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+type pvResizer string // "/dev/sda3" or potentially a whole disk e.g. "/dev/sdb"
+
+// NewPVResizer returns the Resizer for the LVM physical volume on the
+// block device pv, which may be a partition or a whole disk.
+func NewPVResizer(pv string) Resizer { return pvResizer(pv) }
+
+func (r pvResizer) String() string { return fmt.Sprintf("LVM PV %s", string(r)) }
+
+func (r pvResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r pvResizer) Size(ctx context.Context) (int64, error) {
+	dev := string(r)
+	cmd := Command(ctx, "pvdisplay", "-c", dev)
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	return parsePVSize(dev, out)
+}
+
+// parsePVSize returns the PV size in bytes from the output of
+// pvdisplay -c dev.
+func parsePVSize(dev string, out []byte) (int64, error) {
+	// Despite the pvdisplay man page claiming kilobytes, the third
+	// field is the PV size in 512 byte sectors.
+	f, ok := colonRecord(out, 3)
+	if !ok {
+		return 0, fmt.Errorf("bogus pvdisplay -c %s output: %q", dev, out)
+	}
+	sectors, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil || sectors < 0 || sectors > math.MaxInt64/512 {
+		return 0, fmt.Errorf("bogus size field in pvdisplay -c %s output: %q: %v", dev, out, err)
+	}
+	return sectors * 512, nil
+}
+
+// sizeFor returns the size the PV would be on a device of devBytes
+// bytes: what's left after its metadata area, in whole extents if it's
+// in a volume group.
+func (r pvResizer) sizeFor(ctx context.Context, devBytes int64) (int64, error) {
+	dev := string(r)
+	cmd := Command(ctx, "pvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "pe_start,vg_extent_size", dev)
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	f := strings.Fields(string(out))
+	if len(f) == 0 {
+		return 0, fmt.Errorf("unexpected pvs output for %s: %q", dev, out)
+	}
+	peStart, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected pvs output for %s: %q", dev, out)
+	}
+	n := devBytes - peStart
+	if len(f) > 1 {
+		// No extent size means it's not in a volume group.
+		if ext, err := strconv.ParseInt(f[1], 10, 64); err == nil && ext > 0 {
+			n = n / ext * ext
+		}
+	}
+	return max(n, 0), nil
+}
+
+func (r pvResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	return Action{
+		Steps:        []string{cmdLine(Command(ctx, "pvresize", string(r)), nil)},
+		CurrentBytes: n,
+	}, nil
+}
+
+func (r pvResizer) Resize(ctx context.Context) error {
+	dev := string(r)
+	cmd := Command(ctx, "pvresize", dev)
+	out, err := runCmd(r.String(), cmd)
+	if err != nil {
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+func (r pvResizer) check(ctx context.Context) error {
+	if UDisks {
+		return fmt.Errorf("%v: %w", r, errUDisksUnsupported)
+	}
+	return nil
+}
+
+func (r pvResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	dev := string(r)
+	if dep, err := registeredDevice(ctx, dev); dep != nil || err != nil {
+		return deps(dep), err
+	}
+	if d := lookupBlockDevice(ctx, dev); d != nil {
+		switch d.Type {
+		case "part":
+			return []Resizer{partitionResizer(dev)}, nil
+		case "disk":
+			return deps(hypervDisk(dev)), nil
+		}
+		return nil, nil
+	}
+	if isPartitionDev(dev) {
+		return []Resizer{partitionResizer(dev)}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// replay makes CommandRunner play back the recordings in the file
+// testdata/recordings/name.jsonl for the rest of t, failing t if any
+// aren't played.
+func replay(t *testing.T, name string) {
+	t.Helper()
+	f, err := os.Open("testdata/recordings/" + name + ".jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := ReadRecordings(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayRecordings(t, recs)
+}
+
+func replayRecordings(t *testing.T, recs []Recording) {
+	rr := NewReplayRunner(recs)
+	old := CommandRunner
+	CommandRunner = rr
+	t.Cleanup(func() {
+		CommandRunner = old
+		for _, rec := range rr.Unplayed() {
+			t.Errorf("command not run: %s", shellQuote(rec.Args))
+		}
+	})
+}
+
+func TestResizeLVMReplay(t *testing.T) {
+	replay(t, "lvm-grow-second-pv")
+	changes, err := Resize(context.Background(), NewLVResizer("/dev/mapper/datavg-data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"LVM PV /dev/vdc: 10.0 GiB → 20.0 GiB (+10.0 GiB)",
+		"LVM LV /dev/mapper/datavg-data: 20.0 GiB → 30.0 GiB (+10.0 GiB)",
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("changes = %q; want %q", got, want)
+	}
+}
+
+func TestLVExtendNoFreeSpace(t *testing.T) {
+	replayRecordings(t, []Recording{{
+		Args:   []string{"lvextend", "-l", "+100%FREE", "/dev/mapper/vg-lv"},
+		Stderr: "  Insufficient free space: 1 extents needed, but only 0 available\n",
+		Err:    "exit status 5",
+	}})
+	err := NewLVResizer("/dev/mapper/vg-lv").Resize(context.Background())
+	if !errors.Is(err, ErrNoFreeSpace) {
+		t.Errorf("Resize error = %v; want ErrNoFreeSpace", err)
+	}
+}
+
+func FuzzParseLVDisplay(f *testing.F) {
+	f.Add([]byte("  /dev/datavg/data:datavg:3:1:-1:1:41926656:5118:-1:0:-1:254:0\n"))
+	f.Add([]byte("  WARNING: Not using device /dev/sdb for PV abc.\n  /dev/vg/root:vg:3:1:-1:1:8434778112:1029636:-1:0:-1:254:0\n"))
+	f.Fuzz(func(t *testing.T, out []byte) {
+		s, err := parseLVDisplay("/dev/mapper/vg-lv", out)
+		if err == nil && (s.numSectors < 0 || s.vg == "") {
+			t.Errorf("parseLVDisplay(%q) = %+v, no error", out, s)
+		}
+	})
+}
+
+func FuzzParsePVSize(f *testing.F) {
+	f.Add([]byte("  /dev/vdc:datavg:41943040:-1:8:8:-1:4096:5119:2560:2559:r9TgWm-2HcB-yQ4x-Lk6V-Zs0N-p3Ea-Jd5uXc\n"))
+	f.Fuzz(func(t *testing.T, out []byte) {
+		n, err := parsePVSize("/dev/vdc", out)
+		if err == nil && n < 0 {
+			t.Errorf("parsePVSize(%q) = %d, no error", out, n)
+		}
+	})
+}
+
+func FuzzVGPVs(f *testing.F) {
+	f.Add([]byte("  /dev/vda2:rootvg:20969472:-1:8:8:-1:4096:2559:0:2559:x\n  /dev/vdb:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:y\n"), "datavg")
+	f.Fuzz(func(t *testing.T, out []byte, vg string) {
+		for _, pv := range vgPVs(out, vg) {
+			if !strings.HasPrefix(pv, "/dev/") {
+				t.Errorf("vgPVs(%q, %q) includes %q", out, vg, pv)
+			}
+		}
+	})
+}
+
+func TestParseLVMReport(t *testing.T) {
+	out := "  WARNING: Not using device /dev/sdc for PV abc.\n" +
+		"  datavg|4194304|5119|256\n" +
+		"  rootvg|4194304|2559|0\n"
+	rows := parseLVMReport([]byte(out))
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows; want 2: %q", len(rows), rows)
+	}
+	if got := strings.Join(rows[0], ","); got != "datavg,4194304,5119,256" {
+		t.Errorf("row 0 = %q", got)
+	}
+}
+
+func TestLVCandidate(t *testing.T) {
+	for attr, want := range map[string]bool{
+		"-wi-ao----": true,  // plain
+		"owi-aos---": true,  // snapshot origin
+		"rwi-a-r---": true,  // RAID
+		"twi-aotz--": true,  // thin pool
+		"swi-a-s---": false, // snapshot
+		"Vwi-a-tz--": false, // thin volume
+		"":           false,
+	} {
+		if got := lvCandidate(attr); got != want {
+			t.Errorf("lvCandidate(%q) = %v; want %v", attr, got, want)
+		}
+	}
+}
+
+func TestVGFreeBytesAfterGrowth(t *testing.T) {
+	vg := VGStatus{
+		ExtentBytes: 4 << 20,
+		FreeExtents: 10,
+		PVs:         []PVStatus{{GrowBytes: 10<<20 + 1}, {GrowBytes: 0}},
+	}
+	if got, want := vg.FreeBytesAfterGrowth(), int64(48<<20); got != want {
+		t.Errorf("FreeBytesAfterGrowth = %d; want %d", got, want)
+	}
+}
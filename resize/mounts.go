@@ -0,0 +1,208 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/findmnt"
+)
+
+var (
+	// MountinfoFile is the mount table whose mount points are
+	// resized, in the format of /proc/self/mountinfo.
+	MountinfoFile = "/proc/self/mountinfo"
+
+	// MountsFile is the same mount table in the format of /proc/mounts,
+	// read if neither MountinfoFile nor findmnt can be.
+	MountsFile = "/proc/mounts"
+
+	// HostRoot, if non-empty, is where the mount points in the mount
+	// table are reached, as when resizing the host's filesystems from
+	// inside a container: MountinfoFile is then "/proc/1/mountinfo",
+	// MountsFile "/proc/1/mounts", and HostRoot "/proc/1/root".
+	HostRoot string
+)
+
+// A Mount is one entry in the mount table. Its paths have had their
+// octal escapes decoded.
+type Mount struct {
+	ID, ParentID int    // mount IDs, or 0 if not known
+	Major, Minor uint32 // device number, or 0:0 if not known
+	Root         string // path within the filesystem mounted, "/" unless bind mounted, or "" if not known
+	Mountpoint   string // e.g. "/"
+	Options      string // per-mount options, e.g. "rw,relatime"
+	SuperOptions string // the filesystem's own options, e.g. "rw,errors=remount-ro", or all options if not known separately
+	Type         string // e.g. "ext4"
+	Source       string // e.g. "/dev/sda1"
+}
+
+// readOnly reports whether m is mounted read-only.
+func (m Mount) readOnly() bool {
+	for _, o := range strings.Split(m.Options, ",") {
+		if o == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// Mounts returns the mount table, in the order things were mounted.
+// It's read from MountinfoFile, or else from findmnt, or else from
+// MountsFile, which lacks the device numbers and roots. On systems
+// without /proc, like FreeBSD, it's asked of the kernel instead.
+func Mounts() ([]Mount, error) {
+	if ms, ok, err := systemMounts(); ok {
+		return ms, err
+	}
+	data, err := ioutil.ReadFile(MountinfoFile)
+	if err == nil {
+		return parseMountinfo(data)
+	}
+	if ms, ferr := findmntMounts(); ferr == nil {
+		return ms, nil
+	}
+	data, merr := ioutil.ReadFile(MountsFile)
+	if merr != nil {
+		return nil, err
+	}
+	return parseMounts(data), nil
+}
+
+// parseMountinfo parses the mount table in the format of
+// /proc/self/mountinfo, documented in proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountinfo(data []byte) ([]Mount, error) {
+	var ms []Mount
+	bs := bufio.NewScanner(bytes.NewReader(data))
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		if len(f) == 0 {
+			continue
+		}
+		sep := -1
+		for i := 6; i < len(f); i++ {
+			if f[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(f) {
+			return nil, fmt.Errorf("malformed %s line %q", MountinfoFile, bs.Text())
+		}
+		var m Mount
+		m.ID, _ = strconv.Atoi(f[0])
+		m.ParentID, _ = strconv.Atoi(f[1])
+		if maj, min, ok := strings.Cut(f[2], ":"); ok {
+			ma, _ := strconv.ParseUint(maj, 10, 32)
+			mi, _ := strconv.ParseUint(min, 10, 32)
+			m.Major, m.Minor = uint32(ma), uint32(mi)
+		}
+		m.Root = UnescapeMount(f[3])
+		m.Mountpoint = UnescapeMount(f[4])
+		m.Options = f[5]
+		m.Type = f[sep+1]
+		m.Source = UnescapeMount(f[sep+2])
+		if sep+3 < len(f) {
+			m.SuperOptions = f[sep+3]
+		}
+		ms = append(ms, m)
+	}
+	return ms, bs.Err()
+}
+
+// findmntMounts returns the mount table as findmnt reports it.
+func findmntMounts() ([]Mount, error) {
+	args := findmnt.Args("--kernel")
+	if HostRoot != "" {
+		args = append(args, "--task", "1")
+	}
+	out, err := output(Command(context.Background(), "findmnt", args...))
+	if err != nil {
+		return nil, err
+	}
+	o, err := findmnt.Parse(out)
+	if err != nil {
+		return nil, err
+	}
+	var ms []Mount
+	for _, fs := range o.All() {
+		m := Mount{
+			Mountpoint:   fs.Target,
+			Options:      fs.Options,
+			SuperOptions: fs.Options,
+			Type:         fs.FSType,
+			Source:       fs.Source,
+		}
+		m.Major, m.Minor, _ = fs.Device()
+		if src, root, ok := strings.Cut(fs.Source, "["); ok {
+			// A bind mount: "/dev/sda1[/subdir]".
+			m.Source, m.Root = src, strings.TrimSuffix(root, "]")
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// parseMounts parses the mount table in the format of /proc/mounts.
+func parseMounts(data []byte) []Mount {
+	var ms []Mount
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 {
+			continue
+		}
+		ms = append(ms, Mount{
+			Source:       UnescapeMount(f[0]),
+			Mountpoint:   UnescapeMount(f[1]),
+			Type:         f[2],
+			Options:      f[3],
+			SuperOptions: f[3],
+		})
+	}
+	return ms
+}
+
+// HostPath maps mnt, a path in the mount table from Mounts, to a
+// path it can be reached at.
+func HostPath(mnt string) string {
+	if HostRoot != "" {
+		return filepath.Join(HostRoot, mnt)
+	}
+	return mnt
+}
+
+// checkHostDev returns an error if the block device dev, named in the
+// host's mount table, isn't in our /dev.
+func checkHostDev(dev string) error {
+	if HostRoot == "" {
+		return nil
+	}
+	if _, err := os.Stat(dev); err != nil {
+		return fmt.Errorf("host device %s %w in the container's /dev; mount the host's /dev into the container", dev, ErrDeviceNotFound)
+	}
+	return nil
+}
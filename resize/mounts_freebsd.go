@@ -0,0 +1,48 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import "golang.org/x/sys/unix"
+
+// systemMounts returns the mount table from getfsstat(2). It has no
+// mount IDs, device numbers, or roots, and of the options, only
+// whether the mount is read-only.
+func systemMounts() (ms []Mount, ok bool, err error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, true, err
+	}
+	buf := make([]unix.Statfs_t, n)
+	n, err = unix.Getfsstat(buf, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, true, err
+	}
+	for _, st := range buf[:n] {
+		opts := "rw"
+		if st.Flags&unix.MNT_RDONLY != 0 {
+			opts = "ro"
+		}
+		ms = append(ms, Mount{
+			Mountpoint:   unix.ByteSliceToString(st.Mntonname[:]),
+			Options:      opts,
+			SuperOptions: opts,
+			Type:         unix.ByteSliceToString(st.Fstypename[:]),
+			Source:       unix.ByteSliceToString(st.Mntfromname[:]),
+		})
+	}
+	return ms, true, nil
+}
@@ -0,0 +1,1111 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	lvmGPTTypeID         = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+	rootx8664GPTTypeID   = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	rootArm64GPTTypeID   = "B921B045-1DF0-41C3-AF44-4C6F280D3FAE"
+	rootPPC64LEGPTTypeID = "C31C45E6-3F39-412E-80FB-4809C4980599"
+	rootPPC64GPTTypeID   = "912ADE1D-A839-4913-8964-A10EEE08FBD2" // big-endian
+	linuxGPTTypeID       = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+	// The PReP boot partition holds the boot loader of Power
+	// machines, ahead of the root partition.
+	prepGPTTypeID = "9E1A2D38-C612-4316-AA26-8B49521E5A8B"
+	prepMBRType   = "41"
+
+	// lvmMBRType is Linux LVM, as installers put the PV in on MBR
+	// disks, like RHEL's on Power: PReP boot, /boot, then the PV.
+	lvmMBRType = "8E"
+)
+
+type partitionResizer string // "/dev/sda3"
+
+// RegeneratePartUUIDs gives a GPT partition a new random PARTUUID when
+// its entry is rewritten to grow it. Without it, the PARTUUID is kept
+// exactly, as boot loaders, fstab, and the kernel's root= often name
+// partitions by it, and a table read back with it changed is put back.
+var RegeneratePartUUIDs bool
+
+// NewPartitionResizer returns the Resizer for the partition part, such
+// as "/dev/sda3". It grows into any free space after the partition, up
+// to the next partition or the end of the disk.
+func NewPartitionResizer(part string) Resizer { return partitionResizer(part) }
+
+// nvmePartition matches an NVMe partition device, capturing its
+// namespace: "/dev/nvme0n2p3" is partition 3 of namespace 2 on
+// controller 0. With native NVMe multipath, a path through a
+// particular controller of subsystem 0 is named like "/dev/nvme0c1n2p3".
+var nvmePartition = regexp.MustCompile(`^(/dev/nvme\d+(?:c\d+)?n\d+)p\d+$`)
+
+// mmcPartition matches a partition in the user area of an SD card or
+// eMMC device, capturing the device.
+var mmcPartition = regexp.MustCompile(`^(/dev/mmcblk\d+)p\d+$`)
+
+var mmcHardwarePartition = regexp.MustCompile(`^mmcblk\d+(boot\d+|rpmb|gp\d+)$`)
+
+// IsMMCHardwarePartition reports whether dev, such as
+// "/dev/mmcblk0boot0" or "mmcblk0rpmb", is one of an eMMC device's
+// boot, RPMB, or general purpose hardware partitions. The kernel shows
+// them as disks of their own, but their sizes are fixed when the chip
+// is made or provisioned, and they're never what's grown.
+func IsMMCHardwarePartition(dev string) bool {
+	return mmcHardwarePartition.MatchString(filepath.Base(dev))
+}
+
+// isPartitionDev reports whether dev, a block device path in /dev,
+// looks like a partition rather than a whole disk. Unlike SCSI and
+// virtio disks, an NVMe namespace ("/dev/nvme0n2") or eMMC boot area
+// ("/dev/mmcblk0boot0") ends in a number without being a partition.
+func isPartitionDev(dev string) bool {
+	if strings.HasPrefix(dev, "/dev/nvme") {
+		return nvmePartition.MatchString(dev)
+	}
+	if strings.HasPrefix(dev, "/dev/mmcblk") {
+		return mmcPartition.MatchString(dev)
+	}
+	return devEndsInNumber(dev)
+}
+
+// DiskDevice maps a partition device like "/dev/sda3" to its disk,
+// "/dev/sda", by its name. It returns an error wrapping
+// ErrDeviceNotFound for names it doesn't know, such as Xen's.
+func DiskDevice(partDev string) (string, error) {
+	if !strings.HasPrefix(partDev, "/dev/") {
+		return "", fmt.Errorf("bogus partition dev %q", partDev)
+	}
+	if strings.HasPrefix(partDev, "/dev/sd") || strings.HasPrefix(partDev, "/dev/vd") {
+		return strings.TrimRight(partDev, "0123456789"), nil
+	}
+	if strings.HasPrefix(partDev, "/dev/mmcblk") {
+		m := mmcPartition.FindStringSubmatch(partDev)
+		if m == nil {
+			return "", fmt.Errorf("partition %q doesn't look like an mmc partition", partDev)
+		}
+		return m[1], nil
+	}
+	if strings.HasPrefix(partDev, "/dev/nvme") {
+		m := nvmePartition.FindStringSubmatch(partDev)
+		if m == nil {
+			return "", fmt.Errorf("partition %q doesn't look like an nvme partition", partDev)
+		}
+		return m[1], nil
+	}
+	return "", fmt.Errorf("%w: can't tell the disk of partition %q from its name", ErrDeviceNotFound, partDev)
+}
+
+func (p partitionResizer) String() string { return fmt.Sprintf("partition %s", string(p)) }
+
+func (p partitionResizer) State(ctx context.Context) (string, error) {
+	n, err := p.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+// Size returns the partition's size in bytes. The sysfs size file is
+// always in 512 byte units, regardless of the device's sector size.
+func (p partitionResizer) Size(ctx context.Context) (int64, error) {
+	return blockDevSize(string(p))
+}
+
+func (p partitionResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	if !onHyperV() {
+		return nil, nil
+	}
+	disk, err := DiskOf(ctx, string(p))
+	if err != nil {
+		return nil, err
+	}
+	return deps(hypervDisk(disk)), nil
+}
+
+// grownTable returns the partition table of p's disk, diskDev, with
+// p grown to fill the rest of the disk, and p's new entry in it. If p
+// already fills the disk, ok is false.
+func (p partitionResizer) grownTable(ctx context.Context) (diskDev string, pt *partitionTable, part sfdiskLine, ok bool, err error) {
+	vlogf("Resizing partition %q ...", string(p))
+	partDev := string(p)
+	if diskDev, err = DiskOf(ctx, partDev); err != nil {
+		return
+	}
+	vlogf("Getting partition table for %q ...", diskDev)
+	pt, err = getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return
+	}
+	if len(pt.parts) == 0 {
+		err = fmt.Errorf("device %q has no partitions", diskDev)
+		return
+	}
+	vlogf("Device %q has %d partitions.", diskDev, len(pt.parts))
+	isGPT, err := partitionTableIsGPT(ctx, diskDev, pt)
+	if err != nil {
+		return
+	}
+
+	if _, ok = pt.lastNonZeroPartition(); !ok {
+		err = fmt.Errorf("no non-zero partition found on %s", diskDev)
+		return
+	}
+	// Make sure we grow the partition we were made for, and not
+	// whichever happens to be last.
+	part, ok = pt.partition(partDev)
+	if !ok {
+		err = fmt.Errorf("partition %s %w in partition table of %s", partDev, ErrDeviceNotFound, diskDev)
+		return
+	}
+	if err = part.checkExtent(); err != nil {
+		return
+	}
+	if isGPT {
+		if err = checkWritable(part); err != nil {
+			return
+		}
+	}
+	var limit int64 // sector the partition may grow up to; 0 for the end of the disk
+	next, hasNext := pt.nextPartition(part)
+	if hasNext {
+		// It can only grow into free space before the next
+		// partition, which MBR logical partitions don't have
+		// room for, as each is preceded by its own EBR.
+		if !isGPT && part.pno > 4 {
+			err = fmt.Errorf("%s: %w; %s follows it", partDev, ErrPartitionNotLast, next.dev)
+			return
+		}
+		limit = next.Start()
+	}
+	if err = checkPartitionType(part, isGPT); err != nil {
+		return
+	}
+
+	if Verbose {
+		fmt.Printf("Current partition table:\n")
+		pt.Write(os.Stdout)
+		fmt.Println()
+	}
+
+	size, err := readInt64File(sysPath("/sys/block/" + filepath.Base(diskDev) + "/size"))
+	if err != nil {
+		return
+	}
+	ss := pt.Meta("sector-size")
+	if ss == "" {
+		// Older sfdisk doesn't say; ask the kernel.
+		if b, err := os.ReadFile(sysPath("/sys/block/" + filepath.Base(diskDev) + "/queue/logical_block_size")); err == nil {
+			ss = strings.TrimSpace(string(b))
+		}
+	}
+	if ss != "" && ss != "512" {
+		// TODO: get from /sys/block/sda/queue/hw_sector_size and
+		// use throughout.
+		err = fmt.Errorf("%s has %s byte sectors; only 512 byte sectors are supported", diskDev, ss)
+		return
+	}
+	maxEnd, err := pt.maxEnd(isGPT, size)
+	if err != nil {
+		return
+	}
+	end := part.Start() + part.Size()
+	var newEnd int64
+	if limit != 0 {
+		// No need to align; the next partition starts right
+		// where this can end.
+		newEnd = min(limit, maxEnd)
+		if newEnd <= end {
+			err = fmt.Errorf("%s: %w; %s follows it with no free space between", partDev, ErrPartitionNotLast, next.dev)
+			if _, ok := findCryptSwap(ctx, next.dev); ok && !MoveSwap {
+				err = fmt.Errorf("%w; it's random-key encrypted swap, which --move-swap can move to the end of the disk", err)
+			}
+			return
+		}
+	} else {
+		// End on a 1 MiB boundary, as partitioning tools align.
+		const align = (1 << 20) / 512
+		newEnd = maxEnd / align * align
+	}
+	if isGPT {
+		if newEnd, err = repartEnd(pt, part, end, newEnd, limit == 0); err != nil {
+			return
+		}
+	}
+	if Verbose {
+		fmt.Printf("Cur size: %d\n", size)
+		fmt.Printf("Part start: %d\n", part.Start())
+		fmt.Printf("Part size: %d\n", part.Size())
+		fmt.Printf("Part end: %d\n", end)
+		fmt.Printf("Max end: %d\n", maxEnd)
+		fmt.Printf("New end: %d\n", newEnd)
+	}
+	if newEnd <= end {
+		// partition at max size; no need to extend
+		return diskDev, pt, part, false, nil
+	}
+
+	extend := newEnd - end
+	oldStart, oldSize := part.Start(), part.Size()
+	if err = part.SetSize(oldSize + extend); err != nil {
+		return
+	}
+	pt.RemoveMeta("last-lba") // or sfdisk complains
+	if RegeneratePartUUIDs {
+		if err = regeneratePartUUID(pt, part, isGPT); err != nil {
+			return
+		}
+	}
+
+	// Never write an entry the table format or disk can't hold.
+	if e := part.Start() + part.Size(); e > maxEnd || e > size {
+		err = fmt.Errorf("%s: new end at sector %d is past the last usable sector %d of %s", partDev, e, min(maxEnd, size)-1, diskDev)
+		return
+	}
+
+	// Check the new entry against both the old one and the kernel's
+	// idea of the partition, so a misparsed table can't truncate it.
+	if part.Start() != oldStart {
+		err = fmt.Errorf("%s: new partition entry starts at sector %d, not %d; refusing to resize", partDev, part.Start(), oldStart)
+		return
+	}
+	if err = checkGrowth(p, oldSize*512, part.Size()*512); err != nil {
+		return
+	}
+	kernelSize, err := p.Size(ctx)
+	if err != nil {
+		return
+	}
+	if err = checkGrowth(p, kernelSize, part.Size()*512); err != nil {
+		return
+	}
+
+	if Verbose {
+		fmt.Printf("Need to extend disk by %d sectors (%d bytes, %0.03f GiB)\n", extend, extend*512, float64(extend)*512/(1<<30))
+	}
+	return diskDev, pt, part, true, nil
+}
+
+// checkPartitionType returns an error unless part's type is one of
+// those that hold a filesystem or LVM PV embiggen-disk grows.
+func checkPartitionType(part sfdiskLine, isGPT bool) error {
+	typ := strings.ToUpper(part.Type())
+	if isGPT {
+		switch typ {
+		case lvmGPTTypeID, rootx8664GPTTypeID, rootArm64GPTTypeID, rootPPC64LEGPTTypeID, rootPPC64GPTTypeID, linuxGPTTypeID:
+			return nil
+		case prepGPTTypeID:
+			return fmt.Errorf("%s is a PReP boot partition, holding a Power machine's boot loader, which is never grown", part.dev)
+		}
+		return fmt.Errorf("unknown GPT partition type %q for %s", typ, part.dev)
+	}
+	switch typ {
+	case "83", lvmMBRType:
+		return nil
+	case prepMBRType:
+		return fmt.Errorf("%s is a PReP boot partition, holding a Power machine's boot loader, which is never grown", part.dev)
+	}
+	return fmt.Errorf("unknown MBR partition type %q for %s", typ, part.dev)
+}
+
+func (p partitionResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := p.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	if sw, err := p.blockingSwap(ctx); err != nil {
+		return Action{}, err
+	} else if sw != nil {
+		// The table to grow p in is only read once the swap has
+		// moved, so describe growing p up to it.
+		part, _ := sw.pt.partition(string(p))
+		return Action{
+			Steps: append(sw.steps(ctx),
+				fmt.Sprintf("grow %s to end at sector %d, where %s then starts", p, sw.part.Start(), sw.part.dev)),
+			CurrentBytes:  n,
+			ProposedBytes: (sw.part.Start() - part.Start()) * 512,
+		}, nil
+	}
+	diskDev, pt, part, ok, err := p.grownTable(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	if !ok {
+		return Action{CurrentBytes: n, ProposedBytes: n}, nil
+	}
+	var steps []string
+	if cmd, ok := luksBackupCommand(ctx, string(p), time.Now()); ok {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	return Action{
+		Steps:         append(steps, tableSteps(ctx, diskDev, pt, part)...),
+		CurrentBytes:  n,
+		ProposedBytes: part.Size() * 512,
+	}, nil
+}
+
+func (p partitionResizer) Resize(ctx context.Context) error {
+	if UDisks {
+		if err := backupLUKSHeader(ctx, string(p)); err != nil {
+			return err
+		}
+		return udisksGrow(ctx, string(p), "Partition")
+	}
+	if sw, err := p.blockingSwap(ctx); err != nil {
+		return err
+	} else if sw != nil {
+		if err := sw.move(ctx); err != nil {
+			return err
+		}
+	}
+	diskDev, pt, part, ok, err := p.grownTable(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	if err := backupLUKSHeader(ctx, string(p)); err != nil {
+		return err
+	}
+	return p.writeTable(ctx, diskDev, pt, part)
+}
+
+// partitionTableIsGPT reports whether pt, the partition table of
+// diskDev, is GPT rather than MBR, or returns an error if it's neither
+// or can't be safely manipulated.
+func partitionTableIsGPT(ctx context.Context, diskDev string, pt *partitionTable) (isGPT bool, err error) {
+	switch t := pt.Meta("label"); t {
+	case "dos":
+	case "gpt":
+		isGPT = true
+	case "":
+		// Old version of sfdisk? See https://github.com/google/embiggen-disk/issues/6
+		// Look at the disk to figure out what it is.
+		// But only trust the value "dos", because if it's gpt and sfdisk
+		// is old and doesn't support gpt, we don't want to use that old sfdisk
+		// to manipulate the gpt tables.
+		got, err := probePTType(diskDev)
+		if err != nil {
+			return false, err
+		}
+		if got != "dos" {
+			return false, fmt.Errorf("Old sfdisk and %s has an unexpected %s partition table", diskDev, got)
+		}
+	default:
+		// It might work, but fail as a precaution. Untested.
+		return false, fmt.Errorf("unsupported partition table type %q on %s", t, diskDev)
+	}
+	return isGPT, nil
+}
+
+// writeTable writes pt, in which part has been modified, to diskDev,
+// tells the kernel about part's new size, and waits for it to settle.
+func (p partitionResizer) writeTable(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) error {
+	if err := part.checkExtent(); err != nil {
+		return err
+	}
+	if Verbose {
+		fmt.Printf("New partition table to write:\n")
+	}
+
+	var newPart bytes.Buffer
+	pt.Write(&newPart)
+	if Verbose {
+		fmt.Printf("%s\n", newPart.Bytes())
+	}
+
+	// Keep the table as it is on disk, to check the new one against
+	// and to put back if the new one isn't what we meant to write.
+	backup, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return err
+	}
+
+	if Verbose {
+		fmt.Println("Setting new partition table...")
+	}
+	// Hold the disk's lock, as other partitioning tools do, until
+	// the kernel has the change, so neither they nor udev's probing
+	// sees the table half done. udev waits for it, so it's released
+	// before waiting for udev.
+	unlock, err := lockDisk(ctx, diskDev)
+	if err != nil {
+		return err
+	}
+	err = p.writeLocked(ctx, diskDev, pt, part, backup)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	if RegeneratePartUUIDs {
+		was, _ := backup.partition(part.dev)
+		Logger.Warn("partition has a new PARTUUID; update anything naming it by the old one",
+			"partition", part.dev, "old", was.Attr("uuid"), "new", part.Attr("uuid"))
+	}
+
+	savedTables.Lock()
+	if savedTables.m == nil {
+		savedTables.m = make(map[string]*partitionTable)
+	}
+	savedTables.m[part.dev] = backup
+	savedTables.Unlock()
+
+	return p.waitSettled(ctx, part)
+}
+
+// writeLocked writes pt, in which part has been modified, to diskDev,
+// checks it, and tells the kernel, putting back backup, the table
+// before, if that fails. The disk must be locked.
+func (p partitionResizer) writeLocked(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine, backup *partitionTable) error {
+	if err := p.write(ctx, diskDev, pt, part); err != nil {
+		return err
+	}
+
+	restore := func(err error) error {
+		was, ok := backup.partition(part.dev)
+		if !ok {
+			return fmt.Errorf("%v; can't restore the previous table, which lacks %s", err, part.dev)
+		}
+		if rerr := p.write(ctx, diskDev, backup, was); rerr != nil {
+			return fmt.Errorf("%v; restoring the previous table also failed: %w", err, rerr)
+		}
+		return fmt.Errorf("%v; restored the previous table", err)
+	}
+	if err := p.verifyTable(ctx, diskDev, backup, part); err != nil {
+		return restore(err)
+	}
+
+	// Tell the kernel.
+	if err := updateKernelPartition(diskDev, part); err != nil {
+		// The kernel still has the old size, so the old table
+		// matches it.
+		return restore(fmt.Errorf("updating kernel of %s partition change: %v", part.dev, err))
+	}
+	return nil
+}
+
+// settleTimeout is how long waitSettled waits for each of the kernel
+// and udev.
+const settleTimeout = 10 * time.Second
+
+// waitSettled waits until the kernel reports part at its new size and
+// udev has finished handling the change, as udev briefly holds the
+// device open and rewrites its /dev symlinks, which can make the
+// next layer's tool fail.
+func (p partitionResizer) waitSettled(ctx context.Context, part sfdiskLine) error {
+	want := part.Size() * 512
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		n, err := blockDevSize(part.dev)
+		if err == nil && n == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("kernel reports %s as %d bytes, not %d, after resizing it", part.dev, n, want)
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	cmd, ok := udevSettleCommand(ctx)
+	if !ok {
+		return nil
+	}
+	if out, err := runCmd(p.String(), cmd); err != nil {
+		// Not fatal; the device has its new size.
+		Logger.Warn("waiting for udev failed", "err", toolError(cmd, out, err))
+	}
+	return nil
+}
+
+// udevSettleCommand returns the command waiting for udev to finish
+// handling events, if udevadm is installed.
+func udevSettleCommand(ctx context.Context) (cmd *exec.Cmd, ok bool) {
+	if _, err := ToolPath("udevadm"); err != nil {
+		return nil, false
+	}
+	return Command(ctx, "udevadm", "settle", fmt.Sprintf("--timeout=%d", int(settleTimeout/time.Second))), true
+}
+
+// savedTables holds, for each partition writeTable has changed, its
+// disk's partition table from before the change, for undo.
+var savedTables struct {
+	sync.Mutex
+	m map[string]*partitionTable // keyed by partition device
+}
+
+// undo puts back the partition table of p's disk from before p was
+// last resized, and tells the kernel. It's only safe if nothing has
+// grown into the space p gained since.
+func (p partitionResizer) undo(ctx context.Context) error {
+	savedTables.Lock()
+	backup := savedTables.m[string(p)]
+	delete(savedTables.m, string(p))
+	savedTables.Unlock()
+	if backup == nil {
+		return fmt.Errorf("no saved partition table for %s", string(p))
+	}
+	old, ok := backup.partition(string(p))
+	if !ok {
+		return fmt.Errorf("partition %s %w in saved partition table", string(p), ErrDeviceNotFound)
+	}
+	diskDev, err := DiskOf(ctx, string(p))
+	if err != nil {
+		return err
+	}
+	if err := p.write(ctx, diskDev, backup, old); err != nil {
+		return err
+	}
+	if err := updateKernelPartition(diskDev, old); err != nil {
+		return fmt.Errorf("updating kernel of %s partition change: %v", old.dev, err)
+	}
+	return p.waitSettled(ctx, old)
+}
+
+// write writes pt, which differs from the partition table on diskDev
+// only in part's size, to diskDev with the tool that read pt.
+func (p partitionResizer) write(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) error {
+	for _, w := range pt.tool.writeCmds(ctx, diskDev, pt, part) {
+		cmd := w.cmd
+		if w.stdin != nil {
+			cmd.Stdin = bytes.NewReader(w.stdin)
+		}
+		// Run it in its own process group so a terminal's ^C, which
+		// we handle ourselves after this stage, doesn't also reach
+		// the partitioning tool.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if out, err := runCmd(p.String(), cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+	}
+	return nil
+}
+
+// verifyTable reads back the partition table of diskDev, just written
+// with part modified, and checks that it differs from old, the table
+// before the write, only in part's size, and with
+// RegeneratePartUUIDs, its PARTUUID, which must be as intended.
+func (p partitionResizer) verifyTable(ctx context.Context, diskDev string, old *partitionTable, part sfdiskLine) error {
+	pt, err := old.tool.readTable(ctx, diskDev)
+	if err != nil {
+		return fmt.Errorf("reading back partition table of %s: %w", diskDev, err)
+	}
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("partition table of %s read back after writing: %s", diskDev, fmt.Sprintf(format, args...))
+	}
+	if len(pt.parts) != len(old.parts) {
+		return bad("has %d partitions, not %d", len(pt.parts), len(old.parts))
+	}
+	// MBR PARTUUIDs are the disk identifier and partition number.
+	if now, was := pt.Meta("label-id"), old.Meta("label-id"); now != was {
+		return bad("disk identifier is %s, not %s", now, was)
+	}
+	for i, was := range old.parts {
+		now := pt.parts[i]
+		if now.dev != was.dev {
+			return bad("entry %d is %s, not %s", i+1, now.dev, was.dev)
+		}
+		if now.dev != part.dev {
+			if now.String() != was.String() {
+				return bad("%s changed from %q to %q", now.dev, was, now)
+			}
+			continue
+		}
+		if now.Start() != was.Start() {
+			return bad("%s starts at sector %d, not %d", now.dev, now.Start(), was.Start())
+		}
+		// Say so specifically if the tool dropped an attribute
+		// bit, like LegacyBIOSBootable, which firmware needs.
+		nowAttrs, err := now.gptAttrBits()
+		if err != nil {
+			return bad("%v", err)
+		}
+		if wasAttrs, err := was.gptAttrBits(); err == nil && nowAttrs != wasAttrs {
+			return bad("%s has GPT attributes %q, not %q", now.dev, gptAttrs(nowAttrs), gptAttrs(wasAttrs))
+		}
+		if now.Size() != part.Size() {
+			return bad("%s is %d sectors, not %d", now.dev, now.Size(), part.Size())
+		}
+		if !strings.EqualFold(now.Attr("uuid"), part.Attr("uuid")) {
+			return bad("%s has PARTUUID %s, not %s", now.dev, now.Attr("uuid"), part.Attr("uuid"))
+		}
+		if withSize(now, 0) != withSize(part, 0) {
+			return bad("%s changed from %q to %q", now.dev, was, now)
+		}
+	}
+	return nil
+}
+
+// withSize returns sl's String with its size replaced by size, for
+// comparing entries apart from their sizes.
+func withSize(sl sfdiskLine, size int64) string {
+	c := sfdiskLine{dev: sl.dev, attr: append([]string(nil), sl.attr...), pno: sl.pno}
+	c.SetSize(size) // an entry without a size is compared whole
+	return c.String()
+}
+
+// sfdiskWriteCommand returns the command writing a new partition
+// table to diskDev. It's not subject to ctx's cancelation: killing
+// sfdisk mid-write could leave a corrupt partition table, and it's
+// quick anyway.
+func sfdiskWriteCommand(ctx context.Context, diskDev string) *exec.Cmd {
+	return Command(context.WithoutCancel(ctx), "sfdisk", "-f", "--no-reread", "--no-tell-kernel", diskDev)
+}
+
+// tableSteps describes, for an Action, writing pt, in which part has
+// been modified, to diskDev, telling the kernel, and waiting for udev.
+func tableSteps(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) []string {
+	var steps []string
+	for _, w := range pt.tool.writeCmds(ctx, diskDev, pt, part) {
+		steps = append(steps, cmdLine(w.cmd, w.stdin))
+	}
+	steps = append(steps,
+		fmt.Sprintf("ioctl(%s, BLKPG, {op: BLKPG_RESIZE_PARTITION, pno: %d, start: %d, length: %d})",
+			diskDev, part.pno, part.Start()*512, part.Size()*512))
+	if cmd, ok := udevSettleCommand(ctx); ok {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	return steps
+}
+
+type partitionTable struct {
+	meta  []string // without newlines
+	parts []sfdiskLine
+	tool  partitionTool // what read the table, and writes it
+}
+
+func (pt *partitionTable) Meta(k string) string {
+	for _, row := range pt.meta {
+		if strings.HasPrefix(row, k) &&
+			strings.HasPrefix(row, k+":") {
+			return strings.TrimSpace(row[len(k)+1:])
+		}
+	}
+	return ""
+}
+
+func (pt *partitionTable) RemoveMeta(key string) {
+	var newMeta []string
+	for _, meta := range pt.meta {
+		if strings.HasPrefix(meta, key) &&
+			strings.HasPrefix(meta, key+": ") {
+			continue
+		}
+		newMeta = append(newMeta, meta)
+	}
+	pt.meta = newMeta
+}
+
+func (pt *partitionTable) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	for _, meta := range pt.meta {
+		buf.WriteString(meta)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	for _, part := range pt.parts {
+		buf.WriteString(part.String())
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// maxEnd returns the sector just past the last one a partition in pt,
+// on a disk of diskSectors 512 byte sectors, may use. For GPT, that's
+// past the last usable LBA as it will be once sfdisk moves the backup
+// GPT to the end of the disk: the backup header takes the last sector,
+// with the partition entries before it. For MBR, it's the end of the
+// disk, or the most a 32-bit sector number can reach.
+func (pt *partitionTable) maxEnd(isGPT bool, diskSectors int64) (int64, error) {
+	if !isGPT {
+		return min(diskSectors, 1<<32-1), nil
+	}
+	entries := int64(128)
+	if v := pt.Meta("table-length"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bogus GPT table-length %q", v)
+		}
+		entries = n
+	}
+	const entrySize = 128
+	entrySectors := (entries*entrySize + 511) / 512
+	return diskSectors - 1 - entrySectors, nil
+}
+
+// partition returns the entry for the partition device dev.
+func (pt *partitionTable) partition(dev string) (part sfdiskLine, ok bool) {
+	for _, part := range pt.parts {
+		if part.dev == dev {
+			return part, true
+		}
+	}
+	return
+}
+
+func (pt *partitionTable) lastNonZeroPartition() (part sfdiskLine, ok bool) {
+	for i := len(pt.parts) - 1; i >= 0; i-- {
+		part = pt.parts[i]
+		if part.Type() == "0" && part.Start() == 0 && part.Size() == 0 {
+			// Skip useless partitions.
+			// See https://github.com/google/embiggen-disk/issues/6#issuecomment-429055087
+			continue
+		}
+		return part, true
+	}
+	return
+}
+
+// nextPartition returns the partition following part on the disk.
+func (pt *partitionTable) nextPartition(part sfdiskLine) (next sfdiskLine, ok bool) {
+	for _, p := range pt.parts {
+		if p.Start() > part.Start() && (!ok || p.Start() < next.Start()) {
+			next, ok = p, true
+		}
+	}
+	return
+}
+
+type sfdiskLine struct {
+	dev  string   // "/dev/sda1"
+	attr []string // key=value or key ("type=83", "bootable", "size=497664")
+	pno  int      //partition number
+}
+
+func (sl sfdiskLine) String() string {
+	return fmt.Sprintf("%s : %s", sl.dev, strings.Join(sl.attr, ", "))
+}
+
+func (sl sfdiskLine) Attr(key string) string {
+	for _, attr := range sl.attr {
+		if key == attr {
+			return key // Attr("bootable") == "bootable", not "true" or empty string
+		}
+		if strings.HasPrefix(attr, key) &&
+			strings.HasPrefix(attr, key+"=") {
+			return strings.TrimSpace(attr[len(key)+1:])
+		}
+	}
+	return ""
+}
+
+func (sl sfdiskLine) SetSize(size int64) error { return sl.setAttrInt64("size", size) }
+
+func (sl sfdiskLine) SetStart(start int64) error { return sl.setAttrInt64("start", start) }
+
+// setAttrInt64 sets sl's existing integer attribute key to n.
+func (sl sfdiskLine) setAttrInt64(key string, n int64) error {
+	for i, attr := range sl.attr {
+		if strings.HasPrefix(attr, key+"=") {
+			sl.attr[i] = fmt.Sprintf("%s=%d", key, n)
+			return nil
+		}
+	}
+	return fmt.Errorf("partition %s has no %s attribute in its partition table entry", sl.dev, key)
+}
+
+// gptReadOnlyBit is the GPT attribute with which the Discoverable
+// Partitions Specification, like Microsoft's basic data partitions,
+// marks a partition read-only, which keeps it from being grown.
+const gptReadOnlyBit = 60
+
+// gptAttrBits returns the GPT attribute bits of sl, from its attrs,
+// which are 0 for MBR partitions.
+func (sl sfdiskLine) gptAttrBits() (uint64, error) {
+	a := sl.Attr("attrs")
+	if s, err := strconv.Unquote(a); err == nil {
+		a = s
+	}
+	return parseGPTAttrs(a)
+}
+
+// checkWritable returns an error wrapping ErrImmutable if part's GPT
+// entry marks it read-only, unless Force is set.
+func checkWritable(part sfdiskLine) error {
+	attrs, err := part.gptAttrBits()
+	if err != nil {
+		return fmt.Errorf("%s: %w", part.dev, err)
+	}
+	if attrs&(1<<gptReadOnlyBit) != 0 && !Force {
+		return fmt.Errorf("%w: partition %s is marked read-only in its GPT entry (attribute bit %d); clear the bit or use --force", ErrImmutable, part.dev, gptReadOnlyBit)
+	}
+	return nil
+}
+
+// SetUUID sets sl's GPT partition GUID, its PARTUUID, reporting
+// whether it had one to set.
+func (sl sfdiskLine) SetUUID(uuid string) bool {
+	for i, attr := range sl.attr {
+		if strings.HasPrefix(attr, "uuid=") {
+			sl.attr[i] = "uuid=" + uuid
+			return true
+		}
+	}
+	return false
+}
+
+// regeneratePartUUID gives part, in pt, a new random PARTUUID, for
+// RegeneratePartUUIDs. Only GPT partitions have their own.
+func regeneratePartUUID(pt *partitionTable, part sfdiskLine, isGPT bool) error {
+	if !isGPT {
+		return fmt.Errorf("%s: only GPT partitions have PARTUUIDs of their own to regenerate; an MBR partition's comes from its disk's identifier", part.dev)
+	}
+	if _, ok := pt.tool.(partedTool); ok {
+		return fmt.Errorf("%s: parted can't set a partition's PARTUUID; install sfdisk or sgdisk to regenerate it", part.dev)
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	uuid := strings.ToUpper(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))
+	if !part.SetUUID(uuid) {
+		return fmt.Errorf("%s has no PARTUUID in its partition table entry to regenerate", part.dev)
+	}
+	return nil
+}
+
+func (sl sfdiskLine) AttrInt64(key string) (int64, error) {
+	v := sl.Attr(key)
+	if v == "" {
+		return 0, fmt.Errorf("partition %s has no %s attribute in its partition table entry", sl.dev, key)
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("partition %s has non-integer %s %q in its partition table entry", sl.dev, key, v)
+	}
+	return n, nil
+}
+
+// checkExtent returns an error unless sl has start and size attributes
+// that are sector counts a byte offset can hold. Reading a partition
+// table checks each entry, so Start and Size can't fail after that.
+func (sl sfdiskLine) checkExtent() error {
+	for _, k := range []string{"start", "size"} {
+		n, err := sl.AttrInt64(k)
+		if err != nil {
+			return err
+		}
+		if n < 0 || n > math.MaxInt64/512 {
+			return fmt.Errorf("partition %s has out-of-range %s %d in its partition table entry", sl.dev, k, n)
+		}
+	}
+	return nil
+}
+
+func (sl sfdiskLine) Type() string {
+	return sl.Attr(sl.typeKey())
+}
+
+// typeKey returns the key of sl's partition type attribute. sfdisk
+// from util-linux 2.26 on, like 2.29.2 on Debian under Proxmox/Qemu,
+// dumps "type=", but before that, like 2.23.2 on CentOS 7.5 on Azure,
+// "Id=", which is all it reads back.
+func (sl sfdiskLine) typeKey() string {
+	if sl.Attr("type") == "" && sl.Attr("Id") != "" {
+		return "Id"
+	}
+	return "type"
+}
+
+// typeKey returns the key of the partition type attribute of pt's
+// entries, for new entries to match: "Id" if pt was dumped by sfdisk
+// before 2.26, else "type".
+func (pt *partitionTable) typeKey() string {
+	if len(pt.parts) > 0 {
+		return pt.parts[0].typeKey()
+	}
+	return "type"
+}
+
+// Start and Size return sl's start and size in sectors, or 0 if sl
+// fails checkExtent.
+func (sl sfdiskLine) Start() int64 {
+	n, _ := sl.AttrInt64("start")
+	return n
+}
+
+func (sl sfdiskLine) Size() int64 {
+	n, _ := sl.AttrInt64("size")
+	return n
+}
+
+// sfdiskHeaderLine matches the lines of an sfdisk dump's header: a
+// "key: value" line, like "unit: sectors", or a comment, like the
+// "# partition table of /dev/sda" sfdisk before 2.26 starts with.
+var sfdiskHeaderLine = regexp.MustCompile(`^(#|[a-z][a-z-]*:)`)
+
+// parsePartitionTable parses the output of sfdisk -d. See the notes at
+// the end of this file.
+func parsePartitionTable(out []byte) (*partitionTable, error) {
+	pt := &partitionTable{tool: sfdiskTool{}}
+	lines := strings.Split(string(out), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			if pt.parts == nil {
+				pt.parts = make([]sfdiskLine, 0)
+			}
+			continue
+		}
+		if pt.parts == nil {
+			if !sfdiskHeaderLine.MatchString(line) {
+				// sfdisk before 2.26 can print warnings, like
+				// "Warning: extended partition does not start
+				// at a cylinder boundary.", on stdout before
+				// the dump. It wouldn't read them back.
+				vlogf("Skipping non-dump line %q in sfdisk output", line)
+				continue
+			}
+			pt.meta = append(pt.meta, line)
+		} else {
+			f := strings.SplitN(string(line), ":", 2)
+			if len(f) < 2 {
+				return nil, fmt.Errorf("unsupported sfdisk line %q", line)
+			}
+			dev := strings.TrimSpace(f[0])
+			rest := strings.TrimSpace(f[1])
+			// Partitions are listed in table order, which
+			// for MBR skips from the primaries to the
+			// logical ones at 5, so number them by name.
+			pno, err := strconv.Atoi(dev[len(strings.TrimRight(dev, "0123456789")):])
+			if err != nil {
+				return nil, fmt.Errorf("sfdisk line %q has no partition number", line)
+			}
+			part := sfdiskLine{dev: dev, pno: pno}
+			for _, attr := range splitAttrs(rest) {
+				k, v, ok := strings.Cut(attr, "=")
+				if ok {
+					attr = strings.TrimSpace(k) + "=" + strings.TrimSpace(v)
+				}
+				part.attr = append(part.attr, attr)
+			}
+			if err := part.checkExtent(); err != nil {
+				return nil, fmt.Errorf("sfdisk line %q: %w", line, err)
+			}
+			pt.parts = append(pt.parts, part)
+		}
+	}
+	return pt, nil
+}
+
+// splitAttrs splits the attributes of an sfdisk -d partition line at
+// its commas, except those in quoted values, like name="a, b".
+func splitAttrs(s string) []string {
+	var attrs []string
+	var quoted bool
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				attrs = append(attrs, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(attrs, strings.TrimSpace(s[start:]))
+}
+
+func readInt64File(f string) (int64, error) {
+	x, err := ioutil.ReadFile(f)
+	if err != nil {
+		return 0, err
+	}
+	x = bytes.TrimSpace(x)
+	n, err := strconv.ParseInt(string(x), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// blockDevSize returns the size in bytes of the block device dev,
+// which may be a symlink such as /dev/mapper/vg-lv. The sysfs size
+// file is always in 512 byte units, regardless of the device's sector
+// size.
+func blockDevSize(dev string) (int64, error) {
+	if d, err := evalSymlinks(dev); err == nil {
+		dev = d
+	}
+	n, err := readInt64File(sysPath(fmt.Sprintf("/sys/class/block/%s/size", filepath.Base(dev))))
+	if err != nil {
+		return 0, err
+	}
+	return n * 512, nil
+}
+
+func devEndsInNumber(d string) bool {
+	return len(d) > 0 && unicode.IsNumber(rune(d[len(d)-1]))
+}
+
+/*
+
+Notes on sfdisk output:
+
+can be GPT:
+
+label: gpt
+label-id: 841DBE6B-6A8D-43E1-93E1-D765373DDE3B
+device: /dev/sda
+unit: sectors
+first-lba: 34
+last-lba: 10485726
+
+/dev/sda1 : start=        2048, size=      192512, type=21686148-6449-6E6F-744E-656564454649, uuid=D7F261B7-9D9A-4864-AB85-A68ED9CD7CF0
+/dev/sda2 : start=      194560, size=      391168, type=0FC63DAF-8483-4772-8E79-3D69D8477DE4, uuid=B3EB025F-F682-4FE4-8F97-96974ADFD3BF
+/dev/sda3 : start=      585728, size=     9897984, type=E6D6D379-F507-44C2-A23C-238F2A3DF928, uuid=654CE2C8-5871-4DBE-A829-F3C4D953BBB9
+
+or MBR:
+
+label: dos
+label-id: 0xeba7536a
+device: /dev/sda
+unit: sectors
+
+/dev/sda1 : start=        2048, size=      497664, type=83, bootable
+/dev/sda2 : start=      501758, size=   209211394, type=5
+/dev/sda5 : start=      501760, size=   209211392, type=83
+
+*/
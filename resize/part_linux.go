@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// updateKernelPartition tells the kernel part's new extent on diskDev
+// with the BLKPG ioctl, which, unlike BLKRRPART, works while the disk
+// is in use.
+func updateKernelPartition(diskDev string, part sfdiskLine) error {
+	if err := checkNotDryRun("BLKPG_RESIZE_PARTITION on " + diskDev); err != nil {
+		return err
+	}
+	defer deviceChanges.Add(1)
+	return blkpgPartition(diskDev, unix.BLKPG_RESIZE_PARTITION, part)
+}
+
+// moveKernelPartition tells the kernel part's new extent on diskDev,
+// where it's moved, by deleting and re-adding it with the BLKPG ioctl.
+// The partition mustn't be in use.
+func moveKernelPartition(diskDev string, part sfdiskLine) error {
+	if err := checkNotDryRun("BLKPG_DEL_PARTITION on " + diskDev); err != nil {
+		return err
+	}
+	defer deviceChanges.Add(1)
+	for _, op := range []int32{unix.BLKPG_DEL_PARTITION, unix.BLKPG_ADD_PARTITION} {
+		if err := blkpgPartition(diskDev, op, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addKernelPartition tells the kernel of part, new on diskDev, with
+// the BLKPG ioctl.
+func addKernelPartition(diskDev string, part sfdiskLine) error {
+	if err := checkNotDryRun("BLKPG_ADD_PARTITION on " + diskDev); err != nil {
+		return err
+	}
+	defer deviceChanges.Add(1)
+	return blkpgPartition(diskDev, unix.BLKPG_ADD_PARTITION, part)
+}
+
+// blkpgPartition does the BLKPG operation op for part on diskDev,
+// through Privileges.
+func blkpgPartition(diskDev string, op int32, part sfdiskLine) error {
+	return Privileges.BLKPG(diskDev, op, int32(part.pno), part.Start()*512, part.Size()*512)
+}
+
+// blkpg does the BLKPG ioctl operation op for partition pno of disk.
+func blkpg(disk string, op, pno int32, start, length int64) error {
+	devf, err := os.Open(disk)
+	if err != nil {
+		return err
+	}
+	defer devf.Close()
+	arg := &unix.BlkpgIoctlArg{
+		Op: op,
+		Data: (*byte)(unsafe.Pointer(&unix.BlkpgPartition{
+			Start:  start,
+			Length: length,
+			Pno:    pno,
+		})),
+	}
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(devf.Fd()), unix.BLKPG, uintptr(unsafe.Pointer(arg))); e != 0 {
+		return syscall.Errno(e)
+	}
+	return nil
+}
+
+// lockDisk takes the exclusive BSD lock on the whole disk diskDev that
+// udev honors and partitioning tools like systemd-repart and
+// cloud-utils' growpart take while changing its partitions, waiting
+// up to settleTimeout for other holders. It returns the func
+// releasing it.
+func lockDisk(ctx context.Context, diskDev string) (unlock func(), err error) {
+	if err := checkNotDryRun("locking " + diskDev); err != nil {
+		return nil, err
+	}
+	f, err := Privileges.OpenFile(diskDev, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			return func() { f.Close() }, nil
+		}
+		if err != unix.EWOULDBLOCK || time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("locking %s against other partitioning tools: %v", diskDev, err)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
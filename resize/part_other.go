@@ -0,0 +1,53 @@
+//go:build !linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// updateKernelPartition fails: BLKPG is Linux's. Elsewhere, partitions
+// are grown by the system's own tool, like FreeBSD's gpart, which
+// tells the kernel itself.
+func updateKernelPartition(diskDev string, part sfdiskLine) error {
+	return fmt.Errorf("resizing partition %d of %s: %w", part.pno, diskDev, errors.ErrUnsupported)
+}
+
+// moveKernelPartition fails, as updateKernelPartition does.
+func moveKernelPartition(diskDev string, part sfdiskLine) error {
+	return fmt.Errorf("moving partition %d of %s: %w", part.pno, diskDev, errors.ErrUnsupported)
+}
+
+// addKernelPartition fails, as updateKernelPartition does.
+func addKernelPartition(diskDev string, part sfdiskLine) error {
+	return fmt.Errorf("adding partition %d of %s: %w", part.pno, diskDev, errors.ErrUnsupported)
+}
+
+// blkpg fails: BLKPG is Linux's.
+func blkpg(disk string, op, pno int32, start, length int64) error {
+	return fmt.Errorf("BLKPG on %s: %w", disk, errors.ErrUnsupported)
+}
+
+// lockDisk does nothing: the system's own partitioning tool locks the
+// disk itself.
+func lockDisk(ctx context.Context, diskDev string) (unlock func(), err error) {
+	return func() {}, nil
+}
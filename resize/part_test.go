@@ -0,0 +1,406 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the .golden files in testdata")
+
+type wantPart struct {
+	dev         string
+	pno         int
+	start, size int64
+	typ         string
+}
+
+// The testdata/sfdisk/*.dump files are sfdisk -d output as written by
+// the util-linux versions on the systems they're named for. Each .golden file
+// is how partitionTable.Write writes its .dump back.
+var sfdiskTests = []struct {
+	file  string
+	label string // Meta("label")
+	parts []wantPart
+	last  string // dev of lastNonZeroPartition
+	names map[string]string
+}{
+	{
+		file: "util-linux-2.23-centos7",
+		parts: []wantPart{
+			{"/dev/sda1", 1, 2048, 1024000, "83"},
+			{"/dev/sda2", 2, 1026048, 61888512, "83"},
+			{"/dev/sda3", 3, 0, 0, "0"},
+			{"/dev/sda4", 4, 0, 0, "0"},
+		},
+		last: "/dev/sda2",
+	},
+	{
+		file: "util-linux-2.17-rhel6-logical",
+		parts: []wantPart{
+			{"/dev/sda1", 1, 2048, 1024000, "83"},
+			{"/dev/sda2", 2, 1026048, 40916992, "5"},
+			{"/dev/sda3", 3, 0, 0, "0"},
+			{"/dev/sda4", 4, 0, 0, "0"},
+			{"/dev/sda5", 5, 1028096, 40914944, "8e"},
+		},
+		last: "/dev/sda5",
+	},
+	{
+		file:  "util-linux-2.25-debian8-logical",
+		label: "dos",
+		parts: []wantPart{
+			{"/dev/sda1", 1, 2048, 497664, "83"},
+			{"/dev/sda2", 2, 501758, 209211394, "5"},
+			{"/dev/sda5", 5, 501760, 209211392, "8e"},
+		},
+		last: "/dev/sda5",
+	},
+	{
+		file:  "util-linux-2.27-ubuntu1604-gpt",
+		label: "gpt",
+		parts: []wantPart{
+			{"/dev/sda1", 1, 2048, 192512, "21686148-6449-6E6F-744E-656564454649"},
+			{"/dev/sda2", 2, 194560, 391168, linuxGPTTypeID},
+			{"/dev/sda3", 3, 585728, 9897984, lvmGPTTypeID},
+		},
+		last: "/dev/sda3",
+	},
+	{
+		file:  "util-linux-2.33-raspbian-mmc",
+		label: "dos",
+		parts: []wantPart{
+			{"/dev/mmcblk0p1", 1, 8192, 524288, "c"},
+			{"/dev/mmcblk0p2", 2, 532480, 3643392, "83"},
+		},
+		last: "/dev/mmcblk0p2",
+	},
+	{
+		file:  "util-linux-2.34-ubuntu2004-cloudimg",
+		label: "gpt",
+		parts: []wantPart{
+			{"/dev/sda1", 1, 227328, 62687199, linuxGPTTypeID},
+			{"/dev/sda14", 14, 2048, 8192, "21686148-6449-6E6F-744E-656564454649"},
+			{"/dev/sda15", 15, 10240, 217088, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+		},
+		last: "/dev/sda15",
+	},
+	{
+		file:  "util-linux-2.38-nvme-named",
+		label: "gpt",
+		parts: []wantPart{
+			{"/dev/nvme0n1p1", 1, 2048, 1048576, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+			{"/dev/nvme0n1p2", 2, 1050624, 40890368, rootx8664GPTTypeID},
+		},
+		last: "/dev/nvme0n1p2",
+		names: map[string]string{
+			"/dev/nvme0n1p1": `"EFI System Partition"`,
+			"/dev/nvme0n1p2": `"root, x86-64"`,
+		},
+	},
+}
+
+func TestParsePartitionTable(t *testing.T) {
+	for _, tt := range sfdiskTests {
+		t.Run(tt.file, func(t *testing.T) {
+			base := filepath.Join("testdata", "sfdisk", tt.file)
+			dump, err := os.ReadFile(base + ".dump")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt, err := parsePartitionTable(dump)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pt.Meta("label"); got != tt.label {
+				t.Errorf("label = %q; want %q", got, tt.label)
+			}
+			var got []wantPart
+			for _, p := range pt.parts {
+				got = append(got, wantPart{p.dev, p.pno, p.Start(), p.Size(), p.Type()})
+			}
+			if !reflect.DeepEqual(got, tt.parts) {
+				t.Errorf("partitions:\n got %+v\nwant %+v", got, tt.parts)
+			}
+			if last, _ := pt.lastNonZeroPartition(); last.dev != tt.last {
+				t.Errorf("last partition = %q; want %q", last.dev, tt.last)
+			}
+			for dev, want := range tt.names {
+				p, _ := pt.partition(dev)
+				if got := p.Attr("name"); got != want {
+					t.Errorf("%s name = %s; want %s", dev, got, want)
+				}
+			}
+
+			// Write it back, as writeTable does, and parse that.
+			var buf bytes.Buffer
+			if err := pt.Write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if *updateGolden {
+				if err := os.WriteFile(base+".golden", buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(base + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), golden) {
+				t.Errorf("Write output differs from %s.golden:\n%s", base, buf.Bytes())
+			}
+			pt2, err := parsePartitionTable(buf.Bytes())
+			if err != nil {
+				t.Fatalf("parsing Write output: %v", err)
+			}
+			if !reflect.DeepEqual(pt2, pt) {
+				t.Errorf("Write output parses differently:\n got %+v\nwant %+v", pt2, pt)
+			}
+		})
+	}
+}
+
+func TestPartitionEntryErrors(t *testing.T) {
+	const header = "label: dos\ndevice: /dev/sda\nunit: sectors\n\n"
+	for _, line := range []string{
+		"/dev/sda1 : start=2048, type=83",
+		"/dev/sda1 : size=4096, type=83",
+		"/dev/sda1 : start=2048, size=lots, type=83",
+		"/dev/sda1 : start=-1, size=4096, type=83",
+		"/dev/sda1 : start=2048, size=99999999999999999, type=83",
+	} {
+		if _, err := parsePartitionTable([]byte(header + line + "\n")); err == nil {
+			t.Errorf("parsing %q succeeded; want error", line)
+		}
+	}
+
+	part := sfdiskLine{dev: "/dev/sda1", pno: 1, attr: []string{"type=83"}}
+	if err := part.SetSize(4096); err == nil {
+		t.Errorf("SetSize of an entry without a size succeeded")
+	}
+	if err := part.SetStart(2048); err == nil {
+		t.Errorf("SetStart of an entry without a start succeeded")
+	}
+	if n, err := part.AttrInt64("size"); err == nil {
+		t.Errorf("AttrInt64(size) = %d; want error", n)
+	}
+	if err := part.checkExtent(); err == nil {
+		t.Errorf("checkExtent of an entry without a start or size succeeded")
+	}
+	if err := (partitionResizer("/dev/sda1")).writeTable(context.Background(), "/dev/sda", &partitionTable{parts: []sfdiskLine{part}}, part); err == nil {
+		t.Errorf("writeTable of an entry without a start or size succeeded")
+	}
+
+	part.attr = []string{"start=2048", "size=4096", "type=83"}
+	if err := part.SetSize(8192); err != nil || part.Size() != 8192 || part.Start() != 2048 {
+		t.Errorf("SetSize(8192) = %v; entry now %v", err, part)
+	}
+}
+
+func TestSplitAttrs(t *testing.T) {
+	got := splitAttrs(`start=  2048, size= 8192, name="a, b", attrs="GUID:63"`)
+	want := []string{"start=  2048", "size= 8192", `name="a, b"`, `attrs="GUID:63"`}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("splitAttrs = %q; want %q", got, want)
+	}
+}
+
+func TestDiskDevice(t *testing.T) {
+	tests := []struct {
+		part, disk string
+	}{
+		{"/dev/sda3", "/dev/sda"},
+		{"/dev/vdb1", "/dev/vdb"},
+		{"/dev/mmcblk0p2", "/dev/mmcblk0"},
+		{"/dev/nvme0n1p1", "/dev/nvme0n1"},
+		{"/dev/nvme0n2p3", "/dev/nvme0n2"},
+		{"/dev/nvme12n34p56", "/dev/nvme12n34"},
+		{"/dev/nvme0c1n2p3", "/dev/nvme0c1n2"},
+	}
+	for _, tt := range tests {
+		if got, err := DiskDevice(tt.part); got != tt.disk || err != nil {
+			t.Errorf("DiskDevice(%q) = %q, %v; want %q", tt.part, got, err, tt.disk)
+		}
+	}
+}
+
+func TestDiskDeviceNotPartition(t *testing.T) {
+	for _, dev := range []string{"/dev/nvme0n2", "/dev/nvme0", "/dev/nvme0n1p", "/dev/nvme0p1", "/dev/mmcblk0boot0", "/dev/mmcblk0rpmb", "/dev/xvda1", "/dev/hda1", "sda1"} {
+		if disk, err := DiskDevice(dev); err == nil {
+			t.Errorf("DiskDevice(%q) = %q; want error", dev, disk)
+		}
+	}
+}
+
+func TestIsMMCHardwarePartition(t *testing.T) {
+	for dev, want := range map[string]bool{
+		"/dev/mmcblk0boot0": true,
+		"mmcblk0boot1":      true,
+		"/dev/mmcblk0rpmb":  true,
+		"/dev/mmcblk2gp3":   true,
+		"/dev/mmcblk0":      false,
+		"/dev/mmcblk0p1":    false,
+		"/dev/sda":          false,
+	} {
+		if got := IsMMCHardwarePartition(dev); got != want {
+			t.Errorf("IsMMCHardwarePartition(%q) = %v; want %v", dev, got, want)
+		}
+	}
+}
+
+func TestIsPartitionDev(t *testing.T) {
+	tests := []struct {
+		dev  string
+		want bool
+	}{
+		{"/dev/sda", false},
+		{"/dev/sda3", true},
+		{"/dev/nvme0n1", false},
+		{"/dev/nvme0n2", false},
+		{"/dev/nvme0c1n2", false},
+		{"/dev/nvme0n2p3", true},
+		{"/dev/nvme0c1n2p3", true},
+		{"/dev/mmcblk0", false},
+		{"/dev/mmcblk0p2", true},
+		{"/dev/mmcblk0boot0", false},
+		{"/dev/mmcblk0boot1", false},
+		{"/dev/mmcblk0rpmb", false},
+		{"/dev/mmcblk1gp0", false},
+	}
+	for _, tt := range tests {
+		if got := isPartitionDev(tt.dev); got != tt.want {
+			t.Errorf("isPartitionDev(%q) = %v; want %v", tt.dev, got, tt.want)
+		}
+	}
+}
+
+func FuzzParsePartitionTable(f *testing.F) {
+	files, _ := filepath.Glob("testdata/sfdisk/*.dump")
+	for _, file := range files {
+		dump, err := os.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(dump)
+	}
+	f.Fuzz(func(t *testing.T, dump []byte) {
+		pt, err := parsePartitionTable(dump)
+		if err != nil {
+			return
+		}
+		for _, p := range pt.parts {
+			if p.Start() < 0 || p.Size() < 0 {
+				t.Errorf("%s has start %d, size %d", p.dev, p.Start(), p.Size())
+			}
+		}
+		var buf bytes.Buffer
+		if err := pt.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		pt2, err := parsePartitionTable(buf.Bytes())
+		if err != nil {
+			t.Fatalf("parsing Write output %q: %v", buf.Bytes(), err)
+		}
+		if (len(pt.parts) > 0 || len(pt2.parts) > 0) && !reflect.DeepEqual(pt2.parts, pt.parts) {
+			t.Errorf("Write output parses differently:\n got %+v\nwant %+v", pt2.parts, pt.parts)
+		}
+	})
+}
+
+func TestCheckWritable(t *testing.T) {
+	defer func(old bool) { Force = old }(Force)
+	part := func(attrs string) sfdiskLine {
+		return sfdiskLine{dev: "/dev/sda2", pno: 2, attr: []string{"start=2048", "size=4096", "type=0FC63DAF-8483-4772-8E79-3D69D8477DE4", attrs}}
+	}
+	for _, attrs := range []string{"", `attrs="RequiredPartition LegacyBIOSBootable"`, `attrs="GUID:59"`} {
+		if err := checkWritable(part(attrs)); err != nil {
+			t.Errorf("checkWritable(%s) = %v", attrs, err)
+		}
+	}
+	ro := part(`attrs="LegacyBIOSBootable GUID:60"`)
+	if err := checkWritable(ro); !errors.Is(err, ErrImmutable) {
+		t.Errorf("checkWritable(read-only) = %v; want ErrImmutable", err)
+	}
+	Force = true
+	if err := checkWritable(ro); err != nil {
+		t.Errorf("with Force, checkWritable(read-only) = %v", err)
+	}
+	if err := checkWritable(part(`attrs="GUID:x"`)); err == nil {
+		t.Error("checkWritable(bogus attrs) succeeded")
+	}
+}
+
+func TestCheckPartitionType(t *testing.T) {
+	for _, tt := range []struct {
+		dev, typ string
+		gpt, ok  bool
+	}{
+		{"/dev/sda2", "0FC63DAF-8483-4772-8E79-3D69D8477DE4", true, true},
+		{"/dev/vda2", "C31C45E6-3F39-412E-80FB-4809C4980599", true, true},  // ppc64le root
+		{"/dev/sda2", "c31c45e6-3f39-412e-80fb-4809c4980599", true, true},  // lower case
+		{"/dev/sda2", "912ADE1D-A839-4913-8964-A10EEE08FBD2", true, true},  // ppc64 root
+		{"/dev/sda1", "9E1A2D38-C612-4316-AA26-8B49521E5A8B", true, false}, // PReP boot
+		{"/dev/sda1", "C12A7328-F81F-11D2-BA4B-00A0C93EC93B", true, false}, // ESP
+		{"/dev/vda2", "83", false, true},
+		{"/dev/sda3", "8e", false, true},  // LVM, after PReP and /boot
+		{"/dev/vda1", "41", false, false}, // PReP boot
+	} {
+		part := sfdiskLine{dev: tt.dev, attr: []string{"start=2048", "size=16384", "type=" + tt.typ}}
+		err := checkPartitionType(part, tt.gpt)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkPartitionType(%s, type %s) = %v; want ok = %v", tt.dev, tt.typ, err, tt.ok)
+		}
+		if err != nil && strings.Contains(err.Error(), "unknown") == (tt.typ == "41" || strings.HasPrefix(tt.typ, "9E1A")) {
+			t.Errorf("checkPartitionType(%s, type %s) = %v; want PReP partitions recognized", tt.dev, tt.typ, err)
+		}
+	}
+}
+
+func TestRegeneratePartUUID(t *testing.T) {
+	pt, err := parsePartitionTable([]byte(repartDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, _ := pt.partition("/dev/vda2")
+	old := part.Attr("uuid")
+	if err := regeneratePartUUID(pt, part, true); err != nil {
+		t.Fatal(err)
+	}
+	now, _ := pt.partition("/dev/vda2")
+	uuid := now.Attr("uuid")
+	if uuid == old || len(uuid) != 36 || uuid[14] != '4' || uuid != strings.ToUpper(uuid) {
+		t.Errorf("new PARTUUID = %q; want a new random uppercase UUID", uuid)
+	}
+	if esp, _ := pt.partition("/dev/vda1"); esp.Attr("uuid") != "D7F261B7-9D9A-4864-AB85-A68ED9CD7CF0" {
+		t.Errorf("ESP's PARTUUID changed to %q", esp.Attr("uuid"))
+	}
+	if err := regeneratePartUUID(pt, part, false); err == nil {
+		t.Error("regenerating an MBR partition's PARTUUID succeeded")
+	}
+	pt.tool = partedTool{}
+	if err := regeneratePartUUID(pt, part, true); err == nil {
+		t.Error("regenerating a PARTUUID with parted succeeded")
+	}
+}
@@ -0,0 +1,432 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A partitionTool reads and writes partition tables. Whichever tool
+// reads a table, it's held in sfdisk's dump format, and written back
+// by the tool that read it.
+type partitionTool interface {
+	// name is the tool's executable, as given to Command.
+	name() string
+
+	// supports reports whether the tool can write a partition table
+	// of type ptType, as blkid reports it ("dos" or "gpt").
+	supports(ptType string) bool
+
+	// readTable returns the partition table of diskDev.
+	readTable(ctx context.Context, diskDev string) (*partitionTable, error)
+
+	// writeCmds returns the commands writing pt, which differs from
+	// the table on diskDev only in part's size, to diskDev.
+	writeCmds(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) []tableWrite
+}
+
+// A tableWrite is a command writing a partition table, and its
+// standard input.
+type tableWrite struct {
+	cmd   *exec.Cmd
+	stdin []byte
+}
+
+// altPartitionTools are the tools used, in order of preference, when
+// sfdisk isn't installed or is too old to know GPT (see
+// https://github.com/google/embiggen-disk/issues/6).
+var altPartitionTools = []partitionTool{sgdiskTool{}, partedTool{}}
+
+func haveTool(name string) bool {
+	_, err := ToolPath(name)
+	return err == nil
+}
+
+func haveAltPartitionTool() bool {
+	for _, t := range altPartitionTools {
+		if haveTool(t.name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// getPartitionTable returns the partition table of dev, read with
+// sfdisk, or with sgdisk or parted if sfdisk isn't installed or
+// doesn't know the table's type. The table's tool writes it back.
+func getPartitionTable(ctx context.Context, dev string) (*partitionTable, error) {
+	var sfdiskPT *partitionTable
+	if haveTool("sfdisk") || !haveAltPartitionTool() {
+		pt, err := sfdiskTool{}.readTable(ctx, dev)
+		if err != nil {
+			return nil, err
+		}
+		if pt.Meta("label") != "" || !haveAltPartitionTool() {
+			// Where it's all there is, partitionTableIsGPT
+			// decides whether an old sfdisk can be trusted.
+			return pt, nil
+		}
+		sfdiskPT = pt
+	}
+	ptType, err := probePTType(dev)
+	if err != nil {
+		return nil, err
+	}
+	if ptType == "dos" && sfdiskPT != nil {
+		// Even old sfdisk handles MBR.
+		return sfdiskPT, nil
+	}
+	for _, t := range altPartitionTools {
+		if t.supports(ptType) && haveTool(t.name()) {
+			vlogf("Using %s for the %s partition table of %s", t.name(), ptType, dev)
+			return t.readTable(ctx, dev)
+		}
+	}
+	return nil, fmt.Errorf("%w: no sfdisk, sgdisk, or parted that can write the %s partition table of %s", ErrToolMissing, ptType, dev)
+}
+
+// probePTType returns the type of diskDev's partition table, "dos"
+// or "gpt" as blkid names them, from its first sectors. A GPT disk
+// starts with a protective MBR, a single partition of type 0xEE
+// covering the disk, so it's only "dos" if there's no GPT header after
+// it.
+func probePTType(diskDev string) (string, error) {
+	// The GPT header is in the second logical sector, so look after
+	// 512 and 4096 bytes unless the kernel says which.
+	sizes := []int64{512, 4096}
+	if ss, err := readInt64File(sysPath("/sys/block/" + filepath.Base(diskDev) + "/queue/logical_block_size")); err == nil {
+		sizes = []int64{ss}
+	}
+	buf := make([]byte, 2*sizes[len(sizes)-1])
+	if err := readAt(diskDev, buf, 0); err != nil {
+		return "", fmt.Errorf("probing partition table of %s: %v", diskDev, err)
+	}
+	for _, ss := range sizes {
+		h := buf[ss : 2*ss]
+		if string(h[:8]) != "EFI PART" {
+			continue
+		}
+		hsize := binary.LittleEndian.Uint32(h[12:])
+		if hsize < 92 || int64(hsize) > ss {
+			return "", fmt.Errorf("GPT header of %s has bogus size %d", diskDev, hsize)
+		}
+		hdr := append([]byte(nil), h[:hsize]...)
+		want := binary.LittleEndian.Uint32(hdr[16:])
+		binary.LittleEndian.PutUint32(hdr[16:], 0)
+		if crc32.ChecksumIEEE(hdr) != want {
+			return "", fmt.Errorf("GPT header of %s has a bad checksum", diskDev)
+		}
+		return "gpt", nil
+	}
+	if buf[510] != 0x55 || buf[511] != 0xAA {
+		return "", fmt.Errorf("no MBR or GPT partition table on %s", diskDev)
+	}
+	for i := 0; i < 4; i++ {
+		if buf[446+16*i+4] == 0xEE {
+			return "", fmt.Errorf("%s has a GPT protective MBR but no valid GPT header", diskDev)
+		}
+	}
+	return "dos", nil
+}
+
+// parseBlkidExport parses the KEY=value lines of blkid -o export,
+// which escapes spaces and other special characters in values with
+// backslashes.
+func parseBlkidExport(out []byte) map[string]string {
+	m := map[string]string{}
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	for bs.Scan() {
+		k, v, ok := strings.Cut(bs.Text(), "=")
+		if !ok {
+			continue
+		}
+		var b strings.Builder
+		for i := 0; i < len(v); i++ {
+			if v[i] == '\\' && i+1 < len(v) {
+				i++
+			}
+			b.WriteByte(v[i])
+		}
+		m[k] = b.String()
+	}
+	return m
+}
+
+type sfdiskTool struct{}
+
+func (sfdiskTool) name() string                { return "sfdisk" }
+func (sfdiskTool) supports(ptType string) bool { return ptType == "dos" || ptType == "gpt" }
+
+func (sfdiskTool) readTable(ctx context.Context, diskDev string) (*partitionTable, error) {
+	cmd := Command(ctx, "sfdisk", "-d", diskDev)
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if u := sfdiskUnit(out); u != "sectors" {
+		// sfdisk before 2.26 can be set to dump in cylinders,
+		// which are rounded; ask it for exact sectors instead.
+		vlogf("sfdisk dumped %s in %s; reading it again in sectors", diskDev, u)
+		cmd := Command(ctx, "sfdisk", "-d", "-uS", diskDev)
+		if out, err = query(ctx, cmd); err != nil {
+			return nil, err
+		}
+		if u := sfdiskUnit(out); u != "sectors" {
+			return nil, fmt.Errorf("sfdisk dumps the partition table of %s in %s, not sectors", diskDev, u)
+		}
+	}
+	return parsePartitionTable(out)
+}
+
+// sfdiskUnit returns the unit of the sfdisk dump out, from the
+// "unit:" line in its header, or "sectors" if it has none.
+func sfdiskUnit(out []byte) string {
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "/dev/") {
+			break
+		}
+		if u, ok := strings.CutPrefix(line, "unit:"); ok {
+			return strings.TrimSpace(u)
+		}
+	}
+	return "sectors"
+}
+
+func (sfdiskTool) writeCmds(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) []tableWrite {
+	var buf bytes.Buffer
+	pt.Write(&buf)
+	return []tableWrite{{sfdiskWriteCommand(ctx, diskDev), buf.Bytes()}}
+}
+
+// blkidTable reads the partition table of diskDev with blkid -p, which
+// probes each partition's entry in the table on disk rather than
+// asking the kernel, into sfdisk's dump format. It's how the tables
+// sgdisk and parted write are read, as neither lists every partition's
+// type, UUID, name, and attributes in one parseable place.
+func blkidTable(ctx context.Context, diskDev string, tool partitionTool) (*partitionTable, error) {
+	cmd := Command(ctx, "blkid", "-p", "-o", "export", diskDev)
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	disk := parseBlkidExport(out)
+	ptType, err := probePTType(diskDev)
+	if err != nil {
+		return nil, err
+	}
+	pt := &partitionTable{tool: tool, parts: []sfdiskLine{}}
+	pt.meta = append(pt.meta, "label: "+ptType)
+	if id := disk["PTUUID"]; id != "" {
+		pt.meta = append(pt.meta, "label-id: "+id)
+	}
+	pt.meta = append(pt.meta, "device: "+diskDev, "unit: sectors")
+	name := filepath.Base(diskDev)
+	if ss, err := readInt64File(sysPath("/sys/block/" + name + "/queue/logical_block_size")); err == nil {
+		pt.meta = append(pt.meta, fmt.Sprintf("sector-size: %d", ss))
+	}
+
+	// The kernel lists the partitions, which it has as they were
+	// before any write, so their number, if not their sizes, is
+	// current.
+	files, _ := filepath.Glob(sysPath("/sys/block/" + name + "/" + name + "*/partition"))
+	for _, f := range files {
+		dev := "/dev/" + filepath.Base(filepath.Dir(f))
+		cmd := Command(ctx, "blkid", "-p", "-o", "export", dev)
+		out, err := query(ctx, cmd)
+		if err != nil {
+			return nil, err
+		}
+		part, err := blkidPartition(dev, parseBlkidExport(out))
+		if err != nil {
+			return nil, err
+		}
+		pt.parts = append(pt.parts, part)
+	}
+	sort.Slice(pt.parts, func(i, j int) bool { return pt.parts[i].pno < pt.parts[j].pno })
+	return pt, nil
+}
+
+// blkidPartition returns the sfdisk dump line for the partition dev,
+// given blkid's PART_ENTRY_* values for it.
+func blkidPartition(dev string, m map[string]string) (sfdiskLine, error) {
+	bad := func(k string) (sfdiskLine, error) {
+		return sfdiskLine{}, fmt.Errorf("bogus %s %q from blkid for %s", k, m[k], dev)
+	}
+	pno, err := strconv.Atoi(m["PART_ENTRY_NUMBER"])
+	if err != nil || pno <= 0 {
+		return bad("PART_ENTRY_NUMBER")
+	}
+	part := sfdiskLine{dev: dev, pno: pno}
+	for _, f := range []struct{ key, attr string }{
+		{"PART_ENTRY_OFFSET", "start"},
+		{"PART_ENTRY_SIZE", "size"},
+	} {
+		n, err := strconv.ParseInt(m[f.key], 10, 64)
+		if err != nil || n < 0 || n > math.MaxInt64/512 {
+			return bad(f.key)
+		}
+		part.attr = append(part.attr, fmt.Sprintf("%s=%d", f.attr, n))
+	}
+	flags, err := strconv.ParseUint(strings.TrimPrefix(m["PART_ENTRY_FLAGS"], "0x"), 16, 64)
+	if err != nil && m["PART_ENTRY_FLAGS"] != "" {
+		return bad("PART_ENTRY_FLAGS")
+	}
+	switch m["PART_ENTRY_SCHEME"] {
+	case "dos":
+		part.attr = append(part.attr, "type="+strings.TrimPrefix(m["PART_ENTRY_TYPE"], "0x"))
+		if flags&0x80 != 0 {
+			part.attr = append(part.attr, "bootable")
+		}
+	case "gpt":
+		part.attr = append(part.attr, "type="+strings.ToUpper(m["PART_ENTRY_TYPE"]))
+		if u := m["PART_ENTRY_UUID"]; u != "" {
+			part.attr = append(part.attr, "uuid="+strings.ToUpper(u))
+		}
+		if n := m["PART_ENTRY_NAME"]; n != "" {
+			part.attr = append(part.attr, "name="+strconv.Quote(n))
+		}
+		if flags != 0 {
+			part.attr = append(part.attr, fmt.Sprintf("attrs=%q", gptAttrs(flags)))
+		}
+	default:
+		return bad("PART_ENTRY_SCHEME")
+	}
+	return part, nil
+}
+
+// gptAttrNames are the names sfdisk gives the GPT attribute bits
+// defined for all partition types.
+var gptAttrNames = []string{"RequiredPartition", "NoBlockIOProtocol", "LegacyBIOSBootable"}
+
+// gptAttrs formats the GPT attribute bits flags as sfdisk -d does:
+// names for the first three, "GUID:" and the numbers of the type
+// specific bits 48-63, and numbers for any others.
+func gptAttrs(flags uint64) string {
+	var f, guid []string
+	for bit := 0; bit < 64; bit++ {
+		if flags&(1<<bit) == 0 {
+			continue
+		}
+		switch {
+		case bit < len(gptAttrNames):
+			f = append(f, gptAttrNames[bit])
+		case bit >= 48:
+			guid = append(guid, strconv.Itoa(bit))
+		default:
+			f = append(f, strconv.Itoa(bit))
+		}
+	}
+	if len(guid) > 0 {
+		f = append(f, "GUID:"+strings.Join(guid, ","))
+	}
+	return strings.Join(f, " ")
+}
+
+// parseGPTAttrs parses the attrs value of an sfdisk -d GPT partition
+// line, as gptAttrs formats it, into attribute bits.
+func parseGPTAttrs(s string) (uint64, error) {
+	var flags uint64
+	for _, f := range strings.Fields(s) {
+		nums := f
+		if rest, ok := strings.CutPrefix(f, "GUID:"); ok {
+			nums = rest
+		} else if i := slices.Index(gptAttrNames, f); i >= 0 {
+			flags |= 1 << i
+			continue
+		}
+		for _, n := range strings.Split(nums, ",") {
+			bit, err := strconv.Atoi(n)
+			if err != nil || bit < 0 || bit > 63 {
+				return 0, fmt.Errorf("bogus GPT attribute %q in %q", f, s)
+			}
+			flags |= 1 << bit
+		}
+	}
+	return flags, nil
+}
+
+// sgdiskTool writes GPT partition tables with gdisk's sgdisk.
+type sgdiskTool struct{}
+
+func (sgdiskTool) name() string                { return "sgdisk" }
+func (sgdiskTool) supports(ptType string) bool { return ptType == "gpt" }
+
+func (t sgdiskTool) readTable(ctx context.Context, diskDev string) (*partitionTable, error) {
+	return blkidTable(ctx, diskDev, t)
+}
+
+// writeCmds returns the sgdisk command moving the backup GPT to the
+// end of the disk and recreating part's entry with its new size and
+// otherwise as it was, as sgdisk can't change an entry's end in place.
+func (sgdiskTool) writeCmds(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) []tableWrite {
+	n := strconv.Itoa(part.pno)
+	args := []string{
+		"--move-second-header",
+		"--delete=" + n,
+		fmt.Sprintf("--new=%s:%d:%d", n, part.Start(), part.Start()+part.Size()-1),
+		"--typecode=" + n + ":" + part.Type(),
+	}
+	if u := part.Attr("uuid"); u != "" {
+		args = append(args, "--partition-guid="+n+":"+u)
+	}
+	if name := part.Attr("name"); name != "" {
+		if s, err := strconv.Unquote(name); err == nil {
+			name = s
+		}
+		args = append(args, "--change-name="+n+":"+name)
+	}
+	// grownTable has checked the attributes parse.
+	if flags, err := part.gptAttrBits(); err == nil && flags != 0 {
+		args = append(args, fmt.Sprintf("--attributes=%s:=:%016x", n, flags))
+	}
+	args = append(args, diskDev)
+	return []tableWrite{{cmd: Command(context.WithoutCancel(ctx), "sgdisk", args...)}}
+}
+
+// partedTool writes MBR and GPT partition tables with GNU parted.
+type partedTool struct{}
+
+func (partedTool) name() string                { return "parted" }
+func (partedTool) supports(ptType string) bool { return ptType == "dos" || ptType == "gpt" }
+
+func (t partedTool) readTable(ctx context.Context, diskDev string) (*partitionTable, error) {
+	return blkidTable(ctx, diskDev, t)
+}
+
+// writeCmds returns the parted command moving part's end. --fix (from
+// parted 3.5) has it move the backup GPT to the end of the grown disk
+// rather than refuse to use the space after it. Untested: parted may
+// still ask for confirmation, which fails in script mode, before
+// resizing a partition in use or shrinking one back.
+func (partedTool) writeCmds(ctx context.Context, diskDev string, pt *partitionTable, part sfdiskLine) []tableWrite {
+	end := fmt.Sprintf("%ds", part.Start()+part.Size()-1)
+	cmd := Command(context.WithoutCancel(ctx), "parted", "--script", "--fix", diskDev, "unit", "s", "resizepart", strconv.Itoa(part.pno), end)
+	return []tableWrite{{cmd: cmd}}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBlkidPartition(t *testing.T) {
+	tests := []struct {
+		name, export, want string
+	}{
+		{
+			name: "gpt",
+			export: `DEVNAME=/dev/sda3
+PART_ENTRY_SCHEME=gpt
+PART_ENTRY_NAME=root\ disk
+PART_ENTRY_UUID=654ce2c8-5871-4dbe-a829-f3c4d953bbb9
+PART_ENTRY_TYPE=e6d6d379-f507-44c2-a23c-238f2a3df928
+PART_ENTRY_FLAGS=0x8000000000000001
+PART_ENTRY_NUMBER=3
+PART_ENTRY_OFFSET=585728
+PART_ENTRY_SIZE=9897984
+PART_ENTRY_DISK=8:0
+`,
+			want: `/dev/sda3 : start=585728, size=9897984, type=E6D6D379-F507-44C2-A23C-238F2A3DF928, uuid=654CE2C8-5871-4DBE-A829-F3C4D953BBB9, name="root disk", attrs="RequiredPartition GUID:63"`,
+		},
+		{
+			name: "dos",
+			export: `DEVNAME=/dev/mmcblk0p2
+UUID=3857a514-b0f4-49ce-8430-34762068bb6f
+TYPE=ext4
+PART_ENTRY_SCHEME=dos
+PART_ENTRY_UUID=6c586e13-02
+PART_ENTRY_TYPE=0x83
+PART_ENTRY_FLAGS=0x80
+PART_ENTRY_NUMBER=2
+PART_ENTRY_OFFSET=532480
+PART_ENTRY_SIZE=3643392
+`,
+			want: `/dev/mmcblk0p2 : start=532480, size=3643392, type=83, bootable`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := parseBlkidExport([]byte(tt.export))
+			part, err := blkidPartition(m["DEVNAME"], m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.String(); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlkidPartitionBogus(t *testing.T) {
+	for _, export := range []string{
+		"PART_ENTRY_SCHEME=gpt\nPART_ENTRY_OFFSET=2048\nPART_ENTRY_SIZE=100\n",
+		"PART_ENTRY_SCHEME=gpt\nPART_ENTRY_NUMBER=1\nPART_ENTRY_OFFSET=-1\nPART_ENTRY_SIZE=100\n",
+		"PART_ENTRY_SCHEME=bsd\nPART_ENTRY_NUMBER=1\nPART_ENTRY_OFFSET=2048\nPART_ENTRY_SIZE=100\n",
+	} {
+		if part, err := blkidPartition("/dev/sda1", parseBlkidExport([]byte(export))); err == nil {
+			t.Errorf("blkidPartition(%q) = %v; want error", export, part)
+		}
+	}
+}
+
+func TestGPTAttrs(t *testing.T) {
+	for _, flags := range []uint64{0, 1, 1<<2 | 1<<60, 1<<48 | 1<<63, 1 << 5} {
+		s := gptAttrs(flags)
+		got, err := parseGPTAttrs(s)
+		if err != nil || got != flags {
+			t.Errorf("parseGPTAttrs(gptAttrs(%#x) = %q) = %#x, %v", flags, s, got, err)
+		}
+	}
+	if got, err := parseGPTAttrs("LegacyBIOSBootable GUID:48,60"); err != nil || got != 1<<2|1<<48|1<<60 {
+		t.Errorf("parseGPTAttrs = %#x, %v", got, err)
+	}
+}
+
+func TestPartitionToolWriteCmds(t *testing.T) {
+	part := sfdiskLine{
+		dev:  "/dev/nvme0n1p2",
+		pno:  2,
+		attr: []string{"start=1050624", "size=81885184", "type=0FC63DAF-8483-4772-8E79-3D69D8477DE4", "uuid=B3EB025F-F682-4FE4-8F97-96974ADFD3BF", `name="root, x86-64"`, `attrs="GUID:59"`},
+	}
+	pt := &partitionTable{parts: []sfdiskLine{part}}
+	tests := []struct {
+		tool partitionTool
+		want string
+	}{
+		{sgdiskTool{}, "--move-second-header --delete=2 --new=2:1050624:82935807 --typecode=2:0FC63DAF-8483-4772-8E79-3D69D8477DE4 --partition-guid=2:B3EB025F-F682-4FE4-8F97-96974ADFD3BF --change-name=2:root, x86-64 --attributes=2:=:0800000000000000 /dev/nvme0n1"},
+		{partedTool{}, "--script --fix /dev/nvme0n1 unit s resizepart 2 82935807s"},
+	}
+	for _, tt := range tests {
+		ws := tt.tool.writeCmds(context.Background(), "/dev/nvme0n1", pt, part)
+		if len(ws) != 1 {
+			t.Fatalf("%s: %d commands; want 1", tt.tool.name(), len(ws))
+		}
+		if got := strings.Join(ws[0].cmd.Args[1:], " "); got != tt.want {
+			t.Errorf("%s args:\n got %s\nwant %s", tt.tool.name(), got, tt.want)
+		}
+	}
+}
+
+func TestSfdiskCylinderUnits(t *testing.T) {
+	sectors := "# partition table of /dev/sda\nunit: sectors\n\n" +
+		"/dev/sda1 : start=       63, size= 41929587, Id=83, bootable\n" +
+		"/dev/sda2 : start=        0, size=        0, Id= 0\n"
+	replayRecordings(t, []Recording{
+		{Args: []string{"sfdisk", "-d", "/dev/sda"}, Stdout: "# partition table of /dev/sda\nunit: cylinders\n\n" +
+			"/dev/sda1 : start=        0+, size=     2610-, Id=83, bootable\n" +
+			"/dev/sda2 : start=        0, size=        0, Id= 0\n"},
+		{Args: []string{"sfdisk", "-d", "-uS", "/dev/sda"}, Stdout: sectors},
+	})
+	pt, err := sfdiskTool{}.readTable(context.Background(), "/dev/sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, _ := pt.partition("/dev/sda1")
+	if part.Start() != 63 || part.Size() != 41929587 || part.Type() != "83" {
+		t.Errorf("sda1 = %v; want it in sectors", part)
+	}
+	if got := pt.typeKey(); got != "Id" {
+		t.Errorf("typeKey = %q; want Id, as old sfdisk dumped", got)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import "context"
+
+// An Action is what a Resizer would do if resized now, from its Plan
+// method.
+type Action struct {
+	// Steps describe what it would do, in order: the command lines it
+	// would run, shell-quoted, with any input as a here-document, and
+	// any other operations, such as ioctls. It's empty if there's
+	// nothing to do.
+	Steps []string
+
+	// CurrentBytes is its current size.
+	CurrentBytes int64
+
+	// ProposedBytes is the size it would grow to, or 0 if that
+	// depends on how much the layers below it grow first.
+	ProposedBytes int64
+}
+
+// A PlanStep is one Resizer's part of a Plan.
+type PlanStep struct {
+	Resizer Resizer
+	Action
+
+	// Estimated is whether ProposedBytes, which the Resizer left 0,
+	// was estimated from how much the layers directly below it grow,
+	// with ExpectedSize.
+	Estimated bool
+}
+
+// A sizer is a Resizer whose size, once grown, follows from the size
+// of the layer below it, less overhead such as a metadata area.
+type sizer interface {
+	sizeFor(ctx context.Context, belowBytes int64) (int64, error)
+}
+
+// ExpectedSize returns the size r, now cur bytes, should be once grown
+// after the layers directly below it have grown from belowBefore to
+// belowAfter bytes in total. Most layers grow by as much as the layers
+// below them; an LVM PV grows to what fits after its metadata area,
+// in whole extents.
+func ExpectedSize(ctx context.Context, r Resizer, cur, belowBefore, belowAfter int64) (int64, error) {
+	if s, ok := r.(sizer); ok {
+		return s.sizeFor(ctx, belowAfter)
+	}
+	return cur + belowAfter - belowBefore, nil
+}
+
+// Plan returns what Resize would do to e and the layers below it, in
+// the order it would do it, without changing anything.
+func Plan(ctx context.Context, e Resizer) ([]PlanStep, error) {
+	var steps []PlanStep
+	_, err := plan(withQueryCache(ctx), e, &steps)
+	return steps, err
+}
+
+// plan appends the plan for e and the layers below it to steps and
+// returns the step for e.
+func plan(ctx context.Context, e Resizer, steps *[]PlanStep) (PlanStep, error) {
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return PlanStep{}, err
+	}
+	var below []PlanStep
+	for _, dep := range deps {
+		st, err := plan(ctx, dep, steps)
+		if err != nil {
+			return PlanStep{}, err
+		}
+		below = append(below, st)
+	}
+	a, err := e.Plan(ctx)
+	if err != nil {
+		return PlanStep{}, err
+	}
+	st := PlanStep{Resizer: e, Action: a}
+	if st.ProposedBytes == 0 {
+		st.ProposedBytes = st.CurrentBytes
+		if len(below) > 0 {
+			var before, after int64
+			for _, b := range below {
+				before += b.CurrentBytes
+				after += b.ProposedBytes
+			}
+			if st.ProposedBytes, err = ExpectedSize(ctx, e, st.CurrentBytes, before, after); err != nil {
+				return PlanStep{}, err
+			}
+			st.Estimated = true
+		}
+	}
+	*steps = append(*steps, st)
+	return st, nil
+}
+
+// reportAction describes a through DryRunf and ProposeSize.
+func reportAction(a Action) {
+	if a.ProposedBytes != 0 && ProposeSize != nil {
+		ProposeSize(a.ProposedBytes)
+	}
+	for _, s := range a.Steps {
+		DryRunf("would've run: %s", s)
+	}
+}
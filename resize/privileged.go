@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Privileged does the privileged operations resizers need other than
+// running commands, which go through CommandRunner: opening devices
+// and system files, creating directories and renaming files in system
+// places, and telling the kernel of partition changes.
+type Privileged interface {
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+
+	// BLKPG does the BLKPG ioctl operation op, such as
+	// BLKPG_RESIZE_PARTITION, for partition pno of the disk disk,
+	// with its start and length in bytes.
+	BLKPG(disk string, op, pno int32, start, length int64) error
+}
+
+// Privileges does the privileged operations resizers need. The default,
+// LocalPrivileged, does them in this process; a process that gives up
+// root substitutes one asking a helper that kept the capabilities
+// they need.
+var Privileges Privileged = LocalPrivileged{}
+
+// A LayerResizer is a Privileged that resizes whole layers, as a
+// helper that kept root can for a process that gave it up. With one as
+// Privileges, Resize has it resize each layer, and undo it, rather
+// than doing so in this process, which then only reads.
+type LayerResizer interface {
+	ResizeLayer(ctx context.Context, r Resizer) error
+	UndoLayer(ctx context.Context, r Resizer) error
+}
+
+// Undo undoes r's last Resize in this process, if r is a layer that
+// can be undone, such as a partition. It's for a LayerResizer's helper
+// to call for the layers it's asked to undo.
+func Undo(ctx context.Context, r Resizer) error {
+	u, ok := r.(undoer)
+	if !ok {
+		return fmt.Errorf("%v can't be undone", r)
+	}
+	return u.undo(ctx)
+}
+
+// LocalPrivileged is the Privileged doing its operations in this
+// process.
+type LocalPrivileged struct{}
+
+func (LocalPrivileged) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (LocalPrivileged) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (LocalPrivileged) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (LocalPrivileged) BLKPG(disk string, op, pno int32, start, length int64) error {
+	return blkpg(disk, op, pno, start, length)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// resize2fsBarWidth is the number of 'X' marks resize2fs -p prints
+// for a complete pass. See e2fsprogs resize/sim_progress.c.
+const resize2fsBarWidth = 40
+
+var resize2fsPassRx = regexp.MustCompile(`Begin pass (\d+) \(max = \d+\)`)
+
+// resize2fsProgress is an io.Writer that parses the output of
+// "resize2fs -p" and calls report as each pass progresses.
+//
+// resize2fs prints "Begin pass N (max = M)", a label, and then a bar
+// of up to resize2fsBarWidth 'X' characters as the pass advances.
+type resize2fsProgress struct {
+	report func(pass int, percent float64, eta time.Duration)
+	now    func() time.Time // or nil for time.Now
+
+	out       bytes.Buffer // everything written, for error messages
+	line      []byte       // current partial line
+	pass      int
+	marks     int
+	passStart time.Time
+}
+
+func (p *resize2fsProgress) timeNow() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+func (p *resize2fsProgress) Write(b []byte) (int, error) {
+	p.out.Write(b)
+	for _, c := range b {
+		switch c {
+		case '\n':
+			if m := resize2fsPassRx.FindSubmatch(p.line); m != nil {
+				p.pass, _ = strconv.Atoi(string(m[1]))
+				p.marks = 0
+				p.passStart = p.timeNow()
+			}
+			p.line = p.line[:0]
+		case 'X':
+			if p.pass == 0 || p.marks >= resize2fsBarWidth {
+				p.line = append(p.line, c)
+				continue
+			}
+			p.marks++
+			frac := float64(p.marks) / resize2fsBarWidth
+			elapsed := p.timeNow().Sub(p.passStart)
+			eta := time.Duration(float64(elapsed)/frac) - elapsed
+			if p.report != nil {
+				p.report(p.pass, frac*100, eta.Round(time.Second))
+			}
+		default:
+			p.line = append(p.line, c)
+		}
+	}
+	return len(b), nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResize2fsProgress(t *testing.T) {
+	bar := strings.Repeat("X", resize2fsBarWidth)
+	tests := []struct {
+		name    string
+		out     string
+		reports int           // number of reports
+		pass    int           // of the last report
+		percent float64       // of the last report
+		eta     time.Duration // of the last report
+	}{
+		{
+			name: "offline",
+			out: "resize2fs 1.47.0 (5-Feb-2023)\n" +
+				"Resizing the filesystem on /dev/vdb to 5242880 (4k) blocks.\n" +
+				"Begin pass 1 (max = 32)\n" +
+				"Extending the inode table     " + bar + "\n" +
+				"The filesystem on /dev/vdb is now 5242880 (4k) blocks long.\n",
+			reports: 40, pass: 1, percent: 100, eta: 0,
+		},
+		{
+			name: "partial_later_pass",
+			out: "Begin pass 2 (max = 128)\n" +
+				"Relocating blocks             " + bar + "\n" +
+				"Begin pass 3 (max = 160)\n" +
+				"Scanning inode table          XXXXXXXXXX",
+			reports: 50, pass: 3, percent: 25, eta: 30 * time.Second,
+		},
+		{
+			name: "online",
+			out: "resize2fs 1.47.0 (5-Feb-2023)\n" +
+				"Filesystem at /dev/vdb is mounted on /mnt; on-line resizing required\n" +
+				"old_desc_blocks = 1, new_desc_blocks = 3\n" +
+				"The filesystem on /dev/vdb is now 5242880 (4k) blocks long.\n",
+		},
+		{
+			name:    "overlong_bar",
+			out:     "Begin pass 1 (max = 32)\nExtending the inode table " + bar + "XXX\n",
+			reports: 40, pass: 1, percent: 100, eta: 0,
+		},
+		{
+			name: "marks_before_any_pass",
+			out:  "XXXX\nBegin pass (max = 3)\nXX\n",
+		},
+	}
+	for _, tt := range tests {
+		// Write the output all at once and a byte at a time, as a
+		// pipe may deliver it.
+		for _, chunk := range []int{len(tt.out), 1} {
+			var got []float64
+			var pass int
+			var eta time.Duration
+			var clock time.Time
+			p := &resize2fsProgress{
+				report: func(gotPass int, percent float64, gotETA time.Duration) {
+					got = append(got, percent)
+					pass, eta = gotPass, gotETA
+				},
+				now: func() time.Time {
+					clock = clock.Add(time.Second)
+					return clock
+				},
+			}
+			for s := tt.out; s != ""; {
+				n := min(chunk, len(s))
+				p.Write([]byte(s[:n]))
+				s = s[n:]
+			}
+			if len(got) != tt.reports {
+				t.Errorf("%s, %d-byte writes: %d reports; want %d", tt.name, chunk, len(got), tt.reports)
+				continue
+			}
+			if len(got) == 0 {
+				continue
+			}
+			if last := got[len(got)-1]; pass != tt.pass || last != tt.percent || eta != tt.eta {
+				t.Errorf("%s, %d-byte writes: last report pass %d, %v%%, ETA %v; want pass %d, %v%%, ETA %v", tt.name, chunk, pass, last, eta, tt.pass, tt.percent, tt.eta)
+			}
+			if p.out.String() != tt.out {
+				t.Errorf("%s, %d-byte writes: kept output %q; want %q", tt.name, chunk, p.out.String(), tt.out)
+			}
+		}
+	}
+}
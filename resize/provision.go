@@ -0,0 +1,245 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Provision sets up a brand-new blank disk for use: it gives the
+// disk a GPT holding one Linux data partition that fills it, makes a
+// filesystem on the partition, mounts it, and adds it to FstabPath.
+type Provision struct {
+	Disk       string // the whole disk, like "/dev/sdb"
+	FSType     string // "ext4", "xfs", or "btrfs"
+	Mountpoint string
+	Label      string // the filesystem's label; optional
+	Options    string // its mount options in fstab; "defaults" if empty
+}
+
+// mkfsCommands are the commands making each filesystem type Provision
+// can make, quietly, before the label and device arguments.
+var mkfsCommands = map[string][]string{
+	"ext4":  {"mkfs.ext4", "-q"},
+	"xfs":   {"mkfs.xfs", "-q"},
+	"btrfs": {"mkfs.btrfs", "-q"},
+}
+
+// partition returns the device of p's data partition.
+func (p Provision) partition() string { return partitionDevice(p.Disk, 1) }
+
+// Check returns an error if p can't or mustn't be done: if its disk
+// isn't a whole disk, isn't blank, or is in use, or if something is
+// already mounted at, or in FstabPath for, its mount point. A disk
+// with a partition table, filesystem, or any other signature wipefs
+// knows isn't blank.
+func (p Provision) Check(ctx context.Context) error {
+	if mkfsCommands[p.FSType] == nil {
+		return fmt.Errorf("%w %q; want ext4, xfs, or btrfs", ErrUnsupportedFilesystem, p.FSType)
+	}
+	if !filepath.IsAbs(p.Mountpoint) {
+		return fmt.Errorf("mount point %q isn't an absolute path", p.Mountpoint)
+	}
+	name := filepath.Base(p.Disk)
+	if _, err := os.Stat(sysPath("/sys/block/" + name)); err != nil {
+		return fmt.Errorf("%s %w as a whole disk in /sys/block", p.Disk, ErrDeviceNotFound)
+	}
+	if parts, _ := filepath.Glob(sysPath("/sys/block/" + name + "/" + name + "*/partition")); len(parts) > 0 {
+		return fmt.Errorf("%s has %d partitions; only blank disks are provisioned", p.Disk, len(parts))
+	}
+	if holders, _ := os.ReadDir(sysPath("/sys/block/" + name + "/holders")); len(holders) > 0 {
+		return fmt.Errorf("%s is in use by %s", p.Disk, holders[0].Name())
+	}
+	cmd := Command(ctx, "wipefs", "--no-act", "--noheadings", "--output", "TYPE", p.Disk)
+	out, err := output(cmd)
+	if err != nil {
+		return err
+	}
+	if sigs := strings.Fields(string(out)); len(sigs) > 0 {
+		return fmt.Errorf("%s isn't blank: it has a %s signature; only blank disks are provisioned", p.Disk, strings.Join(sigs, ", "))
+	}
+	if _, err := Stat(p.Mountpoint); err == nil {
+		return fmt.Errorf("something is already mounted at %s", p.Mountpoint)
+	}
+	if e, ok := fstabLookup(FstabPath, p.Mountpoint); ok {
+		return fmt.Errorf("%s already has %s in %s", p.Mountpoint, e.spec, FstabPath)
+	}
+	return nil
+}
+
+// tableCommand returns the command writing p's partition table, and
+// its standard input.
+func (p Provision) tableCommand(ctx context.Context) (*exec.Cmd, []byte) {
+	cmd := Command(context.WithoutCancel(ctx), "sfdisk", "-q", p.Disk)
+	return cmd, []byte("label: gpt\n\ntype=" + linuxGPTTypeID + "\n")
+}
+
+func (p Provision) mkfsCommand(ctx context.Context) *exec.Cmd {
+	args := append([]string(nil), mkfsCommands[p.FSType][1:]...)
+	if p.Label != "" {
+		args = append(args, "-L", p.Label)
+	}
+	return Command(ctx, mkfsCommands[p.FSType][0], append(args, p.partition())...)
+}
+
+func (p Provision) mountCommand(ctx context.Context) *exec.Cmd {
+	return Command(ctx, "mount", "-t", p.FSType, "-o", p.options(), p.partition(), p.Mountpoint)
+}
+
+func (p Provision) options() string {
+	if p.Options == "" {
+		return "defaults"
+	}
+	return p.Options
+}
+
+// fstabLine returns p's fstab entry for the filesystem with UUID
+// uuid. Only ext4 is checked at boot; fsck does nothing for XFS and
+// btrfs.
+func (p Provision) fstabLine(uuid string) string {
+	pass := 0
+	if p.FSType == "ext4" {
+		pass = 2
+	}
+	return fmt.Sprintf("UUID=%s\t%s\t%s\t%s\t0\t%d\n", uuid, escapeMount(p.Mountpoint), p.FSType, p.options(), pass)
+}
+
+// Plan describes what Run would do.
+func (p Provision) Plan(ctx context.Context) (Action, error) {
+	if err := p.Check(ctx); err != nil {
+		return Action{}, err
+	}
+	size, err := blockDevSize(p.Disk)
+	if err != nil {
+		return Action{}, err
+	}
+	table, stdin := p.tableCommand(ctx)
+	steps := []string{cmdLine(table, stdin)}
+	if cmd, ok := udevSettleCommand(ctx); ok {
+		steps = append(steps, cmdLine(cmd, nil))
+	}
+	steps = append(steps,
+		cmdLine(p.mkfsCommand(ctx), nil),
+		"mkdir -p "+p.Mountpoint,
+		cmdLine(p.mountCommand(ctx), nil),
+		fmt.Sprintf("append to %s: %s", FstabPath, strings.TrimSpace(p.fstabLine("<new filesystem's UUID>"))))
+	return Action{Steps: steps, ProposedBytes: size}, nil
+}
+
+// Run provisions p's disk, after checking it with Check.
+func (p Provision) Run(ctx context.Context) error {
+	if err := p.Check(ctx); err != nil {
+		return err
+	}
+	stage := fmt.Sprintf("provisioning %s", p.Disk)
+	run := func(cmd *exec.Cmd) error {
+		if out, err := runCmd(stage, cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+		return nil
+	}
+	table, stdin := p.tableCommand(ctx)
+	table.Stdin = bytes.NewReader(stdin)
+	table.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := run(table); err != nil {
+		return err
+	}
+	if err := p.waitPartition(ctx); err != nil {
+		return err
+	}
+	if err := run(p.mkfsCommand(ctx)); err != nil {
+		return err
+	}
+	out, err := output(Command(ctx, "blkid", "-p", "-o", "value", "-s", "UUID", p.partition()))
+	if err != nil {
+		return err
+	}
+	uuid := strings.TrimSpace(string(out))
+	if uuid == "" {
+		return fmt.Errorf("blkid found no UUID on the new filesystem on %s", p.partition())
+	}
+	if err := os.MkdirAll(p.Mountpoint, 0755); err != nil {
+		return err
+	}
+	if err := run(p.mountCommand(ctx)); err != nil {
+		return err
+	}
+	return appendFstab(FstabPath, p.fstabLine(uuid))
+}
+
+// waitPartition waits until the kernel has p's new partition and udev
+// has made its device node.
+func (p Provision) waitPartition(ctx context.Context) error {
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		_, err := blockDevSize(p.partition())
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("waiting for new partition %s: %v", p.partition(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if cmd, ok := udevSettleCommand(ctx); ok {
+		if out, err := runCmd(fmt.Sprintf("provisioning %s", p.Disk), cmd); err != nil {
+			Logger.Warn("waiting for udev failed", "err", toolError(cmd, out, err))
+		}
+	}
+	return nil
+}
+
+// appendFstab adds line to the end of the fstab file at path,
+// replacing the file atomically, with its mode kept, so a crash never
+// leaves it half written.
+func appendFstab(path, line string) error {
+	if err := checkNotDryRun("appending to " + path); err != nil {
+		return err
+	}
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if len(old) > 0 && !bytes.HasSuffix(old, []byte("\n")) {
+		old = append(old, '\n')
+	}
+	tmp := path + ".embiggen-disk.tmp"
+	if err := os.WriteFile(tmp, append(old, line...), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
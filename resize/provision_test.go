@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionCheck(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	defer func(old string) { FstabPath = old }(FstabPath)
+	Snapshot = t.TempDir()
+	for _, d := range []string{"sys/block/vdb/holders", "sys/block/vdc/vdc1"} {
+		if err := os.MkdirAll(filepath.Join(Snapshot, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(Snapshot, "sys/block/vdc/vdc1/partition"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	FstabPath = filepath.Join(t.TempDir(), "fstab")
+	if err := os.WriteFile(FstabPath, []byte("UUID=1234 /nonexistent/home ext4 defaults 0 2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	p := Provision{Disk: "/dev/vdb", FSType: "ext4", Mountpoint: filepath.Join(t.TempDir(), "data")}
+
+	replayRecordings(t, []Recording{
+		{Args: []string{"wipefs", "--no-act", "--noheadings", "--output", "TYPE", "/dev/vdb"}, Stdout: "gpt\nPMBR\n"},
+		{Args: []string{"wipefs", "--no-act", "--noheadings", "--output", "TYPE", "/dev/vdb"}},
+		{Args: []string{"wipefs", "--no-act", "--noheadings", "--output", "TYPE", "/dev/vdb"}},
+	})
+	if err := p.Check(ctx); err == nil || !strings.Contains(err.Error(), "gpt, PMBR signature") {
+		t.Errorf("Check of disk with a GPT = %v; want not blank", err)
+	}
+	if err := p.Check(ctx); err != nil {
+		t.Errorf("Check of blank disk = %v", err)
+	}
+
+	for _, tt := range []struct {
+		p    Provision
+		want string
+	}{
+		{Provision{Disk: "/dev/vdc", FSType: "ext4", Mountpoint: "/data"}, "has 1 partitions"},
+		{Provision{Disk: "/dev/vdd", FSType: "ext4", Mountpoint: "/data"}, "not found"},
+		{Provision{Disk: "/dev/vdb", FSType: "vfat", Mountpoint: "/data"}, "unsupported filesystem"},
+		{Provision{Disk: "/dev/vdb", FSType: "ext4", Mountpoint: "data"}, "absolute"},
+		{Provision{Disk: "/dev/vdb", FSType: "ext4", Mountpoint: "/nonexistent/home/"}, "already has UUID=1234"},
+	} {
+		if err := tt.p.Check(ctx); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Check(%+v) = %v; want error containing %q", tt.p, err, tt.want)
+		}
+	}
+}
+
+func TestProvisionFstab(t *testing.T) {
+	p := Provision{Disk: "/dev/nvme1n1", FSType: "xfs", Mountpoint: "/srv/my data", Options: "noatime"}
+	if got, want := p.fstabLine("abcd"), "UUID=abcd\t/srv/my\\040data\txfs\tnoatime\t0\t0\n"; got != want {
+		t.Errorf("fstabLine = %q; want %q", got, want)
+	}
+	if got := p.partition(); got != "/dev/nvme1n1p1" {
+		t.Errorf("partition = %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "fstab")
+	if err := os.WriteFile(path, []byte("UUID=1234 / ext4 defaults 0 1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendFstab(path, p.fstabLine("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "UUID=1234 / ext4 defaults 0 1\n" + p.fstabLine("abcd"); string(got) != want {
+		t.Errorf("fstab = %q; want %q", got, want)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("fstab mode changed: %v, %v", fi.Mode(), err)
+	}
+	if e, ok := fstabLookup(path, "/srv/my data"); !ok || e.spec != "UUID=abcd" {
+		t.Errorf("fstabLookup of the new entry = %+v, %v", e, ok)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A growthChecker is a Resizer that can tell cheaply, mostly without
+// running any tools, whether it might have room to grow.
+type growthChecker interface {
+	mayGrow(ctx context.Context) (bool, error)
+}
+
+// MayGrow reports whether Resize might grow e or any layer below it.
+// It's meant to be quick, reading sizes from sysfs and on-disk headers
+// rather than running tools where it can, so runs with nothing to do,
+// as at most boots, cost next to nothing. It errs toward true: a layer
+// it can't check might grow.
+func MayGrow(ctx context.Context, e Resizer) bool {
+	gc, ok := e.(growthChecker)
+	if !ok {
+		return true
+	}
+	if grow, err := gc.mayGrow(ctx); err != nil || grow {
+		if err != nil {
+			vlogf("MayGrow: checking %v: %v", e, err)
+		}
+		return true
+	}
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return true
+	}
+	for _, dep := range deps {
+		if MayGrow(ctx, dep) {
+			return true
+		}
+	}
+	return false
+}
+
+// readAt reads len(buf) bytes at offset off of the file or device at
+// path.
+func readAt(path string, buf []byte, off int64) error {
+	f, err := Privileges.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, off)
+	return err
+}
+
+func (e fsResizer) mayGrow(ctx context.Context) (bool, error) {
+	devBytes, err := blockDevSize(e.fs.Device)
+	if err != nil {
+		return false, err
+	}
+	fsBytes, blockSize, ok, err := superblockSize(e.fs.Device, e.fs.Type)
+	if !ok || err != nil {
+		return true, err
+	}
+	return devBytes-fsBytes >= blockSize, nil
+}
+
+// superblockSize returns the size and block size of the filesystem of
+// type fstype on dev as its superblock records them, or false if it
+// doesn't know where fstype records them.
+func superblockSize(dev, fstype string) (fsBytes, blockSize int64, ok bool, err error) {
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		sb := make([]byte, 1024)
+		if err := readAt(dev, sb, 1024); err != nil {
+			return 0, 0, true, err
+		}
+		logBlockSize := binary.LittleEndian.Uint32(sb[0x18:])
+		if binary.LittleEndian.Uint16(sb[0x38:]) != 0xEF53 || logBlockSize > 6 {
+			return 0, 0, true, fmt.Errorf("no ext2/3/4 superblock on %s", dev)
+		}
+		blocks := int64(binary.LittleEndian.Uint32(sb[0x4:]))
+		const incompat64bit = 0x80
+		if binary.LittleEndian.Uint32(sb[0x60:])&incompat64bit != 0 {
+			blocks |= int64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+		}
+		blockSize = 1024 << logBlockSize
+		return blocks * blockSize, blockSize, true, nil
+	case "xfs":
+		sb := make([]byte, 16)
+		if err := readAt(dev, sb, 0); err != nil {
+			return 0, 0, true, err
+		}
+		blockSize = int64(binary.BigEndian.Uint32(sb[4:]))
+		if string(sb[:4]) != "XFSB" || blockSize < 512 || blockSize > 65536 {
+			return 0, 0, true, fmt.Errorf("no XFS superblock on %s", dev)
+		}
+		return int64(binary.BigEndian.Uint64(sb[8:])) * blockSize, blockSize, true, nil
+	}
+	return 0, 0, false, nil
+}
+
+func (p partitionResizer) mayGrow(ctx context.Context) (bool, error) {
+	partDev := string(p)
+	if d, err := evalSymlinks(partDev); err == nil {
+		partDev = d
+	}
+	name := filepath.Base(partDev)
+	// A partition's sysfs directory is in its disk's.
+	sys, err := evalSymlinks("/sys/class/block/" + name)
+	if err != nil {
+		return false, err
+	}
+	disk := filepath.Base(filepath.Dir(sys))
+	start, err := readInt64File(sysPath("/sys/class/block/" + name + "/start"))
+	if err != nil {
+		return false, err
+	}
+	size, err := readInt64File(sysPath("/sys/class/block/" + name + "/size"))
+	if err != nil {
+		return false, err
+	}
+	diskSize, err := readInt64File(sysPath("/sys/block/" + disk + "/size"))
+	if err != nil {
+		return false, err
+	}
+	end := start + size
+	// Like grownTable, grow up to the next partition, or else to a
+	// 1 MiB boundary near the end of the disk.
+	limit := diskSize / 2048 * 2048
+	sibs, _ := filepath.Glob(sysPath("/sys/block/" + disk + "/" + disk + "*/start"))
+	for _, f := range sibs {
+		if s, err := readInt64File(f); err == nil && s > start && s < limit {
+			limit = s
+		}
+	}
+	return limit > end, nil
+}
+
+func (r pvResizer) mayGrow(ctx context.Context) (bool, error) {
+	dev := string(r)
+	devBytes, err := blockDevSize(dev)
+	if err != nil {
+		return false, err
+	}
+	// The LVM label is in one of the first four sectors, and
+	// records the device size as of pvcreate or the last pvresize.
+	buf := make([]byte, 4*512)
+	if err := readAt(dev, buf, 0); err != nil {
+		return false, err
+	}
+	for s := 0; s < 4; s++ {
+		sec := buf[s*512 : (s+1)*512]
+		if string(sec[:8]) != "LABELONE" || string(sec[24:32]) != "LVM2 001" {
+			continue
+		}
+		off := int(binary.LittleEndian.Uint32(sec[20:]))
+		if off+40 > len(sec) {
+			break
+		}
+		// The PV header: a 32 byte UUID, then the device size.
+		labelSize := int64(binary.LittleEndian.Uint64(sec[off+32:]))
+		return devBytes > labelSize, nil
+	}
+	return false, fmt.Errorf("no LVM2 label on %s", dev)
+}
+
+func (r lvResizer) mayGrow(ctx context.Context) (bool, error) {
+	cmd := Command(ctx, "lvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "vg_free", string(r))
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return false, err
+	}
+	free, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("unexpected lvs output for %s: %q", string(r), out)
+	}
+	return free > 0, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"sync"
+)
+
+// A FilesystemFunc returns the Resizer for the mounted filesystem fs.
+type FilesystemFunc func(ctx context.Context, fs FSStat) (Resizer, error)
+
+// A DeviceFunc returns the Resizer for the block device dev, below a
+// filesystem or LVM PV, or (nil, nil) if it doesn't handle dev.
+type DeviceFunc func(ctx context.Context, dev string) (Resizer, error)
+
+var (
+	regMu    sync.Mutex
+	fsFuncs  = map[string]FilesystemFunc{} // by filesystem type
+	devFuncs []DeviceFunc
+)
+
+// RegisterFilesystem makes FileSystem use fn for filesystems of type
+// fstype, as named in /proc/mounts. It panics if fstype is already
+// registered, including the built-in ext2, ext3, ext4, xfs, btrfs,
+// and ubifs.
+func RegisterFilesystem(fstype string, fn FilesystemFunc) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	if _, dup := fsFuncs[fstype]; dup {
+		panic("resize: RegisterFilesystem called twice for " + fstype)
+	}
+	fsFuncs[fstype] = fn
+}
+
+// RegisterDevice adds fn to the funcs consulted, in the order they
+// were registered, for the layer below a filesystem or LVM PV. They're
+// consulted before the built-in handling of partitions and device
+// mapper devices, so they can claim devices it would get wrong.
+func RegisterDevice(fn DeviceFunc) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	devFuncs = append(devFuncs, fn)
+}
+
+func filesystemFunc(fstype string) FilesystemFunc {
+	regMu.Lock()
+	defer regMu.Unlock()
+	return fsFuncs[fstype]
+}
+
+// deps returns r as a list of dependencies: empty if r is nil.
+func deps(r Resizer) []Resizer {
+	if r == nil {
+		return nil
+	}
+	return []Resizer{r}
+}
+
+// registeredDevice returns the Resizer the first registered DeviceFunc
+// handling dev gives, or (nil, nil) if none does.
+func registeredDevice(ctx context.Context, dev string) (Resizer, error) {
+	regMu.Lock()
+	fns := devFuncs
+	regMu.Unlock()
+	for _, fn := range fns {
+		if r, err := fn(ctx, dev); r != nil || err != nil {
+			return r, err
+		}
+	}
+	return nil, nil
+}
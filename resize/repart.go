@@ -0,0 +1,329 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Repart says how partitions that systemd-repart manages are grown:
+// those matched by a repart.d definition in RepartDirs, or with the
+// GrowFileSystem GPT attribute set. With "honor", the default, they
+// grow no bigger than their definition's SizeMaxBytes, nor, when the
+// free space after them is where repart would create the partitions
+// of other definitions, beyond their share of it by Weight. With
+// "skip", they're left to repart. With "ignore", they're grown like
+// any other partition.
+var Repart = "honor"
+
+// RepartDirs are the systemd-repart definition directories, in order
+// of precedence: a file in one overrides a file of the same name in
+// those after it.
+var RepartDirs = []string{"/etc/repart.d", "/run/repart.d", "/usr/local/lib/repart.d", "/usr/lib/repart.d"}
+
+// gptGrowFileSystemBit is the GPT attribute with which the
+// Discoverable Partitions Specification marks a partition whose
+// filesystem systemd-growfs should grow to fill it.
+const gptGrowFileSystemBit = 59
+
+// repartTypes maps the partition type names systemd-repart accepts
+// for Type= to GPT type GUIDs.
+var repartTypes = map[string]string{
+	"esp":           "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+	"xbootldr":      "BC13C2FF-59E6-4262-A352-B275FD6F7172",
+	"swap":          "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+	"home":          "933AC7E1-2EB4-4F13-B844-0E14E2AEF915",
+	"srv":           "3B8F8425-20E0-4F3B-907F-1A25A76F98E8",
+	"var":           "4D21B016-B534-45C2-A9FB-5C16E091FD2D",
+	"tmp":           "7EC6F557-3BC5-4ACA-B293-16EF5DF639D1",
+	"linux-generic": linuxGPTTypeID,
+	"root-x86-64":   rootx8664GPTTypeID,
+	"root-arm64":    rootArm64GPTTypeID,
+	"root-ppc64-le": rootPPC64LEGPTTypeID,
+	"root-ppc64":    rootPPC64GPTTypeID,
+}
+
+// repartTypeGUID returns the GPT type GUID for the Type= value t.
+func repartTypeGUID(t string) string {
+	if t == "root" {
+		t = map[string]string{
+			"amd64":   "root-x86-64",
+			"arm64":   "root-arm64",
+			"ppc64le": "root-ppc64-le",
+			"ppc64":   "root-ppc64",
+		}[runtime.GOARCH]
+	}
+	if g, ok := repartTypes[t]; ok {
+		return g
+	}
+	return strings.ToUpper(t)
+}
+
+// repartTypeName returns the Type= value for the GPT type GUID g: its
+// name if it has one, else g.
+func repartTypeName(g string) string {
+	for name, guid := range repartTypes {
+		if strings.EqualFold(guid, g) {
+			return name
+		}
+	}
+	return g
+}
+
+// A repartDef is a systemd-repart partition definition, a repart.d
+// file's [Partition] section.
+type repartDef struct {
+	file         string // base name, "50-root.conf"
+	typeGUID     string
+	label        string
+	weight       int64 // 1000 unless set
+	sizeMinBytes int64 // 0 if unset
+	sizeMaxBytes int64 // 0 if unset
+}
+
+// parseRepartDef parses the repart.d file named file, with contents
+// data.
+func parseRepartDef(file string, data []byte) (repartDef, error) {
+	d := repartDef{file: file, weight: 1000}
+	section := ""
+	bs := bufio.NewScanner(bytes.NewReader(data))
+	for bs.Scan() {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || section != "Partition" {
+			continue
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		var err error
+		switch k {
+		case "Type":
+			d.typeGUID = repartTypeGUID(v)
+		case "Label":
+			d.label = v
+		case "Weight":
+			d.weight, err = strconv.ParseInt(v, 10, 64)
+		case "SizeMinBytes":
+			d.sizeMinBytes, err = parseRepartSize(v)
+		case "SizeMaxBytes":
+			d.sizeMaxBytes, err = parseRepartSize(v)
+		}
+		if err != nil {
+			return d, fmt.Errorf("%s: bad %s=%s: %v", file, k, v, err)
+		}
+	}
+	if d.typeGUID == "" {
+		return d, fmt.Errorf("%s: no Type= in [Partition]", file)
+	}
+	return d, bs.Err()
+}
+
+// parseRepartSize parses a size as systemd does, with an optional K,
+// M, G, T, P, or E suffix for powers of 1024.
+func parseRepartSize(s string) (int64, error) {
+	mult := int64(1)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	if i := strings.IndexByte("KMGTPE", strings.ToUpper(s[len(s)-1:])[0]); i >= 0 {
+		mult = 1 << (10 * uint(i+1))
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// readRepartDefs returns the definitions in RepartDirs, within Sysroot
+// if it's set, in the order systemd-repart applies them: by file name.
+func readRepartDefs() ([]repartDef, error) {
+	files := map[string]string{} // base name to path
+	for _, dir := range RepartDirs {
+		matches, _ := filepath.Glob(filepath.Join(SysrootPath(dir), "*.conf"))
+		for _, m := range matches {
+			if _, ok := files[filepath.Base(m)]; !ok {
+				files[filepath.Base(m)] = m
+			}
+		}
+	}
+	var defs []repartDef
+	for base, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		d, err := parseRepartDef(base, data)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].file < defs[j].file })
+	return defs, nil
+}
+
+// matchRepartDefs matches defs to the partitions in pt as
+// systemd-repart does: each definition, in order, to the first
+// partition of its type not yet matched. It returns the definition
+// matched to each partition, by device, and those matching none,
+// which repart would create.
+func matchRepartDefs(pt *partitionTable, defs []repartDef) (matched map[string]repartDef, unmatched []repartDef) {
+	matched = map[string]repartDef{}
+	for _, d := range defs {
+		found := false
+		for _, part := range pt.parts {
+			if _, dup := matched[part.dev]; !dup && strings.EqualFold(part.Type(), d.typeGUID) {
+				matched[part.dev] = d
+				found = true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, d)
+		}
+	}
+	return matched, unmatched
+}
+
+// repartEnd returns the sector before which part, in the GPT pt, may
+// end as Repart has it, given that it could otherwise grow from end to
+// newEnd. atDiskEnd is whether the free space it would grow into is at
+// the end of the disk, where repart creates new partitions.
+func repartEnd(pt *partitionTable, part sfdiskLine, end, newEnd int64, atDiskEnd bool) (int64, error) {
+	if Repart == "ignore" {
+		return newEnd, nil
+	}
+	defs, err := readRepartDefs()
+	if err != nil {
+		return 0, err
+	}
+	matched, unmatched := matchRepartDefs(pt, defs)
+	def, managed := matched[part.dev]
+	attrs, _ := part.gptAttrBits()
+	growFS := attrs&(1<<gptGrowFileSystemBit) != 0
+	if !managed && !growFS {
+		return newEnd, nil
+	}
+	switch Repart {
+	case "skip":
+		Logger.Info("leaving partition managed by systemd-repart to it", "partition", part.dev, "definition", def.file, "growfs", growFS)
+		return end, nil
+	case "honor":
+	default:
+		return 0, fmt.Errorf("unknown repart mode %q; want honor, skip, or ignore", Repart)
+	}
+	if !managed {
+		return newEnd, nil
+	}
+	if def.weight == 0 {
+		return end, nil
+	}
+	limit := newEnd
+	if atDiskEnd && len(unmatched) > 0 {
+		// Repart would create the unmatched partitions in this
+		// space, giving each its minimum size and then sharing
+		// the rest by weight.
+		free := (newEnd - end) * 512
+		weights := def.weight
+		for _, d := range unmatched {
+			free -= d.sizeMinBytes
+			weights += d.weight
+		}
+		share := max(free, 0) / 512 * def.weight / weights
+		limit = min(limit, end+share)
+	}
+	if def.sizeMaxBytes > 0 {
+		limit = min(limit, part.Start()+def.sizeMaxBytes/512)
+	}
+	if limit < newEnd {
+		// Keep the end aligned, as repart would.
+		const align = (1 << 20) / 512
+		limit = max(limit/align*align, end)
+		Logger.Info("limiting partition growth per its systemd-repart definition", "partition", part.dev, "definition", def.file, "end", limit)
+	}
+	return limit, nil
+}
+
+// RepartDropIns returns systemd-repart definitions describing the GPT
+// partition table of the disk holding partDev, keyed by file name, for
+// a repart.d directory. The definitions pin each partition at its size
+// but partDev, which may grow to fill the disk, and whose filesystem
+// systemd-growfs grows with it, so repart at boot does what
+// embiggen-disk would.
+func RepartDropIns(ctx context.Context, partDev string) (map[string]string, error) {
+	diskDev, err := DiskOf(ctx, partDev)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return nil, err
+	}
+	if pt.Meta("label") != "gpt" {
+		return nil, fmt.Errorf("%s has no GPT; systemd-repart only manages GPT disks", diskDev)
+	}
+	if _, ok := pt.partition(partDev); !ok {
+		return nil, fmt.Errorf("partition %s %w in partition table of %s", partDev, ErrDeviceNotFound, diskDev)
+	}
+	files := map[string]string{}
+	for _, part := range pt.parts {
+		if part.Size() == 0 {
+			continue
+		}
+		typ := repartTypeName(part.Type())
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s, from the partition table of %s.\n", part.dev, diskDev)
+		fmt.Fprintf(&b, "[Partition]\nType=%s\n", typ)
+		if name := part.Attr("name"); name != "" {
+			if u, err := strconv.Unquote(name); err == nil {
+				name = u
+			}
+			fmt.Fprintf(&b, "Label=%s\n", name)
+		}
+		if uuid := part.Attr("uuid"); uuid != "" {
+			fmt.Fprintf(&b, "UUID=%s\n", uuid)
+		}
+		size := part.Size() * 512
+		if part.dev == partDev {
+			fmt.Fprintf(&b, "SizeMinBytes=%d\nGrowFileSystem=yes\n", size)
+		} else {
+			fmt.Fprintf(&b, "SizeMinBytes=%d\nSizeMaxBytes=%d\n", size, size)
+		}
+		if len(typ) == 36 {
+			typ = "part"
+		}
+		files[fmt.Sprintf("%02d-%s.conf", part.pno*10, typ)] = b.String()
+	}
+	return files, nil
+}
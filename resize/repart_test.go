@@ -0,0 +1,137 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// repartDump is sfdisk -d output for a 20 GiB GPT disk with an ESP, a
+// 4 GiB root partition marked GrowFileSystem, and free space after it.
+const repartDump = `label: gpt
+label-id: 841DBE6B-6A8D-43E1-93E1-D765373DDE3B
+device: /dev/vda
+unit: sectors
+first-lba: 2048
+last-lba: 41943006
+sector-size: 512
+
+/dev/vda1 : start=        2048, size=     1048576, type=C12A7328-F81F-11D2-BA4B-00A0C93EC93B, uuid=D7F261B7-9D9A-4864-AB85-A68ED9CD7CF0, name="esp"
+/dev/vda2 : start=     1050624, size=     8388608, type=4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709, uuid=B3EB025F-F682-4FE4-8F97-96974ADFD3BF, name="root-x86-64", attrs="GUID:59"
+`
+
+func writeRepartDefs(t *testing.T, defs map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, conf := range defs {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := RepartDirs
+	RepartDirs = []string{dir}
+	t.Cleanup(func() { RepartDirs = old })
+}
+
+func TestParseRepartDef(t *testing.T) {
+	d, err := parseRepartDef("50-root.conf", []byte("# root\n[Partition]\nType=root-x86-64\nLabel=root\nWeight=2000\nSizeMaxBytes=30G\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := repartDef{file: "50-root.conf", typeGUID: rootx8664GPTTypeID, label: "root", weight: 2000, sizeMaxBytes: 30 << 30}
+	if d != want {
+		t.Errorf("got %+v; want %+v", d, want)
+	}
+	if _, err := parseRepartDef("x.conf", []byte("[Partition]\nLabel=x\n")); err == nil {
+		t.Error("definition without Type= parsed")
+	}
+	if _, err := parseRepartDef("x.conf", []byte("[Partition]\nType=home\nSizeMinBytes=\n")); err == nil {
+		t.Error("empty SizeMinBytes= parsed")
+	}
+}
+
+func TestRepartEnd(t *testing.T) {
+	pt, err := parsePartitionTable([]byte(repartDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := pt.partition("/dev/vda2")
+	end := root.Start() + root.Size() // 9439232
+	const newEnd = 41940992
+	defer func(old string) { Repart = old }(Repart)
+
+	for _, tt := range []struct {
+		name string
+		mode string
+		defs map[string]string
+		want int64
+	}{
+		{"no definitions, GrowFileSystem honored", "honor", nil, newEnd},
+		{"no definitions, GrowFileSystem skipped", "skip", nil, end},
+		{"SizeMaxBytes", "honor", map[string]string{
+			"10-esp.conf":  "[Partition]\nType=esp\n",
+			"50-root.conf": "[Partition]\nType=root-x86-64\nSizeMaxBytes=8G\n",
+		}, root.Start() + 8<<30/512},
+		{"shared with a new partition by weight", "honor", map[string]string{
+			"50-root.conf": "[Partition]\nType=root-x86-64\n",
+			"60-home.conf": "[Partition]\nType=home\nWeight=3000\n",
+		}, end + (newEnd-end)/4/2048*2048},
+		{"Weight=0", "honor", map[string]string{
+			"50-root.conf": "[Partition]\nType=root-x86-64\nWeight=0\n",
+		}, end},
+		{"ignored", "ignore", map[string]string{
+			"50-root.conf": "[Partition]\nType=root-x86-64\nSizeMaxBytes=8G\n",
+		}, newEnd},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			writeRepartDefs(t, tt.defs)
+			Repart = tt.mode
+			got, err := repartEnd(pt, root, end, newEnd, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("repartEnd = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepartDropIns(t *testing.T) {
+	replayRecordings(t, []Recording{
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Err: "exit status 1"},
+		{Args: []string{"sfdisk", "-d", "/dev/vda"}, Stdout: repartDump},
+	})
+	files, err := RepartDropIns(context.Background(), "/dev/vda2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	esp, root := files["10-esp.conf"], files["20-root-x86-64.conf"]
+	if len(files) != 2 || esp == "" || root == "" {
+		t.Fatalf("got files %v; want 10-esp.conf and 20-root-x86-64.conf", files)
+	}
+	if !strings.Contains(esp, "Type=esp\n") || !strings.Contains(esp, "SizeMaxBytes=536870912\n") {
+		t.Errorf("10-esp.conf doesn't pin the ESP's size:\n%s", esp)
+	}
+	if strings.Contains(root, "SizeMaxBytes") || !strings.Contains(root, "GrowFileSystem=yes\n") || !strings.Contains(root, "Label=root-x86-64\n") {
+		t.Errorf("20-root-x86-64.conf doesn't let root grow:\n%s", root)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// A Recording is a command a RecordRunner ran and what it did, for a
+// ReplayRunner to play back.
+type Recording struct {
+	// Args is the command line, starting with the tool's name rather
+	// than its path, and without the "lvm" of LVM subcommands run
+	// through the lvm binary, so recordings replay on other systems.
+	Args   []string `json:"args"`
+	Stdin  string   `json:"stdin,omitempty"`
+	Stdout string   `json:"stdout,omitempty"`
+	Stderr string   `json:"stderr,omitempty"`
+	Err    string   `json:"err,omitempty"` // the error running it returned, if any
+}
+
+// toolArgs returns args with the tool's name in place of its path, as
+// in a Recording.
+func toolArgs(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	name := filepath.Base(args[0])
+	if name == "lvm" && len(args) > 1 && lvmCommands[args[1]] {
+		return slices.Clone(args[1:])
+	}
+	return append([]string{name}, args[1:]...)
+}
+
+// A RecordRunner runs commands with another Runner and records each,
+// with its input, output, and error, as a Recording. Run embiggen-disk
+// with --record-commands to make recordings of real systems for
+// tests to replay.
+type RecordRunner struct {
+	Runner Runner // runs the commands; ExecRunner if nil
+
+	// Out, if non-nil, is written each Recording as it's made, as a
+	// line of JSON, the format ReadRecordings reads.
+	Out io.Writer
+
+	mu   sync.Mutex
+	recs []Recording
+}
+
+func (r *RecordRunner) Run(cmd *exec.Cmd) error {
+	rec := Recording{Args: toolArgs(cmd.Args)}
+	if cmd.Stdin != nil {
+		stdin, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		rec.Stdin = string(stdin)
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = teeWriter(cmd.Stdout, &stdout)
+	cmd.Stderr = teeWriter(cmd.Stderr, &stderr)
+	runner := r.Runner
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	err := runner.Run(cmd)
+	rec.Stdout, rec.Stderr = stdout.String(), stderr.String()
+	if err != nil {
+		rec.Err = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recs = append(r.recs, rec)
+	if r.Out != nil {
+		line, jerr := json.Marshal(rec)
+		if jerr == nil {
+			_, jerr = r.Out.Write(append(line, '\n'))
+		}
+		if jerr != nil {
+			Logger.Warn("writing command recording", "err", jerr)
+		}
+	}
+	return err
+}
+
+func teeWriter(w io.Writer, buf *bytes.Buffer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(w, buf)
+}
+
+// Recordings returns the commands recorded so far, in order.
+func (r *RecordRunner) Recordings() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.recs)
+}
+
+// ReadRecordings reads the lines of JSON a RecordRunner writes to its
+// Out.
+func ReadRecordings(rd io.Reader) ([]Recording, error) {
+	var recs []Recording
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(nil, 16<<20)
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("bad recording %q: %v", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// A ReplayRunner plays back Recordings instead of running commands,
+// for testing resizers without root or real disks. Each command gets
+// the first recording not yet played with the same Args and Stdin, so
+// a command run repeatedly, such as to read a size before and after
+// resizing, gets each of its recordings in turn.
+type ReplayRunner struct {
+	mu     sync.Mutex
+	recs   []Recording
+	played []bool
+}
+
+// NewReplayRunner returns a ReplayRunner playing back recs.
+func NewReplayRunner(recs []Recording) *ReplayRunner {
+	return &ReplayRunner{recs: recs, played: make([]bool, len(recs))}
+}
+
+// ErrNotRecorded is returned by a ReplayRunner for a command it has no
+// recording left for.
+var ErrNotRecorded = errors.New("command not recorded")
+
+func (r *ReplayRunner) Run(cmd *exec.Cmd) error {
+	args := toolArgs(cmd.Args)
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		if stdin, err = io.ReadAll(cmd.Stdin); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, rec := range r.recs {
+		if r.played[i] || !slices.Equal(rec.Args, args) || rec.Stdin != string(stdin) {
+			continue
+		}
+		r.played[i] = true
+		if cmd.Stdout != nil {
+			io.WriteString(cmd.Stdout, rec.Stdout)
+		}
+		if cmd.Stderr != nil {
+			io.WriteString(cmd.Stderr, rec.Stderr)
+		}
+		if rec.Err != "" {
+			return errors.New(rec.Err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrNotRecorded, shellQuote(args))
+}
+
+// Unplayed returns the recordings not played back yet.
+func (r *ReplayRunner) Unplayed() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var recs []Recording
+	for i, rec := range r.recs {
+		if !r.played[i] {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
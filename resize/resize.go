@@ -0,0 +1,368 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package resize live resizes a filesystem and the LVM objects and
+// partition tables below it, as the embiggen-disk command does.
+//
+// FileSystem returns the Resizer for a mount point, which depends on
+// the Resizers for the layers below it. Resize then grows each layer,
+// lowest first:
+//
+//	r, err := resize.FileSystem(ctx, "/")
+//	if err != nil {
+//		return err
+//	}
+//	changes, err := resize.Resize(ctx, r, nil)
+//
+// The package-level variables configure how resizers run. Set them
+// before building or running any.
+package resize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+var (
+	// DryRun makes Resize and Shrink describe what they'd do, through
+	// DryRunf and ProposeSize, instead of doing it. Resize gets the
+	// description from each Resizer's Plan method.
+	DryRun bool
+
+	// Verbose makes resizers print the partition tables they read and
+	// write to stdout and stream the output of the commands they run
+	// to stderr.
+	Verbose bool
+
+	// Offline makes FileSystem resize the (ext2/3/4) filesystem of a
+	// target that isn't mounted but is in FstabPath, rather than only
+	// the layers below it.
+	Offline bool
+
+	// CommandRunner runs every external command resizers use.
+	CommandRunner Runner = ExecRunner{}
+
+	// RemountRW makes resizing a filesystem mounted read-only remount
+	// it read-write for the resize and then restore its mount
+	// options. Without it, Resize refuses read-only filesystems
+	// before resizing anything.
+	RemountRW bool
+
+	// Force makes Resize go ahead with a filesystem its checks say is
+	// unsafe to grow, such as one with errors recorded in its
+	// superblock, and grow partitions marked read-only in their GPT
+	// entries.
+	Force bool
+
+	// Logger receives diagnostic logging.
+	Logger = slog.Default()
+
+	// DryRunf is called in dry-run mode to describe each thing a
+	// resizer skipped. Commands are described as "would've run: "
+	// followed by the shell-quoted command line.
+	DryRunf = func(format string, args ...interface{}) {}
+
+	// ProposeSize, if non-nil, is called in dry-run mode for each
+	// resizer that knows the size in bytes it'd grow or shrink to.
+	ProposeSize func(n int64)
+
+	// Progress, if non-nil, is called as a long-running resize makes
+	// progress. Only resize2fs reports progress, and only when it
+	// resizes offline; it prints nothing while growing a mounted
+	// filesystem.
+	Progress func(r Resizer, pass int, percent float64, eta time.Duration)
+)
+
+// A Resizer is anything that can enlarge something and describe its state.
+// A Resizer can depend on other Resizers, such as each PV of an LV's
+// volume group, to run first.
+//
+// The context bounds the external commands a Resizer runs, except
+// those that are unsafe to interrupt, such as writing a partition
+// table.
+type Resizer interface {
+	String() string                                              // "ext4 filesystem at /", "LVM PV foo"
+	State(ctx context.Context) (string, error)                   // "20.0 GiB (21474836480 bytes)"
+	Size(ctx context.Context) (int64, error)                     // current size in bytes
+	Plan(ctx context.Context) (Action, error)                    // what Resize would do; no side effects
+	Resize(ctx context.Context) error                            // both may be non-zero
+	DepResizers(ctx context.Context) (deps []Resizer, err error) // can return (nil, nil) for none
+}
+
+// A checker is a Resizer that can tell, before anything is resized,
+// that it can't or shouldn't be resized.
+type checker interface {
+	check(ctx context.Context) error
+}
+
+// An undoer is a Resizer that can undo its last Resize, as long as
+// nothing above it has grown into the space it gained.
+type undoer interface {
+	undo(ctx context.Context) error
+}
+
+// Hooks are called by Resize and Shrink as they work through a chain
+// of Resizers. Any may be nil.
+type Hooks struct {
+	// Enter is called when work on r starts, before its size and
+	// dependency are looked up.
+	Enter func(r Resizer)
+
+	// Before is called just before r is resized, with its current
+	// size. If it returns an error, the run stops with that error
+	// and nothing is undone.
+	Before func(r Resizer, size int64) error
+
+	// After is called once r is resized, with its size before and
+	// after, how long resizing took, and any error, in which case
+	// after is zero. If it returns an error, the run stops with that
+	// error and nothing is undone, r's change included.
+	After func(r Resizer, before, after int64, d time.Duration, err error) error
+}
+
+func (h *Hooks) enter(r Resizer) {
+	if h != nil && h.Enter != nil {
+		h.Enter(r)
+	}
+}
+
+func (h *Hooks) before(r Resizer, size int64) error {
+	if h != nil && h.Before != nil {
+		return h.Before(r, size)
+	}
+	return nil
+}
+
+func (h *Hooks) after(r Resizer, before, after int64, d time.Duration, err error) error {
+	if h != nil && h.After != nil {
+		return h.After(r, before, after, d, err)
+	}
+	return nil
+}
+
+// Resize resizes each of e's dependencies, in order, and then resizes
+// e, calling h's hooks along the way. It returns each change made.
+//
+// If a layer fails after the layers below it have grown, those that
+// can be, such as partitions, are put back as they were, as long as
+// the layer above each is still the size it was before the run. The
+// changes returned don't include them. Nothing is undone when a hook
+// stops the run.
+func Resize(ctx context.Context, e Resizer, h *Hooks) (changes []Change, err error) {
+	ctx = withQueryCache(ctx)
+	changes, err = resize(ctx, e, h)
+	var herr hookError
+	if err == nil || DryRun || errors.As(err, &herr) {
+		return changes, err
+	}
+	// Undo the trailing changes nothing has grown into, newest
+	// first, even if ctx is what failed.
+	ctx = context.WithoutCancel(ctx)
+	for len(changes) > 0 {
+		c := changes[len(changes)-1]
+		if _, ok := c.r.(undoer); !ok {
+			break
+		}
+		if c.above != nil {
+			// The failed layer may have changed its device, as a
+			// resize2fs killed partway through does, so don't
+			// trust what was read before.
+			deviceChanges.Add(1)
+			if n, serr := c.above.Size(ctx); serr != nil || n != c.aboveSize {
+				Logger.Warn("not undoing growth; the layer above may have grown into it", "resizer", c.Resizer, "above", c.above.String(), "err", serr)
+				break
+			}
+		}
+		if uerr := undoLayer(ctx, c.r); uerr != nil {
+			return changes, fmt.Errorf("%w; undoing the growth of %v also failed: %v", err, c.r, uerr)
+		}
+		Logger.Warn("undid growth after a later failure", "resizer", c.Resizer, "bytes", c.BeforeBytes)
+		changes = changes[:len(changes)-1]
+	}
+	return changes, err
+}
+
+// A hookError is an error returned by one of the Hooks. It stops a
+// run, but as no layer failed, Resize undoes nothing for it.
+type hookError struct{ error }
+
+func (e hookError) Unwrap() error { return e.error }
+
+// resize is Resize, without undoing anything on failure.
+func resize(ctx context.Context, e Resizer, h *Hooks) (changes []Change, err error) {
+	defer func() { setStage(err, e) }()
+	h.enter(e)
+	if c, ok := e.(checker); ok {
+		if err = c.check(ctx); err != nil {
+			return
+		}
+	}
+	n0, err := e.Size(ctx)
+	if err != nil {
+		return
+	}
+	deps, err := e.DepResizers(ctx)
+	if err != nil {
+		return
+	}
+	for _, dep := range deps {
+		depChanges, err := resize(ctx, dep, h)
+		// Only dep's own change doesn't yet know the layer above it.
+		for i := range depChanges {
+			if depChanges[i].above == nil {
+				depChanges[i].above, depChanges[i].aboveSize = e, n0
+			}
+		}
+		changes = append(changes, depChanges...)
+		if err != nil {
+			return changes, err
+		}
+	}
+	c, err := resizeOne(ctx, e, h, n0)
+	return append(changes, c...), err
+}
+
+// resizeOne resizes e, now n0 bytes, but not its dependencies, calling
+// h's Before and After hooks. It returns the change made, if any, even
+// if the After hook fails.
+func resizeOne(ctx context.Context, e Resizer, h *Hooks, n0 int64) (changes []Change, err error) {
+	defer func() { setStage(err, e) }()
+	if err = h.before(e, n0); err != nil {
+		err = hookError{err}
+		return
+	}
+	t0 := time.Now()
+	if DryRun {
+		var a Action
+		if a, err = e.Plan(ctx); err == nil {
+			reportAction(a)
+		}
+	} else {
+		err = resizeLayer(ctx, e)
+	}
+	d := time.Since(t0)
+	var n1 int64
+	if err == nil {
+		if n1, err = e.Size(ctx); err != nil {
+			err = fmt.Errorf("error after successful resize of %v: %w", e, err)
+		}
+	}
+	if err == nil && n1 < n0 && !DryRun {
+		// Should never happen; the layers above no longer fit.
+		err = fmt.Errorf("%v shrank from %d to %d bytes while growing: %w", e, n0, n1, ErrWouldShrink)
+	}
+	if err == nil && n0 != n1 {
+		changes = append(changes, newChange(ActionGrow, e, n0, n1, d))
+	}
+	if herr := h.after(e, n0, n1, d, err); err == nil && herr != nil {
+		err = hookError{herr}
+	}
+	return
+}
+
+// resizeLayer resizes e, in this process or by way of Privileges.
+func resizeLayer(ctx context.Context, e Resizer) error {
+	if lr, ok := Privileges.(LayerResizer); ok {
+		return lr.ResizeLayer(ctx, e)
+	}
+	return e.Resize(ctx)
+}
+
+// undoLayer undoes the last resize of e, an undoer, in this process
+// or by way of Privileges.
+func undoLayer(ctx context.Context, e Resizer) error {
+	if lr, ok := Privileges.(LayerResizer); ok {
+		return lr.UndoLayer(ctx, e)
+	}
+	return e.(undoer).undo(ctx)
+}
+
+// checkGrowth returns an error wrapping ErrWouldShrink if growing r,
+// now cur bytes, to next bytes would in fact shrink it, as a parser
+// bug or unit mismatch could make happen. Resizers call it before
+// changing anything.
+func checkGrowth(r Resizer, cur, next int64) error {
+	if next < cur {
+		return fmt.Errorf("%v: %w (%d bytes now, %d computed); refusing to resize", r, ErrWouldShrink, cur, next)
+	}
+	return nil
+}
+
+// Kind is the kind of layer a Resizer resizes.
+type Kind string
+
+const (
+	KindFilesystem Kind = "filesystem"
+	KindLV         Kind = "lv"
+	KindPV         Kind = "pv"
+	KindPartition  Kind = "partition"
+	KindDMLinear   Kind = "dm-linear"
+	KindDisk       Kind = "disk" // a disk rescanned to see its new size
+	KindUBI        Kind = "ubi"  // a UBI volume
+)
+
+// KindOf returns the kind of layer r resizes, or the empty string if
+// r isn't from this package.
+func KindOf(r Resizer) Kind {
+	switch r.(type) {
+	case fsResizer, btrfsAddResizer, ubifsResizer:
+		return KindFilesystem
+	case lvResizer, lvShareResizer:
+		return KindLV
+	case pvResizer:
+		return KindPV
+	case partitionResizer:
+		return KindPartition
+	case dmLinearResizer:
+		return KindDMLinear
+	case hypervDiskResizer:
+		return KindDisk
+	case ubiResizer:
+		return KindUBI
+	}
+	return ""
+}
+
+// Device returns the block device r operates on, or the empty string
+// if r isn't from this package.
+func Device(r Resizer) string {
+	switch r := r.(type) {
+	case fsResizer:
+		return r.fs.Device
+	case btrfsAddResizer:
+		return r.fs.Device
+	case lvResizer:
+		return string(r)
+	case lvShareResizer:
+		return string(r.lv)
+	case pvResizer:
+		return string(r)
+	case partitionResizer:
+		return string(r)
+	case dmLinearResizer:
+		return string(r)
+	case hypervDiskResizer:
+		return string(r)
+	case ubiResizer:
+		return "/dev/" + string(r)
+	case ubifsResizer:
+		return r.fs.Device
+	}
+	return ""
+}
@@ -0,0 +1,243 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestDryRunChangesNothing runs a chain under DryRun with a Runner
+// that has recordings of only the read-only commands, so any command
+// that could change something fails the test.
+func TestDryRunChangesNothing(t *testing.T) {
+	DryRun = true
+	defer func() { DryRun = false }()
+	var planned []string
+	DryRunf = func(format string, args ...interface{}) { planned = append(planned, format) }
+	defer func() { DryRunf = func(format string, args ...interface{}) {} }()
+
+	recs := []Recording{
+		{Args: []string{"lvdisplay", "-c", "/dev/mapper/datavg-data"}, Stdout: "  /dev/datavg/data:datavg:3:1:-1:1:41926656:5118:-1:0:-1:254:0\n"},
+		{Args: []string{"pvdisplay", "-c"}, Stdout: "  /dev/vdb:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:x\n  /dev/vdc:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:y\n"},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdb"}, Stdout: "  /dev/vdb:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:x\n"},
+		{Args: []string{"pvdisplay", "-c", "/dev/vdc"}, Stdout: "  /dev/vdc:datavg:20971520:-1:8:8:-1:4096:2559:0:2559:y\n"},
+	}
+	replayRecordings(t, recs)
+	changes, err := Resize(context.Background(), NewLVResizer("/dev/mapper/datavg-data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("dry run made changes: %v", changes)
+	}
+	if len(planned) != 3 {
+		t.Errorf("dry run described %d steps; want 3 (pvresize twice, lvextend)", len(planned))
+	}
+}
+
+func TestDryRunRefusesChanges(t *testing.T) {
+	DryRun = true
+	defer func() { DryRun = false }()
+	rr := new(RecordingRunner)
+	old := CommandRunner
+	CommandRunner = rr
+	defer func() { CommandRunner = old }()
+
+	if _, err := runCmd("test", exec.Command("pvresize", "/dev/vdb")); !errors.Is(err, errDryRunChange) {
+		t.Errorf("runCmd error = %v; want errDryRunChange", err)
+	}
+	if err := updateKernelPartition("/dev/vdb", sfdiskLine{dev: "/dev/vdb1", pno: 1}); !errors.Is(err, errDryRunChange) {
+		t.Errorf("updateKernelPartition error = %v; want errDryRunChange", err)
+	}
+	if cmds := rr.Commands(); len(cmds) > 0 {
+		t.Errorf("ran %q in dry-run mode", cmds)
+	}
+}
+
+func TestNewUnmountedResizerExt4(t *testing.T) {
+	replayRecordings(t, []Recording{
+		{Args: []string{"blkid", "-o", "value", "-s", "TYPE", "/dev/vda2"}, Stdout: "ext4\n"},
+	})
+	r, err := NewUnmountedResizer(context.Background(), "/dev/vda2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.String(), "unmounted ext4 filesystem on /dev/vda2"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+}
+
+// fakeLayer is a Resizer of a given size that grows to grow, or
+// fails with err after growing to partial, if non-zero.
+type fakeLayer struct {
+	name          string
+	size          *int64
+	grow, partial int64
+	err           error
+	dep           Resizer
+	undone        *bool
+}
+
+func (f fakeLayer) String() string                            { return f.name }
+func (f fakeLayer) State(ctx context.Context) (string, error) { return "", nil }
+func (f fakeLayer) Size(ctx context.Context) (int64, error)   { return *f.size, nil }
+func (f fakeLayer) Plan(ctx context.Context) (Action, error)  { return Action{}, nil }
+func (f fakeLayer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	if f.dep == nil {
+		return nil, nil
+	}
+	return []Resizer{f.dep}, nil
+}
+
+func (f fakeLayer) Resize(ctx context.Context) error {
+	if f.err != nil {
+		if f.partial != 0 {
+			*f.size = f.partial
+		}
+		return f.err
+	}
+	*f.size = f.grow
+	return nil
+}
+
+// fakeUndoLayer is a fakeLayer that can undo its growth, like a
+// partition.
+type fakeUndoLayer struct{ fakeLayer }
+
+func (f fakeUndoLayer) undo(ctx context.Context) error {
+	*f.undone = true
+	return nil
+}
+
+func TestResizeUndo(t *testing.T) {
+	errFS := errors.New("resize2fs failed")
+	errHook := errors.New("post hook failed")
+	errStop := errors.New("interrupted")
+	tests := []struct {
+		name        string
+		fsPartial   int64 // what a failing filesystem grows to first
+		fsErr       error
+		hookErr     error // from the filesystem's After hook
+		stopErr     error // from its Before hook, as on SIGINT
+		wantUndone  bool
+		wantChanges int
+	}{
+		{name: "layer above failed", fsErr: errFS, wantUndone: true, wantChanges: 0},
+		{name: "layer above grew partway", fsErr: errFS, fsPartial: 150, wantUndone: false, wantChanges: 1},
+		{name: "hook failed", hookErr: errHook, wantUndone: false, wantChanges: 2},
+		{name: "stopped", stopErr: errStop, wantUndone: false, wantChanges: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partSize, fsSize := int64(100), int64(100)
+			var undone bool
+			part := fakeUndoLayer{fakeLayer{name: "partition", size: &partSize, grow: 200, undone: &undone}}
+			fs := fakeLayer{name: "filesystem", size: &fsSize, grow: 200, partial: tt.fsPartial, err: tt.fsErr, dep: part}
+			h := &Hooks{Before: func(r Resizer, size int64) error {
+				if r.String() == "filesystem" {
+					return tt.stopErr
+				}
+				return nil
+			}, After: func(r Resizer, before, after int64, d time.Duration, err error) error {
+				if r.String() == "filesystem" {
+					return tt.hookErr
+				}
+				return nil
+			}}
+			changes, err := Resize(context.Background(), fs, h)
+			want := tt.fsErr
+			if want == nil {
+				want = tt.hookErr
+			}
+			if want == nil {
+				want = tt.stopErr
+			}
+			if !errors.Is(err, want) {
+				t.Errorf("error = %v; want %v", err, want)
+			}
+			if undone != tt.wantUndone {
+				t.Errorf("undone = %v; want %v", undone, tt.wantUndone)
+			}
+			if len(changes) != tt.wantChanges {
+				t.Errorf("changes = %v; want %d", changes, tt.wantChanges)
+			}
+		})
+	}
+}
+
+// TestKindOfEveryResizer checks that KindOf knows every Resizer in the
+// package, as the --privsep helper only resizes the layers it can name
+// by kind and device. It looks for the types with a Resize method in
+// the package's Linux source, where --privsep runs.
+func TestKindOfEveryResizer(t *testing.T) {
+	resizers := []Resizer{
+		fsResizer{},
+		btrfsAddResizer{},
+		ubifsResizer{},
+		lvResizer(""),
+		lvShareResizer{},
+		pvResizer(""),
+		partitionResizer(""),
+		dmLinearResizer(""),
+		hypervDiskResizer(""),
+		ubiResizer(""),
+	}
+	known := map[string]bool{}
+	for _, r := range resizers {
+		name := reflect.TypeOf(r).Name()
+		known[name] = true
+		if KindOf(r) == "" {
+			t.Errorf("KindOf(%s) is empty", name)
+		}
+	}
+
+	bctx := build.Default
+	bctx.GOOS = "linux"
+	pkg, err := bctx.ImportDir(".", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range f.Decls {
+			fn, ok := d.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || fn.Name.Name != "Resize" {
+				continue
+			}
+			typ := fn.Recv.List[0].Type
+			if star, ok := typ.(*ast.StarExpr); ok {
+				typ = star.X
+			}
+			if id, ok := typ.(*ast.Ident); ok && !known[id.Name] {
+				t.Errorf("%s: %s has a Resize method but isn't in this test's list", fset.Position(fn.Pos()), id.Name)
+			}
+		}
+	}
+}
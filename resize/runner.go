@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A Runner runs the external commands resizers use, as built by
+// Command. Run runs cmd to completion like (*exec.Cmd).Run, reading
+// cmd.Stdin and writing to cmd.Stdout and cmd.Stderr. A Runner may
+// run the command elsewhere, such as over SSH or in another namespace.
+type Runner interface {
+	Run(cmd *exec.Cmd) error
+}
+
+// ExecRunner is the Runner that runs commands on this machine.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(cmd *exec.Cmd) error { return cmd.Run() }
+
+// A RecordingRunner records the commands it's given instead of running
+// them, for testing resizers without root.
+type RecordingRunner struct {
+	// Reply, if non-nil, returns the output of the command with
+	// arguments args, given stdin, and its error. Otherwise commands
+	// succeed with no output.
+	Reply func(args []string, stdin []byte) (out []byte, err error)
+
+	mu   sync.Mutex
+	cmds [][]string
+}
+
+func (r *RecordingRunner) Run(cmd *exec.Cmd) error {
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		if stdin, err = io.ReadAll(cmd.Stdin); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.cmds = append(r.cmds, cmd.Args)
+	r.mu.Unlock()
+	if r.Reply == nil {
+		return nil
+	}
+	out, err := r.Reply(cmd.Args, stdin)
+	if cmd.Stdout != nil {
+		cmd.Stdout.Write(out)
+	}
+	return err
+}
+
+// Commands returns the arguments of each command run so far, in order.
+// The first is the path of the tool, as found by ToolPath.
+func (r *RecordingRunner) Commands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.cmds...)
+}
+
+// output runs cmd with CommandRunner and returns its standard output.
+// If it fails, the error is a *ToolError with its standard error.
+func output(cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := CommandRunner.Run(cmd); err != nil {
+		return nil, toolError(cmd, stderr.Bytes(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// deviceChanges counts the commands and ioctls that may have changed
+// a device, so cached queries from before them aren't used.
+var deviceChanges atomic.Uint64
+
+// A queryCache holds the output of the read-only commands run during
+// one Resize, Shrink, or Plan, such as partition table dumps and LVM
+// reports, so they aren't run again.
+type queryCache struct {
+	mu  sync.Mutex
+	gen uint64            // deviceChanges when m was filled
+	m   map[string][]byte // by command line
+}
+
+type queryCacheKey struct{}
+
+// withQueryCache returns ctx with a query cache for a run, unless it
+// already has one.
+func withQueryCache(ctx context.Context) context.Context {
+	if ctx.Value(queryCacheKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryCacheKey{}, new(queryCache))
+}
+
+// query is output for commands that only read, such as sfdisk -d.
+// Within a run, it returns the output of the same command run before
+// unless a device may have changed since.
+func query(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	c, _ := ctx.Value(queryCacheKey{}).(*queryCache)
+	if c == nil {
+		return output(cmd)
+	}
+	key := strings.Join(cmd.Args, "\x00")
+	c.mu.Lock()
+	if gen := deviceChanges.Load(); c.gen != gen {
+		c.gen, c.m = gen, nil
+	}
+	if out, ok := c.m[key]; ok {
+		c.mu.Unlock()
+		return out, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	out, err := output(cmd)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen == gen && deviceChanges.Load() == gen {
+		if c.m == nil {
+			c.m = make(map[string][]byte)
+		}
+		c.m[key] = out
+	}
+	return out, nil
+}
+
+// combinedOutput runs cmd with CommandRunner and returns its standard
+// output and standard error. If it fails, the error is a *ToolError.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	if err := CommandRunner.Run(cmd); err != nil {
+		return buf.Bytes(), toolError(cmd, buf.Bytes(), err)
+	}
+	return buf.Bytes(), nil
+}
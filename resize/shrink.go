@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Shrinker is a Resizer that can also be made smaller.
+//
+// Shrinking runs in the opposite order to growing: the filesystem
+// first, then each layer below it, each shrinking to just hold the
+// layer above.
+type Shrinker interface {
+	Resizer
+	// Shrink makes the object as small as it can be while still
+	// holding need bytes of the layer above it. It never grows it.
+	Shrink(ctx context.Context, need int64) error
+}
+
+// Shrink shrinks e to target bytes and then shrinks each layer below
+// it to just fit the layer above, calling h's hooks along the way. It
+// returns each change made.
+func Shrink(ctx context.Context, e Resizer, target int64, h *Hooks) (changes []Change, err error) {
+	ctx = withQueryCache(ctx)
+	need := target
+	var cur Resizer
+	defer func() { setStage(err, cur) }()
+	for r := e; r != nil; {
+		cur = r
+		h.enter(r)
+		s, ok := r.(Shrinker)
+		if !ok {
+			return changes, fmt.Errorf("%v can't be shrunk", r)
+		}
+		n0, err := s.Size(ctx)
+		if err != nil {
+			return changes, err
+		}
+		if err := h.before(s, n0); err != nil {
+			return changes, err
+		}
+		t0 := time.Now()
+		if need < n0 {
+			if err = s.Shrink(ctx, need); err != nil {
+				err = fmt.Errorf("shrinking %v: %w", s, err)
+			}
+		}
+		var n1 int64
+		if err == nil {
+			if n1, err = s.Size(ctx); err != nil {
+				err = fmt.Errorf("error after successful shrink of %v: %w", s, err)
+			}
+		}
+		if err == nil && n1 < need && !DryRun {
+			// Should never happen; the layer above no longer fits.
+			err = fmt.Errorf("%v shrank to %d bytes, less than the %d bytes needed", s, n1, need)
+		}
+		d := time.Since(t0)
+		if herr := h.after(s, n0, n1, d, err); err == nil {
+			err = herr
+		}
+		if err != nil {
+			return changes, err
+		}
+		if n0 != n1 {
+			changes = append(changes, newChange(ActionShrink, s, n0, n1, d))
+		}
+		if DryRun {
+			// Lower layers would be sized to hold this one's new size.
+			n1 = need
+		}
+		need = n1
+		deps, err := s.DepResizers(ctx)
+		if err != nil {
+			return changes, err
+		}
+		switch len(deps) {
+		case 0:
+			r = nil
+		case 1:
+			r = deps[0]
+		default:
+			return changes, fmt.Errorf("%v has %d layers below it; shrinking only supports one", s, len(deps))
+		}
+	}
+	return changes, nil
+}
+
+// MinSize returns the smallest size in bytes the filesystem resized by
+// r, from FileSystem, can safely be shrunk to.
+func MinSize(ctx context.Context, r Resizer) (int64, error) {
+	e, ok := r.(fsResizer)
+	if !ok {
+		return 0, fmt.Errorf("%v is not a filesystem", r)
+	}
+	return minFSSize(ctx, e)
+}
+
+// minFSSize returns the smallest size in bytes the filesystem of e can
+// safely be shrunk to, as estimated by its own tools, plus 10% headroom.
+// If the tools give no estimate, it's based on how much space is in use.
+func minFSSize(ctx context.Context, e fsResizer) (int64, error) {
+	var minSize, blockSize int64
+	if e.offline {
+		n, bs, err := ext2Superblock(ctx, e.fs.Device)
+		if err != nil {
+			return 0, err
+		}
+		minSize, blockSize = n*bs, bs
+	} else {
+		st, err := Stat(e.fs.Mountpoint)
+		if err != nil {
+			return 0, err
+		}
+		minSize, blockSize = st.UsedBytes(), st.BlockSize()
+	}
+	switch e.fs.Type {
+	case "ext2", "ext3", "ext4":
+		// "Estimated minimum size of the filesystem: 1234567" (in blocks)
+		cmd := Command(ctx, "resize2fs", "-P", e.fs.Device)
+		out, err := combinedOutput(cmd)
+		if err != nil {
+			return 0, err
+		}
+		if m := resize2fsMinRx.FindSubmatch(out); m != nil {
+			blocks, _ := strconv.ParseInt(string(m[1]), 10, 64)
+			minSize = blocks * blockSize
+		}
+	case "btrfs":
+		// "123456789 bytes (117.74MiB)"
+		cmd := Command(ctx, "btrfs", "inspect-internal", "min-dev-size", HostPath(e.fs.FSMountpoint))
+		out, err := combinedOutput(cmd)
+		if err != nil {
+			return 0, err
+		}
+		if f := strings.Fields(string(out)); len(f) > 0 {
+			if n, err := strconv.ParseInt(f[0], 10, 64); err == nil {
+				minSize = n
+			}
+		}
+	}
+	return minSize + minSize/10, nil
+}
+
+var resize2fsMinRx = regexp.MustCompile(`minimum size of the filesystem: (\d+)`)
+
+func (e fsResizer) Shrink(ctx context.Context, need int64) error {
+	minSize, err := minFSSize(ctx, e)
+	if err != nil {
+		return err
+	}
+	if need < minSize {
+		return fmt.Errorf("target size %s is below the smallest safe size of %s", HumanBytes(need), HumanBytes(minSize))
+	}
+	switch e.fs.Type {
+	case "btrfs":
+		return runShrinkCmd(e, Command(ctx, "btrfs", "filesystem", "resize", strconv.FormatInt(need, 10), HostPath(e.fs.FSMountpoint)))
+	case "ext2", "ext3", "ext4":
+		if mounted, _ := devMounted(e.fs.Device); mounted {
+			return fmt.Errorf("%s filesystems can only be shrunk while unmounted; unmount %s and use --offline", e.fs.Type, e.fs.Device)
+		}
+		if err := runShrinkCmd(e, Command(ctx, "e2fsck", "-f", "-p", e.fs.Device)); err != nil {
+			return err
+		}
+		// resize2fs wants sizes in units; use KiB, rounding down so
+		// we end at or below need.
+		return runShrinkCmd(e, Command(ctx, "resize2fs", e.fs.Device, fmt.Sprintf("%dK", need/1024)))
+	case "xfs":
+		return fmt.Errorf("%w: XFS filesystems can't be shrunk", ErrUnsupportedFilesystem)
+	}
+	return fmt.Errorf("%w: shrinking %s filesystems is not supported", ErrUnsupportedFilesystem, e.fs.Type)
+}
+
+func (r lvResizer) Shrink(ctx context.Context, need int64) error {
+	// lvreduce rounds up to a whole number of extents, so the LV still
+	// holds need bytes.
+	return runShrinkCmd(r, Command(ctx, "lvreduce", "-f", "-L", fmt.Sprintf("%db", need), string(r)))
+}
+
+func (r pvResizer) Shrink(ctx context.Context, need int64) error {
+	// The PV must keep all its allocated extents, not just those of
+	// the LV we shrank, so shrink it to what's in use.
+	used, err := r.usedBytes(ctx)
+	if err != nil {
+		return err
+	}
+	if used < need {
+		used = need
+	}
+	return runShrinkCmd(r, Command(ctx, "pvresize", "-y", "--setphysicalvolumesize", fmt.Sprintf("%db", used), string(r)))
+}
+
+// usedBytes returns the bytes at the start of the PV that must be kept:
+// its metadata area plus all allocated extents.
+func (r pvResizer) usedBytes(ctx context.Context) (int64, error) {
+	dev := string(r)
+	cmd := Command(ctx, "pvs", "--noheadings", "--nosuffix", "--units", "b", "-o", "pe_start,pv_used", dev)
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return 0, err
+	}
+	f := strings.Fields(string(out))
+	if len(f) != 2 {
+		return 0, fmt.Errorf("unexpected pvs output for %s: %q", dev, out)
+	}
+	peStart, err1 := strconv.ParseInt(f[0], 10, 64)
+	pvUsed, err2 := strconv.ParseInt(f[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("unexpected pvs output for %s: %q", dev, out)
+	}
+	return peStart + pvUsed, nil
+}
+
+func (p partitionResizer) Shrink(ctx context.Context, need int64) error {
+	partDev := string(p)
+	diskDev, err := DiskOf(ctx, partDev)
+	if err != nil {
+		return err
+	}
+	pt, err := getPartitionTable(ctx, diskDev)
+	if err != nil {
+		return err
+	}
+	if _, err := partitionTableIsGPT(ctx, diskDev, pt); err != nil {
+		return err
+	}
+	part, ok := pt.partition(partDev)
+	if !ok {
+		return fmt.Errorf("partition %s %w in partition table of %s", partDev, ErrDeviceNotFound, diskDev)
+	}
+	// Round up to a 1 MiB boundary, as partitioning tools align.
+	const align = (1 << 20) / 512
+	sectors := (need + 511) / 512
+	sectors = (sectors + align - 1) / align * align
+	if sectors >= part.Size() {
+		return nil
+	}
+	if err := part.SetSize(sectors); err != nil {
+		return err
+	}
+	pt.RemoveMeta("last-lba")
+	if DryRun {
+		reportAction(Action{Steps: tableSteps(ctx, diskDev, pt, part), ProposedBytes: part.Size() * 512})
+		return nil
+	}
+	return p.writeTable(ctx, diskDev, pt, part)
+}
+
+// runShrinkCmd runs cmd to shrink r, or describes it in dry-run mode.
+func runShrinkCmd(r Resizer, cmd *exec.Cmd) error {
+	if DryRun {
+		dryRunCmd(cmd, nil)
+		return nil
+	}
+	out, err := runCmd(r.String(), cmd)
+	if err != nil {
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+// devMounted reports whether the block device dev is mounted anywhere.
+func devMounted(dev string) (bool, error) {
+	mounts, err := Mounts()
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.Source == dev {
+			return true, nil
+		}
+	}
+	return false, nil
+}
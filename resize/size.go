@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// HumanBytes formats n bytes using IEC units, e.g. "20.0 GiB".
+func HumanBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	i := -1
+	for (v >= unit || v <= -unit) && i < len(iecPrefixes)-1 {
+		v /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %siB", v, iecPrefixes[i:i+1])
+}
+
+const iecPrefixes = "KMGTPE"
+
+// HumanDelta formats a change of n bytes with an explicit sign,
+// e.g. "+30.0 GiB".
+func HumanDelta(n int64) string {
+	if n >= 0 {
+		return "+" + HumanBytes(n)
+	}
+	return "-" + HumanBytes(-n)
+}
+
+// sizeState formats n bytes for a Resizer's State method.
+func sizeState(n int64) string {
+	return fmt.Sprintf("%s (%d bytes)", HumanBytes(n), n)
+}
+
+// ParseSize parses a size into bytes. A plain number is bytes. A
+// suffix of K, M, G, T, P, or E, alone or followed by "iB", is a power
+// of 1024, as in "512M" or "10GiB"; followed by just "B", it's an SI
+// power of 1000, as in "10GB". A suffix of "s" counts 512-byte
+// sectors, as in "4096s". Fractions like "1.5G" are allowed.
+func ParseSize(s string) (int64, error) {
+	return parseSize(s, -1)
+}
+
+// ParseSizeOf is like ParseSize, but also accepts a percentage of
+// whole, as in "25%".
+func ParseSizeOf(s string, whole int64) (int64, error) {
+	return parseSize(s, whole)
+}
+
+func parseSize(s string, whole int64) (int64, error) {
+	t := strings.TrimSpace(s)
+	if t == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	if strings.HasPrefix(t, "-") {
+		return 0, fmt.Errorf("invalid size %q: negative", s)
+	}
+	mult := 1.0
+	u := strings.TrimLeft(t, "0123456789.")
+	num := t[:len(t)-len(u)]
+	u = strings.TrimSpace(u)
+	switch {
+	case u == "" || u == "B":
+	case u == "s":
+		mult = 512
+	case u == "%" && whole >= 0:
+		mult = float64(whole) / 100
+	case u == "%":
+		return 0, fmt.Errorf("invalid size %q: a percentage doesn't make sense here", s)
+	default:
+		i := strings.IndexByte(iecPrefixes, strings.ToUpper(u[:1])[0])
+		if i < 0 {
+			return 0, fmt.Errorf("invalid size %q: unknown unit %q; want K, M, G, T, P, or E, optionally followed by iB or B, or s for 512-byte sectors", s, u)
+		}
+		switch rest := u[1:]; {
+		case rest == "" || rest == "iB" || rest == "ib":
+			mult = math.Pow(1024, float64(i+1))
+		case rest == "B" || rest == "b":
+			mult = math.Pow(1000, float64(i+1))
+		default:
+			return 0, fmt.Errorf("invalid size %q: unknown unit %q; want e.g. %siB or %sB", s, u, u[:1], u[:1])
+		}
+	}
+	if num == "" {
+		return 0, fmt.Errorf("invalid size %q: no number before the unit", s)
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %q isn't a number", s, num)
+	}
+	if u == "%" && n > 100 {
+		return 0, fmt.Errorf("invalid size %q: more than 100%%", s)
+	}
+	v := n * mult
+	if v >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(v), nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		whole int64
+		want  int64
+	}{
+		{"1048576", -1, 1 << 20},
+		{"512M", -1, 512 << 20},
+		{"10G", -1, 10 << 30},
+		{"10GiB", -1, 10 << 30},
+		{"10g", -1, 10 << 30},
+		{"10GB", -1, 10e9},
+		{"500kB", -1, 500e3},
+		{"1.5K", -1, 1536},
+		{"4096s", -1, 4096 * 512},
+		{" 2 T ", -1, 2 << 40},
+		{"100B", -1, 100},
+		{"25%", 400, 100},
+		{"100%", 400, 400},
+	} {
+		got, err := parseSize(tt.in, tt.whole)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q, %d) = %d, %v; want %d", tt.in, tt.whole, got, err, tt.want)
+		}
+	}
+	for in, wantErr := range map[string]string{
+		"":      "empty size",
+		"G":     "no number",
+		"-5G":   "negative",
+		"10X":   `unknown unit "X"`,
+		"10GiX": `want e.g. GiB or GB`,
+		"1.2.3": "isn't a number",
+		"25%":   "percentage doesn't make sense",
+		"99E":   "too large",
+	} {
+		_, err := ParseSize(in)
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("ParseSize(%q) error = %v; want one containing %q", in, err, wantErr)
+		}
+	}
+	if _, err := ParseSizeOf("101%", 100); err == nil {
+		t.Errorf("ParseSizeOf(101%%) succeeded")
+	}
+}
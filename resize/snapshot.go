@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot, if non-empty, is a directory holding a copy of another
+// machine's /sys, /proc, and /dev links, as collected by embiggen-disk
+// collect-diagnostics, that's read instead of this machine's. With
+// MountinfoFile and FstabPath pointing into it, Statfs returning the
+// sizes recorded with it, and CommandRunner replaying the commands, a
+// DryRun then reproduces what Resize would do on that machine. Tools
+// are only found through ToolPaths, which should list those it had.
+var Snapshot string
+
+// Statfs reads the statistics of the filesystem mounted at path, as
+// unix.Statfs does. Replaying a Snapshot substitutes those recorded
+// with it.
+var Statfs = unix.Statfs
+
+// sysPath returns where to read p, an absolute path under /sys, /proc,
+// or /dev: within Snapshot, if that's set.
+func sysPath(p string) string {
+	if Snapshot == "" {
+		return p
+	}
+	return filepath.Join(Snapshot, p)
+}
+
+// evalSymlinks is filepath.EvalSymlinks for p, an absolute path under
+// /sys or /dev, resolved within Snapshot if that's set.
+func evalSymlinks(p string) (string, error) {
+	if Snapshot == "" {
+		return filepath.EvalSymlinks(p)
+	}
+	d, err := filepath.EvalSymlinks(sysPath(p))
+	if err != nil {
+		return "", err
+	}
+	if rel, ok := strings.CutPrefix(d, filepath.Clean(Snapshot)); ok {
+		return "/" + strings.TrimPrefix(rel, "/"), nil
+	}
+	return d, nil
+}
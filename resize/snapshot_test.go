@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSnapshot lays out a snapshot like collect-diagnostics does, of
+// a disk vda with one partition, vda1, and returns its directory.
+func writeSnapshot(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"sys/devices/virtio1/block/vda/size":       "41943040\n",
+		"sys/devices/virtio1/block/vda/vda1/size":  "20969472\n",
+		"sys/devices/virtio1/block/vda/vda1/start": "2048\n",
+		"dev/vda":  "",
+		"dev/vda1": "",
+	}
+	links := map[string]string{
+		"sys/class/block/vda":   "../../devices/virtio1/block/vda",
+		"sys/class/block/vda1":  "../../devices/virtio1/block/vda/vda1",
+		"sys/block/vda":         "../devices/virtio1/block/vda",
+		"dev/disk/by-uuid/f00d": "../../vda1",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSnapshot(t *testing.T) {
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = writeSnapshot(t)
+
+	if got, err := evalSymlinks("/dev/disk/by-uuid/f00d"); err != nil || got != "/dev/vda1" {
+		t.Errorf("evalSymlinks(by-uuid) = %q, %v; want /dev/vda1", got, err)
+	}
+	if got, err := resolveDevSpec(context.Background(), "UUID=f00d"); err != nil || got != "/dev/vda1" {
+		t.Errorf("resolveDevSpec(UUID=f00d) = %q, %v; want /dev/vda1", got, err)
+	}
+	if n, err := blockDevSize("/dev/vda1"); err != nil || n != int64(20969472)*512 {
+		t.Errorf("blockDevSize(/dev/vda1) = %d, %v; want %d", n, err, int64(20969472)*512)
+	}
+	// The disk has 10 GiB free after the partition.
+	if ok, err := partitionResizer("/dev/vda1").mayGrow(context.Background()); err != nil || !ok {
+		t.Errorf("mayGrow = %v, %v; want true", ok, err)
+	}
+	if _, err := ToolPath("sfdisk"); err == nil {
+		t.Errorf("ToolPath(sfdisk) found a tool not in ToolPaths")
+	}
+}
@@ -0,0 +1,28 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import "golang.org/x/sys/unix"
+
+// statfsBlockSize returns the fundamental block size from st: f_frsize,
+// or f_bsize on kernels that leave that zero.
+func statfsBlockSize(st *unix.Statfs_t) int64 {
+	if st.Frsize != 0 {
+		return int64(st.Frsize)
+	}
+	return int64(st.Bsize)
+}
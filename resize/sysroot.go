@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+)
+
+// Sysroot, if non-empty, is an alternate root whose mount points
+// FileSystem resolves, such as an image's root filesystem mounted by
+// an image build pipeline. A mount point mnt is Sysroot joined with
+// mnt if that's mounted, and otherwise the filesystem Sysroot's
+// /etc/fstab has at mnt, found on the disk Sysroot is mounted from,
+// like the loop or NBD device the image is attached to.
+var Sysroot string
+
+// SysrootPath returns where the mount point mnt, within Sysroot if
+// that's set, is mounted.
+func SysrootPath(mnt string) string {
+	if Sysroot == "" {
+		return mnt
+	}
+	return filepath.Join(Sysroot, mnt)
+}
+
+// sysrootFileSystem is FileSystem for a mount point within Sysroot.
+func sysrootFileSystem(ctx context.Context, mnt string) (Resizer, error) {
+	host := SysrootPath(mnt)
+	fs, err := Stat(host)
+	if err == nil {
+		return mountedFileSystem(ctx, host, fs)
+	}
+	if err != errMountNotFound {
+		return nil, err
+	}
+	fstab := filepath.Join(Sysroot, "etc/fstab")
+	ent, ok := fstabLookup(fstab, mnt)
+	if !ok {
+		return nil, fmt.Errorf("%s is not mounted and not in %s", host, fstab)
+	}
+	disk, err := sysrootDisk(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devs, err := blockDevicesBelow(ctx, disk)
+	if err != nil {
+		return nil, err
+	}
+	d := matchSpec(ctx, growableFilesystems(devs), ent.spec)
+	if d == nil {
+		return nil, fmt.Errorf("%w: %s has no filesystem matching %s, the %s entry for %s", ErrDeviceNotFound, disk, ent.spec, fstab, mnt)
+	}
+	return unmountedResizer(ctx, host, "/dev/"+d.KName, ent.vfstype)
+}
+
+// sysrootDisk returns the disk holding the filesystem mounted at
+// Sysroot.
+func sysrootDisk(ctx context.Context) (string, error) {
+	st, err := Stat(Sysroot)
+	if err == errMountNotFound {
+		return "", fmt.Errorf("sysroot %s isn't a mount point", Sysroot)
+	}
+	if err != nil {
+		return "", err
+	}
+	devs, err := Topology(ctx)
+	if err != nil {
+		return "", err
+	}
+	dev := st.Device
+	if d, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = d
+	}
+	for _, disk := range devs {
+		if findBlockDevice([]*BlockDevice{disk}, filepath.Base(dev)) != nil {
+			return "/dev/" + disk.KName, nil
+		}
+	}
+	return "", fmt.Errorf("%w: lsblk doesn't list %s, on which sysroot %s is mounted", ErrDeviceNotFound, st.Device, Sysroot)
+}
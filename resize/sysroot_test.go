@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSysrootPath(t *testing.T) {
+	defer func(old string) { Sysroot = old }(Sysroot)
+	Sysroot = ""
+	if got := SysrootPath("/boot"); got != "/boot" {
+		t.Errorf("without Sysroot, SysrootPath(/boot) = %q", got)
+	}
+	Sysroot = "/mnt/image"
+	for mnt, want := range map[string]string{
+		"/":     "/mnt/image",
+		"/boot": "/mnt/image/boot",
+	} {
+		if got := SysrootPath(mnt); got != want {
+			t.Errorf("SysrootPath(%q) = %q; want %q", mnt, got, want)
+		}
+	}
+}
+
+func TestBlockDevicesBelow(t *testing.T) {
+	replayRecordings(t, []Recording{
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Stdout: lsblkLVMOnXen},
+	})
+	devs, err := blockDevicesBelow(context.Background(), "/dev/xvda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range growableFilesystems(devs) {
+		got = append(got, d.KName)
+	}
+	if len(devs) != 4 || len(got) != 1 || got[0] != "dm-0" {
+		t.Errorf("got %d devices with growable filesystems %q; want 4 with [dm-0]", len(devs), got)
+	}
+}
+
+func TestMatchSpec(t *testing.T) {
+	fss := []*BlockDevice{
+		{Name: "loop0p2", KName: "loop0p2", Type: "part", FSType: "ext4"},
+		{Name: "vg-root", KName: "dm-3", Type: "lvm", FSType: "xfs"},
+	}
+	const p2 = "DEVNAME=/dev/loop0p2\nLABEL=boot\\ fs\nUUID=0b1a3e2c-5f04-4c8e-9d3e-0c6c1a4f9a11\nTYPE=ext4\nPART_ENTRY_NAME=boot\nPART_ENTRY_UUID=9e1f6b0a-7d3c-4a52-8e61-2b5c0d7f4e33\n"
+	const dm3 = "DEVNAME=/dev/dm-3\nUUID=4f7d2a91-1c3b-4e8f-a6d2-7b9e0c5f1a88\nTYPE=xfs\n"
+	blkid := func(dev, out string) Recording {
+		return Recording{Args: []string{"blkid", "-p", "-o", "export", dev}, Stdout: out}
+	}
+	replayRecordings(t, []Recording{
+		blkid("/dev/loop0p2", p2), blkid("/dev/dm-3", dm3),
+		blkid("/dev/loop0p2", p2),
+		blkid("/dev/loop0p2", p2),
+		blkid("/dev/loop0p2", p2),
+	})
+	ctx := context.Background()
+	for _, tt := range []struct {
+		spec, want string
+	}{
+		{"UUID=4F7D2A91-1C3B-4E8F-A6D2-7B9E0C5F1A88", "dm-3"},
+		{"LABEL=\"boot fs\"", "loop0p2"},
+		{"PARTLABEL=boot", "loop0p2"},
+		{"/dev/disk/by-partuuid/9e1f6b0a-7d3c-4a52-8e61-2b5c0d7f4e33", "loop0p2"},
+		{"/dev/mapper/vg-root", "dm-3"},
+	} {
+		got := ""
+		if d := matchSpec(ctx, fss, tt.spec); d != nil {
+			got = d.KName
+		}
+		if got != tt.want {
+			t.Errorf("matchSpec(%q) = %q; want %q", tt.spec, got, tt.want)
+		}
+	}
+}
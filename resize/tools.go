@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ToolPaths overrides where to find external tools, keyed by the
+// tool's name. "lvm" is used for all LVM commands.
+var ToolPaths = map[string]string{}
+
+// lvmCommands are the LVM tools we run. They're all symlinks to (or
+// subcommands of) the one lvm binary.
+var lvmCommands = map[string]bool{
+	"lvdisplay": true,
+	"pvdisplay": true,
+	"lvextend":  true,
+	"pvresize":  true,
+	"lvs":       true,
+	"pvs":       true,
+	"vgs":       true,
+}
+
+// sbinDirs are searched after $PATH, since non-root users (and some
+// init environments) often lack them in $PATH.
+var sbinDirs = []string{"/sbin", "/usr/sbin", "/usr/local/sbin"}
+
+// ToolPath returns the path to run for the external tool name: its
+// entry in ToolPaths, or else where it's found in $PATH or the sbin
+// directories. Absolute names are returned as is.
+func ToolPath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	if p := ToolPaths[name]; p != "" {
+		return p, nil
+	}
+	if Snapshot != "" {
+		return "", fmt.Errorf("%s: %w on the machine snapshotted", name, ErrToolMissing)
+	}
+	if p, err := exec.LookPath(name); err == nil {
+		return p, nil
+	}
+	for _, dir := range sbinDirs {
+		if p, err := exec.LookPath(filepath.Join(dir, name)); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w in $PATH or %v; install it or give its path", name, ErrToolMissing, sbinDirs)
+}
+
+// Command returns a command running the external tool name (see
+// ToolPath) with args, killed if ctx is done first. If the tool can't
+// be found, running the command returns an error saying so.
+func Command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	if lvm := ToolPaths["lvm"]; lvmCommands[name] && lvm != "" {
+		return cLocale(exec.CommandContext(ctx, lvm, append([]string{name}, arg...)...))
+	}
+	path, err := ToolPath(name)
+	if err != nil && lvmCommands[name] {
+		if lvm, lerr := ToolPath("lvm"); lerr == nil {
+			return cLocale(exec.CommandContext(ctx, lvm, append([]string{name}, arg...)...))
+		}
+	}
+	if err != nil {
+		cmd := exec.CommandContext(ctx, name, arg...)
+		cmd.Err = err
+		return cmd
+	}
+	return cLocale(exec.CommandContext(ctx, path, arg...))
+}
+
+// cLocale sets cmd to run in the C locale, so the output we parse and
+// the error messages we match aren't translated or localized (e.g.
+// decimal commas in sizes).
+func cLocale(cmd *exec.Cmd) *exec.Cmd {
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == "LANG" || k == "LANGUAGE" || strings.HasPrefix(k, "LC_") {
+			continue
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+	cmd.Env = append(cmd.Env, "LC_ALL=C")
+	return cmd
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A BlockDevice is a block device as lsblk reports it.
+type BlockDevice struct {
+	Name       string `json:"name"`   // "debvg-root"
+	KName      string `json:"kname"`  // kernel name, "dm-0"
+	PKName     string `json:"pkname"` // kernel name of its parent, "sda3"
+	Type       string `json:"type"`   // "disk", "part", "lvm", "crypt", "loop", ...
+	MajMin     string `json:"maj:min"`
+	FSType     string `json:"fstype"`
+	Mountpoint string `json:"mountpoint"`
+
+	// Children are the devices built on this one, such as a disk's
+	// partitions or the LVs on a PV. An LV on several PVs is a child
+	// of each.
+	Children []*BlockDevice `json:"children"`
+}
+
+// Topology returns the tree of the system's block devices, with the
+// disks at its roots, from one run of lsblk.
+func Topology(ctx context.Context) ([]*BlockDevice, error) {
+	cmd := Command(ctx, "lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT")
+	out, err := query(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseLsblkJSON(out)
+}
+
+// parseLsblkJSON parses the output of lsblk -J.
+func parseLsblkJSON(out []byte) ([]*BlockDevice, error) {
+	var v struct {
+		BlockDevices []*BlockDevice `json:"blockdevices"`
+	}
+	if err := json.Unmarshal(out, &v); err != nil {
+		return nil, fmt.Errorf("parsing lsblk -J output: %v", err)
+	}
+	if v.BlockDevices == nil {
+		return nil, fmt.Errorf("lsblk -J output lists no block devices: %q", out)
+	}
+	return v.BlockDevices, nil
+}
+
+// findBlockDevice returns the device with kernel name kname in devs or
+// below them, or nil if there's none.
+func findBlockDevice(devs []*BlockDevice, kname string) *BlockDevice {
+	for _, d := range devs {
+		if d.KName == kname {
+			return d
+		}
+		if c := findBlockDevice(d.Children, kname); c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// lookupBlockDevice returns lsblk's entry for dev, a path in /dev, or
+// nil if lsblk isn't installed or doesn't list it, in which case
+// callers go by dev's name.
+func lookupBlockDevice(ctx context.Context, dev string) *BlockDevice {
+	devs, err := Topology(ctx)
+	if err != nil {
+		vlogf("no block device topology from lsblk: %v", err)
+		return nil
+	}
+	if d, err := evalSymlinks(dev); err == nil {
+		dev = d
+	}
+	return findBlockDevice(devs, filepath.Base(dev))
+}
+
+// DiskOf returns the disk holding the partition partDev, such as
+// "/dev/xvda" for "/dev/xvda1", as lsblk reports it, or if lsblk can't
+// say, as sysfs does, or failing that, as DiskDevice maps its name.
+func DiskOf(ctx context.Context, partDev string) (string, error) {
+	if d := lookupBlockDevice(ctx, partDev); d != nil && d.Type == "part" && d.PKName != "" {
+		return "/dev/" + d.PKName, nil
+	}
+	if disk, ok := sysfsDiskOf(partDev); ok {
+		return disk, nil
+	}
+	return DiskDevice(partDev)
+}
+
+// sysfsDiskOf returns the disk holding the partition partDev, whose
+// directory in sysfs is within its disk's.
+func sysfsDiskOf(partDev string) (disk string, ok bool) {
+	if d, err := evalSymlinks(partDev); err == nil {
+		partDev = d
+	}
+	dir, err := evalSymlinks("/sys/class/block/" + filepath.Base(partDev))
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(sysPath(dir + "/partition")); err != nil {
+		return "", false
+	}
+	return "/dev/" + filepath.Base(filepath.Dir(dir)), true
+}
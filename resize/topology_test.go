@@ -0,0 +1,164 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lsblkLVMOnXen is lsblk -J output from util-linux 2.38 for a Xen guest
+// with LVM on its root disk's third partition, and a second disk
+// holding an ext4 filesystem directly.
+const lsblkLVMOnXen = `{
+   "blockdevices": [
+      {
+         "name": "xvda",
+         "kname": "xvda",
+         "pkname": null,
+         "type": "disk",
+         "maj:min": "202:0",
+         "fstype": null,
+         "mountpoint": null,
+         "children": [
+            {
+               "name": "xvda1",
+               "kname": "xvda1",
+               "pkname": "xvda",
+               "type": "part",
+               "maj:min": "202:1",
+               "fstype": "vfat",
+               "mountpoint": "/boot/efi"
+            },{
+               "name": "xvda3",
+               "kname": "xvda3",
+               "pkname": "xvda",
+               "type": "part",
+               "maj:min": "202:3",
+               "fstype": "LVM2_member",
+               "mountpoint": null,
+               "children": [
+                  {
+                     "name": "debvg-root",
+                     "kname": "dm-0",
+                     "pkname": "xvda3",
+                     "type": "lvm",
+                     "maj:min": "254:0",
+                     "fstype": "ext4",
+                     "mountpoint": "/"
+                  }
+               ]
+            }
+         ]
+      },{
+         "name": "xvdb",
+         "kname": "xvdb",
+         "pkname": null,
+         "type": "disk",
+         "maj:min": "202:16",
+         "fstype": "ext4",
+         "mountpoint": "/data"
+      }
+   ]
+}
+`
+
+func TestParseLsblkJSON(t *testing.T) {
+	devs, err := parseLsblkJSON([]byte(lsblkLVMOnXen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 2 {
+		t.Fatalf("got %d disks; want 2", len(devs))
+	}
+	tests := []struct {
+		kname, name, typ, pkname, mnt string
+	}{
+		{"xvda", "xvda", "disk", "", ""},
+		{"xvda3", "xvda3", "part", "xvda", ""},
+		{"dm-0", "debvg-root", "lvm", "xvda3", "/"},
+		{"xvdb", "xvdb", "disk", "", "/data"},
+	}
+	for _, tt := range tests {
+		d := findBlockDevice(devs, tt.kname)
+		if d == nil {
+			t.Errorf("%s not found", tt.kname)
+			continue
+		}
+		if d.Name != tt.name || d.Type != tt.typ || d.PKName != tt.pkname || d.Mountpoint != tt.mnt {
+			t.Errorf("%s = %+v; want name %q, type %q, pkname %q, mountpoint %q", tt.kname, *d, tt.name, tt.typ, tt.pkname, tt.mnt)
+		}
+	}
+	if d := findBlockDevice(devs, "sda"); d != nil {
+		t.Errorf("found nonexistent sda: %+v", *d)
+	}
+	for _, bad := range []string{"", "{}", `{"blockdevices": 3}`} {
+		if _, err := parseLsblkJSON([]byte(bad)); err == nil {
+			t.Errorf("parseLsblkJSON(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestDiskOfFromTopology(t *testing.T) {
+	recs := []Recording{
+		{Args: []string{"lsblk", "-J", "-o", "NAME,KNAME,PKNAME,TYPE,MAJ:MIN,FSTYPE,MOUNTPOINT"}, Stdout: lsblkLVMOnXen},
+	}
+	replayRecordings(t, recs)
+	// DiskDevice doesn't know Xen's names.
+	if got, err := DiskOf(context.Background(), "/dev/xvda3"); got != "/dev/xvda" || err != nil {
+		t.Errorf("DiskOf(/dev/xvda3) = %q, %v; want /dev/xvda", got, err)
+	}
+	deps, err := NewPVResizer("/dev/xvda3").DepResizers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0] != partitionResizer("/dev/xvda3") {
+		t.Errorf("PV deps = %v; want partition /dev/xvda3", deps)
+	}
+}
+
+func TestDiskOfFromSysfs(t *testing.T) {
+	replayRecordings(t, nil)
+	defer func(old string) { Snapshot = old }(Snapshot)
+	Snapshot = t.TempDir()
+	dir := filepath.Join(Snapshot, "sys/devices/vbd-51712/block/xvda/xvda1")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "partition"), []byte("1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	class := filepath.Join(Snapshot, "sys/class/block")
+	if err := os.MkdirAll(class, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../devices/vbd-51712/block/xvda/xvda1", filepath.Join(class, "xvda1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../devices/vbd-51712/block/xvda", filepath.Join(class, "xvda")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DiskOf(context.Background(), "/dev/xvda1"); got != "/dev/xvda" || err != nil {
+		t.Errorf("DiskOf(/dev/xvda1) = %q, %v; want /dev/xvda", got, err)
+	}
+	// A disk has no partition file, and DiskDevice can't name its disk.
+	if got, err := DiskOf(context.Background(), "/dev/xvda"); err == nil {
+		t.Errorf("DiskOf(/dev/xvda) = %q; want error", got)
+	}
+}
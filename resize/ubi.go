@@ -0,0 +1,231 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterFilesystem("ubifs", func(ctx context.Context, fs FSStat) (Resizer, error) {
+		vol, err := ubiVolume(fs.Device)
+		if err != nil {
+			return nil, err
+		}
+		return ubifsResizer{fs: fs, vol: vol}, nil
+	})
+}
+
+var ubiVolumeRx = regexp.MustCompile(`^ubi\d+_\d+$`)
+
+// ubiVolume returns the UBI volume, like "ubi0_1", that the ubifs
+// mount source src names, in the forms the kernel accepts: "ubi0_1"
+// or "/dev/ubi0_1"; "ubi1", for volume 1 of ubi0; or "ubi0:rootfs",
+// "ubi0!rootfs", or "ubi:rootfs", by name, the last on ubi0.
+func ubiVolume(src string) (ubiResizer, error) {
+	src = strings.TrimPrefix(src, "/dev/")
+	if ubiVolumeRx.MatchString(src) {
+		return ubiResizer(src), nil
+	}
+	dev, name, byName := strings.Cut(src, ":")
+	if !byName {
+		dev, name, byName = strings.Cut(src, "!")
+	}
+	if !byName {
+		if id, ok := strings.CutPrefix(src, "ubi"); ok && ubiVolumeRx.MatchString("ubi0_"+id) {
+			return ubiResizer("ubi0_" + id), nil
+		}
+		return "", fmt.Errorf("%w: unrecognized UBI volume %q", ErrDeviceNotFound, src)
+	}
+	if dev == "ubi" {
+		dev = "ubi0"
+	}
+	vols, _ := filepath.Glob(sysPath("/sys/class/ubi/" + dev + "_*"))
+	for _, v := range vols {
+		b, err := os.ReadFile(filepath.Join(v, "name"))
+		if err == nil && strings.TrimSpace(string(b)) == name && ubiVolumeRx.MatchString(filepath.Base(v)) {
+			return ubiResizer(filepath.Base(v)), nil
+		}
+	}
+	return "", fmt.Errorf("%w: no UBI volume named %q on %s", ErrDeviceNotFound, name, dev)
+}
+
+// A ubiResizer grows a UBI volume, on flash, into the free eraseblocks
+// of its UBI device. An MTD partition, below the device, can't change
+// size while attached, but if its layout has grown, as after new
+// mtdparts, UBI adds the new eraseblocks to the device's free pool
+// when it's next attached, from which this takes them.
+type ubiResizer string // the volume's kernel name, "ubi0_1"
+
+func (r ubiResizer) String() string { return fmt.Sprintf("UBI volume /dev/%s", string(r)) }
+
+// ubiDev returns the volume's UBI device, "ubi0".
+func (r ubiResizer) ubiDev() string {
+	dev, _, _ := strings.Cut(string(r), "_")
+	return dev
+}
+
+// attr returns the integer sysfs attribute name of the volume, or if
+// dev, of its UBI device.
+func (r ubiResizer) attr(name string, dev bool) (int64, error) {
+	d := string(r)
+	if dev {
+		d = r.ubiDev()
+	}
+	return readInt64File(sysPath("/sys/class/ubi/" + d + "/" + name))
+}
+
+func (r ubiResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r ubiResizer) Size(ctx context.Context) (int64, error) {
+	ebs, err := r.attr("reserved_ebs", false)
+	if err != nil {
+		return 0, err
+	}
+	size, err := r.attr("usable_eb_size", false)
+	if err != nil {
+		return 0, err
+	}
+	return ebs * size, nil
+}
+
+func (r ubiResizer) DepResizers(ctx context.Context) ([]Resizer, error) { return nil, nil }
+
+// growth returns the command growing the volume into all its device's
+// free eraseblocks, and the volume's size after, or ok false if it
+// has none.
+func (r ubiResizer) growth(ctx context.Context) (cmd *exec.Cmd, newSize int64, ok bool, err error) {
+	typ, err := os.ReadFile(sysPath("/sys/class/ubi/" + string(r) + "/type"))
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if strings.TrimSpace(string(typ)) == "static" {
+		return nil, 0, false, fmt.Errorf("%w: %v is a static volume, sized to its contents", ErrImmutable, r)
+	}
+	free, err := r.attr("avail_eraseblocks", true)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if free == 0 {
+		return nil, 0, false, nil
+	}
+	ebs, err := r.attr("reserved_ebs", false)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	size, err := r.attr("usable_eb_size", false)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	id, err := r.attr("vol_id", false)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	cmd = Command(ctx, "ubirsvol", "/dev/"+r.ubiDev(), "-n", strconv.FormatInt(id, 10), "-S", strconv.FormatInt(ebs+free, 10))
+	return cmd, (ebs + free) * size, true, nil
+}
+
+func (r ubiResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	cmd, newSize, ok, err := r.growth(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	if !ok {
+		return Action{CurrentBytes: n, ProposedBytes: n}, nil
+	}
+	return Action{Steps: []string{cmdLine(cmd, nil)}, CurrentBytes: n, ProposedBytes: newSize}, nil
+}
+
+func (r ubiResizer) Resize(ctx context.Context) error {
+	cmd, newSize, ok, err := r.growth(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	n, err := r.Size(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkGrowth(r, n, newSize); err != nil {
+		return err
+	}
+	if out, err := runCmd(r.String(), cmd); err != nil {
+		return toolError(cmd, out, err)
+	}
+	return nil
+}
+
+// A ubifsResizer is the UBIFS filesystem on a UBI volume. UBIFS can't
+// grow while mounted: it takes the space its volume gained, up to the
+// most eraseblocks it was made for (mkfs.ubifs -c), the next time it's
+// mounted, so growing it only grows its volume.
+type ubifsResizer struct {
+	fs  FSStat
+	vol ubiResizer
+}
+
+func (e ubifsResizer) String() string { return fmt.Sprintf("ubifs filesystem at %s", e.fs.Mountpoint) }
+
+func (e ubifsResizer) State(ctx context.Context) (string, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (e ubifsResizer) Size(ctx context.Context) (int64, error) {
+	st, err := Stat(e.fs.Mountpoint)
+	if err != nil {
+		return 0, err
+	}
+	return st.SizeBytes(), nil
+}
+
+func (e ubifsResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	return []Resizer{e.vol}, nil
+}
+
+func (e ubifsResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := e.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	// Nothing to do until it's next mounted.
+	return Action{CurrentBytes: n, ProposedBytes: n}, nil
+}
+
+func (e ubifsResizer) Resize(ctx context.Context) error {
+	Logger.Info("UBIFS takes its volume's new space when next mounted", "mountpoint", e.fs.Mountpoint, "volume", "/dev/"+string(e.vol))
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeUBISysfs lays out, in a Snapshot, the sysfs of ubi0 with a
+// static "kernel" volume and a dynamic "rootfs" one of 100 eraseblocks,
+// and 50 eraseblocks free.
+func writeUBISysfs(t *testing.T) {
+	old := Snapshot
+	t.Cleanup(func() { Snapshot = old })
+	Snapshot = t.TempDir()
+	for path, v := range map[string]string{
+		"ubi0/avail_eraseblocks": "50",
+		"ubi0_0/name":            "kernel",
+		"ubi0_0/type":            "static",
+		"ubi0_0/vol_id":          "0",
+		"ubi0_0/reserved_ebs":    "40",
+		"ubi0_0/usable_eb_size":  "126976",
+		"ubi0_1/name":            "rootfs",
+		"ubi0_1/type":            "dynamic",
+		"ubi0_1/vol_id":          "1",
+		"ubi0_1/reserved_ebs":    "100",
+		"ubi0_1/usable_eb_size":  "126976",
+	} {
+		p := filepath.Join(Snapshot, "sys/class/ubi", path)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUBIVolume(t *testing.T) {
+	writeUBISysfs(t)
+	for src, want := range map[string]ubiResizer{
+		"ubi0_1":      "ubi0_1",
+		"/dev/ubi0_1": "ubi0_1",
+		"ubi1":        "ubi0_1",
+		"ubi0:rootfs": "ubi0_1",
+		"ubi0!rootfs": "ubi0_1",
+		"ubi:kernel":  "ubi0_0",
+	} {
+		if got, err := ubiVolume(src); err != nil || got != want {
+			t.Errorf("ubiVolume(%q) = %q, %v; want %q", src, got, err, want)
+		}
+	}
+	for _, src := range []string{"ubi0:data", "ubi1:rootfs", "/dev/mtdblock3"} {
+		if got, err := ubiVolume(src); !errors.Is(err, ErrDeviceNotFound) {
+			t.Errorf("ubiVolume(%q) = %q, %v; want ErrDeviceNotFound", src, got, err)
+		}
+	}
+}
+
+func TestUBIResize(t *testing.T) {
+	writeUBISysfs(t)
+	ctx := context.Background()
+	a, err := ubiResizer("ubi0_1").Plan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.CurrentBytes != 100*126976 || a.ProposedBytes != 150*126976 {
+		t.Errorf("Plan sizes = %d → %d; want %d → %d", a.CurrentBytes, a.ProposedBytes, 100*126976, 150*126976)
+	}
+	if len(a.Steps) != 1 || a.Steps[0] != "ubirsvol /dev/ubi0 -n 1 -S 150" {
+		t.Errorf("Plan steps = %q", a.Steps)
+	}
+	replayRecordings(t, []Recording{{Args: []string{"ubirsvol", "/dev/ubi0", "-n", "1", "-S", "150"}}})
+	if err := ubiResizer("ubi0_1").Resize(ctx); err != nil {
+		t.Errorf("Resize: %v", err)
+	}
+	if _, err := ubiResizer("ubi0_0").Plan(ctx); !errors.Is(err, ErrImmutable) {
+		t.Errorf("Plan of static volume = %v; want ErrImmutable", err)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UDisks makes Resize grow partitions and filesystems through the
+// udisks2 daemon's D-Bus API rather than by running tools itself.
+// udisks authorizes the caller with PolicyKit, so it needn't be root.
+// LVM layers aren't supported, and checks that need to read the
+// device, like that of an ext2/3/4 superblock for errors, are left to
+// udisks.
+var UDisks bool
+
+const udisksName = "org.freedesktop.UDisks2"
+
+// errUDisksUnsupported is returned, before anything is changed, for
+// layers UDisks mode can't grow.
+var errUDisksUnsupported = errors.New("growing LVM isn't supported through udisks2")
+
+// udisksEscape escapes s for use in an object path as udisks2 does,
+// replacing each byte but letters, digits, and underscores with an
+// underscore and its value in hex: "dm-0" becomes "dm_2d0".
+func udisksEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	return b.String()
+}
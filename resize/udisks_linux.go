@@ -0,0 +1,58 @@
+//go:build linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// udisksObject returns the path of udisks2's object for the block
+// device dev.
+func udisksObject(dev string) dbus.ObjectPath {
+	if d, err := filepath.EvalSymlinks(dev); err == nil {
+		dev = d
+	}
+	return dbus.ObjectPath("/org/freedesktop/UDisks2/block_devices/" + udisksEscape(filepath.Base(dev)))
+}
+
+// udisksGrow calls the Resize method of udisks2's iface interface,
+// "Partition" or "Filesystem", on dev, growing it to fill the space
+// available, as a size of 0 asks.
+func udisksGrow(ctx context.Context, dev, iface string) error {
+	if err := checkNotDryRun("udisks2 " + iface + ".Resize of " + dev); err != nil {
+		return err
+	}
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("connecting to the system bus for udisks2: %v", err)
+	}
+	defer deviceChanges.Add(1)
+	obj := conn.Object(udisksName, udisksObject(dev))
+	// Without auth.no_user_interaction, PolicyKit may ask the user
+	// to authenticate.
+	call := obj.CallWithContext(ctx, udisksName+"."+iface+".Resize", 0, uint64(0), map[string]dbus.Variant{})
+	if call.Err != nil {
+		return fmt.Errorf("udisks2 %s.Resize of %s: %w", iface, dev, call.Err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUDisksEscape(t *testing.T) {
+	for name, want := range map[string]string{
+		"sda3":      "sda3",
+		"nvme0n1p2": "nvme0n1p2",
+		"dm-0":      "dm_2d0",
+		"sr_0.x":    "sr_0_2ex",
+	} {
+		if got := udisksEscape(name); got != want {
+			t.Errorf("udisksEscape(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
+
+// TestUDisksRefusesLVM checks that an LV is refused in UDisks mode
+// before anything below it is resized.
+func TestUDisksRefusesLVM(t *testing.T) {
+	UDisks = true
+	defer func() { UDisks = false }()
+	rr := new(RecordingRunner)
+	old := CommandRunner
+	CommandRunner = rr
+	defer func() { CommandRunner = old }()
+
+	_, err := Resize(context.Background(), NewLVResizer("/dev/mapper/datavg-data"), nil)
+	if !errors.Is(err, errUDisksUnsupported) {
+		t.Errorf("Resize error = %v; want %v", err, errUDisksUnsupported)
+	}
+	if len(rr.Commands()) != 0 {
+		t.Errorf("ran %q; want no commands", rr.Commands())
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A VGStatus describes an LVM volume group's space, for planning which
+// of its LVs to extend.
+type VGStatus struct {
+	Name        string     `json:"name"`
+	ExtentBytes int64      `json:"extentBytes"`
+	Extents     int64      `json:"extents"`
+	FreeExtents int64      `json:"freeExtents"`
+	PVs         []PVStatus `json:"pvs"`
+	LVs         []LVStatus `json:"lvs"`
+}
+
+// FreeBytes returns the VG's unallocated space in bytes.
+func (vg VGStatus) FreeBytes() int64 { return vg.FreeExtents * vg.ExtentBytes }
+
+// FreeBytesAfterGrowth returns what FreeBytes would be once its PVs
+// grew, in whole extents.
+func (vg VGStatus) FreeBytesAfterGrowth() int64 {
+	n := vg.FreeBytes()
+	for _, pv := range vg.PVs {
+		if vg.ExtentBytes > 0 {
+			n += pv.GrowBytes / vg.ExtentBytes * vg.ExtentBytes
+		}
+	}
+	return n
+}
+
+// A PVStatus is a PV in a VGStatus.
+type PVStatus struct {
+	Device    string `json:"device"`
+	Bytes     int64  `json:"bytes"`
+	GrowBytes int64  `json:"growBytes"`       // how much it, and the layers below it, could grow
+	Error     string `json:"error,omitempty"` // why GrowBytes couldn't be found
+}
+
+// An LVStatus is an LV in a VGStatus.
+type LVStatus struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"` // "/dev/vg/lv"
+	Bytes      int64  `json:"bytes"`
+	Attr       string `json:"attr"` // lvs' lv_attr, e.g. "-wi-ao----"
+	Mountpoint string `json:"mountpoint,omitempty"`
+	FSType     string `json:"fsType,omitempty"`
+
+	// Candidate is whether lvextend can give it the VG's free space:
+	// a plain, mirrored, RAID, or snapshot origin LV or a thin pool,
+	// rather than a snapshot, thin volume, or another LV's internal
+	// part.
+	Candidate bool `json:"candidate"`
+}
+
+// lvsSep separates the fields of the LVM reports VGStatuses reads.
+// LVM names can't contain it.
+const lvsSep = "|"
+
+// VGStatuses returns the status of each volume group, or of only
+// those named in vgs if any are.
+func VGStatuses(ctx context.Context, vgs ...string) ([]VGStatus, error) {
+	report := func(cmd string, fields string, names ...string) ([][]string, error) {
+		args := append([]string{"--noheadings", "--nosuffix", "--units", "b", "--separator", lvsSep, "-o", fields}, names...)
+		out, err := query(ctx, Command(ctx, cmd, args...))
+		if err != nil {
+			return nil, err
+		}
+		return parseLVMReport(out), nil
+	}
+	vgRows, err := report("vgs", "vg_name,vg_extent_size,vg_extent_count,vg_free_count", vgs...)
+	if err != nil {
+		return nil, err
+	}
+	// pvs takes PV names, not VGs, so its rows are filtered below.
+	pvRows, err := report("pvs", "pv_name,vg_name,pv_size")
+	if err != nil {
+		return nil, err
+	}
+	lvRows, err := report("lvs", "vg_name,lv_name,lv_path,lv_dm_path,lv_size,lv_attr", vgs...)
+	if err != nil {
+		return nil, err
+	}
+	var sts []VGStatus
+	for _, f := range vgRows {
+		if len(f) < 4 {
+			return nil, fmt.Errorf("unexpected vgs output: %q", strings.Join(f, lvsSep))
+		}
+		st := VGStatus{Name: f[0]}
+		if st.ExtentBytes, err = strconv.ParseInt(f[1], 10, 64); err == nil {
+			if st.Extents, err = strconv.ParseInt(f[2], 10, 64); err == nil {
+				st.FreeExtents, err = strconv.ParseInt(f[3], 10, 64)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unexpected vgs output: %q", strings.Join(f, lvsSep))
+		}
+		for _, f := range pvRows {
+			if len(f) < 3 || f[1] != st.Name {
+				continue
+			}
+			pv := PVStatus{Device: f[0]}
+			pv.Bytes, _ = strconv.ParseInt(f[2], 10, 64)
+			if grow, err := pvGrowth(ctx, f[0]); err != nil {
+				pv.Error = err.Error()
+			} else {
+				pv.GrowBytes = grow
+			}
+			st.PVs = append(st.PVs, pv)
+		}
+		for _, f := range lvRows {
+			if len(f) < 6 || f[0] != st.Name {
+				continue
+			}
+			lv := LVStatus{Name: f[1], Path: f[2], Attr: f[5], Candidate: lvCandidate(f[5])}
+			lv.Bytes, _ = strconv.ParseInt(f[4], 10, 64)
+			for _, d := range []string{f[3], f[2]} {
+				if m, ok, err := DeviceMount(d); err == nil && ok {
+					lv.Mountpoint, lv.FSType = m.Mountpoint, m.Type
+					break
+				}
+			}
+			st.LVs = append(st.LVs, lv)
+		}
+		sts = append(sts, st)
+	}
+	return sts, nil
+}
+
+// parseLVMReport splits the lines of an LVM report, printed with
+// --noheadings and --separator lvsSep, into their fields.
+func parseLVMReport(out []byte) [][]string {
+	var rows [][]string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || !strings.Contains(line, lvsSep) {
+			continue
+		}
+		f := strings.Split(line, lvsSep)
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+		rows = append(rows, f)
+	}
+	return rows
+}
+
+// lvCandidate reports whether lvextend can grow an LV with the lvs
+// lv_attr attr into its VG's free space. See LVStatus.Candidate.
+func lvCandidate(attr string) bool {
+	if attr == "" {
+		return false
+	}
+	return strings.ContainsRune("-omMrRt", rune(attr[0]))
+}
+
+// pvGrowth returns how much the PV on dev would grow, along with the
+// partition it's on, if resized now.
+func pvGrowth(ctx context.Context, dev string) (int64, error) {
+	steps, err := Plan(ctx, pvResizer(dev))
+	if err != nil {
+		return 0, err
+	}
+	st := steps[len(steps)-1]
+	return max(st.ProposedBytes-st.CurrentBytes, 0), nil
+}
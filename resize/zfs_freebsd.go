@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resize
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterFilesystem("zfs", func(ctx context.Context, fs FSStat) (Resizer, error) {
+		// fs.Device is the dataset, "zroot/ROOT/default".
+		pool, _, _ := strings.Cut(fs.Device, "/")
+		return zfsResizer(pool), nil
+	})
+}
+
+// A zfsResizer grows a ZFS pool onto the grown space of its vdevs. A
+// pool with the autoexpand property on does that itself when a vdev
+// grows, but only as GEOM reports the vdev's resize, so its vdevs are
+// expanded with zpool online -e either way, which is harmless if the
+// pool has already grown.
+type zfsResizer string // the pool, "zroot"
+
+func (r zfsResizer) String() string { return fmt.Sprintf("ZFS pool %s", string(r)) }
+
+func (r zfsResizer) State(ctx context.Context) (string, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return "", err
+	}
+	return sizeState(n), nil
+}
+
+func (r zfsResizer) Size(ctx context.Context) (int64, error) {
+	out, err := query(ctx, Command(ctx, "zpool", "list", "-Hp", "-o", "size", string(r)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected zpool list output for %s: %q", string(r), out)
+	}
+	return n, nil
+}
+
+// vdevs returns the devices holding the pool's data.
+func (r zfsResizer) vdevs(ctx context.Context) ([]string, error) {
+	out, err := query(ctx, Command(ctx, "zpool", "list", "-vHP", string(r)))
+	if err != nil {
+		return nil, err
+	}
+	return parseZpoolVdevs(out), nil
+}
+
+// parseZpoolVdevs returns the data devices in the output of zpool list
+// -vHP, skipping the pool's log, cache, and spare devices:
+//
+//	zroot	19.5G	1.21G	18.3G	-	-	1%	6%	1.00x	ONLINE	-
+//		/dev/gpt/zfs0	19.5G	1.21G	18.3G	-	-	1%	6.19%	-	ONLINE
+//	logs	-	-	-	-	-	-	-	-	-
+//		/dev/ada1p1	1.50G	0	1.50G	-	-	0%	0.00%	-	ONLINE
+func parseZpoolVdevs(out []byte) []string {
+	var devs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "logs", "cache", "spare", "spares":
+			return devs
+		}
+		if strings.HasPrefix(f[0], "/dev/") {
+			devs = append(devs, f[0])
+		}
+	}
+	return devs
+}
+
+// DepResizers returns the Resizers of the pool's vdevs that are
+// partitions or labels on them.
+func (r zfsResizer) DepResizers(ctx context.Context) ([]Resizer, error) {
+	devs, err := r.vdevs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rs []Resizer
+	for _, dev := range devs {
+		dep, err := registeredDevice(ctx, dev)
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, deps(dep)...)
+	}
+	return rs, nil
+}
+
+func (r zfsResizer) commands(ctx context.Context) ([]*exec.Cmd, error) {
+	devs, err := r.vdevs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(devs) == 0 {
+		return nil, fmt.Errorf("%w: no vdevs found in ZFS pool %s", ErrDeviceNotFound, string(r))
+	}
+	var cmds []*exec.Cmd
+	for _, dev := range devs {
+		cmds = append(cmds, Command(ctx, "zpool", "online", "-e", string(r), dev))
+	}
+	return cmds, nil
+}
+
+func (r zfsResizer) Plan(ctx context.Context) (Action, error) {
+	n, err := r.Size(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	cmds, err := r.commands(ctx)
+	if err != nil {
+		return Action{}, err
+	}
+	a := Action{CurrentBytes: n}
+	for _, cmd := range cmds {
+		a.Steps = append(a.Steps, cmdLine(cmd, nil))
+	}
+	return a, nil
+}
+
+func (r zfsResizer) Resize(ctx context.Context) error {
+	cmds, err := r.commands(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if out, err := runCmd(r.String(), cmd); err != nil {
+			return toolError(cmd, out, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var resultFile = flag.String("result-file", "", "if non-empty, file to write the run's outcome to as JSON when done, replacing it atomically, for first-boot scripts and provisioners: its status, exit code, and each mount point's result and layers")
+
+// fileResult is what --result-file holds.
+type fileResult struct {
+	Status   string      `json:"status"` // "ok" or "error"
+	ExitCode int         `json:"exitCode"`
+	Error    string      `json:"error,omitempty"`
+	DryRun   bool        `json:"dryRun,omitempty"`
+	Results  []runResult `json:"results"`
+	Version  string      `json:"version"`
+}
+
+// resultOf returns res, grow's result for mnt, filled in with err if
+// the resize wasn't attempted.
+func resultOf(mnt string, res runResult, err error) runResult {
+	if res.Mountpoint == "" {
+		res = runResult{Mountpoint: mnt, Version: versionString()}
+		if err != nil {
+			res.Error = resultError(err)
+		}
+	}
+	if res.Changes == nil {
+		res.Changes = []string{}
+	}
+	return res
+}
+
+// resultError returns err's message, without the errReported marker.
+func resultError(err error) string {
+	return strings.TrimPrefix(err.Error(), errReported.Error()+": ")
+}
+
+// writeResultFile writes results, and err, the run's first error if
+// any, to --result-file, if set. A failure to write it is logged,
+// not fatal: the resize itself is done.
+func writeResultFile(results []runResult, err error) {
+	if *resultFile == "" {
+		return
+	}
+	fr := fileResult{
+		Status:  "ok",
+		DryRun:  *dry,
+		Results: results,
+		Version: versionString(),
+	}
+	if fr.Results == nil {
+		fr.Results = []runResult{}
+	}
+	if err != nil {
+		fr.Status = "error"
+		fr.ExitCode = exitCode(err)
+		fr.Error = resultError(err)
+	}
+	b, jerr := json.MarshalIndent(fr, "", "  ")
+	if jerr == nil {
+		jerr = writeFileAtomic(*resultFile, append(b, '\n'), 0644)
+	}
+	if jerr != nil {
+		logger.Error("writing --result-file failed", "path", *resultFile, "err", jerr)
+	}
+}
+
+// writeFileAtomic writes data to the file path by writing a temporary
+// file beside it, syncing it, and renaming it over path, so readers
+// see either the old contents or all of the new.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := resultTempFile(path)
+	f, err := resize.Privileges.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // after a successful rename, a no-op
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// With --privsep, the helper creates tmp with perm and we may not
+	// own it to change it.
+	if fi, err := f.Stat(); err != nil || fi.Mode().Perm() != perm {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return resize.Privileges.Rename(tmp, path)
+}
+
+// resultTempFile is the temporary file writeFileAtomic writes beside
+// path.
+func resultTempFile(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+}
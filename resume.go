@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// resumeInfo describes how a run continued from the failed run of
+// the same mount point before it, as when growing the partition
+// worked but lvextend didn't. Nothing special is needed to resume:
+// each layer finds from its current state whether it needs growing.
+// This only reports it.
+type resumeInfo struct {
+	FailedRun   time.Time `json:"failedRun"`             // when the failed run started
+	FailedStage string    `json:"failedStage,omitempty"` // the stage it failed at, if known
+	Skipped     []string  `json:"skipped,omitempty"`     // stages it grew, left alone now
+}
+
+// lastFailedRun returns the --history entry for the last run growing
+// mnt, if it failed.
+func lastFailedRun(mnt string) (historyEntry, bool) {
+	if *historyFile == "" {
+		return historyEntry{}, false
+	}
+	hs, err := readHistory(*historyFile)
+	if err != nil {
+		return historyEntry{}, false
+	}
+	for i := len(hs) - 1; i >= 0; i-- {
+		h := hs[i]
+		if h.Mountpoint != mnt || h.DryRun || h.Action != resize.ActionGrow {
+			continue
+		}
+		return h, h.Error != ""
+	}
+	return historyEntry{}, false
+}
+
+// newResumeInfo returns the resumeInfo for a run following the failed
+// run prev.
+func newResumeInfo(prev historyEntry) *resumeInfo {
+	ri := &resumeInfo{FailedRun: prev.Time}
+	for _, st := range prev.Stages {
+		if st.Error != "" {
+			ri.FailedStage = st.Stage
+		}
+	}
+	return ri
+}
+
+// finish records in ri the stages of prev, the failed run, that grew
+// and that the resize steps of this run then found nothing to do for.
+func (ri *resumeInfo) finish(prev historyEntry, steps []*stepRecord) {
+	for _, ps := range prev.Stages {
+		if ps.Error != "" || ps.AfterBytes <= ps.BeforeBytes {
+			continue
+		}
+		for _, st := range steps {
+			if st.stage == ps.Stage && st.err == nil && st.after == st.before {
+				ri.Skipped = append(ri.Skipped, st.stage)
+				break
+			}
+		}
+	}
+}
+
+// printResumed writes ri to stdout, for the report of a run.
+func printResumed(ri *resumeInfo) {
+	when := ri.FailedRun.Local().Format("2006-01-02 15:04:05")
+	if ri.FailedStage != "" {
+		fmt.Printf("Resumed after the run of %s, which failed at %s.\n", when, ri.FailedStage)
+	} else {
+		fmt.Printf("Resumed after the failed run of %s.\n", when)
+	}
+	if len(ri.Skipped) > 0 {
+		fmt.Printf("Already grown by that run, skipped:\n")
+		for _, s := range ri.Skipped {
+			fmt.Printf("  * %s\n", s)
+		}
+	}
+}
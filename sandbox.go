@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var sandbox = flag.Bool("sandbox", false, "when enlarging mount points, confine this process and the tools it runs with a seccomp filter and landlock rules: writing only block devices, the SCSI rescan attributes in sysfs, and the files its flags name, running only the tools it uses, and making none of the system calls that load kernel code or inspect other processes; Linux only, in a binary built with CGO_ENABLED=0")
+
+// A sandboxPolicy is what --sandbox allows beyond reading files.
+type sandboxPolicy struct {
+	Exec      []string // tools, and trees of shared libraries, that may be run
+	Write     []string // devices and sysfs attributes that may be written
+	WriteDirs []string // trees whose files may be created, written, renamed, and removed
+}
+
+// sandboxLibDirs hold the dynamic loader, which the kernel runs along
+// with each tool.
+var sandboxLibDirs = []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"}
+
+// sandboxTools are the tools resizers run, which --sandbox lets run.
+var sandboxTools = []string{
+	"blkid", "lsblk", "udevadm", "findmnt",
+	"sfdisk", "sgdisk", "parted", "wipefs",
+	"resize2fs", "e2fsck", "dumpe2fs",
+	"xfs_growfs", "btrfs",
+	"lvm", "lvdisplay", "pvdisplay", "lvextend",
+	"pvresize", "lvs", "pvs", "vgs", "vgchange",
+	"cryptsetup", "dmsetup", "ubirsvol",
+	"mount", "umount", "mkswap", "swapon", "swapoff",
+}
+
+// sandboxPolicyFromFlags returns the sandboxPolicy for this run.
+func sandboxPolicyFromFlags() sandboxPolicy {
+	var p sandboxPolicy
+	p.Exec = append(p.Exec, sandboxLibDirs...)
+	p.Exec = append(p.Exec, "/bin/sh") // for hooks and --notify-cmd
+	for _, name := range sandboxTools {
+		if path, err := resize.ToolPath(name); err == nil {
+			p.Exec = append(p.Exec, path)
+		}
+	}
+	if path, err := resize.ToolPath("systemctl"); err == nil {
+		p.Exec = append(p.Exec, path) // for --other-growers
+	}
+
+	p.Write = append(p.Write, "/dev/null", "/dev/mapper")
+	blocks, _ := os.ReadDir("/sys/class/block")
+	for _, b := range blocks {
+		p.Write = append(p.Write, "/dev/"+b.Name(), "/sys/block/"+b.Name()+"/device/rescan")
+	}
+	hosts, _ := filepath.Glob("/sys/class/scsi_host/host*/scan")
+	p.Write = append(p.Write, hosts...)
+
+	// LVM and mount keep their locks and state under /run, and LVM
+	// backs up its metadata under /etc/lvm.
+	p.WriteDirs = append(p.WriteDirs, "/run", "/etc/lvm")
+	for _, f := range []string{*lockFile, *historyFile, *resultFile, *recordCommands} {
+		if f != "" {
+			p.WriteDirs = append(p.WriteDirs, filepath.Dir(f))
+		}
+	}
+	if resize.LUKSHeaderBackupDir != "" {
+		p.WriteDirs = append(p.WriteDirs, resize.LUKSHeaderBackupDir)
+	}
+	return p
+}
+
+// startSandbox, with --sandbox, confines this process, and with
+// --privsep the helper, to sandboxPolicyFromFlags. It's called after
+// startPrivsep, which passes the policy to the helper.
+func startSandbox() {
+	if !*sandbox {
+		return
+	}
+	if err := applySandbox(sandboxPolicyFromFlags()); err != nil {
+		fatalf("--sandbox: %v", err)
+	}
+	vlogf("sandbox: confined with seccomp and landlock")
+}
@@ -0,0 +1,224 @@
+//go:build linux
+
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// applySandbox confines every thread of this process, and the
+// processes it starts, to p, with landlock for files and seccomp for
+// system calls. Files already open, like our stdout and the lock
+// file, are unaffected.
+func applySandbox(p sandboxPolicy) error {
+	if err := allThreads(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %v", err)
+	}
+	if err := landlock(p); err != nil {
+		return fmt.Errorf("landlock: %v", err)
+	}
+	if err := seccomp(); err != nil {
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	return nil
+}
+
+// allThreads makes the system call trap with a1, a2, and a3 in every
+// thread, as no_new_privs and landlock apply per thread. The Go
+// runtime can only do that without cgo.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, e := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	switch e {
+	case 0:
+		return nil
+	case syscall.ENOTSUP:
+		return errors.New("this binary uses cgo; build it with CGO_ENABLED=0")
+	}
+	return e
+}
+
+const (
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE
+	landlockReadAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+	// landlockV1Access is every access right in landlock's first ABI.
+	landlockV1Access = 1<<13 - 1
+)
+
+func landlock(p sandboxPolicy) error {
+	abi, _, e := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if e != 0 {
+		return fmt.Errorf("not available in this kernel: %v", e)
+	}
+	handled := uint64(landlockV1Access)
+	if abi >= 2 {
+		// Otherwise renames between directories are always refused.
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, e := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if e != 0 {
+		return e
+	}
+	defer unix.Close(int(fd))
+	if err := landlockAllow(int(fd), "/", landlockReadAccess); err != nil {
+		return err
+	}
+	for _, path := range p.Exec {
+		if err := landlockAllow(int(fd), path, unix.LANDLOCK_ACCESS_FS_EXECUTE|landlockReadAccess); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.Write {
+		if err := landlockAllow(int(fd), path, unix.LANDLOCK_ACCESS_FS_WRITE_FILE|landlockReadAccess); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.WriteDirs {
+		if err := landlockAllow(int(fd), path, handled&^unix.LANDLOCK_ACCESS_FS_EXECUTE); err != nil {
+			return err
+		}
+	}
+	return allThreads(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+}
+
+// landlockAllow lets the ruleset fd have access to path and, if it's a
+// directory, everything beneath it. Paths that don't exist are
+// skipped.
+func landlockAllow(fd int, path string, access uint64) error {
+	pfd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(pfd)
+	var st unix.Stat_t
+	if err := unix.Fstat(pfd, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(pfd)}
+	if _, _, e := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(fd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); e != 0 {
+		return &os.PathError{Op: "landlock_add_rule", Path: path, Err: e}
+	}
+	return nil
+}
+
+// seccompDenied are the system calls --sandbox refuses, with EPERM:
+// those loading kernel code, reaching into other processes and
+// namespaces, or changing the clock, none of which growing a
+// filesystem needs.
+var seccompDenied = []uint32{
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_REBOOT,
+	unix.SYS_BPF,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_ACCT,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_ADJTIMEX,
+	unix.SYS_CLOCK_ADJTIME,
+}
+
+// seccompArch is the AUDIT_ARCH value of the system calls
+// seccompDenied numbers, by GOARCH.
+var seccompArch = map[string]uint32{
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"386":     unix.AUDIT_ARCH_I386,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}
+
+// Values from linux/seccomp.h.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+
+	// x32SyscallBit marks the x32 system calls, which amd64 processes
+	// can also make, under other numbers.
+	x32SyscallBit = 0x40000000
+)
+
+// seccomp installs a filter on every thread refusing seccompDenied
+// and killing the process on system calls of another architecture.
+func seccomp() error {
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter { return unix.SockFilter{Code: code, K: k} }
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k, Jt: jt, Jf: jf}
+	}
+	n := len(seccompDenied)
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4), // seccomp_data.arch
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0), // seccomp_data.nr
+	}
+	if runtime.GOARCH == "amd64" {
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, uint8(n+1), 0))
+	}
+	for i, nr := range seccompDenied {
+		prog = append(prog, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, uint8(n-i), 0))
+	}
+	prog = append(prog,
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.EPERM)),
+	)
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	tid, _, e := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&fprog)))
+	if e != 0 {
+		return e
+	}
+	if tid != 0 {
+		return fmt.Errorf("thread %d couldn't be synchronized", tid)
+	}
+	return nil
+}
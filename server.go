@@ -0,0 +1,220 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var (
+	listen    = flag.String("listen", "", "if non-empty, serve an HTTP API on this address (e.g. :8080) for planning, resizing, and checking mount points; requires --listen-token-file")
+	tokenFile = flag.String("listen-token-file", "", "file containing the bearer token HTTP API clients must send")
+)
+
+// serveMu serializes HTTP API, CSI, and D-Bus requests, as each run
+// uses global state.
+var serveMu sync.Mutex
+
+// serveMain implements --listen.
+func serveMain() {
+	if *tokenFile == "" {
+		fatalf("--listen requires --listen-token-file")
+	}
+	tok, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	tok = bytes.TrimSpace(tok)
+	if len(tok) == 0 {
+		fatalf("%s is empty", *tokenFile)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/plan", serveRun(true))
+	mux.HandleFunc("/v1/resize", serveRun(false))
+	mux.HandleFunc("/v1/status", serveStatus)
+	srv := &http.Server{Addr: *listen, Handler: requireToken(tok, mux)}
+	go func() {
+		<-stopRequested
+		// Let any run in progress finish first.
+		serveMu.Lock()
+		srv.Close()
+	}()
+	logger.Info("serving HTTP API", "addr", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		fatalf("%v", err)
+	}
+	logger.Info("HTTP API stopped")
+}
+
+// requireToken wraps h to reject requests without the bearer token tok.
+func requireToken(tok []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), tok) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveRun returns the handler for /v1/plan (a dry run) or /v1/resize.
+// Both take the mount point as the "mountpoint" query parameter.
+func serveRun(dryRun bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" && !(dryRun && r.Method == "GET") {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mnt := r.FormValue("mountpoint")
+		if mnt == "" {
+			http.Error(w, "missing mountpoint parameter", http.StatusBadRequest)
+			return
+		}
+		logger.Info("API request", "path", r.URL.Path, "mountpoint", mnt, "remote", r.RemoteAddr)
+		v, err := apiRun(mnt, dryRun)
+		serveJSON(w, err, v)
+	}
+}
+
+// apiRun enlarges mnt for an API caller, returning the runResult, or
+// for a dry run the runPlan, along with any error.
+func apiRun(mnt string, dryRun bool) (interface{}, error) {
+	serveMu.Lock()
+	defer serveMu.Unlock()
+
+	defer func(old bool) { *dry = old }(*dry)
+	*dry = *dry || dryRun
+	res, err := grow(mnt)
+	res.Mountpoint = mnt
+	res.Version = versionString()
+	res.Success = err == nil
+	if err != nil && !errors.Is(err, errReported) {
+		res.Error = err.Error()
+	}
+	if dryRun {
+		p := lastRun.plan
+		p.Mountpoint = mnt
+		p.Error = res.Error
+		if p.Stages == nil {
+			p.Stages = []*planStep{}
+		}
+		return p, err
+	}
+	return res, err
+}
+
+// mountStatus is the /v1/status response.
+type mountStatus struct {
+	Mountpoint string        `json:"mountpoint"`
+	Device     string        `json:"device"`
+	FSType     string        `json:"fstype"`
+	SizeBytes  int64         `json:"sizeBytes"`
+	UsedBytes  int64         `json:"usedBytes"`
+	AvailBytes int64         `json:"availBytes"`
+	Layers     []layerStatus `json:"layers"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// layerStatus is one Resizer under a mount point, from the filesystem
+// down.
+type layerStatus struct {
+	Stage     string `json:"stage"`
+	Device    string `json:"device"`
+	SizeBytes int64  `json:"sizeBytes"`
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	mnt := r.FormValue("mountpoint")
+	if mnt == "" {
+		http.Error(w, "missing mountpoint parameter", http.StatusBadRequest)
+		return
+	}
+	st, err := apiStatus(mnt)
+	serveJSON(w, err, st)
+}
+
+// apiStatus returns the current size of the filesystem at mnt and each
+// layer below it. On error, the status is still filled in as far as
+// it got.
+func apiStatus(mnt string) (mountStatus, error) {
+	serveMu.Lock()
+	defer serveMu.Unlock()
+
+	st := mountStatus{Mountpoint: mnt, Layers: []layerStatus{}}
+	err := func() error {
+		fs, err := resize.Stat(mnt)
+		if err != nil {
+			return err
+		}
+		st.Device, st.FSType = fs.Device, fs.Type
+		st.SizeBytes, st.UsedBytes, st.AvailBytes = fs.SizeBytes(), fs.UsedBytes(), fs.AvailBytes()
+		e, err := resize.FileSystem(context.Background(), mnt)
+		if err != nil {
+			return err
+		}
+		return addLayerStatus(&st, e)
+	}()
+	if err != nil {
+		st.Error = err.Error()
+	}
+	return st, err
+}
+
+// addLayerStatus adds the status of e and then the layers below it,
+// depth first, to st.
+func addLayerStatus(st *mountStatus, e resize.Resizer) error {
+	n, err := e.Size(context.Background())
+	if err != nil {
+		return err
+	}
+	st.Layers = append(st.Layers, layerStatus{Stage: e.String(), Device: resize.Device(e), SizeBytes: n})
+	deps, err := e.DepResizers(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		if err := addLayerStatus(st, dep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveJSON writes v as the JSON response, with a 500 status if err
+// is non-nil.
+func serveJSON(w http.ResponseWriter, err error, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
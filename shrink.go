@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// shrinkMain implements the "shrink" subcommand.
+func shrinkMain(args []string) {
+	fs := flag.NewFlagSet("shrink", flag.ExitOnError)
+	targetSize := fs.String("target-size", "", "new size of the filesystem, e.g. 50G, 50GiB, 50GB (SI), or 104857600s (512-byte sectors) (required)")
+	yes := fs.Bool("yes", false, "really shrink; without this (or --dry-run), shrink refuses to run")
+	adjust := fs.Bool("adjust", false, "if --target-size is below the smallest safe size, shrink to the smallest safe size instead of failing")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk shrink:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] shrink --target-size=<size> [--yes] <mount-point>\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	if fs.NArg() != 1 || *targetSize == "" {
+		fs.Usage()
+	}
+	target, err := resize.ParseSize(*targetSize)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if !*yes && !*dry {
+		fatalf("shrinking can destroy data if anything goes wrong; back up first, then re-run with --yes (or use --dry-run)")
+	}
+	ctx, end, err := beginRun()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	defer end()
+	mnt := fs.Arg(0)
+	e, err := resize.FileSystem(ctx, mnt)
+	if err != nil {
+		fatalf("error preparing to shrink %s: %v", mnt, err)
+	}
+	if resize.KindOf(e) != resize.KindFilesystem {
+		fatalf("%s is not mounted; use --offline to shrink its filesystem offline", mnt)
+	}
+	minSize, err := resize.MinSize(ctx, e)
+	if err != nil {
+		fatalf("error finding the minimum size of %v: %v", e, err)
+	}
+	if *dry {
+		fmt.Printf("Smallest safe size for %v: %s (%d bytes)\n", e, resize.HumanBytes(minSize), minSize)
+	}
+	if target < minSize {
+		if !*adjust {
+			fatalf("target size %s is below the smallest safe size of %s for %v; use --adjust to shrink to that instead",
+				resize.HumanBytes(target), resize.HumanBytes(minSize), e)
+		}
+		fmt.Printf("Adjusting target size from %s up to the smallest safe size, %s.\n", resize.HumanBytes(target), resize.HumanBytes(minSize))
+		target = minSize
+	}
+	run := &run{ctx: ctx, start: time.Now()}
+	changes, err := resize.Shrink(ctx, e, target, &resize.Hooks{
+		Before: func(r resize.Resizer, size int64) error {
+			return checkInterrupted()
+		},
+		After: func(r resize.Resizer, before, after int64, d time.Duration, err error) error {
+			run.steps = append(run.steps, &stepRecord{r: r, stage: r.String(), d: d, before: before, after: after, err: err})
+			if err == nil {
+				logger.Info("shrunk", "stage", r.String(), "device", resize.Device(r), "before", before, "after", after)
+			}
+			return nil
+		},
+	})
+	run.record(mnt, resize.ActionShrink, err)
+	if len(changes) > 0 {
+		fmt.Printf("%s\n", colorize(os.Stdout, colorBold, "Changes made:"))
+		for _, c := range changes {
+			fmt.Printf("  * %s\n", colorize(os.Stdout, colorGreen, c.String()))
+		}
+	} else if err == nil {
+		fmt.Printf("No changes made.\n")
+	}
+	if err != nil {
+		fatalf("error: %v", err)
+	}
+}
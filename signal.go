@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// errInterrupted is returned, by way of the Before hook, when a stop
+// was requested. resize.Resize returns it with the changes made so
+// far, which stay made; the next run picks up where this one stopped.
+var errInterrupted = errors.New("interrupted; remaining stages skipped")
+
+// interrupted is set once we've received SIGINT or SIGTERM.
+var interrupted atomic.Bool
+
+// stopRequested is closed along with setting interrupted, for waiters
+// that need waking up.
+var stopRequested = make(chan struct{})
+
+// handleSignals arranges for SIGINT and SIGTERM to stop the run after
+// the current stage finishes, rather than killing us at an arbitrary
+// point. The stage in progress always runs to completion.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			if interrupted.Swap(true) {
+				logger.Warn("already stopping; waiting for the current stage to finish", "signal", sig.String())
+				continue
+			}
+			logger.Warn("received signal; finishing current stage, then stopping", "signal", sig.String())
+			close(stopRequested)
+		}
+	}()
+}
+
+// checkInterrupted returns errInterrupted if a stop was requested.
+func checkInterrupted() error {
+	if interrupted.Load() {
+		return errInterrupted
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// triggerPath is the file whose modification makes the path unit
+// written by install-systemd run a resize.
+const triggerPath = "/run/embiggen-disk.trigger"
+
+// installSystemdMain implements the "install-systemd" subcommand,
+// which writes systemd units running embiggen-disk with the global
+// flags given on this command line.
+func installSystemdMain(args []string) {
+	fs := flag.NewFlagSet("install-systemd", flag.ExitOnError)
+	unitDir := fs.String("unit-dir", "/etc/systemd/system", "directory to write the units to")
+	mode := fs.String("mode", "boot", `which units to write: "boot" (a oneshot service run once at boot), "daemon" (a service running "embiggen-disk daemon"), "path" (the oneshot service plus a path unit starting it whenever `+triggerPath+` is touched), "firstboot" (a oneshot service running "embiggen-disk firstboot" until it succeeds once), or "all"`)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk install-systemd:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] install-systemd [--mode=boot|daemon|path|firstboot|all] [<mount-point>...]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+
+	var units map[string]string
+	switch *mode {
+	case "boot":
+		units = map[string]string{"embiggen-disk.service": oneshotUnit(fs.Args())}
+	case "daemon":
+		units = map[string]string{"embiggen-disk-daemon.service": daemonUnit(fs.Args())}
+	case "path":
+		units = map[string]string{
+			"embiggen-disk.service": oneshotUnit(fs.Args()),
+			"embiggen-disk.path":    pathUnit(),
+		}
+	case "firstboot":
+		units = map[string]string{"embiggen-disk-firstboot.service": firstbootUnit(fs.Args())}
+	case "all":
+		units = map[string]string{
+			"embiggen-disk.service":        oneshotUnit(fs.Args()),
+			"embiggen-disk.path":           pathUnit(),
+			"embiggen-disk-daemon.service": daemonUnit(fs.Args()),
+		}
+	default:
+		fatalf("unknown --mode %q; want boot, daemon, path, firstboot, or all", *mode)
+	}
+
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(*unitDir, name)
+		if *dry {
+			fmt.Printf("would've written %s:\n%s\n", path, units[name])
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(units[name]), 0644); err != nil {
+			fatalf("%v", err)
+		}
+		fmt.Printf("Wrote %s\n", path)
+	}
+	if !*dry {
+		fmt.Printf("\nTo enable, run:\n  systemctl daemon-reload\n  systemctl enable %s\n", strings.Join(names, " "))
+	}
+}
+
+func oneshotUnit(mnts []string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Enlarge filesystems to fill their disks
+After=local-fs.target
+Wants=local-fs.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+
+[Install]
+WantedBy=multi-user.target
+`, unitCommand(mnts))
+}
+
+func daemonUnit(mnts []string) string {
+	return fmt.Sprintf(`[Unit]
+Description=Enlarge filesystems whenever their disks grow
+After=local-fs.target
+
+[Service]
+Type=simple
+ExecStart=%s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, unitCommand(append([]string{"daemon"}, mnts...)))
+}
+
+func pathUnit() string {
+	return fmt.Sprintf(`[Unit]
+Description=Enlarge filesystems when %[1]s is touched
+
+[Path]
+PathChanged=%[1]s
+Unit=embiggen-disk.service
+
+[Install]
+WantedBy=multi-user.target
+`, triggerPath)
+}
+
+// unitCommand returns an ExecStart= line running this binary with the
+// global flags set on our command line, followed by args.
+func unitCommand(args []string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "/usr/local/bin/embiggen-disk"
+	}
+	// --dry-run and --version are for this invocation, not the unit's.
+	cmd := append([]string{exe}, setFlagArgs("dry-run", "version")...)
+	cmd = append(cmd, args...)
+	for i, a := range cmd {
+		cmd[i] = systemdQuote(a)
+	}
+	return strings.Join(cmd, " ")
+}
+
+// systemdQuote quotes s as a single word of a systemd ExecStart= line.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// toolFlags are the --<tool> flags overriding where to find each
+// external tool, keyed by the tool's name.
+var toolFlags = map[string]*string{
+	"sfdisk":     flag.String("sfdisk", "", "path to sfdisk; default is to search $PATH, /sbin, and /usr/sbin"),
+	"sgdisk":     flag.String("sgdisk", "", "path to sgdisk, used for GPT disks where sfdisk is missing or too old; default is to search $PATH, /sbin, and /usr/sbin"),
+	"parted":     flag.String("parted", "", "path to parted, used where sfdisk and sgdisk are missing or too old; default is to search $PATH, /sbin, and /usr/sbin"),
+	"blkid":      flag.String("blkid", "", "path to blkid; default is to search $PATH, /sbin, and /usr/sbin"),
+	"resize2fs":  flag.String("resize2fs", "", "path to resize2fs; default is to search $PATH, /sbin, and /usr/sbin"),
+	"xfs_growfs": flag.String("xfs-growfs", "", "path to xfs_growfs; default is to search $PATH, /sbin, and /usr/sbin"),
+	"btrfs":      flag.String("btrfs", "", "path to btrfs; default is to search $PATH, /sbin, and /usr/sbin"),
+	"lvm":        flag.String("lvm", "", "path to the lvm binary, used for all LVM commands; default is to run lvdisplay, lvextend, etc from $PATH, /sbin, and /usr/sbin"),
+}
+
+// setToolPaths passes the --<tool> flags on to the resize package.
+func setToolPaths() {
+	for name, f := range toolFlags {
+		if *f != "" {
+			resize.ToolPaths[name] = *f
+		}
+	}
+}
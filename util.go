@@ -17,13 +17,48 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
-	"os/exec"
+	"strings"
 )
 
-func execErrDetail(err error) string {
-	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
-		return fmt.Sprintf("%v; stderr: %s", err, ee.Stderr)
+// setFlagArgs returns the global flags set on our command line, as
+// arguments for passing them on to another embiggen-disk, leaving out
+// those named in skip. A flag given several times, like --stage-hook,
+// is passed on as often.
+func setFlagArgs(skip ...string) (args []string) {
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range skip {
+			if f.Name == s {
+				return
+			}
+		}
+		if mv, ok := f.Value.(interface{ values() []string }); ok {
+			for _, v := range mv.values() {
+				args = append(args, fmt.Sprintf("--%s=%s", f.Name, v))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+	})
+	return args
+}
+
+// shellQuote returns args quoted as a /bin/sh command line.
+func shellQuote(args []string) string {
+	var buf bytes.Buffer
+	for i, a := range args {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if a != "" && strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:+%,@") == "" {
+			buf.WriteString(a)
+			continue
+		}
+		buf.WriteByte('\'')
+		buf.WriteString(strings.ReplaceAll(a, "'", `'\''`))
+		buf.WriteByte('\'')
 	}
-	return err.Error()
+	return buf.String()
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+var verifyFlag = flag.Bool("verify", false, "after resizing, re-read every layer's size and fail if any layer didn't grow along with the layer below it")
+
+// verifySlack is how much less than the layer below it a layer may
+// grow by without being considered stuck, to allow for extent and
+// block rounding and reserved space. Filesystems may additionally fall
+// short by 5%, for the inode tables and other metadata they don't
+// count in their reported size.
+const verifySlack = 64 << 20
+
+// verifySteps re-reads the size of each resized layer and checks that
+// each layer grew along with the layers below it. steps are in the
+// order they ran, lower layers first.
+func verifySteps(ctx context.Context, steps []*stepRecord) error {
+	var problems []string
+	byStage := map[string]*stepRecord{}
+	for _, st := range steps {
+		byStage[st.stage] = st
+	}
+	for _, st := range steps {
+		now, err := st.r.Size(ctx)
+		if err != nil {
+			return fmt.Errorf("re-reading size of %v: %v", st.r, err)
+		}
+		if now != st.after {
+			problems = append(problems, fmt.Sprintf("%v: size changed from %d to %d bytes after resizing", st.r, st.after, now))
+		}
+		if now < st.before {
+			problems = append(problems, fmt.Sprintf("%v: shrank from %d to %d bytes", st.r, st.before, now))
+		}
+		deps, err := st.r.DepResizers(ctx)
+		if err != nil {
+			return fmt.Errorf("re-reading layers below %v: %v", st.r, err)
+		}
+		var belowBefore, belowAfter int64
+		var belowNames []string
+		for _, dep := range deps {
+			if d, ok := byStage[dep.String()]; ok {
+				belowBefore += d.before
+				belowAfter += d.after
+				belowNames = append(belowNames, d.stage)
+			}
+		}
+		if len(belowNames) == 0 {
+			continue
+		}
+		expected, err := resize.ExpectedSize(ctx, st.r, st.before, belowBefore, belowAfter)
+		if err != nil {
+			return fmt.Errorf("working out expected size of %v: %v", st.r, err)
+		}
+		gained, want := now-st.before, expected-st.before
+		if want > verifySlack && gained < want-want/20-verifySlack {
+			problems = append(problems, fmt.Sprintf("%v is stuck: grew by %s but should have grown by %s, as %s below it grew by %s",
+				st.r, resize.HumanBytes(gained), resize.HumanBytes(want), strings.Join(belowNames, " and "), resize.HumanBytes(belowAfter-belowBefore)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
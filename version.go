@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime/debug"
+)
+
+var showVersion = flag.Bool("version", false, "print version information and exit")
+
+// These may be set at build time with, e.g.:
+//
+//	go build -ldflags="-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2018-08-06T21:36:25Z"
+//
+// Otherwise they're filled from the Go module and VCS information
+// embedded by the go command, where available.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "" && bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	var rev, modified, vcsTime string
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			rev = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		case "vcs.time":
+			vcsTime = s.Value
+		}
+	}
+	if commit == "" && rev != "" {
+		commit = rev
+		if modified == "true" {
+			commit += "-dirty"
+		}
+	}
+	if buildDate == "" {
+		buildDate = vcsTime
+	}
+}
+
+// versionString returns a one-line description of this binary's version.
+func versionString() string {
+	v, c, d := version, commit, buildDate
+	if v == "" {
+		v = "unknown"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("embiggen-disk %s (commit %s, built %s)", v, c, d)
+}
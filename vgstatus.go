@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/bradfitz/embiggen-disk/resize"
+)
+
+// vgStatusMain implements the "vg-status" subcommand, a planning view
+// of LVM volume groups for hosts with several LVs: each VG's free
+// space, how much each of its PVs could grow, and which LVs could be
+// given the space. It changes nothing.
+func vgStatusMain(args []string) {
+	fs := flag.NewFlagSet("vg-status", flag.ExitOnError)
+	jsonFlag := fs.Bool("json", false, "print the status as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of embiggen-disk vg-status:\n\n")
+		fmt.Fprintf(os.Stderr, "# embiggen-disk [flags] vg-status [--json] [<vg>...]\n\n")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	parseFlags(fs, args)
+	ctx, cancel := runContext()
+	defer cancel()
+	sts, err := resize.VGStatuses(ctx, fs.Args()...)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(sts); err != nil {
+			fatalf("%v", err)
+		}
+		return
+	}
+	if len(sts) == 0 {
+		fmt.Printf("No volume groups.\n")
+	}
+	for i, vg := range sts {
+		if i > 0 {
+			fmt.Println()
+		}
+		printVGStatus(vg)
+	}
+}
+
+// printVGStatus writes vg to stdout for the vg-status subcommand.
+func printVGStatus(vg resize.VGStatus) {
+	fmt.Printf("%s: %s in %d extents of %s, %s (%d extents) free",
+		colorize(os.Stdout, colorBold, "VG "+vg.Name),
+		resize.HumanBytes(vg.Extents*vg.ExtentBytes), vg.Extents, resize.HumanBytes(vg.ExtentBytes),
+		resize.HumanBytes(vg.FreeBytes()), vg.FreeExtents)
+	if after := vg.FreeBytesAfterGrowth(); after > vg.FreeBytes() {
+		fmt.Printf(", %s once its PVs grow", colorize(os.Stdout, colorGreen, resize.HumanBytes(after)))
+	}
+	fmt.Println()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  PV\tSize\tCan grow\t\n")
+	for _, pv := range vg.PVs {
+		grow := "-"
+		switch {
+		case pv.Error != "":
+			grow = colorize(os.Stdout, colorRed, "unknown: "+pv.Error)
+		case pv.GrowBytes > 0:
+			grow = colorize(os.Stdout, colorGreen, resize.HumanDelta(pv.GrowBytes))
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t\n", pv.Device, resize.HumanBytes(pv.Bytes), grow)
+	}
+	tw.Flush()
+
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  LV\tSize\tMounted\tCandidate\t\n")
+	for _, lv := range vg.LVs {
+		mounted := "-"
+		if lv.Mountpoint != "" {
+			mounted = fmt.Sprintf("%s (%s)", lv.Mountpoint, lv.FSType)
+		}
+		candidate := "no"
+		if lv.Candidate {
+			candidate = "yes"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t\n", lv.Path, resize.HumanBytes(lv.Bytes), mounted, candidate)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var vmwareRescan = flag.Duration("vmware-rescan", 0, "in daemon mode on VMware, if non-zero, rescan the SCSI bus this often, resizing when a virtual disk grew; vSphere's Extend Disk doesn't otherwise reach the guest")
+
+// onVMware reports whether we're running in a VMware virtual machine.
+func onVMware() bool {
+	return dmiField("sys_vendor") == "VMware, Inc."
+}
+
+// vmwareMain implements the "vmware" subcommand, run by the
+// open-vm-tools event scripts in the vmware directory or by hand after
+// extending a disk. It rescans the SCSI bus, as VMware guests don't
+// see a disk grow until they do, and then enlarges the given mount
+// points, or by default / and every filesystem on a VMware virtual
+// disk.
+func vmwareMain(args []string) {
+	if !onVMware() {
+		logger.Warn("this doesn't look like a VMware virtual machine")
+	}
+	rescanSCSI()
+	time.Sleep(time.Second)
+	mnts := args
+	if len(mnts) == 0 {
+		mnts = rootAndMountsOnDisks(vmwareDisks())
+	}
+	if !growAll(mnts) {
+		os.Exit(1)
+	}
+}
+
+// vmwareDisks returns the VMware virtual disks.
+func vmwareDisks() map[string]bool {
+	disks := map[string]bool{}
+	vendors, _ := filepath.Glob("/sys/block/*/device/vendor")
+	for _, f := range vendors {
+		if b, err := ioutil.ReadFile(f); err == nil && strings.TrimSpace(string(b)) == "VMware" {
+			disks[filepath.Base(filepath.Dir(filepath.Dir(f)))] = true
+		}
+	}
+	return disks
+}
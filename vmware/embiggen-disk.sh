@@ -0,0 +1,12 @@
+#!/bin/sh
+# Runs embiggen-disk when vmtoolsd reports that the VM powered on or
+# resumed, picking up any disks extended in vSphere while it was off
+# or suspended. Install it in both of
+#
+#   /etc/vmware-tools/scripts/poweron-vm-default.d/
+#   /etc/vmware-tools/scripts/resume-vm-default.d/
+#
+# For disks extended while the VM runs, also run
+# "embiggen-disk --vmware-rescan=1m daemon" or run "embiggen-disk vmware"
+# through vSphere's guest operations.
+exec /usr/local/bin/embiggen-disk vmware